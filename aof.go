@@ -3,30 +3,130 @@ package main
 import (
 	"bufio"
 	"io"
+	"log"
 	"os"
+	"strconv"
 	"sync"
 	"time"
 )
 
 var aofSet = map[string]bool{
-	"SET":    true,
-	"INCR":   true,
-	"INCRBY": true,
+	"SET":         true,
+	"INCR":        true,
+	"INCRBY":      true,
+	"SETNX":       true,
+	"SETEX":       true,
+	"PSETEX":      true,
+	"GETSET":      true,
+	"GETDEL":      true,
+	"GETEX":       true,
+	"DECR":        true,
+	"DECRBY":      true,
+	"INCRBYFLOAT": true,
+	"APPEND":      true,
+	"SETRANGE":    true,
+	"MSET":        true,
+	"MSETNX":      true,
 	// hash commands
-	"HSET":  true,
-	"LPUSH": true,
-	"LPOP":  true,
-	"RPUSH": true,
-	"RPOP":  true,
+	"HSET":         true,
+	"HMSET":        true,
+	"HSETNX":       true,
+	"HDEL":         true,
+	"HINCRBY":      true,
+	"HINCRBYFLOAT": true,
+	"HEXPIRE":      true,
+	"HPEXPIRE":     true,
+	"HEXPIREAT":    true,
+	"HPEXPIREAT":   true,
+	"HPERSIST":     true,
+	"HGETEX":       true,
+	"LPUSH":        true,
+	"LPOP":         true,
+	"RPUSH":        true,
+	"RPOP":         true,
+	"LPUSHX":       true,
+	"RPUSHX":       true,
+	"LSET":         true,
+	"LINSERT":      true,
+	"LREM":         true,
+	"LTRIM":        true,
+	"LMOVE":        true,
+	"RPOPLPUSH":    true,
+	"LMPOP":        true,
+	"BLPOP":        true,
+	"BRPOP":        true,
+	"BLMOVE":       true,
+	"BRPOPLPUSH":   true,
+	"BLMPOP":       true,
 	// set commands
-	"SADD": true,
-	"SREM": true,
+	"SADD":             true,
+	"SREM":             true,
+	"SINTERSTORE":      true,
+	"SUNIONSTORE":      true,
+	"SDIFFSTORE":       true,
+	"SMOVE":            true,
+	"SPOP":             true,
+	"ZADD":             true,
+	"ZINCRBY":          true,
+	"ZREM":             true,
+	"ZRANGESTORE":      true,
+	"ZREMRANGEBYRANK":  true,
+	"ZREMRANGEBYSCORE": true,
+	"ZREMRANGEBYLEX":   true,
+	"ZUNIONSTORE":      true,
+	"ZINTERSTORE":      true,
+	"ZDIFFSTORE":       true,
+	"ZPOPMIN":          true,
+	"ZPOPMAX":          true,
+	"ZMPOP":            true,
+	"BZPOPMIN":         true,
+	"BZPOPMAX":         true,
+	"BZMPOP":           true,
+	// stream commands
+	"XADD":       true,
+	"XDEL":       true,
+	"XTRIM":      true,
+	"XREADGROUP": true,
+	"XACK":       true,
+	"XGROUP":     true,
+	"XCLAIM":     true,
+	"XAUTOCLAIM": true,
+	// hyperloglog commands
+	"PFADD":   true,
+	"PFCOUNT": true,
+	"PFMERGE": true,
+	// geo commands
+	"GEOADD":         true,
+	"GEOSEARCHSTORE": true,
+	// bit commands
+	"SETBIT":   true,
+	"BITOP":    true,
+	"BITFIELD": true,
+	// generic commands
+	"DEL":      true,
+	"UNLINK":   true,
+	"RENAME":   true,
+	"RENAMENX": true,
+	"COPY":     true,
+	"MOVE":     true,
+	"SWAPDB":   true,
+	"FLUSHDB":  true,
+	"FLUSHALL": true,
+	// expire commands
+	"EXPIRE":    true,
+	"PEXPIRE":   true,
+	"EXPIREAT":  true,
+	"PEXPIREAT": true,
+	"PERSIST":   true,
 }
 
 type Aof struct {
 	file *os.File
 	rd   *bufio.Reader
 	mu   sync.Mutex
+	// database the logged commands apply to, a SELECT is logged before
+	// the first command of another database. -1 until something is logged
+	db int
 }
 
 func NewAof(path string) (*Aof, error) {
@@ -42,6 +142,7 @@ func NewAof(path string) (*Aof, error) {
 	aof := &Aof{
 		file: f,
 		rd:   bufio.NewReader(f),
+		db:   -1,
 	}
 
 	// start go routine to sync aof to disk every 1 second
@@ -71,12 +172,35 @@ func (aof *Aof) Close() error {
 	aof.mu.Lock()
 	defer aof.mu.Unlock()
 
+	err := aof.file.Sync()
+	if err != nil {
+		return err
+	}
 	return aof.file.Close()
 }
 
-func (aof *Aof) Write(value Value) error {
+// Sync flushes everything written so far to stable storage
+func (aof *Aof) Sync() error {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	return aof.file.Sync()
+}
+
+// Write logs a command which ran against the database db
+func (aof *Aof) Write(db int, value Value) error {
 	aof.mu.Lock()
 	defer aof.mu.Unlock()
+	if db != aof.db {
+		selectDb := Value{typ: "array", array: []Value{
+			{typ: "bulk", bulk: "SELECT"},
+			{typ: "bulk", bulk: strconv.Itoa(db)},
+		}}
+		if _, err := aof.file.Write(selectDb.Marshal()); err != nil {
+			return err
+		}
+		aof.db = db
+	}
 	/*
 		Write writes len(b) bytes from b to the File.
 		It returns the number of bytes written and an error, if any. Write returns a non-nil error when n != len(b).
@@ -115,3 +239,25 @@ func (aof *Aof) Read(fn func(value Value)) error {
 
 	return nil
 }
+
+// propagateDel logs a DEL for a key of the database db which expired so
+// that replaying the aof removes it at the same point
+func propagateDel(db int, key string) {
+	propagate(db, "DEL", key)
+}
+
+// propagate logs a command which was not sent by any client, like the DEL of
+// an expired key or the pop done on behalf of a client blocked by BLPOP
+func propagate(db int, args ...string) {
+	if server.aof == nil || server.loading.Load() {
+		return
+	}
+	value := Value{typ: "array", array: make([]Value, 0, len(args))}
+	for _, arg := range args {
+		value.array = append(value.array, Value{typ: "bulk", bulk: arg})
+	}
+	err := server.aof.Write(db, value)
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"math/bits"
+)
+
+// Bit operations on string values. Like redis the bits are numbered from
+// the most significant bit of the first byte, bit 0 is the leftmost one and
+// strings are zero padded on the right when they are shorter than the bit
+// being read or written.
+
+// Errors returned by the bit commands, the text is the one of redis
+var (
+	ErrBitOffset        = errors.New("ERR bit offset is not an integer or out of range")
+	ErrBitValue         = errors.New("ERR bit is not an integer or out of range")
+	ErrBitposBit        = errors.New("ERR The bit argument must be 1 or 0.")
+	ErrBitfieldType     = errors.New("ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.")
+	ErrBitfieldRO       = errors.New("ERR BITFIELD_RO only supports the GET subcommand")
+	ErrBitfieldOverflow = errors.New("ERR Invalid OVERFLOW type specified")
+)
+
+// getBit returns the bit at offset, bits past the end of the string are 0
+func getBit(str []byte, offset int64) int {
+	idx := offset >> 3
+	if idx >= int64(len(str)) {
+		return 0
+	}
+	return int(str[idx]>>(7-uint(offset&7))) & 1
+}
+
+// setBit changes the bit at offset, str must be long enough to hold it
+func setBit(str []byte, offset int64, on bool) {
+	mask := byte(1) << (7 - uint(offset&7))
+	if on {
+		str[offset>>3] |= mask
+	} else {
+		str[offset>>3] &^= mask
+	}
+}
+
+// growBits returns str zero padded so that the bit at offset is part of it
+func growBits(str []byte, offset int64) []byte {
+	need := int(offset>>3) + 1
+	if len(str) >= need {
+		return str
+	}
+	grown := make([]byte, need)
+	copy(grown, str)
+	return grown
+}
+
+// bitRange converts the start and end arguments of BITCOUNT and BITPOS to
+// an inclusive range of bits, start and end are bytes unless isBit is set
+// and can be negative to count from the end of the string.
+// Empty ranges have first > last.
+func bitRange(strlen int64, start int64, end int64, isBit bool) (first int64, last int64) {
+	total := strlen
+	if isBit {
+		total = strlen * 8
+	}
+	if start < 0 {
+		start = total + start
+	}
+	if end < 0 {
+		end = total + end
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= total {
+		end = total - 1
+	}
+	if start > end {
+		return 0, -1
+	}
+	if isBit {
+		return start, end
+	}
+	return start * 8, end*8 + 7
+}
+
+// popcountRange counts the bits set in the inclusive range of bits
+func popcountRange(str []byte, first int64, last int64) int64 {
+	var count int64
+	for first <= last && first&7 != 0 {
+		count += int64(getBit(str, first))
+		first++
+	}
+	for first+7 <= last {
+		count += int64(bits.OnesCount8(str[first>>3]))
+		first += 8
+	}
+	for first <= last {
+		count += int64(getBit(str, first))
+		first++
+	}
+	return count
+}
+
+// bitposRange returns the first bit in the inclusive range which is equal
+// to bit, or -1 when there is none
+func bitposRange(str []byte, bit int, first int64, last int64) int64 {
+	// whole bytes which can't hold the bit are skipped at once
+	skip := byte(0)
+	if bit == 0 {
+		skip = 0xff
+	}
+	for first <= last {
+		if first&7 == 0 && first+7 <= last && str[first>>3] == skip {
+			first += 8
+			continue
+		}
+		if getBit(str, first) == bit {
+			return first
+		}
+		first++
+	}
+	return -1
+}
+
+// The integer type of a BITFIELD operation, like i5 or u16
+type bitfieldType struct {
+	signed bool
+	bits   uint
+}
+
+// parseBitfieldType parses types like "i8" or "u16", signed integers can
+// be up to 64 bits wide and unsigned ones up to 63 bits
+func parseBitfieldType(s string) (bitfieldType, error) {
+	if len(s) < 2 || (s[0] != 'i' && s[0] != 'I' && s[0] != 'u' && s[0] != 'U') {
+		return bitfieldType{}, ErrBitfieldType
+	}
+	signed := s[0] == 'i' || s[0] == 'I'
+	n, ok := parseBitfieldUint(s[1:])
+	if !ok || n < 1 || (signed && n > 64) || (!signed && n > 63) {
+		return bitfieldType{}, ErrBitfieldType
+	}
+	return bitfieldType{signed: signed, bits: uint(n)}, nil
+}
+
+// parseBitfieldUint parses a small unsigned decimal number
+func parseBitfieldUint(s string) (int, bool) {
+	if len(s) == 0 || len(s) > 2 {
+		return 0, false
+	}
+	n := 0
+	for _, ch := range []byte(s) {
+		if ch < '0' || ch > '9' {
+			return 0, false
+		}
+		n = n*10 + int(ch-'0')
+	}
+	return n, true
+}
+
+// getUnsignedBitfield reads bits bits starting at offset as an unsigned
+// integer, the most significant bit first
+func getUnsignedBitfield(str []byte, offset int64, bits uint) uint64 {
+	var value uint64
+	for j := uint(0); j < bits; j++ {
+		value = value<<1 | uint64(getBit(str, offset+int64(j)))
+	}
+	return value
+}
+
+// getSignedBitfield reads a two's complement integer of bits bits
+func getSignedBitfield(str []byte, offset int64, bits uint) int64 {
+	value := getUnsignedBitfield(str, offset, bits)
+	// the sign bit is propagated to the higher bits
+	if bits < 64 && value&(1<<(bits-1)) != 0 {
+		value |= math.MaxUint64 << bits
+	}
+	return int64(value)
+}
+
+// setBitfield writes the low bits bits of value starting at offset, str
+// must be long enough to hold them
+func setBitfield(str []byte, offset int64, bits uint, value uint64) {
+	for j := uint(0); j < bits; j++ {
+		setBit(str, offset+int64(j), (value>>(bits-1-j))&1 == 1)
+	}
+}
+
+// The OVERFLOW behaviours of BITFIELD
+const (
+	bitfieldOverflowWrap = iota
+	bitfieldOverflowSat
+	bitfieldOverflowFail
+)
+
+// unsignedBitfieldOverflow checks whether value+incr fits in bits bits,
+// on overflow it also returns the value to store for WRAP and SAT
+func unsignedBitfieldOverflow(value uint64, incr int64, bits uint, overflow int) (bool, uint64) {
+	max := uint64(1)<<bits - 1
+	maxincr := int64(max - value)
+	minincr := -int64(value)
+	if value > max || (incr > 0 && incr > maxincr) {
+		if overflow == bitfieldOverflowSat {
+			return true, max
+		}
+	} else if incr < 0 && incr < minincr {
+		if overflow == bitfieldOverflowSat {
+			return true, 0
+		}
+	} else {
+		return false, 0
+	}
+	// wrapping keeps the low bits of the sum
+	return true, (value + uint64(incr)) &^ (math.MaxUint64 << bits)
+}
+
+// signedBitfieldOverflow is the signed version of unsignedBitfieldOverflow
+func signedBitfieldOverflow(value int64, incr int64, bits uint, overflow int) (bool, int64) {
+	max := int64(math.MaxInt64)
+	if bits < 64 {
+		max = int64(1)<<(bits-1) - 1
+	}
+	min := -max - 1
+	// maxincr and minincr can overflow but they are only used once value
+	// is known to be in range, when they are correct
+	maxincr := int64(uint64(max) - uint64(value))
+	minincr := min - value
+	if value > max || (bits != 64 && incr > maxincr) || (value >= 0 && incr > 0 && incr > maxincr) {
+		if overflow == bitfieldOverflowSat {
+			return true, max
+		}
+	} else if value < min || (bits != 64 && incr < minincr) || (value < 0 && incr < 0 && incr < minincr) {
+		if overflow == bitfieldOverflowSat {
+			return true, min
+		}
+	} else {
+		return false, 0
+	}
+	// the sum is done unsigned so that it wraps, then the sign bit of the
+	// field is propagated to the higher bits
+	sum := uint64(value) + uint64(incr)
+	if bits < 64 {
+		mask := uint64(math.MaxUint64) << bits
+		if sum&(1<<(bits-1)) != 0 {
+			sum |= mask
+		} else {
+			sum &^= mask
+		}
+	}
+	return true, int64(sum)
+}
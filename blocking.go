@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Blocking commands like BLPOP first try to serve the client right away,
+// if none of the keys has anything to pop the client is parked in the
+// blocking queues of its keys in its database and the command returns without a reply.
+// processCommand then waits for the reply outside of the command lock so that
+// other clients keep running.
+//
+// Commands which may make a key able to serve blocked clients (LPUSH, LMOVE ...)
+// signal the key as ready, once the command completed handleClientsBlockedOnKeys
+// serves the clients blocked on the ready keys in the order they arrived.
+
+// serveFunc tries to serve a blocking command using the values stored at key in
+// the database of the client, it is called with that database locked for writing
+// It returns false if the key holds nothing to serve, otherwise it returns the reply
+// and the command to log in the aof in place of the blocking one
+// Commands which consume nothing other clients wait for (XREAD, XREADGROUP) return
+// errNotServed when the key holds nothing for this client, so that the clients
+// blocked after it are still served
+type serveFunc func(key string) (reply Value, aofArgs []string, ok bool, err error)
+
+var errNotServed = errors.New("nothing to serve for this client")
+
+// Data structure representing a client waiting for one of its keys
+type blockedClient struct {
+	c            *Client
+	db           *Keyspace // the keys are the ones of this database
+	keys         []string
+	serve        serveFunc
+	timeout      time.Duration // 0 blocks forever
+	timeoutReply Value
+	// the reply is sent while the keyspace is locked, so once the client
+	// holds the lock it either already has its reply or it never will
+	result chan Value
+}
+
+var ErrTimeoutNotFloat = errors.New("ERR timeout is not a float or out of range")
+
+// parseTimeout parses the timeout in seconds of the blocking commands
+func parseTimeout(arg string) (time.Duration, error) {
+	timeout, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(timeout) || math.IsInf(timeout, 0) {
+		return 0, ErrTimeoutNotFloat
+	}
+	if timeout < 0 {
+		return 0, errors.New("ERR timeout is negative")
+	}
+	if timeout*float64(time.Second) >= math.MaxInt64 {
+		return 0, ErrTimeoutNotFloat
+	}
+	return time.Duration(timeout * float64(time.Second)), nil
+}
+
+// blockForKeys serves the command from the first key able to do it,
+// otherwise the client is blocked on all the keys until one of them
+// can serve it, the timeout elapses or the client disconnects
+func blockForKeys(c *Client, keys []string, timeout time.Duration, timeoutReply Value, serve serveFunc) Value {
+	db := c.db
+	db.lock()
+	defer db.unlock()
+
+	for _, key := range keys {
+		reply, aofArgs, ok, err := serve(key)
+		if err == errNotServed {
+			continue
+		}
+		if err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+		if ok {
+			c.rewriteCommand(aofArgs...)
+			return reply
+		}
+	}
+
+	// the fake client replaying the aof has nobody to wait for and
+	// a transaction can't wait either, like in redis it times out right away
+	c.preventPropagation()
+	if c.conn == nil || c.inExec {
+		return timeoutReply
+	}
+
+	b := &blockedClient{
+		c:            c,
+		db:           db,
+		serve:        serve,
+		timeout:      timeout,
+		timeoutReply: timeoutReply,
+		result:       make(chan Value, 1),
+	}
+	seen := map[string]bool{}
+	for _, key := range keys {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		b.keys = append(b.keys, key)
+		db.blocking[key] = append(db.blocking[key], b)
+	}
+	c.blocked = b
+	return Value{}
+}
+
+// unblockClient removes the client from the queues of all its keys
+// the caller must hold the lock of the database the client is blocked in
+func unblockClient(b *blockedClient) {
+	for _, key := range b.keys {
+		queue := b.db.blocking[key]
+		for i, other := range queue {
+			if other == b {
+				queue = append(queue[:i], queue[i+1:]...)
+				break
+			}
+		}
+		if len(queue) == 0 {
+			delete(b.db.blocking, key)
+		} else {
+			b.db.blocking[key] = queue
+		}
+	}
+}
+
+// signalKeyAsReady remembers that the key may now serve the clients blocked on it,
+// they are served by handleClientsBlockedOnKeys once the current command completes
+// the caller must hold the keyspace lock
+func (ks *Keyspace) signalKeyAsReady(key string) {
+	if len(ks.blocking[key]) == 0 || ks.readyKeysSet[key] {
+		return
+	}
+	ks.readyKeysSet[key] = true
+	ks.readyKeys = append(ks.readyKeys, key)
+}
+
+// handleClientsBlockedOnKeys serves the clients blocked on the keys signaled as ready
+// It runs after the command which signaled them was logged to the aof,
+// so that the pops done for the blocked clients are logged after it
+func handleClientsBlockedOnKeys() {
+	for _, db := range databases {
+		db.handleClientsBlockedOnKeys()
+	}
+}
+
+// handleClientsBlockedOnKeys serves the clients blocked on the ready keys of ks
+func (ks *Keyspace) handleClientsBlockedOnKeys() {
+	ks.mu.RLock()
+	pending := len(ks.readyKeys) > 0
+	ks.mu.RUnlock()
+	if !pending {
+		return
+	}
+
+	ks.lock()
+	defer ks.unlock()
+	// serving a client may make other keys ready, LMOVE pushes to its destination
+	for len(ks.readyKeys) > 0 {
+		keys := ks.readyKeys
+		ks.readyKeys = nil
+		ks.readyKeysSet = map[string]bool{}
+		for _, key := range keys {
+			ks.serveClientsBlockedOnKey(key)
+		}
+	}
+}
+
+// serveClientsBlockedOnKey serves the clients blocked on key in the order
+// they arrived, until the key has nothing left to serve
+func (ks *Keyspace) serveClientsBlockedOnKey(key string) {
+	queue := append([]*blockedClient{}, ks.blocking[key]...)
+	for _, b := range queue {
+		reply, aofArgs, ok, err := b.serve(key)
+		if err != nil {
+			// the key holds another type than the one this client waits for or
+			// nothing for this client, it stays blocked but the next clients
+			// may still be served
+			continue
+		}
+		if !ok {
+			return
+		}
+		// XREAD changes nothing and has nothing to log
+		if aofArgs != nil {
+			propagate(ks.id, aofArgs...)
+		}
+		unblockClient(b)
+		b.result <- reply
+	}
+}
+
+// waitUnblocked waits for the reply of the blocking command the client is blocked by
+func (c *Client) waitUnblocked() Value {
+	b := c.blocked
+	c.blocked = nil
+
+	var timeout <-chan time.Time
+	if b.timeout > 0 {
+		timer := time.NewTimer(b.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	disconnected, stopWatching := c.watchDisconnect()
+
+	select {
+	case reply := <-b.result:
+		stopWatching()
+		return reply
+	case <-timeout:
+	case <-disconnected:
+	}
+	stopWatching()
+
+	b.db.lock()
+	defer b.db.unlock()
+	// the client may have been served while we were waiting for the lock
+	select {
+	case reply := <-b.result:
+		return reply
+	default:
+	}
+	unblockClient(b)
+	return b.timeoutReply
+}
+
+// watchDisconnect closes the returned channel if the client closes the connection
+// while it is blocked, the returned stop function must be called before reading
+// from the connection again
+func (c *Client) watchDisconnect() (<-chan struct{}, func()) {
+	disconnected := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Peek does not consume anything, commands pipelined after the
+		// blocking one are still read once the client is unblocked
+		_, err := c.resp.reader.Peek(1)
+		if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			close(disconnected)
+		}
+	}()
+
+	stop := func() {
+		// an expired deadline makes the pending Peek return
+		c.conn.SetReadDeadline(time.Now())
+		<-done
+		c.conn.SetReadDeadline(time.Time{})
+	}
+	return disconnected, stop
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Data structure representing a connected client
+// Every connection gets its own Resp reader and Writer which are
+// reused for all the commands sent over that connection
+type Client struct {
+	id            int64
+	conn          net.Conn
+	resp          *Resp
+	writer        *Writer
+	name          string    // set by HELLO SETNAME
+	authenticated bool      // only checked when requirepass is configured
+	db            *Keyspace // the database selected with SELECT, 0 by default
+	// set by handlers which need the aof to log something other than
+	// the command they were called with, see rewriteCommand
+	aofRewrite  *Value
+	aofDisabled bool
+	aofAlso     []Value // logged after the command, see alsoPropagate
+	// set by blocking commands which could not be served right away
+	blocked *blockedClient
+	// the queued commands between MULTI and EXEC, nil outside of a transaction
+	multi *multiState
+	// inExec is set while EXEC runs the queued commands, execLogged once
+	// the MULTI which starts the transaction in the aof was logged
+	inExec     bool
+	execLogged bool
+	// the keys watched with WATCH, dirtyCAS is set once one of them is modified
+	watched  []watchedKey
+	dirtyCAS atomic.Bool
+	// the channels, patterns and shard channels the client is subscribed to
+	channels      map[string]bool
+	patterns      map[string]bool
+	shardChannels map[string]bool
+}
+
+// Map of all the currently connected clients keyed by their id
+var clients = map[int64]*Client{}
+var clientsMu = sync.Mutex{}
+var nextClientId int64 = 0
+
+func NewClient(conn net.Conn) *Client {
+	return &Client{
+		conn:          conn,
+		resp:          NewResp(conn),
+		writer:        NewWriter(conn),
+		authenticated: config.requirePass == "",
+		db:            databases[0],
+	}
+}
+
+// newFakeClient creates a client which is not connected to anything
+// it is used to run the commands replayed from the aof
+func newFakeClient() *Client {
+	return &Client{
+		writer:        NewWriter(io.Discard),
+		authenticated: true,
+		db:            databases[0],
+	}
+}
+
+// registerClient adds the client to the clients map and assigns it an id
+// it returns false if the maxclients limit has already been reached
+func registerClient(c *Client) bool {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	if len(clients) >= config.maxClients {
+		return false
+	}
+	nextClientId++
+	c.id = nextClientId
+	clients[c.id] = c
+	return true
+}
+
+func unregisterClient(c *Client) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	delete(clients, c.id)
+}
+
+// handleConnection serves a single connection until the client disconnects
+// it is run in its own go routine for every accepted connection
+func handleConnection(conn net.Conn) {
+	c := NewClient(conn)
+	defer conn.Close()
+
+	if !registerClient(c) {
+		c.writer.Write(Value{typ: "error", str: "ERR max number of clients reached"})
+		return
+	}
+	defer unregisterClient(c)
+	defer c.unwatchAllKeys()
+	defer c.unsubscribeAll()
+
+	for {
+		value, err := c.resp.Read()
+		if err != nil {
+			// a protocol error leaves the stream in an unknown state so we
+			// report it to the client and close the connection
+			if perr, ok := err.(*ProtocolError); ok {
+				log.Println(perr)
+				c.writer.Write(Value{typ: "error", str: "ERR " + perr.Error()})
+				return
+			}
+			// io.EOF just means the client closed the connection and
+			// net.ErrClosed that it was closed by the server, see push
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				log.Println(err)
+			}
+			return
+		}
+
+		if value.typ != "array" {
+			fmt.Println("Invalid request, expected array")
+			c.writer.Write(Value{typ: "error", str: "ERR Protocol error: expected array"})
+			continue
+		}
+
+		// empty inline commands are just ignored
+		if len(value.array) == 0 {
+			fmt.Println("Invalid request, expected array length > 0")
+			continue
+		}
+
+		c.processCommand(value)
+	}
+}
+
+func (c *Client) processCommand(value Value) {
+	command := strings.ToUpper(value.array[0].bulk)
+	log.Println(command)
+	// the arguments of AUTH and HELLO may hold a password
+	if command == "AUTH" || command == "HELLO" {
+		log.Println("(arguments redacted)")
+	} else {
+		log.Println(value.array[1:])
+	}
+
+	handler, ok := Handlers[command]
+	if !ok {
+		fmt.Println("Invalid command: ", command)
+		c.flagTransaction()
+		c.writer.Write(Value{typ: "error", str: fmt.Sprint("Invalid command: ", command)})
+		return
+	}
+
+	// until the client authenticates it can only use AUTH and HELLO
+	if !c.authenticated && command != "AUTH" && command != "HELLO" {
+		c.writer.Write(Value{typ: "error", str: "NOAUTH Authentication required."})
+		return
+	}
+
+	// a RESP2 connection with subscriptions is only used to receive messages
+	if c.inSubscribeMode() && !subscribeModeCommands[command] {
+		c.writer.Write(Value{typ: "error", str: fmt.Sprintf("ERR Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING are allowed in this context", strings.ToLower(command))})
+		return
+	}
+
+	// in a transaction the commands are only run by EXEC
+	if c.multi != nil && !multiCommands[command] {
+		c.writer.Write(c.queueCommand(command, value, handler))
+		return
+	}
+
+	result := c.call(command, value, handler)
+	// a blocked client waits for its reply without holding the command lock
+	if c.blocked != nil {
+		result = c.waitUnblocked()
+	}
+	c.writer.Write(result)
+}
+
+// call runs the command while holding the server command lock
+// and then serves the clients blocked on the keys it made ready
+func (c *Client) call(command string, value Value, handler func(*Client, []Value) Value) Value {
+	if exclusiveCommands[command] {
+		server.cmdMu.Lock()
+		defer server.cmdMu.Unlock()
+	} else {
+		server.cmdMu.RLock()
+		defer server.cmdMu.RUnlock()
+	}
+
+	result := c.execute(command, value, handler)
+	handleClientsBlockedOnKeys()
+	return result
+}
+
+// execute runs the handler and logs the command to the aof if it is a write
+// command which succeeded, the caller must hold the server command lock
+func (c *Client) execute(command string, value Value, handler func(*Client, []Value) Value) Value {
+	c.aofRewrite = nil
+	c.aofDisabled = false
+	c.aofAlso = nil
+	result := handler(c, value.array[1:])
+
+	// if the command belongs to the aofSet which contains the set of commands to be written to
+	// the aof then log it, nothing is logged while the aof is being replayed
+	if server.aof != nil && !server.loading.Load() && aofSet[command] && result.typ != "error" && !c.aofDisabled {
+		if c.aofRewrite != nil {
+			value = *c.aofRewrite
+		}
+		// the commands run by EXEC are logged in a transaction too
+		if c.inExec && !c.execLogged {
+			c.execLogged = true
+			err := server.aof.Write(c.db.id, Value{typ: "array", array: []Value{{typ: "bulk", bulk: "MULTI"}}})
+			if err != nil {
+				log.Println(err)
+			}
+		}
+		err := server.aof.Write(c.db.id, value)
+		if err != nil {
+			log.Println(err)
+		}
+		for _, also := range c.aofAlso {
+			if err := server.aof.Write(c.db.id, also); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+	return result
+}
+
+// rewriteCommand makes the aof log the given command instead of the one the
+// client sent, for example relative expire times are logged as absolute ones
+// so that replaying the aof later gives the same result
+func (c *Client) rewriteCommand(args ...string) {
+	value := Value{typ: "array", array: make([]Value, 0, len(args))}
+	for _, arg := range args {
+		value.array = append(value.array, Value{typ: "bulk", bulk: arg})
+	}
+	c.aofRewrite = &value
+}
+
+// alsoPropagate logs one more command to the aof after the current one,
+// for when a single command is not enough to replay what happened
+func (c *Client) alsoPropagate(args ...string) {
+	value := Value{typ: "array", array: make([]Value, 0, len(args))}
+	for _, arg := range args {
+		value.array = append(value.array, Value{typ: "bulk", bulk: arg})
+	}
+	c.aofAlso = append(c.aofAlso, value)
+}
+
+// preventPropagation keeps the current command out of the aof,
+// used when a write command ended up not changing anything
+func (c *Client) preventPropagation() {
+	c.aofDisabled = true
+}
+
+// Connection commands
+
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+// switches the connection to the requested protocol version and
+// replies with a map describing the server and the connection
+func hello(c *Client, args []Value) Value {
+	proto := c.writer.proto
+	if len(args) > 0 {
+		ver, err := strconv.Atoi(args[0].bulk)
+		if err != nil {
+			return Value{typ: "error", str: "ERR Protocol version is not an integer or out of range"}
+		}
+		if ver < 2 || ver > 3 {
+			return Value{typ: "error", str: "NOPROTO unsupported protocol version"}
+		}
+		proto = ver
+	}
+
+	authenticated := c.authenticated
+	name, setName := "", false
+	for i := 1; i < len(args); i++ {
+		moreArgs := len(args) - 1 - i
+		switch strings.ToUpper(args[i].bulk) {
+		case "AUTH":
+			if moreArgs < 2 {
+				return Value{typ: "error", str: fmt.Sprintf("ERR Syntax error in HELLO option '%s'", args[i].bulk)}
+			}
+			if !checkPassword(args[i+1].bulk, args[i+2].bulk) {
+				return Value{typ: "error", str: "WRONGPASS invalid username-password pair or user is disabled."}
+			}
+			authenticated = true
+			i += 2
+		case "SETNAME":
+			if moreArgs < 1 {
+				return Value{typ: "error", str: fmt.Sprintf("ERR Syntax error in HELLO option '%s'", args[i].bulk)}
+			}
+			if !validClientName(args[i+1].bulk) {
+				return Value{typ: "error", str: "ERR Client names cannot contain spaces, newlines or special characters."}
+			}
+			name, setName = args[i+1].bulk, true
+			i++
+		default:
+			return Value{typ: "error", str: fmt.Sprintf("ERR Syntax error in HELLO option '%s'", args[i].bulk)}
+		}
+	}
+
+	if !authenticated {
+		return Value{typ: "error", str: "NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time"}
+	}
+
+	// nothing is changed unless all the options were valid
+	c.authenticated = true
+	if setName {
+		c.name = name
+	}
+	c.writer.setProto(proto)
+
+	return Value{typ: "map", array: []Value{
+		{typ: "bulk", bulk: "server"}, {typ: "bulk", bulk: "redis"},
+		{typ: "bulk", bulk: "version"}, {typ: "bulk", bulk: serverVersion},
+		{typ: "bulk", bulk: "proto"}, {typ: "integer", num: int64(proto)},
+		{typ: "bulk", bulk: "id"}, {typ: "integer", num: c.id},
+		{typ: "bulk", bulk: "mode"}, {typ: "bulk", bulk: "standalone"},
+		{typ: "bulk", bulk: "role"}, {typ: "bulk", bulk: "master"},
+		{typ: "bulk", bulk: "modules"}, {typ: "array", array: []Value{}},
+	}}
+}
+
+// AUTH [username] password
+func auth(c *Client, args []Value) Value {
+	if len(args) < 1 || len(args) > 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'auth' command"}
+	}
+	if config.requirePass == "" && len(args) == 1 {
+		return Value{typ: "error", str: "ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?"}
+	}
+
+	username, password := "default", args[0].bulk
+	if len(args) == 2 {
+		username, password = args[0].bulk, args[1].bulk
+	}
+	if !checkPassword(username, password) {
+		return Value{typ: "error", str: "WRONGPASS invalid username-password pair or user is disabled."}
+	}
+	c.authenticated = true
+	return Value{typ: "string", str: "OK"}
+}
+
+// SELECT index
+func selectCommand(c *Client, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'select' command"}
+	}
+	db, err := parseDatabase(args[0].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	c.db = db
+	return Value{typ: "string", str: "OK"}
+}
+
+// There is only the default user, it accepts any password
+// unless requirepass is configured
+func checkPassword(username string, password string) bool {
+	if username != "default" {
+		return false
+	}
+	return config.requirePass == "" || password == config.requirePass
+}
+
+func validClientName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] < '!' || name[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,50 @@
+package main
+
+import "flag"
+
+// Config holds the server settings that can be tuned from the command line
+type Config struct {
+	port       int
+	maxClients int
+	appendOnly bool
+	// seconds between two rdb snapshots, 0 disables them
+	saveInterval int
+	requirePass  string
+	databases    int
+	// sparse HyperLogLogs bigger than this are converted to the dense encoding
+	hllSparseMaxBytes int
+	// subscribers with more bytes than this waiting to be sent are disconnected
+	pubsubBufferLimit int
+	// the classes of keyspace notifications which are published, see notify.go
+	notifyKeyspaceEvents int
+}
+
+var config = Config{}
+
+func init() {
+	flag.IntVar(&config.port, "port", 6379, "TCP port the server listens on")
+	// maxclients sets the number of clients that can be connected at the same time,
+	// connections above this limit are refused with an error
+	flag.IntVar(&config.maxClients, "maxclients", 10000, "max number of simultaneously connected clients")
+	// appendonly enables logging every write command to database.aof
+	// which is replayed when the server starts
+	flag.BoolVar(&config.appendOnly, "appendonly", false, "log write commands to the append only file")
+	// save-interval sets how often the dataset is saved to database.rdb, with 0 it is
+	// only saved by SHUTDOWN SAVE
+	flag.IntVar(&config.saveInterval, "save-interval", 20, "seconds between two rdb snapshots, 0 disables them")
+	// requirepass makes clients authenticate with AUTH or HELLO before running any other command
+	flag.StringVar(&config.requirePass, "requirepass", "", "password of the default user")
+	// databases sets the number of databases clients can SELECT
+	flag.IntVar(&config.databases, "databases", 16, "number of databases")
+	// hll-sparse-max-bytes trades the memory of small HyperLogLogs for the speed of PFADD
+	flag.IntVar(&config.hllSparseMaxBytes, "hll-sparse-max-bytes", 3000, "max size of a sparse HyperLogLog")
+	// client-output-buffer-limit-pubsub keeps slow subscribers from making the server buffer
+	// the messages published to them forever, 0 disables the limit
+	flag.IntVar(&config.pubsubBufferLimit, "client-output-buffer-limit-pubsub", 32*1024*1024, "max bytes waiting to be sent to a subscriber")
+	// notify-keyspace-events is a string of flags like "KEA", see notify.go
+	flag.Func("notify-keyspace-events", "classes of keyspace events to publish", func(flags string) error {
+		classes, err := parseNotifyKeyspaceEvents(flags)
+		config.notifyKeyspaceEvents = classes
+		return err
+	})
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
-	"log"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"slices"
+	"sort"
 	"strconv"
-	"sync"
 )
 
 // Data structure representing a list
@@ -29,387 +33,3691 @@ type HashElement struct {
 	value string
 }
 
-// Map for storing hashes
-// In redis HashMaps are used for storing Hashes
+// pushHead adds a new node holding value in front of the list
+func (list *List) pushHead(value string) {
+	node := &Node{value: value, prev: nil}
+	if list.length == 0 {
+		node.next = nil
+		list.head = node
+		list.tail = node
+	} else {
+		list.head.prev = node
+		node.next = list.head
+		list.head = node
+	}
+	list.length++
+}
+
+// pushTail adds a new node holding value at the end of the list
+func (list *List) pushTail(value string) {
+	node := &Node{value: value, next: nil}
+	if list.length == 0 {
+		node.prev = nil
+		list.head = node
+		list.tail = node
+	} else {
+		list.tail.next = node
+		node.prev = list.tail
+		list.tail = node
+	}
+	list.length++
+}
+
+// popHead removes the first node of the list and returns its value
+// the list must not be empty
+func (list *List) popHead() string {
+	node := list.head
+	list.remove(node)
+	return node.value
+}
+
+// popTail removes the last node of the list and returns its value
+// the list must not be empty
+func (list *List) popTail() string {
+	node := list.tail
+	list.remove(node)
+	return node.value
+}
+
+// remove unlinks the node from the list
+func (list *List) remove(node *Node) {
+	if node.prev != nil {
+		node.prev.next = node.next
+	} else {
+		list.head = node.next
+	}
+	if node.next != nil {
+		node.next.prev = node.prev
+	} else {
+		list.tail = node.prev
+	}
+	node.prev = nil
+	node.next = nil
+	list.length--
+}
+
+// insertBefore adds a new node holding value right before node
+func (list *List) insertBefore(node *Node, value string) {
+	if node == list.head {
+		list.pushHead(value)
+		return
+	}
+	newNode := &Node{value: value, prev: node.prev, next: node}
+	node.prev.next = newNode
+	node.prev = newNode
+	list.length++
+}
+
+// insertAfter adds a new node holding value right after node
+func (list *List) insertAfter(node *Node, value string) {
+	if node == list.tail {
+		list.pushTail(value)
+		return
+	}
+	newNode := &Node{value: value, prev: node, next: node.next}
+	node.next.prev = newNode
+	node.next = newNode
+	list.length++
+}
+
+// nodeAt returns the node at index or nil if the index is out of range
+// Negative indexes count from the end of the list, -1 being the last node
+// The list is walked from whichever end is closer to the index
+func (list *List) nodeAt(index int) *Node {
+	if index < 0 {
+		index += list.length
+	}
+	if index < 0 || index >= list.length {
+		return nil
+	}
+	if index < list.length/2 {
+		node := list.head
+		for i := 0; i < index; i++ {
+			node = node.next
+		}
+		return node
+	}
+	node := list.tail
+	for i := list.length - 1; i > index; i-- {
+		node = node.prev
+	}
+	return node
+}
+
 /*
+All the values are stored in the keyspace (see keyspace.go)
+
+Hashes
+In redis HashMaps are used for storing Hashes
 Commands:
 HSET: sets the value of one or more fields on a hash.
 HGET: returns the value at a given field.
 HMGET: returns the values at one or more given fields.
 HINCRBY: increments the value at a given field by the integer provided.
-*/
-var HSETs = map[string]map[string]string{}
-var HSETsMu = sync.RWMutex{}
 
-// Map for storing sets
-// In redis HashMaps are used for storing Sets
-/*
+Sets
+In redis HashMaps are used for storing Sets
 Commands:
 SADD adds a new member to a set.
 SREM removes the specified member from the set.
 SISMEMBER tests a string for set membership.
 SINTER returns the set of members that two or more sets have in common (i.e., the intersection).
 SCARD returns the cardinality of the set
-*/
-var SETs = map[string]map[string]bool{}
-var SETsMu = sync.RWMutex{}
 
-// Map for storing strings
-// In redis HashMaps are used for storing Sets
-/*
+Strings
 Commands:
 SET
 GET
-*/
-var StringSETS = map[string]string{}
-var StringSETSMu = sync.RWMutex{}
 
-// Map for storing lists
-// In redis LinkedLists are used for storing lists
-/*
+Lists
+In redis LinkedLists are used for storing lists
 Commands:
 LPUSH adds a new element to the head of a list; RPUSH adds to the tail.
 LPOP removes and returns an element from the head of a list; RPOP does the same but from the tail of a list.
 LLEN returns the length of a list.
 LRANGE extracts a range of elements from a list.
 */
-var LISTS = map[string]*List{}
-var LISTSMu = sync.RWMutex{}
-
-// /*
-// General command to acquire and release locks over all the datastructures used
-// ds_acquireAllLocks is to be called before we write to the rdb
-// and ds_releaseAllLocks is to be called after we write to the rdb
-// */
-// func ds_releaseAllLocks() {
-// 	StringSETSMu.Unlock()
-// 	HSETsMu.Unlock()
-// 	SETsMu.Unlock()
-// 	LISTSMu.Unlock()
-// }
-// func ds_acquireAllLocks() {
-// 	StringSETSMu.Lock()
-// 	HSETsMu.Lock()
-// 	SETsMu.Lock()
-// 	LISTSMu.Lock()
-// }
 
 // Set Commands
 
-func ds_strav(set map[string]bool) []string {
-	members := make([]string, 0)
-	for member, isFound := range set {
-		if isFound {
-			members = append(members, member)
-		}
+func ds_strav(set *Dict[struct{}]) []string {
+	members := make([]string, 0, set.len())
+	for member := range set.keys() {
+		members = append(members, member)
 	}
 	return members
 }
-func ds_scard(key string) string {
-	SETsMu.Lock()
-	defer SETsMu.Unlock()
-	if _, ok := SETs[key]; !ok {
-		return "0"
+func ds_scard(db *Keyspace, key string) (int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	obj, err := db.lookupType(key, SetType)
+	if err != nil || obj == nil {
+		return 0, err
 	}
-	len := len(SETs[key])
-	length := strconv.FormatInt(int64(len), 10)
-	return length
+	return int64(obj.set.len()), nil
 }
 
-func ds_srem(key string, members []string) string {
-	SETsMu.Lock()
-	defer SETsMu.Unlock()
-	if _, ok := SETs[key]; !ok {
-		return "0"
+func ds_srem(db *Keyspace, key string, members []string) (int64, error) {
+	db.lock()
+	defer db.unlock()
+	obj, err := db.lookupType(key, SetType)
+	if err != nil || obj == nil {
+		return 0, err
 	}
-	numberOfExistingElementsRemoved := 0
+	var numberOfExistingElementsRemoved int64 = 0
 	for _, member := range members {
-		_, ok := SETs[key][member]
-		if ok {
+		if obj.set.delete(member) {
 			numberOfExistingElementsRemoved++
-			delete(SETs[key], member)
 		}
 	}
-	noOfElementsRemoved := strconv.FormatInt(int64(numberOfExistingElementsRemoved), 10)
-	return noOfElementsRemoved
+	if numberOfExistingElementsRemoved > 0 {
+		db.signalModifiedKey(key)
+		db.notifyKeyspaceEvent(notifySet, "srem", key)
+	}
+	// removing the last member removes the set itself
+	if obj.set.len() == 0 {
+		db.delete(key)
+		db.notifyKeyspaceEvent(notifyGeneric, "del", key)
+	}
+	return numberOfExistingElementsRemoved, nil
 
 }
 
-func ds_sismember(key string, member string) string {
-	SETsMu.Lock()
-	defer SETsMu.Unlock()
-	if _, ok := SETs[key]; !ok {
-		return "0"
+func ds_sismember(db *Keyspace, key string, member string) (int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	obj, err := db.lookupType(key, SetType)
+	if err != nil || obj == nil {
+		return 0, err
 	}
-	_, ok := SETs[key][member]
-	if !ok {
-		return "0"
+	if !obj.set.has(member) {
+		return 0, nil
 	}
-	return "1"
+	return 1, nil
 }
 
-func ds_sadd(key string, members []string) string {
-	SETsMu.Lock()
-	defer SETsMu.Unlock()
-	if _, ok := SETs[key]; !ok {
-		SETs[key] = map[string]bool{}
+func ds_sadd(db *Keyspace, key string, members []string) (int64, error) {
+	db.lock()
+	defer db.unlock()
+	obj, err := db.lookupOrCreate(key, SetType, newSetObject)
+	if err != nil {
+		return 0, err
 	}
-	numberOfNewElementsAdded := 0
+	var numberOfNewElementsAdded int64 = 0
 	for _, member := range members {
-		_, ok := SETs[key][member]
-		if !ok {
-			SETs[key][member] = true
+		if obj.set.set(member, struct{}{}) {
 			numberOfNewElementsAdded++
-		} else {
-			SETs[key][member] = true
 		}
 	}
-	noOfElementsAdded := strconv.FormatInt(int64(numberOfNewElementsAdded), 10)
-	return noOfElementsAdded
+	if numberOfNewElementsAdded > 0 {
+		db.signalModifiedKey(key)
+		db.notifyKeyspaceEvent(notifySet, "sadd", key)
+	}
+	return numberOfNewElementsAdded, nil
+
+}
+
+// ds_smembers returns all the members of the set
+func ds_smembers(db *Keyspace, key string) ([]string, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	obj, err := db.lookupType(key, SetType)
+	if err != nil || obj == nil {
+		return []string{}, err
+	}
+	return ds_strav(obj.set), nil
+}
+
+// ds_smismember tells for every member whether it belongs to the set
+func ds_smismember(db *Keyspace, key string, members []string) ([]int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	results := make([]int64, len(members))
+	obj, err := db.lookupType(key, SetType)
+	if err != nil || obj == nil {
+		return results, err
+	}
+	for i, member := range members {
+		if obj.set.has(member) {
+			results[i] = 1
+		}
+	}
+	return results, nil
+}
+
+// Operations done by SINTER, SUNION and SDIFF and their STORE variants
+type SetOperation int
+
+const (
+	SetUnion SetOperation = iota
+	SetInter
+	SetDiff
+)
+
+// name returns the name of the operation as found in the names of the commands
+func (op SetOperation) name() string {
+	switch op {
+	case SetUnion:
+		return "union"
+	case SetInter:
+		return "inter"
+	}
+	return "diff"
+}
+
+// setOperation computes the result of the operation over the sets stored at keys,
+// missing keys count as empty sets. The caller must hold the keyspace lock
+func setOperation(db *Keyspace, keys []string, op SetOperation) (*Dict[struct{}], error) {
+	sets := make([]*Dict[struct{}], 0, len(keys))
+	for _, key := range keys {
+		obj, err := db.lookupType(key, SetType)
+		if err != nil {
+			return nil, err
+		}
+		if obj == nil {
+			sets = append(sets, newDict[struct{}]())
+			continue
+		}
+		sets = append(sets, obj.set)
+	}
+
+	result := newDict[struct{}]()
+	switch op {
+	case SetUnion:
+		for _, set := range sets {
+			for member := range set.keys() {
+				result.set(member, struct{}{})
+			}
+		}
+	case SetInter:
+		// the members of the smallest set are the only candidates,
+		// iterating it first keeps the intersection cheap
+		sets = smallestSetFirst(sets)
+		for member := range sets[0].keys() {
+			if memberOfAll(member, sets[1:]) {
+				result.set(member, struct{}{})
+			}
+		}
+	case SetDiff:
+		for member := range sets[0].keys() {
+			inOther := false
+			for _, set := range sets[1:] {
+				if set.has(member) {
+					inOther = true
+					break
+				}
+			}
+			if !inOther {
+				result.set(member, struct{}{})
+			}
+		}
+	}
+	return result, nil
+}
+
+// smallestSetFirst sorts the sets from the smallest to the largest
+func smallestSetFirst(sets []*Dict[struct{}]) []*Dict[struct{}] {
+	sorted := append([]*Dict[struct{}]{}, sets...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].len() < sorted[j].len()
+	})
+	return sorted
+}
+
+func memberOfAll(member string, sets []*Dict[struct{}]) bool {
+	for _, set := range sets {
+		if !set.has(member) {
+			return false
+		}
+	}
+	return true
+}
+
+// ds_setop returns the members of the union, intersection or difference of the sets
+func ds_setop(db *Keyspace, keys []string, op SetOperation) ([]string, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	result, err := setOperation(db, keys, op)
+	if err != nil {
+		return nil, err
+	}
+	return ds_strav(result), nil
+}
+
+// ds_setopstore stores the result of the operation at destination overwriting it,
+// an empty result deletes destination. It returns the size of the result
+func ds_setopstore(db *Keyspace, destination string, keys []string, op SetOperation) (int64, error) {
+	db.lock()
+	defer db.unlock()
+	result, err := setOperation(db, keys, op)
+	if err != nil {
+		return 0, err
+	}
+	if result.len() == 0 {
+		if db.delete(destination) {
+			db.notifyKeyspaceEvent(notifyGeneric, "del", destination)
+		}
+		return 0, nil
+	}
+	obj := newSetObject()
+	obj.set = result
+	db.set(destination, obj)
+	db.notifyKeyspaceEvent(notifySet, "s"+op.name()+"store", destination)
+	return int64(result.len()), nil
+}
+
+// ds_sintercard returns the size of the intersection of the sets,
+// it stops counting at limit unless limit is 0
+func ds_sintercard(db *Keyspace, keys []string, limit int64) (int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	sets := make([]*Dict[struct{}], 0, len(keys))
+	for _, key := range keys {
+		obj, err := db.lookupType(key, SetType)
+		if err != nil {
+			return 0, err
+		}
+		if obj == nil {
+			// the type of the other keys is still checked
+			sets = append(sets, newDict[struct{}]())
+			continue
+		}
+		sets = append(sets, obj.set)
+	}
+	sets = smallestSetFirst(sets)
+	var count int64 = 0
+	for member := range sets[0].keys() {
+		if memberOfAll(member, sets[1:]) {
+			count++
+			if count == limit {
+				break
+			}
+		}
+	}
+	return count, nil
+}
+
+// ds_smove moves member from the source set to the destination set
+// It returns 0 if member is not in source
+func ds_smove(db *Keyspace, source string, destination string, member string) (int64, error) {
+	db.lock()
+	defer db.unlock()
+	src, err := db.lookupType(source, SetType)
+	if err != nil {
+		return 0, err
+	}
+	dst, err := db.lookupType(destination, SetType)
+	if err != nil {
+		return 0, err
+	}
+	if src == nil || !src.set.has(member) {
+		return 0, nil
+	}
+	if source == destination {
+		return 1, nil
+	}
+	src.set.delete(member)
+	db.signalModifiedKey(source)
+	db.notifyKeyspaceEvent(notifySet, "srem", source)
+	if src.set.len() == 0 {
+		db.delete(source)
+		db.notifyKeyspaceEvent(notifyGeneric, "del", source)
+	}
+	if dst == nil {
+		dst = newSetObject()
+		db.set(destination, dst)
+	}
+	dst.set.set(member, struct{}{})
+	db.signalModifiedKey(destination)
+	db.notifyKeyspaceEvent(notifySet, "sadd", destination)
+	return 1, nil
+}
+
+// ds_spop removes up to count random members from the set and returns them
+// it returns false if the set does not exist
+func ds_spop(db *Keyspace, key string, count int64) ([]string, bool, error) {
+	db.lock()
+	defer db.unlock()
+	obj, err := db.lookupType(key, SetType)
+	if err != nil || obj == nil {
+		return nil, false, err
+	}
+	members := obj.set.randomKeys(int(min(count, int64(obj.set.len()))))
+	for _, member := range members {
+		obj.set.delete(member)
+	}
+	if len(members) > 0 {
+		db.signalModifiedKey(key)
+		db.notifyKeyspaceEvent(notifySet, "spop", key)
+	}
+	if obj.set.len() == 0 {
+		db.delete(key)
+		db.notifyKeyspaceEvent(notifyGeneric, "del", key)
+	}
+	return members, true, nil
+}
+
+// ds_srandmember returns random members of the set
+// with a positive count the members are distinct and there are at most count of them,
+// with a negative count the same member may be returned more than once
+func ds_srandmember(db *Keyspace, key string, count int64) ([]string, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	obj, err := db.lookupType(key, SetType)
+	if err != nil || obj == nil {
+		return []string{}, err
+	}
+	if count >= 0 {
+		return obj.set.randomKeys(int(min(count, int64(obj.set.len())))), nil
+	}
+	// the count comes from the client, it is not used to size the reply upfront
+	picked := []string{}
+	for i := int64(0); i < -count; i++ {
+		member, _ := obj.set.randomKey()
+		picked = append(picked, member)
+	}
+	return picked, nil
+}
 
+// ds_sscan returns the members found in the next buckets of the set from
+// cursor on and the cursor to continue with, see SCAN
+func ds_sscan(db *Keyspace, key string, cursor uint64, opts scanOptions) (uint64, []string, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	members := make([]string, 0)
+	obj, err := db.lookupType(key, SetType)
+	if err != nil || obj == nil {
+		return 0, members, err
+	}
+	cursor = scanDict(obj.set, cursor, opts.count, func(member string, _ struct{}) {
+		if opts.matches(member) {
+			members = append(members, member)
+		}
+	})
+	return cursor, members, nil
 }
 
 // List Commands
 
-func ds_lpush(key string, values []string) string { // works
-	LISTSMu.Lock()
-	defer LISTSMu.Unlock()
-	list, ok := LISTS[key]
-	if !ok {
-		list = &List{head: nil, tail: nil, length: 0}
-		LISTS[key] = list
+func ds_lpush(db *Keyspace, key string, values []string) (int64, error) { // works
+	return ds_push(db, key, values, true, false)
+}
+
+func ds_rpush(db *Keyspace, key string, values []string) (int64, error) { // works
+	return ds_push(db, key, values, false, false)
+}
+
+// ds_push adds the values at the head or at the tail of the list
+// with onlyIfExists set nothing is done when the list does not exist (LPUSHX/RPUSHX)
+func ds_push(db *Keyspace, key string, values []string, head bool, onlyIfExists bool) (int64, error) {
+	db.lock()
+	defer db.unlock()
+	obj, err := db.lookupType(key, ListType)
+	if err != nil {
+		return 0, err
+	}
+	if obj == nil {
+		if onlyIfExists {
+			return 0, nil
+		}
+		obj = newListObject()
+		db.set(key, obj)
 	}
 	for _, value := range values {
-		node := &Node{value: value, prev: nil}
-		if list.length == 0 {
-			node.next = nil
-			list.head = node
-			list.tail = node
+		if head {
+			obj.list.pushHead(value)
 		} else {
-			list.head.prev = node
-			node.next = list.head
-			list.head = node
+			obj.list.pushTail(value)
 		}
-		list.length++
 	}
-	length := strconv.FormatInt(int64(list.length), 10)
-	return length
+	db.signalModifiedKey(key)
+	db.signalKeyAsReady(key)
+	db.notifyKeyspaceEvent(notifyList, listEvent(head, "push"), key)
+	return int64(obj.list.length), nil
 }
 
-func ds_rpush(key string, values []string) string { // works
-	LISTSMu.Lock()
-	defer LISTSMu.Unlock()
-	list, ok := LISTS[key]
-	if !ok {
-		list = &List{head: nil, tail: nil, length: 0}
-		LISTS[key] = list
+func ds_lpop(db *Keyspace, key string) (string, bool, error) { // works
+	values, ok, err := ds_pop(db, key, 1, true)
+	if err != nil || !ok {
+		return "", false, err
 	}
-	for _, value := range values {
-		node := &Node{value: value, next: nil}
-		if list.length == 0 {
-			node.prev = nil
-			list.head = node
-			list.tail = node
+	return values[0], true, nil
+}
+func ds_rpop(db *Keyspace, key string) (string, bool, error) { //works
+	values, ok, err := ds_pop(db, key, 1, false)
+	if err != nil || !ok {
+		return "", false, err
+	}
+	return values[0], true, nil
+}
+
+// ds_pop removes up to count values from the head or the tail of the list
+// it returns false if the list does not exist
+func ds_pop(db *Keyspace, key string, count int, head bool) ([]string, bool, error) {
+	db.lock()
+	defer db.unlock()
+	obj, err := db.lookupType(key, ListType)
+	if err != nil || obj == nil {
+		return nil, false, err
+	}
+	return listPop(db, key, obj.list, count, head), true, nil
+}
+
+// listPop pops up to count values from the list stored at key, deleting
+// the key once the list is empty. The caller must hold the keyspace lock
+func listPop(db *Keyspace, key string, list *List, count int, head bool) []string {
+	values := make([]string, 0)
+	for i := 0; i < count && list.length > 0; i++ {
+		if head {
+			values = append(values, list.popHead())
 		} else {
-			list.tail.next = node
-			node.prev = list.tail
-			list.tail = node
+			values = append(values, list.popTail())
+		}
+	}
+	if len(values) > 0 {
+		db.signalModifiedKey(key)
+		db.notifyKeyspaceEvent(notifyList, listEvent(head, "pop"), key)
+	}
+	if list.length == 0 {
+		db.delete(key)
+		db.notifyKeyspaceEvent(notifyGeneric, "del", key)
+	}
+	return values
+}
+
+// ds_mpop pops up to count values from the first non empty list among keys
+// it returns the key the values were popped from, or false if all the lists are empty
+func ds_mpop(db *Keyspace, keys []string, count int, head bool) (string, []string, bool, error) {
+	db.lock()
+	defer db.unlock()
+	for _, key := range keys {
+		obj, err := db.lookupType(key, ListType)
+		if err != nil {
+			return "", nil, false, err
+		}
+		if obj == nil {
+			continue
 		}
-		list.length++
+		return key, listPop(db, key, obj.list, count, head), true, nil
 	}
-	length := strconv.FormatInt(int64(list.length), 10)
-	return length
+	return "", nil, false, nil
 }
 
-func ds_lpop(key string) (string, bool) { // works
-	LISTSMu.Lock()
-	defer LISTSMu.Unlock()
-	log.Println(key)
-	list, ok := LISTS[key]
-	if !ok {
-		log.Println("this list is not present")
-		return "", false
+// ds_lmove atomically pops a value from source and pushes it to destination,
+// fromHead and toHead tell which end of each list is used
+func ds_lmove(db *Keyspace, source string, destination string, fromHead bool, toHead bool) (string, bool, error) {
+	db.lock()
+	defer db.unlock()
+	return listMove(db, source, destination, fromHead, toHead)
+}
+
+// listMove does the work of ds_lmove, the caller must hold the keyspace lock
+func listMove(db *Keyspace, source string, destination string, fromHead bool, toHead bool) (string, bool, error) {
+	src, err := db.lookupType(source, ListType)
+	if err != nil || src == nil {
+		return "", false, err
 	}
-	head := list.head
-	value := head.value
-	next := head.next
-	list.head = next
-	list.length--
-	if list.length == 0 {
-		delete(LISTS, key)
+	dst, err := db.lookupType(destination, ListType)
+	if err != nil {
+		return "", false, err
+	}
+
+	value := listPop(db, source, src.list, 1, fromHead)[0]
+	if dst == nil || dst.list.length == 0 {
+		// when source and destination are the same list, popping its only
+		// value deleted it so it has to be created again
+		dst = newListObject()
+		db.set(destination, dst)
 	}
-	return value, true
+	if toHead {
+		dst.list.pushHead(value)
+	} else {
+		dst.list.pushTail(value)
+	}
+	db.signalModifiedKey(destination)
+	db.signalKeyAsReady(destination)
+	db.notifyKeyspaceEvent(notifyList, listEvent(toHead, "push"), destination)
+	return value, true, nil
 }
-func ds_rpop(key string) (string, bool) { //works
-	LISTSMu.Lock()
-	defer LISTSMu.Unlock()
-	list, ok := LISTS[key]
-	if !ok {
-		return "", false
+
+// serveListPop returns the serveFunc of BLPOP and BRPOP, or of BLMPOP when count is positive
+func serveListPop(db *Keyspace, head bool, count int) serveFunc {
+	pop := "RPOP"
+	if head {
+		pop = "LPOP"
 	}
-	tail := list.tail
-	value := tail.value
-	prev := tail.prev
-	list.tail = prev
-	list.length--
-	if list.length == 0 {
-		delete(LISTS, key)
+	return func(key string) (Value, []string, bool, error) {
+		obj, err := db.lookupType(key, ListType)
+		if err != nil || obj == nil {
+			return Value{}, nil, false, err
+		}
+		if count == 0 {
+			value := listPop(db, key, obj.list, 1, head)[0]
+			reply := Value{typ: "array", array: []Value{{typ: "bulk", bulk: key}, {typ: "bulk", bulk: value}}}
+			return reply, []string{pop, key}, true, nil
+		}
+		values := listPop(db, key, obj.list, count, head)
+		reply := Value{typ: "array", array: []Value{{typ: "bulk", bulk: key}, bulkArray(values)}}
+		return reply, []string{pop, key, strconv.Itoa(len(values))}, true, nil
+	}
+}
+
+// serveListMove returns the serveFunc of BLMOVE and BRPOPLPUSH
+func serveListMove(db *Keyspace, destination string, fromHead bool, toHead bool) serveFunc {
+	return func(key string) (Value, []string, bool, error) {
+		value, ok, err := listMove(db, key, destination, fromHead, toHead)
+		if err != nil || !ok {
+			return Value{}, nil, false, err
+		}
+		aofArgs := []string{"LMOVE", key, destination, listEndName(fromHead), listEndName(toHead)}
+		return Value{typ: "bulk", bulk: value}, aofArgs, true, nil
+	}
+}
+
+func listEndName(head bool) string {
+	if head {
+		return "LEFT"
+	}
+	return "RIGHT"
+}
+
+// listEvent returns the keyspace event of a push or a pop at one end of a list, like lpush
+func listEvent(head bool, op string) string {
+	if head {
+		return "l" + op
 	}
-	return value, true
+	return "r" + op
 }
 
-func ds_lrange(key string, index string) (string, bool) {
-	idx, _ := strconv.ParseInt(index, 10, 64)
-	list, ok := LISTS[key]
+// ds_lrange returns the values between the start and stop indexes, both included
+// negative indexes count from the end of the list, -1 being the last value
+func ds_lrange(db *Keyspace, key string, start int64, stop int64) ([]string, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	obj, err := db.lookupType(key, ListType)
+	if err != nil || obj == nil {
+		return []string{}, err
+	}
+	list := obj.list
+	start, stop, ok := normalizeRange(start, stop, int64(list.length))
 	if !ok {
-		return "", false
+		return []string{}, nil
+	}
+	values := make([]string, 0, stop-start+1)
+	node := list.nodeAt(int(start))
+	for i := start; i <= stop; i++ {
+		values = append(values, node.value)
+		node = node.next
+	}
+	return values, nil
+}
+
+// normalizeRange turns the start and stop indexes given to commands like LRANGE
+// into positive indexes inside a sequence of the given length
+// It returns false if the range is empty
+func normalizeRange(start int64, stop int64, length int64) (int64, int64, bool) {
+	if start < 0 {
+		start += length
+	}
+	if stop < 0 {
+		stop += length
 	}
-	node := *list.head
-	for i := 0; i < int(idx); i++ {
-		node = *node.next
+	if start < 0 {
+		start = 0
 	}
-	return node.value, true
+	if start > stop || start >= length {
+		return 0, 0, false
+	}
+	if stop >= length {
+		stop = length - 1
+	}
+	return start, stop, true
 }
 
 func ds_ltrav(list *List) []string {
-	values := make([]string, 0)
-	node := *list.head
-	size := list.length
-	for i := 0; i < size; i++ {
+	values := make([]string, 0, list.length)
+	for node := list.head; node != nil; node = node.next {
 		values = append(values, node.value)
-		if node.next == nil {
-			break
-		}
-		node = *node.next
 	}
 	return values
 
 }
-func ds_lindex(key string, index string) (string, bool) {
-	idx, _ := strconv.ParseInt(index, 10, 64)
-	list, ok := LISTS[key]
-	if !ok {
-		return "", false
-	}
-	if idx >= int64(list.length) {
-		return "", false
+
+// ds_lindex returns the value at index, negative indexes count from the end of the list
+func ds_lindex(db *Keyspace, key string, index int64) (string, bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	obj, err := db.lookupType(key, ListType)
+	if err != nil || obj == nil {
+		return "", false, err
 	}
-	node := *list.head
-	for i := 0; i < int(idx); i++ {
-		node = *node.next
+	node := obj.list.nodeAt(int(index))
+	if node == nil {
+		return "", false, nil
 	}
-	return node.value, true
+	return node.value, true, nil
 }
-func ds_llen(key string) string {
-	LISTSMu.Lock()
-	defer LISTSMu.Unlock()
-	list, ok := LISTS[key]
-	if !ok {
-		return "0"
+func ds_llen(db *Keyspace, key string) (int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	obj, err := db.lookupType(key, ListType)
+	if err != nil || obj == nil {
+		return 0, err
 	}
-	length := strconv.FormatInt(int64(list.length), 10)
-	return length
+	return int64(obj.list.length), nil
 }
 
-// Hash commands
-func ds_hget(hash string, key string) (string, bool) {
-	HSETsMu.Lock()
-	defer HSETsMu.Unlock()
-	hashMap, ok := HSETs[hash]
-	if !ok {
-		return "", false
+var ErrIndexOutOfRange = errors.New("ERR index out of range")
+
+// ds_lset replaces the value at index
+func ds_lset(db *Keyspace, key string, index int64, value string) error {
+	db.lock()
+	defer db.unlock()
+	obj, err := db.lookupType(key, ListType)
+	if err != nil {
+		return err
 	}
-	value, ok := hashMap[key]
-	if !ok {
-		return "", false
+	if obj == nil {
+		return ErrNoSuchKey
 	}
+	node := obj.list.nodeAt(int(index))
+	if node == nil {
+		return ErrIndexOutOfRange
+	}
+	node.value = value
+	db.signalModifiedKey(key)
+	db.notifyKeyspaceEvent(notifyList, "lset", key)
+	return nil
+}
 
-	return value, true
+// ds_linsert inserts value before or after the first occurrence of pivot
+// It returns the new length of the list, -1 if pivot was not found
+// and 0 if the list does not exist
+func ds_linsert(db *Keyspace, key string, before bool, pivot string, value string) (int64, error) {
+	db.lock()
+	defer db.unlock()
+	obj, err := db.lookupType(key, ListType)
+	if err != nil || obj == nil {
+		return 0, err
+	}
+	list := obj.list
+	for node := list.head; node != nil; node = node.next {
+		if node.value == pivot {
+			if before {
+				list.insertBefore(node, value)
+			} else {
+				list.insertAfter(node, value)
+			}
+			db.signalModifiedKey(key)
+			db.notifyKeyspaceEvent(notifyList, "linsert", key)
+			return int64(list.length), nil
+		}
+	}
+	return -1, nil
 }
 
-func ds_hset(hash string, key string, value string) {
-	HSETsMu.Lock()
-	defer HSETsMu.Unlock()
-	if _, ok := HSETs[hash]; !ok {
-		HSETs[hash] = map[string]string{}
+// ds_lrem removes the first count occurrences of value, starting from the tail
+// when count is negative, or all of them when count is 0
+func ds_lrem(db *Keyspace, key string, count int64, value string) (int64, error) {
+	db.lock()
+	defer db.unlock()
+	obj, err := db.lookupType(key, ListType)
+	if err != nil || obj == nil {
+		return 0, err
+	}
+	list := obj.list
+	var removed int64 = 0
+	if count >= 0 {
+		for node := list.head; node != nil && (count == 0 || removed < count); {
+			next := node.next
+			if node.value == value {
+				list.remove(node)
+				removed++
+			}
+			node = next
+		}
+	} else {
+		for node := list.tail; node != nil && removed < -count; {
+			prev := node.prev
+			if node.value == value {
+				list.remove(node)
+				removed++
+			}
+			node = prev
+		}
+	}
+	if removed > 0 {
+		db.signalModifiedKey(key)
+		db.notifyKeyspaceEvent(notifyList, "lrem", key)
+	}
+	if list.length == 0 {
+		db.delete(key)
+		db.notifyKeyspaceEvent(notifyGeneric, "del", key)
 	}
-	HSETs[hash][key] = value
+	return removed, nil
 }
 
-func ds_htrav(hash map[string]string) []HashElement {
-	hashElements := make([]HashElement, 0)
-	for key, value := range hash {
-		hashElements = append(hashElements, HashElement{key: key, value: value})
+// ds_ltrim only keeps the values between the start and stop indexes
+func ds_ltrim(db *Keyspace, key string, start int64, stop int64) error {
+	db.lock()
+	defer db.unlock()
+	obj, err := db.lookupType(key, ListType)
+	if err != nil || obj == nil {
+		return err
 	}
-	return hashElements
+	list := obj.list
+	start, stop, ok := normalizeRange(start, stop, int64(list.length))
+	if !ok {
+		db.delete(key)
+		db.notifyKeyspaceEvent(notifyList, "ltrim", key)
+		db.notifyKeyspaceEvent(notifyGeneric, "del", key)
+		return nil
+	}
+	removeTail := int64(list.length) - 1 - stop
+	for i := int64(0); i < start; i++ {
+		list.popHead()
+	}
+	for i := int64(0); i < removeTail; i++ {
+		list.popTail()
+	}
+	db.signalModifiedKey(key)
+	db.notifyKeyspaceEvent(notifyList, "ltrim", key)
+	return nil
 }
 
-// String Commands
-func ds_set(key string, value string) {
-	StringSETSMu.Lock()
-	defer StringSETSMu.Unlock()
-	StringSETS[key] = value
+// ds_lpos returns the indexes of the values matching element
+// rank tells which match to start from, negative ranks search from the tail,
+// count is the number of matches wanted with 0 meaning all of them and
+// maxlen limits the number of values compared with 0 meaning no limit
+func ds_lpos(db *Keyspace, key string, element string, rank int64, count int64, maxlen int64) ([]int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	matches := make([]int64, 0)
+	obj, err := db.lookupType(key, ListType)
+	if err != nil || obj == nil {
+		return matches, err
+	}
+	list := obj.list
+	var compared int64 = 0
+	if rank > 0 {
+		index := int64(0)
+		for node := list.head; node != nil && (maxlen == 0 || compared < maxlen); node = node.next {
+			compared++
+			if node.value == element {
+				if rank > 1 {
+					rank--
+				} else {
+					matches = append(matches, index)
+					if count != 0 && int64(len(matches)) == count {
+						break
+					}
+				}
+			}
+			index++
+		}
+	} else {
+		index := int64(list.length) - 1
+		for node := list.tail; node != nil && (maxlen == 0 || compared < maxlen); node = node.prev {
+			compared++
+			if node.value == element {
+				if rank < -1 {
+					rank++
+				} else {
+					matches = append(matches, index)
+					if count != 0 && int64(len(matches)) == count {
+						break
+					}
+				}
+			}
+			index--
+		}
+	}
+	return matches, nil
 }
 
-func ds_get(key string) (string, bool) {
-	StringSETSMu.Lock()
-	defer StringSETSMu.Unlock()
-	v, ok := StringSETS[key]
+// Hash commands
+func ds_hget(db *Keyspace, hash string, key string) (string, bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	obj, err := db.lookupType(hash, HashType)
+	if err != nil || obj == nil {
+		return "", false, err
+	}
+	value, ok := obj.hashGet(key)
 	if !ok {
-		return "", false
+		return "", false, nil
 	}
-	return v, true
+
+	return value, true, nil
 }
-func ds_mget(keys []string) []string {
-	StringSETSMu.Lock()
-	defer StringSETSMu.Unlock()
-	values := make([]string, 0)
-	for _, key := range keys {
-		v, ok := StringSETS[key]
-		if !ok {
-			values = append(values, "nil")
-		} else {
-			values = append(values, v)
+
+// ds_hset sets the fields of the hash to the given values
+// with nx set the fields which already exist are left untouched (HSETNX)
+// It returns the number of fields which were added
+func ds_hset(db *Keyspace, hash string, elements []HashElement, nx bool) (int64, error) {
+	db.lock()
+	defer db.unlock()
+	obj, err := db.lookupOrCreate(hash, HashType, newHashObject)
+	if err != nil {
+		return 0, err
+	}
+	var added int64 = 0
+	for _, element := range elements {
+		exists := obj.hash.has(element.key)
+		if !exists {
+			added++
+		} else if nx {
+			continue
 		}
+		obj.hashSet(element.key, element.value)
 	}
-	return values
+	if added > 0 || !nx {
+		db.signalModifiedKey(hash)
+		db.notifyKeyspaceEvent(notifyHash, "hset", hash)
+	}
+	return added, nil
 }
 
-func ds_incr(key string) string {
-	StringSETSMu.Lock()
-	defer StringSETSMu.Unlock()
-
-	val, ok := StringSETS[key]
-	if !ok {
-		return ""
+// ds_hdel removes the fields from the hash and returns how many were removed
+// the key is deleted together with its last field
+func ds_hdel(db *Keyspace, hash string, fields []string) (int64, error) {
+	db.lock()
+	defer db.unlock()
+	obj, err := db.lookupType(hash, HashType)
+	if err != nil || obj == nil {
+		return 0, err
+	}
+	var removed int64 = 0
+	for _, field := range fields {
+		if obj.hash.has(field) {
+			obj.hashDelete(field)
+			removed++
+		}
+	}
+	if removed > 0 {
+		db.signalModifiedKey(hash)
+		db.notifyKeyspaceEvent(notifyHash, "hdel", hash)
 	}
+	if obj.hash.len() == 0 {
+		db.delete(hash)
+		db.notifyKeyspaceEvent(notifyGeneric, "del", hash)
+	}
+	return removed, nil
+}
 
-	// Parse existing value
-	value, err := strconv.ParseInt(val, 10, 64)
-	if err != nil {
-		return ""
+func ds_hlen(db *Keyspace, hash string) (int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	obj, err := db.lookupType(hash, HashType)
+	if err != nil || obj == nil {
+		return 0, err
 	}
+	return int64(obj.hashLen()), nil
+}
 
-	value++
-	StringSETS[key] = strconv.FormatInt(value, 10)
-	return StringSETS[key]
+// ds_hmget returns the values of the fields, found tells which of them exist
+func ds_hmget(db *Keyspace, hash string, fields []string) (values []string, found []bool, err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	values = make([]string, len(fields))
+	found = make([]bool, len(fields))
+	obj, err := db.lookupType(hash, HashType)
+	if err != nil || obj == nil {
+		return values, found, err
+	}
+	for i, field := range fields {
+		values[i], found[i] = obj.hashGet(field)
+	}
+	return values, found, nil
 }
 
-func ds_incrby(key string, increment int64) string {
-	StringSETSMu.Lock()
-	defer StringSETSMu.Unlock()
+var ErrHashNotInteger = errors.New("ERR hash value is not an integer")
+var ErrHashNotFloat = errors.New("ERR hash value is not a float")
+var ErrOverflow = errors.New("ERR increment or decrement would overflow")
+var ErrNaNOrInfinity = errors.New("ERR increment would produce NaN or Infinity")
 
-	val, ok := StringSETS[key]
-	if !ok {
-		return ""
+// ds_hincrby adds incr to the integer stored in the field, a missing field counts as 0
+func ds_hincrby(db *Keyspace, hash string, field string, incr int64) (int64, error) {
+	db.lock()
+	defer db.unlock()
+	obj, err := db.lookupOrCreate(hash, HashType, newHashObject)
+	if err != nil {
+		return 0, err
+	}
+	var num int64 = 0
+	if value, ok := obj.hash.get(field); ok {
+		num, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, ErrHashNotInteger
+		}
 	}
+	if (incr > 0 && num > math.MaxInt64-incr) || (incr < 0 && num < math.MinInt64-incr) {
+		return 0, ErrOverflow
+	}
+	num += incr
+	obj.hash.set(field, strconv.FormatInt(num, 10))
+	db.signalModifiedKey(hash)
+	db.notifyKeyspaceEvent(notifyHash, "hincrby", hash)
+	return num, nil
+}
 
-	// Parse existing value
-	value, err := strconv.ParseInt(val, 10, 64)
+// ds_hincrbyfloat adds incr to the float stored in the field and returns
+// the new value formatted the way it is stored, together with the time
+// to live of the field which is kept (-1 if it has none)
+func ds_hincrbyfloat(db *Keyspace, hash string, field string, incr float64) (string, int64, error) {
+	db.lock()
+	defer db.unlock()
+	obj, err := db.lookupOrCreate(hash, HashType, newHashObject)
 	if err != nil {
-		return ""
+		return "", -1, err
+	}
+	num := 0.0
+	if value, ok := obj.hash.get(field); ok {
+		num, err = parseFloat(value)
+		if err != nil {
+			return "", -1, ErrHashNotFloat
+		}
+	}
+	num += incr
+	if math.IsNaN(num) || math.IsInf(num, 0) {
+		return "", -1, ErrNaNOrInfinity
+	}
+	value := strconv.FormatFloat(num, 'f', -1, 64)
+	obj.hash.set(field, value)
+	db.signalModifiedKey(hash)
+	db.notifyKeyspaceEvent(notifyHash, "hincrbyfloat", hash)
+	return value, obj.getHashFieldExpire(field), nil
+}
+
+// parseFloat parses a float the way redis does, nan is never accepted
+// and neither are leading or trailing spaces
+func parseFloat(value string) (float64, error) {
+	num, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(num) || len(value) == 0 || isSpace(value[0]) || isSpace(value[len(value)-1]) {
+		return 0, errors.New("invalid float")
+	}
+	return num, nil
+}
+
+// ds_hrandfield returns random fields of the hash
+// with a positive count the fields are distinct and there are at most count of them,
+// with a negative count the same field may be returned more than once
+func ds_hrandfield(db *Keyspace, hash string, count int64) ([]HashElement, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	obj, err := db.lookupType(hash, HashType)
+	if err != nil || obj == nil {
+		return []HashElement{}, err
+	}
+	elements := ds_htrav(obj)
+	if count >= 0 {
+		rand.Shuffle(len(elements), func(i, j int) {
+			elements[i], elements[j] = elements[j], elements[i]
+		})
+		if count < int64(len(elements)) {
+			elements = elements[:count]
+		}
+		return elements, nil
+	}
+	// the count comes from the client, it is not used to size the reply upfront
+	picked := []HashElement{}
+	for i := int64(0); i < -count; i++ {
+		picked = append(picked, elements[rand.Intn(len(elements))])
+	}
+	return picked, nil
+}
+
+// ds_hgetall returns all the fields of the hash together with their values
+func ds_hgetall(db *Keyspace, hash string) ([]HashElement, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	obj, err := db.lookupType(hash, HashType)
+	if err != nil || obj == nil {
+		return []HashElement{}, err
+	}
+	return ds_htrav(obj), nil
+}
+
+// ds_htrav returns the fields of the hash which are not expired
+func ds_htrav(obj *Object) []HashElement {
+	hashElements := make([]HashElement, 0)
+	for key, value := range obj.hash.all() {
+		if obj.hashFieldExpired(key) {
+			continue
+		}
+		hashElements = append(hashElements, HashElement{key: key, value: value})
+	}
+	return hashElements
+}
+
+// Results of the hash field expiration commands for every field
+const (
+	HashFieldNotFound   = -2 // the field or the whole hash does not exist
+	HashFieldNoTTL      = -1 // the field exists but has no time to live
+	HashFieldNotUpdated = 0  // the NX, XX, GT or LT condition was not met
+	HashFieldUpdated    = 1  // the time to live was set or removed
+	HashFieldDeleted    = 2  // the field was deleted as the time is in the past
+)
+
+// ds_hexpire sets the time to live of the fields of the hash
+// when is a unix time in milliseconds, the flags work like the ones of EXPIRE
+func ds_hexpire(db *Keyspace, hash string, fields []string, when int64, flags expireFlags) ([]int64, error) {
+	db.lock()
+	defer db.unlock()
+	results := make([]int64, len(fields))
+	obj, err := db.lookupType(hash, HashType)
+	if err != nil {
+		return nil, err
+	}
+	for i, field := range fields {
+		if obj == nil {
+			results[i] = HashFieldNotFound
+			continue
+		}
+		if !obj.hash.has(field) {
+			results[i] = HashFieldNotFound
+			continue
+		}
+		// fields without a time to live are treated as having an infinite one
+		current := obj.getHashFieldExpire(field)
+		if (flags.nx && current != -1) || (flags.xx && current == -1) ||
+			(flags.gt && (current == -1 || when <= current)) ||
+			(flags.lt && current != -1 && when >= current) {
+			results[i] = HashFieldNotUpdated
+			continue
+		}
+		// while the aof is replayed the field is kept, it is deleted by the HDEL
+		// which was logged when it expired
+		if when <= mstime() && !server.loading.Load() {
+			obj.hashDelete(field)
+			results[i] = HashFieldDeleted
+			continue
+		}
+		obj.setHashFieldExpire(field, when)
+		db.trackHashFieldExpires(hash)
+		results[i] = HashFieldUpdated
+	}
+	if slices.ContainsFunc(results, func(result int64) bool { return result > HashFieldNotUpdated }) {
+		db.signalModifiedKey(hash)
+	}
+	// fields deleted right away are reported like an HDEL
+	if slices.Contains(results, HashFieldUpdated) {
+		db.notifyKeyspaceEvent(notifyHash, "hexpire", hash)
+	}
+	if slices.Contains(results, HashFieldDeleted) {
+		db.notifyKeyspaceEvent(notifyHash, "hdel", hash)
+	}
+	if obj != nil && obj.hash.len() == 0 {
+		db.delete(hash)
+		db.notifyKeyspaceEvent(notifyGeneric, "del", hash)
+	}
+	return results, nil
+}
+
+// ds_hpexpiretime returns the unix time in milliseconds at which every field expires
+// or one of HashFieldNotFound and HashFieldNoTTL
+func ds_hpexpiretime(db *Keyspace, hash string, fields []string) ([]int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	results := make([]int64, len(fields))
+	obj, err := db.lookupType(hash, HashType)
+	if err != nil {
+		return nil, err
+	}
+	for i, field := range fields {
+		if obj == nil {
+			results[i] = HashFieldNotFound
+			continue
+		}
+		if _, ok := obj.hashGet(field); !ok {
+			results[i] = HashFieldNotFound
+			continue
+		}
+		results[i] = obj.getHashFieldExpire(field)
+	}
+	return results, nil
+}
+
+// ds_hpersist removes the time to live of the fields
+func ds_hpersist(db *Keyspace, hash string, fields []string) ([]int64, error) {
+	db.lock()
+	defer db.unlock()
+	results := make([]int64, len(fields))
+	obj, err := db.lookupType(hash, HashType)
+	if err != nil {
+		return nil, err
+	}
+	for i, field := range fields {
+		if obj == nil {
+			results[i] = HashFieldNotFound
+			continue
+		}
+		if !obj.hash.has(field) {
+			results[i] = HashFieldNotFound
+			continue
+		}
+		if obj.getHashFieldExpire(field) == -1 {
+			results[i] = HashFieldNoTTL
+			continue
+		}
+		delete(obj.hashExpires, field)
+		results[i] = HashFieldUpdated
+	}
+	if slices.Contains(results, HashFieldUpdated) {
+		db.signalModifiedKey(hash)
+		db.notifyKeyspaceEvent(notifyHash, "hpersist", hash)
+	}
+	return results, nil
+}
+
+// ds_hgetex returns the values of the fields like ds_hmget and then updates the time to
+// live of the ones which exist, with persist set it is removed, otherwise a positive
+// expireAt sets it and a time in the past deletes the fields
+func ds_hgetex(db *Keyspace, hash string, fields []string, expireAt int64, persist bool) (values []string, found []bool, err error) {
+	db.lock()
+	defer db.unlock()
+	values = make([]string, len(fields))
+	found = make([]bool, len(fields))
+	obj, err := db.lookupType(hash, HashType)
+	if err != nil || obj == nil {
+		return values, found, err
+	}
+	for i, field := range fields {
+		values[i], found[i] = obj.hash.get(field)
+		if !found[i] {
+			continue
+		}
+		switch {
+		case persist:
+			delete(obj.hashExpires, field)
+		case expireAt > 0 && expireAt <= mstime() && !server.loading.Load():
+			obj.hashDelete(field)
+		case expireAt > 0:
+			obj.setHashFieldExpire(field, expireAt)
+			db.trackHashFieldExpires(hash)
+		}
+	}
+	if (persist || expireAt > 0) && slices.Contains(found, true) {
+		db.signalModifiedKey(hash)
+		switch {
+		case persist:
+			db.notifyKeyspaceEvent(notifyHash, "hpersist", hash)
+		case expireAt <= mstime() && !server.loading.Load():
+			db.notifyKeyspaceEvent(notifyHash, "hdel", hash)
+		default:
+			db.notifyKeyspaceEvent(notifyHash, "hexpire", hash)
+		}
+	}
+	if obj.hash.len() == 0 {
+		db.delete(hash)
+		db.notifyKeyspaceEvent(notifyGeneric, "del", hash)
+	}
+	return values, found, nil
+}
+
+// ds_hscan returns the fields found in the next buckets of the hash from
+// cursor on and the cursor to continue with, expired fields are skipped
+func ds_hscan(db *Keyspace, hash string, cursor uint64, opts scanOptions) (uint64, []HashElement, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	elements := make([]HashElement, 0)
+	obj, err := db.lookupType(hash, HashType)
+	if err != nil || obj == nil {
+		return 0, elements, err
+	}
+	cursor = scanDict(obj.hash, cursor, opts.count, func(field string, value string) {
+		if opts.matches(field) && !obj.hashFieldExpired(field) {
+			elements = append(elements, HashElement{key: field, value: value})
+		}
+	})
+	return cursor, elements, nil
+}
+
+// Sorted Set Commands
+
+// ds_zadd adds the elements to the sorted set or updates their score following the flags
+// It returns the number of members added and updated, with flags.incr the single
+// element is incremented and its new score is returned, unless the flags prevented it
+func ds_zadd(db *Keyspace, key string, elements []ZSetElement, flags zaddFlags) (added int64, updated int64, score float64, ok bool, err error) {
+	db.lock()
+	defer db.unlock()
+	obj, err := db.lookupType(key, ZSetType)
+	if err != nil {
+		return 0, 0, 0, false, err
+	}
+	if obj == nil {
+		// with XX nothing can be added so the key is not created
+		if flags.xx {
+			return 0, 0, 0, false, nil
+		}
+		obj = newZSetObject()
+		db.set(key, obj)
+	}
+	for _, element := range elements {
+		result, newScore := obj.zset.add(element.score, element.member, flags)
+		switch result {
+		case zaddNaN:
+			return 0, 0, 0, false, ErrScoreNaN
+		case zaddAdded:
+			added++
+		case zaddUpdated:
+			updated++
+		}
+		score, ok = newScore, result != zaddNop
+	}
+	if added > 0 || updated > 0 {
+		db.signalModifiedKey(key)
+		if flags.incr {
+			db.notifyKeyspaceEvent(notifyZset, "zincr", key)
+		} else {
+			db.notifyKeyspaceEvent(notifyZset, "zadd", key)
+		}
+	}
+	if added > 0 {
+		db.signalKeyAsReady(key)
+	}
+	return added, updated, score, ok, nil
+}
+
+var ErrScoreNaN = errors.New("ERR resulting score is not a number (NaN)")
+
+// ds_zrem removes the members from the sorted set, the key is deleted with its last member
+func ds_zrem(db *Keyspace, key string, members []string) (int64, error) {
+	db.lock()
+	defer db.unlock()
+	obj, err := db.lookupType(key, ZSetType)
+	if err != nil || obj == nil {
+		return 0, err
+	}
+	var removed int64 = 0
+	for _, member := range members {
+		if obj.zset.remove(member) {
+			removed++
+		}
+	}
+	if removed > 0 {
+		db.signalModifiedKey(key)
+		db.notifyKeyspaceEvent(notifyZset, "zrem", key)
+	}
+	if obj.zset.length() == 0 {
+		db.delete(key)
+		db.notifyKeyspaceEvent(notifyGeneric, "del", key)
+	}
+	return removed, nil
+}
+
+func ds_zscore(db *Keyspace, key string, member string) (float64, bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	obj, err := db.lookupType(key, ZSetType)
+	if err != nil || obj == nil {
+		return 0, false, err
+	}
+	score, ok := obj.zset.dict.get(member)
+	return score, ok, nil
+}
+
+// ds_zmscore returns the scores of the members, found tells which of them exist
+func ds_zmscore(db *Keyspace, key string, members []string) (scores []float64, found []bool, err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	scores = make([]float64, len(members))
+	found = make([]bool, len(members))
+	obj, err := db.lookupType(key, ZSetType)
+	if err != nil || obj == nil {
+		return scores, found, err
+	}
+	for i, member := range members {
+		scores[i], found[i] = obj.zset.dict.get(member)
+	}
+	return scores, found, nil
+}
+
+func ds_zcard(db *Keyspace, key string) (int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	obj, err := db.lookupType(key, ZSetType)
+	if err != nil || obj == nil {
+		return 0, err
+	}
+	return int64(obj.zset.length()), nil
+}
+
+// ds_zcount returns the number of members with a score in the range
+// the ranks of the first and last members in the range give the count
+func ds_zcount(db *Keyspace, key string, r zrangespec) (int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	obj, err := db.lookupType(key, ZSetType)
+	if err != nil || obj == nil {
+		return 0, err
+	}
+	zsl := obj.zset.zsl
+	first := zsl.firstInRange(&r)
+	if first == nil {
+		return 0, nil
+	}
+	last := zsl.lastInRange(&r)
+	return int64(zsl.getRank(last.score, last.member) - zsl.getRank(first.score, first.member) + 1), nil
+}
+
+// ds_zrank returns the rank of the member together with its score,
+// ranks are counted from the highest score when reverse is set
+func ds_zrank(db *Keyspace, key string, member string, reverse bool) (int64, float64, bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	obj, err := db.lookupType(key, ZSetType)
+	if err != nil || obj == nil {
+		return 0, 0, false, err
+	}
+	rank, ok := obj.zset.rank(member, reverse)
+	if !ok {
+		return 0, 0, false, nil
+	}
+	score, _ := obj.zset.dict.get(member)
+	return int64(rank), score, true, nil
+}
+
+// How the start and stop arguments of ZRANGE are interpreted
+type ZRangeType int
+
+const (
+	ZRangeRank ZRangeType = iota
+	ZRangeScore
+	ZRangeLex
+)
+
+// Range of a sorted set as given to ZRANGE
+type zrangeSpec struct {
+	by          ZRangeType
+	rev         bool
+	start, stop int64 // used when ranging by rank
+	score       zrangespec
+	lex         zlexrangespec
+	offset      int64 // number of elements to skip, LIMIT is only used by score and lex
+	limit       int64 // maximum number of elements, negative for no limit
+}
+
+// ds_zrange returns the elements of the sorted set in the range
+func ds_zrange(db *Keyspace, key string, spec zrangeSpec) ([]ZSetElement, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	obj, err := db.lookupType(key, ZSetType)
+	if err != nil || obj == nil {
+		return []ZSetElement{}, err
+	}
+	return zsetRange(obj.zset, &spec), nil
+}
+
+// zsetRange returns the elements of the sorted set in the range
+func zsetRange(zs *ZSet, spec *zrangeSpec) []ZSetElement {
+	elements := []ZSetElement{}
+	zsl := zs.zsl
+	next := func(x *zskiplistNode) *zskiplistNode {
+		if spec.rev {
+			return x.backward
+		}
+		return x.level[0].forward
+	}
+
+	if spec.by == ZRangeRank {
+		start, stop, ok := normalizeRange(spec.start, spec.stop, int64(zsl.length))
+		if !ok {
+			return elements
+		}
+		var x *zskiplistNode
+		if spec.rev {
+			x = zsl.getElementByRank(zsl.length - int(start))
+		} else {
+			x = zsl.getElementByRank(int(start) + 1)
+		}
+		for i := start; i <= stop; i++ {
+			elements = append(elements, ZSetElement{member: x.member, score: x.score})
+			x = next(x)
+		}
+		return elements
+	}
+
+	if spec.offset < 0 {
+		return elements
+	}
+	// start from the first element in the range in the direction of the
+	// iteration, then stop at the first one past the other end
+	var x *zskiplistNode
+	var inRange func(x *zskiplistNode) bool
+	switch {
+	case spec.by == ZRangeScore && spec.rev:
+		x = zsl.lastInRange(&spec.score)
+		inRange = func(x *zskiplistNode) bool { return spec.score.gteMin(x.score) }
+	case spec.by == ZRangeScore:
+		x = zsl.firstInRange(&spec.score)
+		inRange = func(x *zskiplistNode) bool { return spec.score.lteMax(x.score) }
+	case spec.rev:
+		x = zsl.lastInLexRange(&spec.lex)
+		inRange = func(x *zskiplistNode) bool { return spec.lex.gteMin(x.member) }
+	default:
+		x = zsl.firstInLexRange(&spec.lex)
+		inRange = func(x *zskiplistNode) bool { return spec.lex.lteMax(x.member) }
+	}
+	for offset := spec.offset; x != nil && offset > 0; offset-- {
+		x = next(x)
+	}
+	for limit := spec.limit; x != nil && limit != 0 && inRange(x); limit-- {
+		elements = append(elements, ZSetElement{member: x.member, score: x.score})
+		x = next(x)
+	}
+	return elements
+}
+
+// ds_zrangestore stores the elements of source in the range at destination
+// overwriting it, an empty range deletes destination. It returns the number of elements stored
+func ds_zrangestore(db *Keyspace, destination string, source string, spec zrangeSpec) (int64, error) {
+	db.lock()
+	defer db.unlock()
+	obj, err := db.lookupType(source, ZSetType)
+	if err != nil {
+		return 0, err
+	}
+	elements := []ZSetElement{}
+	if obj != nil {
+		elements = zsetRange(obj.zset, &spec)
+	}
+	if len(elements) == 0 {
+		if db.delete(destination) {
+			db.notifyKeyspaceEvent(notifyGeneric, "del", destination)
+		}
+		return 0, nil
+	}
+	dst := newZSetObject()
+	for _, element := range elements {
+		dst.zset.add(element.score, element.member, zaddFlags{})
+	}
+	db.set(destination, dst)
+	db.notifyKeyspaceEvent(notifyZset, "zrangestore", destination)
+	return int64(len(elements)), nil
+}
+
+// ds_zremrange removes the elements in the range, offset and limit are not used
+// the key is deleted with its last member. It returns the number of elements removed
+func ds_zremrange(db *Keyspace, key string, spec zrangeSpec) (int64, error) {
+	db.lock()
+	defer db.unlock()
+	obj, err := db.lookupType(key, ZSetType)
+	if err != nil || obj == nil {
+		return 0, err
+	}
+	zs := obj.zset
+	removed := 0
+	event := ""
+	switch spec.by {
+	case ZRangeRank:
+		start, stop, ok := normalizeRange(spec.start, spec.stop, int64(zs.length()))
+		if !ok {
+			return 0, nil
+		}
+		removed = zs.zsl.deleteRangeByRank(int(start)+1, int(stop)+1, zs.dict)
+		event = "zremrangebyrank"
+	case ZRangeScore:
+		removed = zs.zsl.deleteRangeByScore(&spec.score, zs.dict)
+		event = "zremrangebyscore"
+	case ZRangeLex:
+		removed = zs.zsl.deleteRangeByLex(&spec.lex, zs.dict)
+		event = "zremrangebylex"
+	}
+	if removed > 0 {
+		db.signalModifiedKey(key)
+		db.notifyKeyspaceEvent(notifyZset, event, key)
+	}
+	if zs.length() == 0 {
+		db.delete(key)
+		db.notifyKeyspaceEvent(notifyGeneric, "del", key)
+	}
+	return int64(removed), nil
+}
+
+// zsetPop removes up to count elements with the lowest scores, or the highest ones
+// when max is set, the key is deleted with its last member
+// the caller must hold the keyspace lock
+func zsetPop(db *Keyspace, key string, zs *ZSet, count int, max bool) []ZSetElement {
+	elements := []ZSetElement{}
+	for ; count > 0 && zs.length() > 0; count-- {
+		x := zs.zsl.header.level[0].forward
+		if max {
+			x = zs.zsl.tail
+		}
+		elements = append(elements, ZSetElement{member: x.member, score: x.score})
+		zs.remove(x.member)
+	}
+	if len(elements) > 0 {
+		db.signalModifiedKey(key)
+		if max {
+			db.notifyKeyspaceEvent(notifyZset, "zpopmax", key)
+		} else {
+			db.notifyKeyspaceEvent(notifyZset, "zpopmin", key)
+		}
+	}
+	if zs.length() == 0 {
+		db.delete(key)
+		db.notifyKeyspaceEvent(notifyGeneric, "del", key)
+	}
+	return elements
+}
+
+// ds_zpop removes and returns up to count elements with the lowest scores,
+// or the highest ones when max is set
+func ds_zpop(db *Keyspace, key string, count int, max bool) ([]ZSetElement, error) {
+	db.lock()
+	defer db.unlock()
+	obj, err := db.lookupType(key, ZSetType)
+	if err != nil || obj == nil {
+		return []ZSetElement{}, err
+	}
+	return zsetPop(db, key, obj.zset, count, max), nil
+}
+
+// ds_zmpop pops from the first non empty sorted set among keys
+// It returns the key which was popped, false if all of them are empty
+func ds_zmpop(db *Keyspace, keys []string, count int, max bool) (string, []ZSetElement, bool, error) {
+	db.lock()
+	defer db.unlock()
+	for _, key := range keys {
+		obj, err := db.lookupType(key, ZSetType)
+		if err != nil {
+			return "", nil, false, err
+		}
+		if obj == nil {
+			continue
+		}
+		return key, zsetPop(db, key, obj.zset, count, max), true, nil
+	}
+	return "", nil, false, nil
+}
+
+// zpopCommandName returns the command logged in the aof for a pop from a sorted set
+func zpopCommandName(max bool) string {
+	if max {
+		return "ZPOPMAX"
+	}
+	return "ZPOPMIN"
+}
+
+// serveZSetPop returns the serveFunc of BZPOPMIN and BZPOPMAX, or of BZMPOP when count is positive
+func serveZSetPop(db *Keyspace, max bool, count int) serveFunc {
+	return func(key string) (Value, []string, bool, error) {
+		obj, err := db.lookupType(key, ZSetType)
+		if err != nil || obj == nil {
+			return Value{}, nil, false, err
+		}
+		if count == 0 {
+			element := zsetPop(db, key, obj.zset, 1, max)[0]
+			reply := Value{typ: "array", array: []Value{
+				{typ: "bulk", bulk: key},
+				{typ: "bulk", bulk: element.member},
+				{typ: "double", dbl: element.score},
+			}}
+			return reply, []string{zpopCommandName(max), key}, true, nil
+		}
+		elements := zsetPop(db, key, obj.zset, count, max)
+		reply := Value{typ: "array", array: []Value{{typ: "bulk", bulk: key}, zsetPairs(elements)}}
+		return reply, []string{zpopCommandName(max), key, strconv.Itoa(len(elements))}, true, nil
+	}
+}
+
+// How ZUNION and ZINTER combine the scores of a member found in several sets
+type ZAggregate int
+
+const (
+	ZAggregateSum ZAggregate = iota
+	ZAggregateMin
+	ZAggregateMax
+)
+
+// aggregate combines the score a member already has in the result with a new one
+func (aggregate ZAggregate) aggregate(target float64, score float64) float64 {
+	switch aggregate {
+	case ZAggregateMin:
+		return math.Min(target, score)
+	case ZAggregateMax:
+		return math.Max(target, score)
+	}
+	target += score
+	// inf + -inf, redis uses 0 in place of NaN
+	if math.IsNaN(target) {
+		return 0
+	}
+	return target
+}
+
+// An input of the sorted set operations, plain sets are accepted
+// and their members all have a score of 1
+type zsetOpInput struct {
+	dict   *Dict[float64]
+	set    *Dict[struct{}]
+	weight float64
+}
+
+func (in *zsetOpInput) length() int {
+	if in.set != nil {
+		return in.set.len()
+	}
+	return in.dict.len()
+}
+
+// score returns the weighted score of the member
+func (in *zsetOpInput) score(member string) (float64, bool) {
+	var score float64 = 1
+	if in.set != nil {
+		if !in.set.has(member) {
+			return 0, false
+		}
+	} else {
+		var ok bool
+		if score, ok = in.dict.get(member); !ok {
+			return 0, false
+		}
+	}
+	score *= in.weight
+	if math.IsNaN(score) {
+		return 0, true
+	}
+	return score, true
+}
+
+// each calls fn with every member of the input and its weighted score
+func (in *zsetOpInput) each(fn func(member string, score float64)) {
+	if in.set != nil {
+		for member := range in.set.keys() {
+			score, _ := in.score(member)
+			fn(member, score)
+		}
+		return
+	}
+	for member := range in.dict.keys() {
+		score, _ := in.score(member)
+		fn(member, score)
+	}
+}
+
+// zsetOperation computes the union, intersection or difference of the sorted sets,
+// weights holds the weight of every key, missing keys are treated as empty sets
+// The result is in a new sorted set, the caller must hold the keyspace lock
+func zsetOperation(db *Keyspace, keys []string, weights []float64, aggregate ZAggregate, op SetOperation) (*ZSet, error) {
+	inputs := make([]*zsetOpInput, 0, len(keys))
+	for i, key := range keys {
+		in := &zsetOpInput{weight: 1}
+		if weights != nil {
+			in.weight = weights[i]
+		}
+		obj, exists := db.lookup(key)
+		switch {
+		case !exists:
+			in.set = newDict[struct{}]()
+		case obj.typ == ZSetType:
+			in.dict = obj.zset.dict
+		case obj.typ == SetType:
+			in.set = obj.set
+		default:
+			return nil, ErrWrongType
+		}
+		inputs = append(inputs, in)
+	}
+
+	result := map[string]float64{}
+	switch op {
+	case SetUnion:
+		for _, in := range inputs {
+			in.each(func(member string, score float64) {
+				if current, ok := result[member]; ok {
+					score = aggregate.aggregate(current, score)
+				}
+				result[member] = score
+			})
+		}
+	case SetInter:
+		// iterate the smallest input, the weights follow their input
+		sort.SliceStable(inputs, func(i, j int) bool { return inputs[i].length() < inputs[j].length() })
+		inputs[0].each(func(member string, score float64) {
+			for _, other := range inputs[1:] {
+				otherScore, ok := other.score(member)
+				if !ok {
+					return
+				}
+				score = aggregate.aggregate(score, otherScore)
+			}
+			result[member] = score
+		})
+	case SetDiff:
+		inputs[0].each(func(member string, score float64) {
+			for _, other := range inputs[1:] {
+				if _, ok := other.score(member); ok {
+					return
+				}
+			}
+			result[member] = score
+		})
+	}
+
+	zs := newZSet()
+	for member, score := range result {
+		zs.add(score, member, zaddFlags{})
+	}
+	return zs, nil
+}
+
+// ds_zsetop returns the result of the operation ordered by score
+func ds_zsetop(db *Keyspace, keys []string, weights []float64, aggregate ZAggregate, op SetOperation) ([]ZSetElement, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	zs, err := zsetOperation(db, keys, weights, aggregate, op)
+	if err != nil {
+		return nil, err
+	}
+	return zs.elements(), nil
+}
+
+// ds_zsetopstore stores the result of the operation at destination overwriting it,
+// an empty result deletes destination. It returns the size of the result
+func ds_zsetopstore(db *Keyspace, destination string, keys []string, weights []float64, aggregate ZAggregate, op SetOperation) (int64, error) {
+	db.lock()
+	defer db.unlock()
+	zs, err := zsetOperation(db, keys, weights, aggregate, op)
+	if err != nil {
+		return 0, err
+	}
+	if zs.length() == 0 {
+		if db.delete(destination) {
+			db.notifyKeyspaceEvent(notifyGeneric, "del", destination)
+		}
+		return 0, nil
+	}
+	obj := newZSetObject()
+	obj.zset = zs
+	db.set(destination, obj)
+	db.notifyKeyspaceEvent(notifyZset, "z"+op.name()+"store", destination)
+	return int64(zs.length()), nil
+}
+
+// ds_zscan returns the members found in the next buckets of the sorted set
+// from cursor on and the cursor to continue with
+func ds_zscan(db *Keyspace, key string, cursor uint64, opts scanOptions) (uint64, []ZSetElement, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	elements := make([]ZSetElement, 0)
+	obj, err := db.lookupType(key, ZSetType)
+	if err != nil || obj == nil {
+		return 0, elements, err
+	}
+	cursor = scanDict(obj.zset.dict, cursor, opts.count, func(member string, score float64) {
+		if opts.matches(member) {
+			elements = append(elements, ZSetElement{member: member, score: score})
+		}
+	})
+	return cursor, elements, nil
+}
+
+// Stream Commands
+
+var (
+	ErrStreamIDTooSmall = errors.New("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+	ErrStreamExhausted  = errors.New("ERR The stream has exhausted the last possible ID, unable to add more items")
+	ErrBusyGroup        = errors.New("BUSYGROUP Consumer Group name already exists")
+	ErrXGroupNoKey      = errors.New("ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+)
+
+// errNoGroup is returned when the consumer group of a command does not exist
+func errNoGroup(key string, group string) error {
+	return fmt.Errorf("NOGROUP No such consumer group '%s' for key name '%s'", group, key)
+}
+
+// errNoKeyOrGroup is returned by the commands which do not tell
+// if the key or the consumer group is missing
+func errNoKeyOrGroup(key string, group string) error {
+	return fmt.Errorf("NOGROUP No such key '%s' or consumer group '%s'", key, group)
+}
+
+// How XADD picks the ID of the new entry
+type xaddID struct {
+	id      StreamID
+	auto    bool // * generates the whole ID
+	autoSeq bool // <ms>-* only generates the sequence number
+}
+
+// ds_xadd appends an entry to the stream and trims it, the stream is
+// created unless noMkStream is set. It returns the ID of the new entry
+// and false if the stream did not exist and was not created
+func ds_xadd(db *Keyspace, key string, id xaddID, fields []string, trim streamTrimArgs, noMkStream bool) (StreamID, bool, error) {
+	db.lock()
+	defer db.unlock()
+	obj, err := db.lookupType(key, StreamType)
+	if err != nil {
+		return StreamID{}, false, err
+	}
+	created := false
+	if obj == nil {
+		if noMkStream {
+			return StreamID{}, false, nil
+		}
+		obj = newStreamObject()
+		created = true
+	}
+	s := obj.stream
+	if s.lastID == maxStreamID {
+		return StreamID{}, false, ErrStreamExhausted
+	}
+
+	newID := id.id
+	switch {
+	case id.auto:
+		newID = s.nextID(mstime())
+	case id.autoSeq && id.id.ms == s.lastID.ms:
+		var ok bool
+		if newID, ok = s.lastID.incr(); !ok || newID.ms != s.lastID.ms {
+			return StreamID{}, false, ErrStreamIDTooSmall
+		}
+	case id.autoSeq:
+		newID.seq = 0
+	}
+	if newID.compare(s.lastID) <= 0 {
+		return StreamID{}, false, ErrStreamIDTooSmall
+	}
+
+	if created {
+		db.set(key, obj)
+	}
+	s.add(newID, fields)
+	trimmed := s.trim(trim)
+	db.signalModifiedKey(key)
+	db.signalKeyAsReady(key)
+	db.notifyKeyspaceEvent(notifyStream, "xadd", key)
+	if trimmed > 0 {
+		db.notifyKeyspaceEvent(notifyStream, "xtrim", key)
+	}
+	return newID, true, nil
+}
+
+func ds_xlen(db *Keyspace, key string) (int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	obj, err := db.lookupType(key, StreamType)
+	if err != nil || obj == nil {
+		return 0, err
+	}
+	return int64(obj.stream.length()), nil
+}
+
+// ds_xrange returns the entries with an ID between start and end included,
+// from end to start when rev is set. count limits the number of entries unless it is 0
+func ds_xrange(db *Keyspace, key string, start StreamID, end StreamID, count int, rev bool) ([]StreamEntry, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	obj, err := db.lookupType(key, StreamType)
+	if err != nil || obj == nil {
+		return []StreamEntry{}, err
+	}
+	return obj.stream.rangeEntries(start, end, count, rev), nil
+}
+
+// ds_xdel deletes the entries from the stream, it returns the number of entries deleted
+// The stream is kept even when it ends up empty
+func ds_xdel(db *Keyspace, key string, ids []StreamID) (int64, error) {
+	db.lock()
+	defer db.unlock()
+	obj, err := db.lookupType(key, StreamType)
+	if err != nil || obj == nil {
+		return 0, err
+	}
+	var deleted int64 = 0
+	for _, id := range ids {
+		if obj.stream.delete(id) {
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		db.signalModifiedKey(key)
+		db.notifyKeyspaceEvent(notifyStream, "xdel", key)
+	}
+	return deleted, nil
+}
+
+// ds_xtrim trims the stream, it returns the number of entries removed
+func ds_xtrim(db *Keyspace, key string, trim streamTrimArgs) (int64, error) {
+	db.lock()
+	defer db.unlock()
+	obj, err := db.lookupType(key, StreamType)
+	if err != nil || obj == nil {
+		return 0, err
+	}
+	removed := obj.stream.trim(trim)
+	if removed > 0 {
+		db.signalModifiedKey(key)
+		db.notifyKeyspaceEvent(notifyStream, "xtrim", key)
+	}
+	return removed, nil
+}
+
+// The ID given to XREAD and XREADGROUP for every stream
+type streamReadID struct {
+	id          StreamID
+	last        bool // $ reads the entries added after the command was called
+	undelivered bool // > reads the entries never delivered to the consumer group
+}
+
+// ds_xread returns the entries following ids[i] in the stream at keys[i],
+// at most count of them unless count is 0
+// The $ IDs are replaced by the last ID of their stream so that
+// a blocked client then waits for the entries following it
+func ds_xread(db *Keyspace, keys []string, ids []streamReadID, count int) ([][]StreamEntry, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	results := make([][]StreamEntry, len(keys))
+	for i, key := range keys {
+		obj, err := db.lookupType(key, StreamType)
+		if err != nil {
+			return nil, err
+		}
+		if ids[i].last {
+			ids[i] = streamReadID{}
+			if obj != nil {
+				ids[i].id = obj.stream.lastID
+			}
+		}
+		results[i] = streamRead(obj, ids[i].id, count)
+	}
+	return results, nil
+}
+
+// streamRead returns the entries with an ID greater than id
+// the caller must hold the keyspace lock
+func streamRead(obj *Object, id StreamID, count int) []StreamEntry {
+	start, ok := id.incr()
+	if obj == nil || !ok {
+		return []StreamEntry{}
+	}
+	return obj.stream.rangeEntries(start, maxStreamID, count, false)
+}
+
+// serveStreamRead returns the serveFunc of XREAD
+func serveStreamRead(db *Keyspace, c *Client, keys []string, ids []streamReadID, count int) serveFunc {
+	return func(key string) (Value, []string, bool, error) {
+		obj, err := db.lookupType(key, StreamType)
+		if err != nil || obj == nil {
+			return Value{}, nil, false, err
+		}
+		var entries []StreamEntry
+		for i := range keys {
+			if keys[i] == key {
+				entries = streamRead(obj, ids[i].id, count)
+				break
+			}
+		}
+		if len(entries) == 0 {
+			return Value{}, nil, false, errNotServed
+		}
+		// XREAD does not write anything so there is nothing to log
+		return streamReadReply(c, []string{key}, [][]StreamEntry{entries}), nil, true, nil
+	}
+}
+
+// ds_xreadgroup reads the streams as the consumer of the group, the consumer is
+// created if it does not exist. The > ID delivers the entries never delivered to
+// the group, other IDs return the entries pending for the consumer which follow them
+func ds_xreadgroup(db *Keyspace, group string, consumer string, keys []string, ids []streamReadID, count int, noAck bool) ([][]StreamEntry, error) {
+	db.lock()
+	defer db.unlock()
+	// all the consumer groups must exist before anything is read
+	streams := make([]*Stream, len(keys))
+	for i, key := range keys {
+		obj, err := db.lookupType(key, StreamType)
+		if err != nil {
+			return nil, err
+		}
+		if obj == nil || obj.stream.groups[group] == nil {
+			return nil, fmt.Errorf("NOGROUP No such key '%s' or consumer group '%s' in XREADGROUP with GROUP option", key, group)
+		}
+		streams[i] = obj.stream
+	}
+	results := make([][]StreamEntry, len(keys))
+	for i := range keys {
+		results[i] = streamReadGroup(streams[i], group, consumer, ids[i], count, noAck)
+	}
+	return results, nil
+}
+
+// streamReadGroup does the work of ds_xreadgroup for a single stream, history
+// entries which were deleted from the stream are returned without fields
+// the caller must hold the keyspace lock
+func streamReadGroup(s *Stream, group string, consumerName string, id streamReadID, count int, noAck bool) []StreamEntry {
+	g := s.groups[group]
+	now := mstime()
+	consumer := g.consumer(consumerName, true, now)
+	consumer.seenTime = now
+
+	entries := []StreamEntry{}
+	if id.undelivered {
+		start, ok := g.lastID.incr()
+		if !ok {
+			return entries
+		}
+		entries = s.rangeEntries(start, maxStreamID, count, false)
+		for _, entry := range entries {
+			s.delivered(g, entry.id)
+			if !noAck {
+				g.deliver(entry.id, consumer, now)
+			}
+		}
+		if len(entries) > 0 {
+			consumer.activeTime = now
+		}
+		return entries
+	}
+
+	for _, pending := range sortedIDs(consumer.pel) {
+		if pending.compare(id.id) <= 0 {
+			continue
+		}
+		if count != 0 && len(entries) == count {
+			break
+		}
+		entry := s.lookup(pending)
+		if entry == nil {
+			entries = append(entries, StreamEntry{id: pending})
+			continue
+		}
+		nack := consumer.pel[pending]
+		nack.deliveryTime = now
+		nack.deliveryCount++
+		entries = append(entries, *entry)
+	}
+	return entries
+}
+
+// serveStreamReadGroup returns the serveFunc of XREADGROUP, clients only
+// block when reading entries never delivered to the group
+func serveStreamReadGroup(db *Keyspace, c *Client, group string, consumer string, count int, noAck bool) serveFunc {
+	return func(key string) (Value, []string, bool, error) {
+		obj, err := db.lookupType(key, StreamType)
+		if err != nil || obj == nil {
+			return Value{}, nil, false, err
+		}
+		if obj.stream.groups[group] == nil {
+			// the group was destroyed while the client was waiting for it
+			return Value{typ: "error", str: errNoKeyOrGroup(key, group).Error()}, nil, true, nil
+		}
+		entries := streamReadGroup(obj.stream, group, consumer, streamReadID{undelivered: true}, count, noAck)
+		if len(entries) == 0 {
+			// clients of other groups may still have entries to read
+			return Value{}, nil, false, errNotServed
+		}
+		aofArgs := []string{"XREADGROUP", "GROUP", group, consumer}
+		if count != 0 {
+			aofArgs = append(aofArgs, "COUNT", strconv.Itoa(count))
+		}
+		if noAck {
+			aofArgs = append(aofArgs, "NOACK")
+		}
+		aofArgs = append(aofArgs, "STREAMS", key, ">")
+		return streamReadReply(c, []string{key}, [][]StreamEntry{entries}), aofArgs, true, nil
+	}
+}
+
+// lookupStreamGroup returns the stream and the consumer group,
+// the group is nil if the key or the group does not exist
+// the caller must hold the keyspace lock
+func lookupStreamGroup(db *Keyspace, key string, group string) (*Stream, *StreamGroup, error) {
+	obj, err := db.lookupType(key, StreamType)
+	if err != nil || obj == nil {
+		return nil, nil, err
+	}
+	return obj.stream, obj.stream.groups[group], nil
+}
+
+// ds_xack acknowledges the entries, removing them from the PEL of the group
+// It returns the number of entries which were pending
+func ds_xack(db *Keyspace, key string, group string, ids []StreamID) (int64, error) {
+	db.lock()
+	defer db.unlock()
+	_, g, err := lookupStreamGroup(db, key, group)
+	if err != nil || g == nil {
+		return 0, err
+	}
+	var acked int64 = 0
+	for _, id := range ids {
+		if g.ack(id) {
+			acked++
+		}
+	}
+	return acked, nil
+}
+
+// ds_xgroupCreate creates a consumer group which delivers the entries following id,
+// or the entries added from now on when last is set
+// The stream is created when mkStream is set and it does not exist
+func ds_xgroupCreate(db *Keyspace, key string, group string, id StreamID, last bool, mkStream bool, entriesRead int64) error {
+	db.lock()
+	defer db.unlock()
+	obj, err := db.lookupType(key, StreamType)
+	if err != nil {
+		return err
+	}
+	if obj == nil {
+		if !mkStream {
+			return ErrXGroupNoKey
+		}
+		obj = newStreamObject()
+		db.set(key, obj)
+	}
+	if last {
+		id = obj.stream.lastID
+	}
+	if !obj.stream.createGroup(group, id, entriesRead) {
+		return ErrBusyGroup
+	}
+	db.signalModifiedKey(key)
+	db.notifyKeyspaceEvent(notifyStream, "xgroup-create", key)
+	return nil
+}
+
+// ds_xgroupSetID sets the last ID delivered to the consumer group
+func ds_xgroupSetID(db *Keyspace, key string, group string, id StreamID, last bool, entriesRead int64) error {
+	db.lock()
+	defer db.unlock()
+	s, g, err := lookupStreamGroup(db, key, group)
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return ErrXGroupNoKey
+	}
+	if g == nil {
+		return errNoGroup(key, group)
+	}
+	if last {
+		id = s.lastID
+	}
+	g.lastID = id
+	g.entriesRead = entriesRead
+	db.signalModifiedKey(key)
+	db.notifyKeyspaceEvent(notifyStream, "xgroup-setid", key)
+	return nil
+}
+
+// ds_xgroupDestroy deletes the consumer group, it returns false if it did not exist
+func ds_xgroupDestroy(db *Keyspace, key string, group string) (bool, error) {
+	db.lock()
+	defer db.unlock()
+	s, g, err := lookupStreamGroup(db, key, group)
+	if err != nil {
+		return false, err
+	}
+	if s == nil {
+		return false, ErrXGroupNoKey
+	}
+	if g == nil {
+		return false, nil
+	}
+	delete(s.groups, group)
+	db.signalModifiedKey(key)
+	db.notifyKeyspaceEvent(notifyStream, "xgroup-destroy", key)
+	// the clients blocked reading as the group get an error
+	db.signalKeyAsReady(key)
+	return true, nil
+}
+
+// ds_xgroupCreateConsumer adds a consumer to the group, it returns false if it already existed
+func ds_xgroupCreateConsumer(db *Keyspace, key string, group string, consumer string) (bool, error) {
+	db.lock()
+	defer db.unlock()
+	s, g, err := lookupStreamGroup(db, key, group)
+	if err != nil {
+		return false, err
+	}
+	if s == nil {
+		return false, ErrXGroupNoKey
+	}
+	if g == nil {
+		return false, errNoGroup(key, group)
+	}
+	if g.consumer(consumer, false, 0) != nil {
+		return false, nil
+	}
+	g.consumer(consumer, true, mstime())
+	db.signalModifiedKey(key)
+	db.notifyKeyspaceEvent(notifyStream, "xgroup-createconsumer", key)
+	return true, nil
+}
+
+// ds_xgroupDelConsumer deletes a consumer from the group,
+// it returns the number of entries it had pending
+func ds_xgroupDelConsumer(db *Keyspace, key string, group string, consumer string) (int64, error) {
+	db.lock()
+	defer db.unlock()
+	s, g, err := lookupStreamGroup(db, key, group)
+	if err != nil {
+		return 0, err
+	}
+	if s == nil {
+		return 0, ErrXGroupNoKey
+	}
+	if g == nil {
+		return 0, errNoGroup(key, group)
+	}
+	if g.consumer(consumer, false, 0) == nil {
+		return 0, nil
+	}
+	pending := g.deleteConsumer(consumer)
+	db.signalModifiedKey(key)
+	db.notifyKeyspaceEvent(notifyStream, "xgroup-delconsumer", key)
+	return pending, nil
+}
+
+// A pending entry as replied by XPENDING, XCLAIM and XINFO
+type streamPendingEntry struct {
+	id            StreamID
+	consumer      string
+	deliveryTime  int64
+	deliveryCount int64
+	entry         *StreamEntry // only set by XCLAIM and XAUTOCLAIM
+}
+
+// A consumer as replied by XPENDING and XINFO
+type streamConsumerInfo struct {
+	name       string
+	seenTime   int64
+	activeTime int64
+	pending    []streamPendingEntry
+}
+
+// ds_xpendingSummary returns the pending entries of the consumer group
+// grouped by consumer, in order of ID and of consumer name
+func ds_xpendingSummary(db *Keyspace, key string, group string) ([]streamConsumerInfo, []StreamID, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	_, g, err := lookupStreamGroup(db, key, group)
+	if err != nil {
+		return nil, nil, err
+	}
+	if g == nil {
+		return nil, nil, errNoKeyOrGroup(key, group)
+	}
+	consumers := []streamConsumerInfo{}
+	for _, consumer := range sortedConsumers(g) {
+		if len(consumer.pel) > 0 {
+			consumers = append(consumers, streamConsumerInfo{name: consumer.name, pending: consumerPending(consumer)})
+		}
+	}
+	return consumers, sortedIDs(g.pel), nil
+}
+
+// ds_xpending returns the pending entries of the consumer group with an ID between
+// start and end and idle for at least minIdle milliseconds, only the entries of
+// consumer are returned unless it is empty
+func ds_xpending(db *Keyspace, key string, group string, start StreamID, end StreamID, count int, consumer string, minIdle int64) ([]streamPendingEntry, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	_, g, err := lookupStreamGroup(db, key, group)
+	if err != nil {
+		return nil, err
+	}
+	if g == nil {
+		return nil, errNoKeyOrGroup(key, group)
+	}
+	pel := g.pel
+	if consumer != "" {
+		c := g.consumer(consumer, false, 0)
+		if c == nil {
+			return []streamPendingEntry{}, nil
+		}
+		pel = c.pel
+	}
+	now := mstime()
+	pending := []streamPendingEntry{}
+	for _, id := range sortedIDs(pel) {
+		if len(pending) == count {
+			break
+		}
+		if id.compare(start) < 0 || id.compare(end) > 0 {
+			continue
+		}
+		nack := pel[id]
+		if now-nack.deliveryTime < minIdle {
+			continue
+		}
+		pending = append(pending, streamPendingEntry{id: id, consumer: nack.consumer.name, deliveryTime: nack.deliveryTime, deliveryCount: nack.deliveryCount})
+	}
+	return pending, nil
+}
+
+// sortedConsumers returns the consumers of the group in order of name
+func sortedConsumers(g *StreamGroup) []*StreamConsumer {
+	consumers := make([]*StreamConsumer, 0, len(g.consumers))
+	for _, consumer := range g.consumers {
+		consumers = append(consumers, consumer)
+	}
+	sort.Slice(consumers, func(i, j int) bool { return consumers[i].name < consumers[j].name })
+	return consumers
+}
+
+// consumerPending returns the entries pending for the consumer in order of ID
+func consumerPending(consumer *StreamConsumer) []streamPendingEntry {
+	pending := make([]streamPendingEntry, 0, len(consumer.pel))
+	for _, id := range sortedIDs(consumer.pel) {
+		nack := consumer.pel[id]
+		pending = append(pending, streamPendingEntry{id: id, consumer: consumer.name, deliveryTime: nack.deliveryTime, deliveryCount: nack.deliveryCount})
+	}
+	return pending
+}
+
+// Options of XCLAIM
+type xclaimOptions struct {
+	deliveryTime int64 // unix time in milliseconds set as the delivery time
+	retryCount   int64 // delivery count set on the entries, -1 to increment it
+	force        bool  // add the entries to the PEL if they are not pending
+	justID       bool  // do not increment the delivery count
+	lastID       *StreamID
+}
+
+// ds_xclaim transfers the entries idle for at least minIdle milliseconds to the
+// consumer. Pending entries which were deleted from the stream are removed from
+// the PEL, the claimed entries are returned followed by the deleted ones
+func ds_xclaim(db *Keyspace, key string, group string, consumer string, minIdle int64, ids []StreamID, opts xclaimOptions) ([]streamPendingEntry, []StreamID, error) {
+	db.lock()
+	defer db.unlock()
+	s, g, err := lookupStreamGroup(db, key, group)
+	if err != nil {
+		return nil, nil, err
+	}
+	if g == nil {
+		return nil, nil, errNoKeyOrGroup(key, group)
+	}
+	if opts.lastID != nil && opts.lastID.compare(g.lastID) > 0 {
+		g.lastID = *opts.lastID
+	}
+	now := mstime()
+	c := g.consumer(consumer, true, now)
+	c.seenTime = now
+
+	claimed, deleted := []streamPendingEntry{}, []StreamID{}
+	for _, id := range ids {
+		nack, ok := g.pel[id]
+		entry := s.lookup(id)
+		if !ok && opts.force && entry != nil {
+			nack = &StreamNACK{}
+			g.pel[id] = nack
+			ok = true
+		}
+		if !ok {
+			continue
+		}
+		if entry == nil {
+			g.ack(id)
+			deleted = append(deleted, id)
+			continue
+		}
+		if nack.consumer != nil && now-nack.deliveryTime < minIdle {
+			continue
+		}
+		claimed = append(claimed, streamClaim(g, id, entry, nack, c, opts))
+	}
+	if len(claimed) > 0 {
+		c.activeTime = now
+	}
+	return claimed, deleted, nil
+}
+
+// streamClaim transfers the pending entry to the consumer
+// the caller must hold the keyspace lock
+func streamClaim(g *StreamGroup, id StreamID, entry *StreamEntry, nack *StreamNACK, consumer *StreamConsumer, opts xclaimOptions) streamPendingEntry {
+	g.claim(id, nack, consumer)
+	nack.deliveryTime = opts.deliveryTime
+	if opts.retryCount >= 0 {
+		nack.deliveryCount = opts.retryCount
+	} else if !opts.justID {
+		nack.deliveryCount++
+	}
+	// the entry is copied as the stream may change once the lock is released
+	copied := *entry
+	return streamPendingEntry{id: id, consumer: consumer.name, deliveryTime: nack.deliveryTime, deliveryCount: nack.deliveryCount, entry: &copied}
+}
+
+// ds_xautoclaim claims up to count entries idle for at least minIdle milliseconds,
+// scanning the PEL from start. It returns the ID from which the scan can continue,
+// 0-0 when the whole PEL was scanned, the claimed entries and the deleted ones
+func ds_xautoclaim(db *Keyspace, key string, group string, consumer string, minIdle int64, start StreamID, count int, justID bool) (StreamID, []streamPendingEntry, []StreamID, error) {
+	db.lock()
+	defer db.unlock()
+	s, g, err := lookupStreamGroup(db, key, group)
+	if err != nil {
+		return StreamID{}, nil, nil, err
+	}
+	if g == nil {
+		return StreamID{}, nil, nil, errNoKeyOrGroup(key, group)
+	}
+	now := mstime()
+	c := g.consumer(consumer, true, now)
+	c.seenTime = now
+	opts := xclaimOptions{deliveryTime: now, retryCount: -1, justID: justID}
+
+	claimed, deleted := []streamPendingEntry{}, []StreamID{}
+	// like redis the number of entries looked at is bounded too
+	attempts := count * 10
+	ids := sortedIDs(g.pel)
+	i := sort.Search(len(ids), func(i int) bool { return ids[i].compare(start) >= 0 })
+	for ; i < len(ids) && attempts > 0 && len(claimed) < count; i++ {
+		attempts--
+		id := ids[i]
+		entry := s.lookup(id)
+		if entry == nil {
+			g.ack(id)
+			deleted = append(deleted, id)
+			continue
+		}
+		nack := g.pel[id]
+		if now-nack.deliveryTime < minIdle {
+			continue
+		}
+		claimed = append(claimed, streamClaim(g, id, entry, nack, c, opts))
+	}
+	if len(claimed) > 0 {
+		c.activeTime = now
+	}
+	next := StreamID{}
+	if i < len(ids) {
+		next = ids[i]
+	}
+	return next, claimed, deleted, nil
+}
+
+// A consumer group as replied by XINFO, the pending entries
+// and the consumers are only listed by XINFO STREAM FULL
+type streamGroupInfo struct {
+	name          string
+	lastID        StreamID
+	entriesRead   int64
+	lag           int64
+	lagKnown      bool
+	pendingCount  int
+	consumerCount int
+	pending       []streamPendingEntry
+	consumers     []streamConsumerInfo
+}
+
+// A stream as replied by XINFO STREAM
+type streamInfo struct {
+	length       int64
+	lastID       StreamID
+	maxDeletedID StreamID
+	entriesAdded int64
+	firstID      StreamID
+	first, last  *StreamEntry
+	groupCount   int
+	entries      []StreamEntry // the first entries of the stream with FULL
+	groups       []streamGroupInfo
+}
+
+// ds_xinfoStream describes the stream, full also returns up to count
+// entries, all of them when count is 0, and the consumer groups in details
+func ds_xinfoStream(db *Keyspace, key string, full bool, count int) (streamInfo, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	obj, err := db.lookupType(key, StreamType)
+	if err != nil {
+		return streamInfo{}, err
+	}
+	if obj == nil {
+		return streamInfo{}, ErrNoSuchKey
+	}
+	s := obj.stream
+	info := streamInfo{
+		length:       int64(s.length()),
+		lastID:       s.lastID,
+		maxDeletedID: s.maxDeletedID,
+		entriesAdded: s.entriesAdded,
+		firstID:      s.firstID,
+		groupCount:   len(s.groups),
+	}
+	if !full {
+		if s.length() > 0 {
+			first, last := s.entries[0], s.entries[s.length()-1]
+			info.first, info.last = &first, &last
+		}
+		return info, nil
+	}
+	info.entries = s.rangeEntries(StreamID{}, maxStreamID, count, false)
+	for _, name := range s.groupNames() {
+		g := s.groups[name]
+		group := streamGroupDescription(s, g)
+		for _, id := range sortedIDs(g.pel) {
+			nack := g.pel[id]
+			group.pending = append(group.pending, streamPendingEntry{id: id, consumer: nack.consumer.name, deliveryTime: nack.deliveryTime, deliveryCount: nack.deliveryCount})
+		}
+		for _, consumer := range sortedConsumers(g) {
+			group.consumers = append(group.consumers, streamConsumerDescription(consumer))
+		}
+		info.groups = append(info.groups, group)
+	}
+	return info, nil
+}
+
+// ds_xinfoGroups describes the consumer groups of the stream
+func ds_xinfoGroups(db *Keyspace, key string) ([]streamGroupInfo, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	obj, err := db.lookupType(key, StreamType)
+	if err != nil {
+		return nil, err
+	}
+	if obj == nil {
+		return nil, ErrNoSuchKey
+	}
+	s := obj.stream
+	groups := []streamGroupInfo{}
+	for _, name := range s.groupNames() {
+		g := s.groups[name]
+		groups = append(groups, streamGroupDescription(s, g))
+	}
+	return groups, nil
+}
+
+// ds_xinfoConsumers describes the consumers of the group
+func ds_xinfoConsumers(db *Keyspace, key string, group string) ([]streamConsumerInfo, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	s, g, err := lookupStreamGroup(db, key, group)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, ErrNoSuchKey
+	}
+	if g == nil {
+		return nil, errNoGroup(key, group)
+	}
+	consumers := []streamConsumerInfo{}
+	for _, consumer := range sortedConsumers(g) {
+		consumers = append(consumers, streamConsumerDescription(consumer))
+	}
+	return consumers, nil
+}
+
+func streamGroupDescription(s *Stream, g *StreamGroup) streamGroupInfo {
+	lag, lagKnown := s.lag(g)
+	return streamGroupInfo{
+		name:          g.name,
+		lastID:        g.lastID,
+		entriesRead:   g.entriesRead,
+		lag:           lag,
+		lagKnown:      lagKnown,
+		pendingCount:  len(g.pel),
+		consumerCount: len(g.consumers),
+	}
+}
+
+func streamConsumerDescription(consumer *StreamConsumer) streamConsumerInfo {
+	return streamConsumerInfo{
+		name:       consumer.name,
+		seenTime:   consumer.seenTime,
+		activeTime: consumer.activeTime,
+		pending:    consumerPending(consumer),
+	}
+}
+
+// HyperLogLog Commands
+
+// lookupHLL returns the string stored at key if it holds a HyperLogLog,
+// nil if the key does not exist. the caller must hold the keyspace lock
+func lookupHLL(db *Keyspace, key string) (*Object, error) {
+	obj, err := db.lookupType(key, StringType)
+	if err != nil || obj == nil {
+		return nil, err
+	}
+	if !isHLL([]byte(obj.str)) {
+		return nil, ErrInvalidHLL
+	}
+	return obj, nil
+}
+
+// ds_pfadd adds the elements to the HyperLogLog at key creating it if needed,
+// it returns true if the HyperLogLog was created or one of its registers changed
+func ds_pfadd(db *Keyspace, key string, elements []string) (bool, error) {
+	db.lock()
+	defer db.unlock()
+	obj, err := lookupHLL(db, key)
+	if err != nil {
+		return false, err
+	}
+	updated := obj == nil
+	var hll []byte
+	if obj == nil {
+		hll = hllCreate()
+	} else {
+		hll = []byte(obj.str)
+	}
+	for _, element := range elements {
+		var changed bool
+		hll, changed, err = hllAdd(hll, element)
+		if err != nil {
+			return false, err
+		}
+		updated = updated || changed
+	}
+	if !updated {
+		return false, nil
+	}
+	hllInvalidateCache(hll)
+	// the value is changed in place to keep the time to live of the key
+	if obj == nil {
+		db.set(key, newStringObject(string(hll)))
+	} else {
+		obj.str = string(hll)
+		db.signalModifiedKey(key)
+	}
+	db.notifyKeyspaceEvent(notifyString, "pfadd", key)
+	return true, nil
+}
+
+// ds_pfcount estimates the cardinality of the union of the HyperLogLogs.
+// The cardinality of a single HyperLogLog is cached in its header, it
+// returns true if the cache was updated
+func ds_pfcount(db *Keyspace, keys []string) (int64, bool, error) {
+	if len(keys) == 1 {
+		db.lock()
+		defer db.unlock()
+		obj, err := lookupHLL(db, keys[0])
+		if err != nil || obj == nil {
+			return 0, false, err
+		}
+		hll := []byte(obj.str)
+		if card, ok := hllCachedCardinality(hll); ok {
+			return int64(card), false, nil
+		}
+		card, err := hllCount(hll)
+		if err != nil {
+			return 0, false, err
+		}
+		hllSetCachedCardinality(hll, card)
+		obj.str = string(hll)
+		db.signalModifiedKey(keys[0])
+		return int64(card), true, nil
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	registers := make([]uint8, hllRegisters)
+	for _, key := range keys {
+		obj, err := lookupHLL(db, key)
+		if err != nil {
+			return 0, false, err
+		}
+		if obj == nil {
+			continue
+		}
+		if err := hllMerge(registers, []byte(obj.str)); err != nil {
+			return 0, false, err
+		}
+	}
+	return int64(hllCountRegisters(registers)), false, nil
+}
+
+// ds_pfmerge stores at destination the union of the HyperLogLogs at sources and at
+// destination itself. The result is dense if one of the HyperLogLogs merged is
+func ds_pfmerge(db *Keyspace, destination string, sources []string) error {
+	db.lock()
+	defer db.unlock()
+	registers := make([]uint8, hllRegisters)
+	dense := false
+	for _, key := range append([]string{destination}, sources...) {
+		obj, err := lookupHLL(db, key)
+		if err != nil {
+			return err
+		}
+		if obj == nil {
+			continue
+		}
+		hll := []byte(obj.str)
+		if hll[4] == hllDense {
+			dense = true
+		}
+		if err := hllMerge(registers, hll); err != nil {
+			return err
+		}
+	}
+
+	obj, _ := lookupHLL(db, destination)
+	var hll []byte
+	if obj == nil {
+		hll = hllCreate()
+	} else {
+		hll = []byte(obj.str)
+	}
+	var err error
+	if dense {
+		if hll, err = hllSparseToDense(hll); err != nil {
+			return err
+		}
+	}
+	for index, count := range registers {
+		if count == 0 {
+			continue
+		}
+		if hll[4] == hllDense {
+			hllDenseSet(hll[hllHeaderSize:], index, count)
+		} else if hll, _, err = hllSparseSet(hll, index, count); err != nil {
+			return err
+		}
+	}
+	hllInvalidateCache(hll)
+	if obj == nil {
+		db.set(destination, newStringObject(string(hll)))
+	} else {
+		obj.str = string(hll)
+		db.signalModifiedKey(destination)
+	}
+	// like in redis the merge is reported as an add to destination
+	db.notifyKeyspaceEvent(notifyString, "pfadd", destination)
+	return nil
+}
+
+// Geo Commands
+
+var ErrGeoMember = errors.New("ERR could not decode requested zset member")
+
+// ds_geopos returns the longitude and latitude of the members, nil for the missing ones
+func ds_geopos(db *Keyspace, key string, members []string) ([]*[2]float64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	obj, err := db.lookupType(key, ZSetType)
+	if err != nil {
+		return nil, err
+	}
+	positions := make([]*[2]float64, len(members))
+	if obj == nil {
+		return positions, nil
+	}
+	for i, member := range members {
+		if score, ok := obj.zset.dict.get(member); ok {
+			xy := geoDecodeScore(score)
+			positions[i] = &xy
+		}
+	}
+	return positions, nil
+}
+
+// ds_geodist returns the distance in meters between the two members,
+// false if one of them does not exist
+func ds_geodist(db *Keyspace, key string, member1 string, member2 string) (float64, bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	obj, err := db.lookupType(key, ZSetType)
+	if err != nil || obj == nil {
+		return 0, false, err
+	}
+	score1, ok1 := obj.zset.dict.get(member1)
+	score2, ok2 := obj.zset.dict.get(member2)
+	if !ok1 || !ok2 {
+		return 0, false, nil
+	}
+	xy1, xy2 := geoDecodeScore(score1), geoDecodeScore(score2)
+	return geoDistance(xy1[0], xy1[1], xy2[0], xy2[1]), true, nil
+}
+
+// Options of GEOSEARCH and GEOSEARCHSTORE
+type geoSearchArgs struct {
+	fromMember string // the member at the center of the search, unless fromLonLat is set
+	fromLonLat bool   // the center is shape.xy
+	shape      geoShape
+	sort       int
+	count      int  // return at most count points, 0 for all of them
+	any        bool // return the first count points found instead of the nearest ones
+}
+
+// geoSearchZSet returns the points of the sorted set inside the searched shape
+// the caller must hold the keyspace lock
+func geoSearchZSet(zs *ZSet, args geoSearchArgs) ([]geoPoint, error) {
+	shape := args.shape
+	if !args.fromLonLat {
+		score, ok := zs.dict.get(args.fromMember)
+		if !ok {
+			return nil, ErrGeoMember
+		}
+		shape.xy = geoDecodeScore(score)
+	}
+	// the nearest points are returned when COUNT is given without ANY
+	order := args.sort
+	if args.count > 0 && order == geoSortNone && !args.any {
+		order = geoSortAsc
+	}
+	limit := 0
+	if args.any {
+		limit = args.count
+	}
+	points := geoSearch(zs, &shape, limit)
+	geoSortPoints(points, order)
+	if args.count > 0 && len(points) > args.count {
+		points = points[:args.count]
+	}
+	return points, nil
+}
+
+func ds_geosearch(db *Keyspace, key string, args geoSearchArgs) ([]geoPoint, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	obj, err := db.lookupType(key, ZSetType)
+	if err != nil || obj == nil {
+		return []geoPoint{}, err
+	}
+	return geoSearchZSet(obj.zset, args)
+}
+
+// ds_geosearchstore stores the points found in source at destination, scored by
+// their distance in the unit of the search when storeDist is set. An empty result
+// deletes destination. It returns the number of points stored
+func ds_geosearchstore(db *Keyspace, destination string, source string, args geoSearchArgs, storeDist bool) (int64, error) {
+	db.lock()
+	defer db.unlock()
+	obj, err := db.lookupType(source, ZSetType)
+	if err != nil {
+		return 0, err
+	}
+	points := []geoPoint{}
+	if obj != nil {
+		if points, err = geoSearchZSet(obj.zset, args); err != nil {
+			return 0, err
+		}
+	}
+	if len(points) == 0 {
+		if db.delete(destination) {
+			db.notifyKeyspaceEvent(notifyGeneric, "del", destination)
+		}
+		return 0, nil
+	}
+	dst := newZSetObject()
+	for _, point := range points {
+		score := point.score
+		if storeDist {
+			score = point.dist / args.shape.conversion
+		}
+		dst.zset.add(score, point.member, zaddFlags{})
+	}
+	db.set(destination, dst)
+	db.notifyKeyspaceEvent(notifyZset, "geosearchstore", destination)
+	return int64(len(points)), nil
+}
+
+// Bit Commands
+
+// ds_setbit sets or clears the bit at offset of the string stored at key,
+// the string is created or zero padded when needed. It returns the old bit
+func ds_setbit(db *Keyspace, key string, offset int64, on bool) (int, error) {
+	db.lock()
+	defer db.unlock()
+	obj, err := db.lookupType(key, StringType)
+	if err != nil {
+		return 0, err
+	}
+	var str []byte
+	if obj != nil {
+		str = []byte(obj.str)
+	}
+	str = growBits(str, offset)
+	old := getBit(str, offset)
+	setBit(str, offset, on)
+	// the value is changed in place to keep the time to live of the key
+	if obj == nil {
+		db.set(key, newStringObject(string(str)))
+	} else {
+		obj.str = string(str)
+		db.signalModifiedKey(key)
+	}
+	db.notifyKeyspaceEvent(notifyString, "setbit", key)
+	return old, nil
+}
+
+// ds_getbit returns the bit at offset of the string stored at key
+func ds_getbit(db *Keyspace, key string, offset int64) (int, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	obj, err := db.lookupType(key, StringType)
+	if err != nil || obj == nil {
+		return 0, err
+	}
+	return getBit([]byte(obj.str), offset), nil
+}
+
+// Range given to BITCOUNT and BITPOS
+type bitRangeSpec struct {
+	start    int64
+	end      int64
+	hasStart bool
+	hasEnd   bool
+	isBit    bool // start and end are bits instead of bytes
+}
+
+// ds_bitcount counts the bits set in the string stored at key
+func ds_bitcount(db *Keyspace, key string, spec bitRangeSpec) (int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	obj, err := db.lookupType(key, StringType)
+	if err != nil || obj == nil {
+		return 0, err
+	}
+	str := []byte(obj.str)
+	if !spec.hasStart {
+		return popcountRange(str, 0, int64(len(str))*8-1), nil
+	}
+	// two negative indexes in the wrong order are an empty range even
+	// when both are before the start of the string
+	if spec.start < 0 && spec.end < 0 && spec.start > spec.end {
+		return 0, nil
+	}
+	first, last := bitRange(int64(len(str)), spec.start, spec.end, spec.isBit)
+	return popcountRange(str, first, last), nil
+}
+
+// ds_bitpos returns the position of the first bit equal to bit in the
+// string stored at key, -1 if there is none.
+// A missing key is an endless string of zeros, so is the part of the
+// string after its end unless the end of the range was given
+func ds_bitpos(db *Keyspace, key string, bit int, spec bitRangeSpec) (int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	obj, err := db.lookupType(key, StringType)
+	if err != nil {
+		return 0, err
+	}
+	if obj == nil {
+		if bit == 1 {
+			return -1, nil
+		}
+		return 0, nil
+	}
+	str := []byte(obj.str)
+	first, last := int64(0), int64(len(str))*8-1
+	if spec.hasStart {
+		end := int64(-1)
+		if spec.hasEnd {
+			end = spec.end
+		}
+		first, last = bitRange(int64(len(str)), spec.start, end, spec.isBit)
+	}
+	if first > last {
+		return -1, nil
+	}
+	pos := bitposRange(str, bit, first, last)
+	if pos == -1 && bit == 0 && !spec.hasEnd {
+		return last + 1, nil
+	}
+	return pos, nil
+}
+
+// ds_bitop stores in dest the result of the bitwise operation op between
+// the strings stored at keys, shorter strings are zero padded and missing
+// keys are empty strings. It returns the length of the result, an empty
+// result deletes dest
+func ds_bitop(db *Keyspace, op string, dest string, keys []string) (int64, error) {
+	db.lock()
+	defer db.unlock()
+	srcs := make([][]byte, len(keys))
+	maxlen := 0
+	for i, key := range keys {
+		obj, err := db.lookupType(key, StringType)
+		if err != nil {
+			return 0, err
+		}
+		if obj != nil {
+			srcs[i] = []byte(obj.str)
+		}
+		maxlen = max(maxlen, len(srcs[i]))
+	}
+	if maxlen == 0 {
+		if db.delete(dest) {
+			db.notifyKeyspaceEvent(notifyGeneric, "del", dest)
+		}
+		return 0, nil
+	}
+	byteAt := func(src []byte, j int) byte {
+		if j < len(src) {
+			return src[j]
+		}
+		return 0
+	}
+	result := make([]byte, maxlen)
+	for j := range result {
+		out := byteAt(srcs[0], j)
+		switch op {
+		case "NOT":
+			out = ^out
+		case "DIFF":
+			// the bits of the first key which are not set in any other key
+			var others byte
+			for _, src := range srcs[1:] {
+				others |= byteAt(src, j)
+			}
+			out &^= others
+		default:
+			for _, src := range srcs[1:] {
+				switch op {
+				case "AND":
+					out &= byteAt(src, j)
+				case "OR":
+					out |= byteAt(src, j)
+				case "XOR":
+					out ^= byteAt(src, j)
+				}
+			}
+		}
+		result[j] = out
+	}
+	db.set(dest, newStringObject(string(result)))
+	db.notifyKeyspaceEvent(notifyString, "set", dest)
+	return int64(maxlen), nil
+}
+
+// The operations of BITFIELD
+const (
+	bitfieldGet = iota
+	bitfieldSet
+	bitfieldIncrBy
+)
+
+// A single GET, SET or INCRBY of BITFIELD
+type bitfieldOp struct {
+	op       int
+	typ      bitfieldType
+	offset   int64
+	value    int64 // the value of SET or the increment of INCRBY
+	overflow int   // the OVERFLOW behaviour in effect for SET and INCRBY
+}
+
+// ds_bitfield runs ops on the string stored at key in order. It returns
+// their results, nil for the SET and INCRBY which failed because of
+// OVERFLOW FAIL, and whether the string was changed
+func ds_bitfield(db *Keyspace, key string, ops []bitfieldOp) ([]*int64, bool, error) {
+	db.lock()
+	defer db.unlock()
+	obj, err := db.lookupType(key, StringType)
+	if err != nil {
+		return nil, false, err
+	}
+	var str []byte
+	if obj != nil {
+		str = []byte(obj.str)
+	}
+	// the string is grown once to hold all the fields being written
+	changed := false
+	for _, op := range ops {
+		if op.op != bitfieldGet {
+			grown := growBits(str, op.offset+int64(op.typ.bits)-1)
+			changed = changed || len(grown) != len(str) || obj == nil
+			str = grown
+		}
+	}
+	results := make([]*int64, len(ops))
+	for i, op := range ops {
+		var result int64
+		if op.op == bitfieldGet {
+			if op.typ.signed {
+				result = getSignedBitfield(str, op.offset, op.typ.bits)
+			} else {
+				result = int64(getUnsignedBitfield(str, op.offset, op.typ.bits))
+			}
+			results[i] = &result
+			continue
+		}
+		// SET replies with the old value and INCRBY with the new one
+		var newval uint64
+		var overflowed bool
+		if op.typ.signed {
+			oldval := getSignedBitfield(str, op.offset, op.typ.bits)
+			var wrapped int64
+			if op.op == bitfieldIncrBy {
+				overflowed, wrapped = signedBitfieldOverflow(oldval, op.value, op.typ.bits, op.overflow)
+				result = oldval + op.value
+				if overflowed {
+					result = wrapped
+				}
+				newval = uint64(result)
+			} else {
+				result = oldval
+				newval = uint64(op.value)
+				overflowed, wrapped = signedBitfieldOverflow(op.value, 0, op.typ.bits, op.overflow)
+				if overflowed {
+					newval = uint64(wrapped)
+				}
+			}
+		} else {
+			oldval := getUnsignedBitfield(str, op.offset, op.typ.bits)
+			var wrapped uint64
+			if op.op == bitfieldIncrBy {
+				newval = oldval + uint64(op.value)
+				overflowed, wrapped = unsignedBitfieldOverflow(oldval, op.value, op.typ.bits, op.overflow)
+				if overflowed {
+					newval = wrapped
+				}
+				result = int64(newval)
+			} else {
+				result = int64(oldval)
+				newval = uint64(op.value)
+				overflowed, wrapped = unsignedBitfieldOverflow(newval, 0, op.typ.bits, op.overflow)
+				if overflowed {
+					newval = wrapped
+				}
+			}
+		}
+		if overflowed && op.overflow == bitfieldOverflowFail {
+			continue
+		}
+		setBitfield(str, op.offset, op.typ.bits, newval)
+		changed = true
+		results[i] = &result
+	}
+	if changed {
+		// the value is changed in place to keep the time to live of the key
+		if obj == nil {
+			db.set(key, newStringObject(string(str)))
+		} else {
+			obj.str = string(str)
+			db.signalModifiedKey(key)
+		}
+		db.notifyKeyspaceEvent(notifyString, "setbit", key)
+	}
+	return results, changed, nil
+}
+
+// String Commands
+
+// ds_set stores a string at key, whatever the key was holding before is overwritten
+func ds_set(db *Keyspace, key string, value string) {
+	db.lock()
+	defer db.unlock()
+	db.set(key, newStringObject(value))
+	db.notifyKeyspaceEvent(notifyString, "set", key)
+}
+
+// Options of SET and of the commands built on it
+type setOptions struct {
+	nx       bool  // only set the key if it does not exist
+	xx       bool  // only set the key if it already exists
+	get      bool  // return the old value stored at key
+	keepTTL  bool  // keep the time to live the key already had
+	persist  bool  // remove the time to live, only used by GETEX
+	expireAt int64 // unix time in milliseconds at which the key expires, -1 for none
+}
+
+// ds_setGeneric implements SET with all its options
+// It returns the old value if opts.get is set and whether the key was set,
+// keys which hold something other than a string can only be overwritten
+// when the old value is not requested
+func ds_setGeneric(db *Keyspace, key string, value string, opts setOptions) (old string, oldExists bool, updated bool, err error) {
+	db.lock()
+	defer db.unlock()
+
+	obj, exists := db.lookup(key)
+	if opts.get && exists {
+		if obj.typ != StringType {
+			return "", false, false, ErrWrongType
+		}
+		old, oldExists = obj.str, true
+	}
+	if (opts.nx && exists) || (opts.xx && !exists) {
+		return old, oldExists, false, nil
+	}
+
+	when := db.getExpire(key)
+	db.set(key, newStringObject(value))
+	db.notifyKeyspaceEvent(notifyString, "set", key)
+	if opts.keepTTL && when != -1 {
+		db.setExpire(key, when)
+	}
+	if opts.expireAt != -1 {
+		db.setExpire(key, opts.expireAt)
+		db.notifyKeyspaceEvent(notifyGeneric, "expire", key)
+		// an expire time in the past deletes the key right away
+		db.expireIfNeeded(key)
+	}
+	return old, oldExists, true, nil
+}
+
+// ds_getdel returns the string stored at key and deletes the key
+func ds_getdel(db *Keyspace, key string) (string, bool, error) {
+	db.lock()
+	defer db.unlock()
+	obj, err := db.lookupType(key, StringType)
+	if err != nil || obj == nil {
+		return "", false, err
+	}
+	db.delete(key)
+	db.notifyKeyspaceEvent(notifyGeneric, "del", key)
+	return obj.str, true, nil
+}
+
+// ds_getex returns the string stored at key changing its time to live
+// according to opts.expireAt or opts.persist
+func ds_getex(db *Keyspace, key string, opts setOptions) (string, bool, error) {
+	db.lock()
+	defer db.unlock()
+	obj, err := db.lookupType(key, StringType)
+	if err != nil || obj == nil {
+		return "", false, err
+	}
+	if opts.persist {
+		if db.removeExpire(key) {
+			db.notifyKeyspaceEvent(notifyGeneric, "persist", key)
+		}
+	} else if opts.expireAt != -1 {
+		db.setExpire(key, opts.expireAt)
+		db.notifyKeyspaceEvent(notifyGeneric, "expire", key)
+		db.expireIfNeeded(key)
+	}
+	return obj.str, true, nil
+}
+
+func ds_get(db *Keyspace, key string) (string, bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	obj, err := db.lookupType(key, StringType)
+	if err != nil || obj == nil {
+		return "", false, err
+	}
+	return obj.str, true, nil
+}
+
+// ds_mget returns the values of the keys, found is false for the keys
+// which are missing or are not holding a string
+func ds_mget(db *Keyspace, keys []string) (values []string, found []bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	values = make([]string, len(keys))
+	found = make([]bool, len(keys))
+	for i, key := range keys {
+		obj, err := db.lookupType(key, StringType)
+		if err == nil && obj != nil {
+			values[i], found[i] = obj.str, true
+		}
+	}
+	return values, found
+}
+
+// Error returned when a value which is not an integer is used as one
+var ErrNotInteger = errors.New("ERR value is not an integer or out of range")
+
+func ds_incr(db *Keyspace, key string) (int64, error) {
+	return ds_incrby(db, key, 1)
+}
+
+// ds_incrby increments the integer stored at key, a missing key is
+// treated as 0 like redis does
+func ds_incrby(db *Keyspace, key string, increment int64) (int64, error) {
+	db.lock()
+	defer db.unlock()
+
+	obj, err := db.lookupType(key, StringType)
+	if err != nil {
+		return 0, err
+	}
+	var value int64 = 0
+	if obj != nil {
+		// Parse existing value
+		value, err = strconv.ParseInt(obj.str, 10, 64)
+		if err != nil {
+			return 0, ErrNotInteger
+		}
+	}
+
+	if (increment > 0 && value > math.MaxInt64-increment) || (increment < 0 && value < math.MinInt64-increment) {
+		return 0, ErrOverflow
+	}
+	value += increment
+	// the value is updated in place so the key keeps its time to live
+	if obj == nil {
+		db.set(key, newStringObject(strconv.FormatInt(value, 10)))
+	} else {
+		obj.str = strconv.FormatInt(value, 10)
+		db.signalModifiedKey(key)
+	}
+	db.notifyKeyspaceEvent(notifyString, "incrby", key)
+	return value, nil
+}
+
+// ds_incrbyfloat adds increment to the float stored at key, a missing key
+// is treated as 0. It returns the new value formatted the way it is stored
+func ds_incrbyfloat(db *Keyspace, key string, increment float64) (string, error) {
+	db.lock()
+	defer db.unlock()
+	obj, err := db.lookupType(key, StringType)
+	if err != nil {
+		return "", err
+	}
+	value := 0.0
+	if obj != nil {
+		value, err = parseFloat(obj.str)
+		if err != nil {
+			return "", ErrNotFloat
+		}
+	}
+	value += increment
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return "", ErrNaNOrInfinity
+	}
+	str := strconv.FormatFloat(value, 'f', -1, 64)
+	if obj == nil {
+		db.set(key, newStringObject(str))
+	} else {
+		obj.str = str
+		db.signalModifiedKey(key)
+	}
+	db.notifyKeyspaceEvent(notifyString, "incrbyfloat", key)
+	return str, nil
+}
+
+// ds_append appends value to the string stored at key, creating it when
+// missing, and returns the new length
+func ds_append(db *Keyspace, key string, value string) (int64, error) {
+	db.lock()
+	defer db.unlock()
+	obj, err := db.lookupType(key, StringType)
+	if err != nil {
+		return 0, err
+	}
+	if obj == nil {
+		db.set(key, newStringObject(value))
+		db.notifyKeyspaceEvent(notifyString, "append", key)
+		return int64(len(value)), nil
+	}
+	if len(obj.str)+len(value) > maxBulkLength {
+		return 0, ErrStringTooLong
+	}
+	obj.str += value
+	db.signalModifiedKey(key)
+	db.notifyKeyspaceEvent(notifyString, "append", key)
+	return int64(len(obj.str)), nil
+}
+
+// ds_strlen returns the length of the string stored at key
+func ds_strlen(db *Keyspace, key string) (int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	obj, err := db.lookupType(key, StringType)
+	if err != nil || obj == nil {
+		return 0, err
+	}
+	return int64(len(obj.str)), nil
+}
+
+// ds_getrange returns the part of the string stored at key between start
+// and end included, negative offsets count from the end of the string
+func ds_getrange(db *Keyspace, key string, start int64, end int64) (string, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	obj, err := db.lookupType(key, StringType)
+	if err != nil || obj == nil {
+		return "", err
+	}
+	size := int64(len(obj.str))
+	if start < 0 && end < 0 && start > end {
+		return "", nil
+	}
+	if start < 0 {
+		start = max(size+start, 0)
+	}
+	if end < 0 {
+		end = max(size+end, 0)
+	}
+	if end >= size {
+		end = size - 1
+	}
+	if start > end || size == 0 {
+		return "", nil
+	}
+	return obj.str[start : end+1], nil
+}
+
+// Errors returned by SETRANGE and APPEND
+var (
+	ErrOffsetOutOfRange = errors.New("ERR offset is out of range")
+	ErrStringTooLong    = errors.New("ERR string exceeds maximum allowed size (proto-max-bulk-len)")
+)
+
+// ds_setrange overwrites the string stored at key starting at offset with
+// value, the string is zero padded when it is shorter than offset.
+// It returns the new length and whether the string was changed
+func ds_setrange(db *Keyspace, key string, offset int64, value string) (int64, bool, error) {
+	db.lock()
+	defer db.unlock()
+	obj, err := db.lookupType(key, StringType)
+	if err != nil {
+		return 0, false, err
+	}
+	var str []byte
+	if obj != nil {
+		str = []byte(obj.str)
+	}
+	// an empty value changes nothing, not even a missing key is created
+	if len(value) == 0 {
+		return int64(len(str)), false, nil
+	}
+	if offset+int64(len(value)) > maxBulkLength {
+		return 0, false, ErrStringTooLong
+	}
+	if need := int(offset) + len(value); len(str) < need {
+		grown := make([]byte, need)
+		copy(grown, str)
+		str = grown
+	}
+	copy(str[offset:], value)
+	// the value is changed in place to keep the time to live of the key
+	if obj == nil {
+		db.set(key, newStringObject(string(str)))
+	} else {
+		obj.str = string(str)
+		db.signalModifiedKey(key)
+	}
+	db.notifyKeyspaceEvent(notifyString, "setrange", key)
+	return int64(len(str)), true, nil
+}
+
+// ds_mset stores values[i] at keys[i], with nx nothing is stored
+// if one of the keys already exists. It returns whether they were stored
+func ds_mset(db *Keyspace, keys []string, values []string, nx bool) bool {
+	db.lock()
+	defer db.unlock()
+	if nx {
+		for _, key := range keys {
+			if _, exists := db.lookup(key); exists {
+				return false
+			}
+		}
+	}
+	for i, key := range keys {
+		db.set(key, newStringObject(values[i]))
+		db.notifyKeyspaceEvent(notifyString, "set", key)
+	}
+	return true
+}
+
+// Error returned by LCS when one of the keys is not a string
+var ErrLCSWrongType = errors.New("ERR The specified keys must contain string values")
+
+// A common substring found by LCS, the ranges are inclusive
+type lcsMatch struct {
+	a      [2]int
+	b      [2]int
+	length int
+}
+
+// ds_lcs returns the longest common subsequence of the strings stored at
+// key1 and key2, missing keys are empty strings. With withMatches it also
+// returns the ranges of the two strings making the subsequence, from the
+// last one to the first one like redis does, skipping the ones shorter
+// than minMatchLen
+func ds_lcs(db *Keyspace, key1 string, key2 string, withMatches bool, minMatchLen int) (string, []lcsMatch, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var strs [2]string
+	for i, key := range []string{key1, key2} {
+		obj, exists := db.lookup(key)
+		if !exists {
+			continue
+		}
+		if obj.typ != StringType {
+			return "", nil, ErrLCSWrongType
+		}
+		strs[i] = obj.str
+	}
+	a, b := strs[0], strs[1]
+	if (uint64(len(a))+1)*(uint64(len(b))+1) > maxBulkLength/4 {
+		return "", nil, errors.New("ERR Insufficient memory, transient memory for LCS exceeds proto-max-bulk-len")
+	}
+	// lcs[i][j] is the length of the longest common subsequence of
+	// the first i bytes of a and the first j bytes of b
+	width := len(b) + 1
+	lcs := make([]uint32, (len(a)+1)*width)
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			if a[i-1] == b[j-1] {
+				lcs[i*width+j] = lcs[(i-1)*width+j-1] + 1
+			} else {
+				lcs[i*width+j] = max(lcs[(i-1)*width+j], lcs[i*width+j-1])
+			}
+		}
+	}
+	// walk the table back from the end of both strings to find the
+	// subsequence and the contiguous ranges it is made of
+	idx := int(lcs[len(a)*width+len(b)])
+	result := make([]byte, idx)
+	matches := make([]lcsMatch, 0)
+	var current *lcsMatch
+	emit := func() {
+		current.length = current.a[1] - current.a[0] + 1
+		if withMatches && (minMatchLen == 0 || current.length >= minMatchLen) {
+			matches = append(matches, *current)
+		}
+		current = nil
+	}
+	for i, j := len(a), len(b); i > 0 && j > 0; {
+		if a[i-1] == b[j-1] {
+			result[idx-1] = a[i-1]
+			idx--
+			i--
+			j--
+			if current == nil {
+				current = &lcsMatch{a: [2]int{i, i}, b: [2]int{j, j}}
+			} else {
+				// the match is contiguous with the current range
+				current.a[0], current.b[0] = i, j
+			}
+			if i == 0 || j == 0 {
+				emit()
+			}
+			continue
+		}
+		if lcs[(i-1)*width+j] > lcs[i*width+j-1] {
+			i--
+		} else {
+			j--
+		}
+		if current != nil {
+			emit()
+		}
 	}
-	value += int64(increment)
-	StringSETS[key] = strconv.FormatInt(value, 10)
-	return StringSETS[key]
+	return string(result), matches, nil
 }
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"hash/maphash"
+	"iter"
+	"math/bits"
+	"math/rand"
+	"slices"
+	"sync/atomic"
+)
+
+// Dict is the hash table holding the keyspace and the members of sets,
+// hashes and sorted sets. Unlike go maps it can be walked with a cursor,
+// see scan, which is what SCAN, SSCAN, HSCAN and ZSCAN are built on.
+//
+// The number of buckets is always a power of two and collisions are
+// chained. The table doubles once it holds as many elements as buckets
+// and is halved once it is less than 1/8 full, it is never resized while
+// it is being iterated with all or keys.
+type Dict[V any] struct {
+	table []*dictEntry[V]
+	used  int
+	// iterations running, see all. Commands holding the keyspace read
+	// lock can iterate the same dict at the same time
+	iterators atomic.Int32
+}
+
+type dictEntry[V any] struct {
+	key   string
+	value V
+	next  *dictEntry[V]
+	// set once the entry is removed so that running iterations skip it
+	deleted bool
+}
+
+const dictMinSize = 4
+
+// every dict hashes keys with the same seed
+var dictSeed = maphash.MakeSeed()
+
+func newDict[V any]() *Dict[V] {
+	return &Dict[V]{table: make([]*dictEntry[V], dictMinSize)}
+}
+
+func (d *Dict[V]) bucket(key string) int {
+	return int(maphash.String(dictSeed, key) & uint64(len(d.table)-1))
+}
+
+func (d *Dict[V]) find(key string) *dictEntry[V] {
+	for entry := d.table[d.bucket(key)]; entry != nil; entry = entry.next {
+		if entry.key == key {
+			return entry
+		}
+	}
+	return nil
+}
+
+func (d *Dict[V]) len() int {
+	return d.used
+}
+
+func (d *Dict[V]) get(key string) (V, bool) {
+	if entry := d.find(key); entry != nil {
+		return entry.value, true
+	}
+	var zero V
+	return zero, false
+}
+
+func (d *Dict[V]) has(key string) bool {
+	return d.find(key) != nil
+}
+
+// set adds the key or replaces its value, it returns true if the key was added
+func (d *Dict[V]) set(key string, value V) bool {
+	if entry := d.find(key); entry != nil {
+		entry.value = value
+		return false
+	}
+	i := d.bucket(key)
+	d.table[i] = &dictEntry[V]{key: key, value: value, next: d.table[i]}
+	d.used++
+	d.resizeIfNeeded()
+	return true
+}
+
+// delete removes the key, it returns false if it was missing
+func (d *Dict[V]) delete(key string) bool {
+	i := d.bucket(key)
+	for prev, entry := (*dictEntry[V])(nil), d.table[i]; entry != nil; prev, entry = entry, entry.next {
+		if entry.key != key {
+			continue
+		}
+		if prev == nil {
+			d.table[i] = entry.next
+		} else {
+			prev.next = entry.next
+		}
+		entry.deleted = true
+		d.used--
+		d.resizeIfNeeded()
+		return true
+	}
+	return false
+}
+
+func (d *Dict[V]) resizeIfNeeded() {
+	if d.iterators.Load() > 0 {
+		return
+	}
+	size := len(d.table)
+	switch {
+	case d.used >= size:
+		d.resize(size * 2)
+	case size > dictMinSize && d.used < size/8:
+		d.resize(max(dictMinSize, size/2))
+	}
+}
+
+func (d *Dict[V]) resize(size int) {
+	old := d.table
+	d.table = make([]*dictEntry[V], size)
+	for _, entry := range old {
+		for entry != nil {
+			next := entry.next
+			i := d.bucket(entry.key)
+			entry.next = d.table[i]
+			d.table[i] = entry
+			entry = next
+		}
+	}
+}
+
+// all iterates over the keys and their values in no particular order.
+// Like with go maps the keys can be deleted during the iteration, keys
+// added during it may or may not be seen
+func (d *Dict[V]) all() iter.Seq2[string, V] {
+	return func(yield func(string, V) bool) {
+		d.iterators.Add(1)
+		defer func() {
+			// a resize is only ever pending after deleting during an
+			// iteration, which needs the keyspace locked for writing
+			if d.iterators.Add(-1) == 0 {
+				d.resizeIfNeeded()
+			}
+		}()
+		var chain []*dictEntry[V]
+		for i := 0; i < len(d.table); i++ {
+			// the chain is copied since the loop body may change it
+			chain = chain[:0]
+			for entry := d.table[i]; entry != nil; entry = entry.next {
+				chain = append(chain, entry)
+			}
+			for _, entry := range chain {
+				if !entry.deleted && !yield(entry.key, entry.value) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// keys iterates over the keys like all does
+func (d *Dict[V]) keys() iter.Seq[string] {
+	return func(yield func(string) bool) {
+		for key := range d.all() {
+			if !yield(key) {
+				return
+			}
+		}
+	}
+}
+
+// scan calls fn for the elements of the bucket at cursor and returns the
+// cursor of the next bucket to visit, 0 once the whole table was visited.
+// The iteration starts with cursor 0.
+//
+// The cursor is incremented starting from its most significant bits, the
+// way redis does it. As the size of the table is a power of two, the
+// buckets of a bigger table which an element of a visited bucket can move
+// to always come before the cursor, and so do the buckets a smaller table
+// merges them into. So an element present during the whole iteration is
+// returned at least once however the table is resized between two calls,
+// though it may be returned more than once after it shrinks
+func (d *Dict[V]) scan(cursor uint64, fn func(key string, value V)) uint64 {
+	mask := uint64(len(d.table) - 1)
+	for entry := d.table[cursor&mask]; entry != nil; entry = entry.next {
+		fn(entry.key, entry.value)
+	}
+	// set the bits above the mask so that incrementing the reversed
+	// cursor carries into the mask bits only
+	cursor |= ^mask
+	cursor = bits.Reverse64(cursor)
+	cursor++
+	return bits.Reverse64(cursor)
+}
+
+// randomKey returns a random key, false if the dict is empty
+func (d *Dict[V]) randomKey() (string, bool) {
+	if d.used == 0 {
+		return "", false
+	}
+	// the table is at least 1/8 full so an element is found quickly
+	var entry *dictEntry[V]
+	for entry == nil {
+		entry = d.table[rand.Intn(len(d.table))]
+	}
+	length := 0
+	for e := entry; e != nil; e = e.next {
+		length++
+	}
+	for n := rand.Intn(length); n > 0; n-- {
+		entry = entry.next
+	}
+	return entry.key, true
+}
+
+// randomKeys returns count distinct random keys, all the keys if there are not
+// more than count. Like redis the keys are picked one by one when count is small
+// compared to the size of the dict, so that it does not take O(N)
+func (d *Dict[V]) randomKeys(count int) []string {
+	if count >= d.used {
+		return slices.Collect(d.keys())
+	}
+	if count*3 > d.used {
+		// shuffle only the first count keys
+		keys := slices.Collect(d.keys())
+		for i := 0; i < count; i++ {
+			j := i + rand.Intn(len(keys)-i)
+			keys[i], keys[j] = keys[j], keys[i]
+		}
+		return keys[:count]
+	}
+	picked := make(map[string]bool, count)
+	keys := make([]string, 0, count)
+	for len(keys) < count {
+		key, _ := d.randomKey()
+		if !picked[key] {
+			picked[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// scanDict calls d.scan until count elements were returned or the whole
+// table was visited, it gives up after visiting 10*count empty buckets so
+// that a sparse table does not make a single call take long, like redis
+func scanDict[V any](d *Dict[V], cursor uint64, count int, fn func(key string, value V)) uint64 {
+	found := 0
+	for maxIterations := count * 10; ; maxIterations-- {
+		cursor = d.scan(cursor, func(key string, value V) {
+			found++
+			fn(key, value)
+		})
+		if cursor == 0 || maxIterations <= 0 || found >= count {
+			return cursor
+		}
+	}
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// Geo commands store the points in a sorted set whose scores are 52 bits
+// geohashes, the interleaved bits of the latitude and the longitude. Like in
+// redis the latitudes are limited to the ones of the web mercator projection,
+// searches look at the geohash box of the center and its eight neighbors
+// whose step is chosen so that they cover the searched area.
+const (
+	geoStepMax = 26 // 26 bits for the latitude and for the longitude
+	geoLatMin  = -85.05112878
+	geoLatMax  = 85.05112878
+	geoLongMin = -180.0
+	geoLongMax = 180.0
+
+	// the radius used by redis for the haversine distance
+	earthRadiusInMeters = 6372797.560856
+	mercatorMax         = 20037726.37
+
+	geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+)
+
+// Search shapes of GEOSEARCH
+const (
+	geoShapeCircle = iota
+	geoShapeBox
+)
+
+// Orders of the results of GEOSEARCH
+const (
+	geoSortNone = iota
+	geoSortAsc
+	geoSortDesc
+)
+
+type geoHashBits struct {
+	bits uint64
+	step uint
+}
+
+func (h geoHashBits) isZero() bool {
+	return h.bits == 0 && h.step == 0
+}
+
+type geoHashRange struct {
+	min, max float64
+}
+
+// The area covered by a geohash
+type geoHashArea struct {
+	longitude geoHashRange
+	latitude  geoHashRange
+}
+
+type geoHashNeighbors struct {
+	north, south, east, west                   geoHashBits
+	northEast, northWest, southEast, southWest geoHashBits
+}
+
+// Area searched by GEOSEARCH, distances are in the unit given by conversion
+// which is its length in meters
+type geoShape struct {
+	typ        int
+	xy         [2]float64 // longitude and latitude of the center
+	conversion float64
+	radius     float64
+	width      float64
+	height     float64
+}
+
+// A point found by a search
+type geoPoint struct {
+	longitude float64
+	latitude  float64
+	dist      float64 // in meters
+	score     float64
+	member    string
+}
+
+var geoLongRange = geoHashRange{min: geoLongMin, max: geoLongMax}
+var geoLatRange = geoHashRange{min: geoLatMin, max: geoLatMax}
+
+func degRad(angle float64) float64 {
+	return angle * (math.Pi / 180.0)
+}
+
+func radDeg(angle float64) float64 {
+	return angle / (math.Pi / 180.0)
+}
+
+// interleave64 interleaves the bits of x and y, the bits of x
+// take the even positions and the ones of y the odd positions
+func interleave64(xlo uint32, ylo uint32) uint64 {
+	B := []uint64{0x5555555555555555, 0x3333333333333333, 0x0F0F0F0F0F0F0F0F, 0x00FF00FF00FF00FF, 0x0000FFFF0000FFFF}
+	S := []uint{1, 2, 4, 8, 16}
+	x, y := uint64(xlo), uint64(ylo)
+	for i := 4; i >= 0; i-- {
+		x = (x | (x << S[i])) & B[i]
+		y = (y | (y << S[i])) & B[i]
+	}
+	return x | (y << 1)
+}
+
+// deinterleave64 reverses interleave64, x is returned in the low
+// 32 bits and y in the high ones
+func deinterleave64(interleaved uint64) uint64 {
+	B := []uint64{0x5555555555555555, 0x3333333333333333, 0x0F0F0F0F0F0F0F0F, 0x00FF00FF00FF00FF, 0x0000FFFF0000FFFF, 0x00000000FFFFFFFF}
+	S := []uint{0, 1, 2, 4, 8, 16}
+	x, y := interleaved, interleaved>>1
+	for i := 0; i < 6; i++ {
+		x = (x | (x >> S[i])) & B[i]
+		y = (y | (y >> S[i])) & B[i]
+	}
+	return x | (y << 32)
+}
+
+// geohashEncode returns the geohash of the point with step bits
+// for each coordinate, false if the point is out of the ranges
+func geohashEncode(longRange geoHashRange, latRange geoHashRange, longitude float64, latitude float64, step uint) (geoHashBits, bool) {
+	if step > 32 || step == 0 {
+		return geoHashBits{}, false
+	}
+	if longitude > geoLongMax || longitude < geoLongMin || latitude > geoLatMax || latitude < geoLatMin {
+		return geoHashBits{}, false
+	}
+	if latitude < latRange.min || latitude > latRange.max || longitude < longRange.min || longitude > longRange.max {
+		return geoHashBits{}, false
+	}
+	latOffset := (latitude - latRange.min) / (latRange.max - latRange.min)
+	longOffset := (longitude - longRange.min) / (longRange.max - longRange.min)
+	latOffset *= float64(uint64(1) << step)
+	longOffset *= float64(uint64(1) << step)
+	return geoHashBits{bits: interleave64(uint32(latOffset), uint32(longOffset)), step: step}, true
+}
+
+// geohashDecode returns the area covered by the geohash
+func geohashDecode(longRange geoHashRange, latRange geoHashRange, hash geoHashBits) geoHashArea {
+	separated := deinterleave64(hash.bits)
+	latScale := latRange.max - latRange.min
+	longScale := longRange.max - longRange.min
+	ilato := uint32(separated)
+	ilono := uint32(separated >> 32)
+	steps := float64(uint64(1) << hash.step)
+	return geoHashArea{
+		latitude: geoHashRange{
+			min: latRange.min + (float64(ilato)*1.0/steps)*latScale,
+			max: latRange.min + ((float64(ilato)+1)*1.0/steps)*latScale,
+		},
+		longitude: geoHashRange{
+			min: longRange.min + (float64(ilono)*1.0/steps)*longScale,
+			max: longRange.min + ((float64(ilono)+1)*1.0/steps)*longScale,
+		},
+	}
+}
+
+// geoAreaCenter returns the longitude and latitude at the center of the area
+func geoAreaCenter(area geoHashArea) [2]float64 {
+	xy := [2]float64{
+		(area.longitude.min + area.longitude.max) / 2,
+		(area.latitude.min + area.latitude.max) / 2,
+	}
+	xy[0] = min(max(xy[0], geoLongMin), geoLongMax)
+	xy[1] = min(max(xy[1], geoLatMin), geoLatMax)
+	return xy
+}
+
+func geohashAlign52Bits(hash geoHashBits) uint64 {
+	return hash.bits << (52 - hash.step*2)
+}
+
+// geoEncodeScore returns the score of the point in the sorted set
+func geoEncodeScore(longitude float64, latitude float64) (float64, bool) {
+	hash, ok := geohashEncode(geoLongRange, geoLatRange, longitude, latitude, geoStepMax)
+	if !ok {
+		return 0, false
+	}
+	return float64(geohashAlign52Bits(hash)), true
+}
+
+// geoDecodeScore returns the longitude and latitude of the point with the score
+func geoDecodeScore(score float64) [2]float64 {
+	hash := geoHashBits{bits: uint64(score), step: geoStepMax}
+	return geoAreaCenter(geohashDecode(geoLongRange, geoLatRange, hash))
+}
+
+// geohashString returns the standard 11 characters geohash of the point,
+// which unlike the scores uses the whole -90 to 90 range of latitudes
+func geohashString(xy [2]float64) string {
+	hash, _ := geohashEncode(geoHashRange{min: -180, max: 180}, geoHashRange{min: -90, max: 90}, xy[0], xy[1], geoStepMax)
+	buf := make([]byte, 11)
+	for i := range buf {
+		// only 52 bits are known, the last character is always 0
+		idx := 0
+		if i < 10 {
+			idx = int((hash.bits >> (52 - (i+1)*5)) & 0x1f)
+		}
+		buf[i] = geohashAlphabet[idx]
+	}
+	return string(buf)
+}
+
+func geohashMoveX(hash *geoHashBits, d int) {
+	if d == 0 {
+		return
+	}
+	x := hash.bits & 0xaaaaaaaaaaaaaaaa
+	y := hash.bits & 0x5555555555555555
+	zz := uint64(0x5555555555555555) >> (64 - hash.step*2)
+	if d > 0 {
+		x = x + (zz + 1)
+	} else {
+		x = x | zz
+		x = x - (zz + 1)
+	}
+	x &= uint64(0xaaaaaaaaaaaaaaaa) >> (64 - hash.step*2)
+	hash.bits = x | y
+}
+
+func geohashMoveY(hash *geoHashBits, d int) {
+	if d == 0 {
+		return
+	}
+	x := hash.bits & 0xaaaaaaaaaaaaaaaa
+	y := hash.bits & 0x5555555555555555
+	zz := uint64(0xaaaaaaaaaaaaaaaa) >> (64 - hash.step*2)
+	if d > 0 {
+		y = y + (zz + 1)
+	} else {
+		y = y | zz
+		y = y - (zz + 1)
+	}
+	y &= uint64(0x5555555555555555) >> (64 - hash.step*2)
+	hash.bits = x | y
+}
+
+func geohashNeighbors(hash geoHashBits) geoHashNeighbors {
+	move := func(dx int, dy int) geoHashBits {
+		neighbor := hash
+		geohashMoveX(&neighbor, dx)
+		geohashMoveY(&neighbor, dy)
+		return neighbor
+	}
+	return geoHashNeighbors{
+		east:      move(1, 0),
+		west:      move(-1, 0),
+		south:     move(0, -1),
+		north:     move(0, 1),
+		northWest: move(-1, 1),
+		southWest: move(-1, -1),
+		northEast: move(1, 1),
+		southEast: move(1, -1),
+	}
+}
+
+func geoLatDistance(lat1 float64, lat2 float64) float64 {
+	return earthRadiusInMeters * math.Abs(degRad(lat2)-degRad(lat1))
+}
+
+// geoDistance returns the haversine distance in meters between the two points
+func geoDistance(lon1 float64, lat1 float64, lon2 float64, lat2 float64) float64 {
+	lon1r, lon2r := degRad(lon1), degRad(lon2)
+	v := math.Sin((lon2r - lon1r) / 2)
+	// points on the same meridian only need the latitudes
+	if v == 0 {
+		return geoLatDistance(lat1, lat2)
+	}
+	lat1r, lat2r := degRad(lat1), degRad(lat2)
+	u := math.Sin((lat2r - lat1r) / 2)
+	a := u*u + math.Cos(lat1r)*math.Cos(lat2r)*v*v
+	return 2.0 * earthRadiusInMeters * math.Asin(math.Sqrt(a))
+}
+
+// contains returns the distance in meters from the center of the shape
+// to the point and whether the point is inside the shape
+func (shape *geoShape) contains(xy [2]float64) (float64, bool) {
+	if shape.typ == geoShapeCircle {
+		distance := geoDistance(shape.xy[0], shape.xy[1], xy[0], xy[1])
+		return distance, distance <= shape.radius*shape.conversion
+	}
+	// the latitude distance is cheaper so it is checked first
+	if geoLatDistance(xy[1], shape.xy[1]) > shape.height*shape.conversion/2 {
+		return 0, false
+	}
+	if geoDistance(xy[0], xy[1], shape.xy[0], xy[1]) > shape.width*shape.conversion/2 {
+		return 0, false
+	}
+	return geoDistance(shape.xy[0], shape.xy[1], xy[0], xy[1]), true
+}
+
+// boundingBox returns the minimum longitude and latitude and the
+// maximum longitude and latitude of a box containing the shape
+func (shape *geoShape) boundingBox() [4]float64 {
+	longitude, latitude := shape.xy[0], shape.xy[1]
+	height, width := shape.radius, shape.radius
+	if shape.typ == geoShapeBox {
+		height, width = shape.height/2, shape.width/2
+	}
+	height *= shape.conversion
+	width *= shape.conversion
+
+	latDelta := radDeg(height / earthRadiusInMeters)
+	longDeltaTop := radDeg(width / earthRadiusInMeters / math.Cos(degRad(latitude+latDelta)))
+	longDeltaBottom := radDeg(width / earthRadiusInMeters / math.Cos(degRad(latitude-latDelta)))
+	// the widest side of the box is the one nearest to the equator
+	longDelta := longDeltaTop
+	if latitude < 0 {
+		longDelta = longDeltaBottom
+	}
+	return [4]float64{longitude - longDelta, latitude - latDelta, longitude + longDelta, latitude + latDelta}
+}
+
+// geohashEstimateStepsByRadius returns the step of the geohash boxes
+// big enough to contain a circle of the radius
+func geohashEstimateStepsByRadius(rangeMeters float64, latitude float64) uint {
+	if rangeMeters == 0 {
+		return geoStepMax
+	}
+	step := 1
+	for rangeMeters < mercatorMax {
+		rangeMeters *= 2
+		step++
+	}
+	// make sure the range is included in most of the cases
+	step -= 2
+	// the boxes are narrower near the poles
+	if latitude > 66 || latitude < -66 {
+		step--
+		if latitude > 80 || latitude < -80 {
+			step--
+		}
+	}
+	return uint(min(max(step, 1), geoStepMax))
+}
+
+// searchAreas returns the geohash box of the center of the shape followed by
+// its neighbors, the neighbors not intersecting the shape are zeroed
+func (shape *geoShape) searchAreas() []geoHashBits {
+	bounds := shape.boundingBox()
+	minLon, minLat, maxLon, maxLat := bounds[0], bounds[1], bounds[2], bounds[3]
+	longitude, latitude := shape.xy[0], shape.xy[1]
+	// boxes use the distance from the center to a corner
+	radiusMeters := shape.radius
+	if shape.typ == geoShapeBox {
+		radiusMeters = math.Sqrt((shape.width/2)*(shape.width/2) + (shape.height/2)*(shape.height/2))
+	}
+	radiusMeters *= shape.conversion
+
+	steps := geohashEstimateStepsByRadius(radiusMeters, latitude)
+	hash, _ := geohashEncode(geoLongRange, geoLatRange, longitude, latitude, steps)
+	neighbors := geohashNeighbors(hash)
+	area := geohashDecode(geoLongRange, geoLatRange, hash)
+
+	// near the edges of its box the estimated step may not be small enough
+	// for the neighbors to cover the whole shape
+	north := geohashDecode(geoLongRange, geoLatRange, neighbors.north)
+	south := geohashDecode(geoLongRange, geoLatRange, neighbors.south)
+	east := geohashDecode(geoLongRange, geoLatRange, neighbors.east)
+	west := geohashDecode(geoLongRange, geoLatRange, neighbors.west)
+	decreaseStep := north.latitude.max < maxLat || south.latitude.min > minLat ||
+		east.longitude.max < maxLon || west.longitude.min > minLon
+	if steps > 1 && decreaseStep {
+		steps--
+		hash, _ = geohashEncode(geoLongRange, geoLatRange, longitude, latitude, steps)
+		neighbors = geohashNeighbors(hash)
+		area = geohashDecode(geoLongRange, geoLatRange, hash)
+	}
+
+	// leave out the neighbors which are useless
+	if steps >= 2 {
+		if area.latitude.min < minLat {
+			neighbors.south, neighbors.southWest, neighbors.southEast = geoHashBits{}, geoHashBits{}, geoHashBits{}
+		}
+		if area.latitude.max > maxLat {
+			neighbors.north, neighbors.northEast, neighbors.northWest = geoHashBits{}, geoHashBits{}, geoHashBits{}
+		}
+		if area.longitude.min < minLon {
+			neighbors.west, neighbors.southWest, neighbors.northWest = geoHashBits{}, geoHashBits{}, geoHashBits{}
+		}
+		if area.longitude.max > maxLon {
+			neighbors.east, neighbors.southEast, neighbors.northEast = geoHashBits{}, geoHashBits{}, geoHashBits{}
+		}
+	}
+	return []geoHashBits{hash, neighbors.north, neighbors.south, neighbors.east, neighbors.west,
+		neighbors.northEast, neighbors.northWest, neighbors.southEast, neighbors.southWest}
+}
+
+// geoSearch returns the points of the sorted set inside the shape in the
+// order the boxes are scanned, it stops after limit points unless it is 0
+func geoSearch(zs *ZSet, shape *geoShape, limit int) []geoPoint {
+	points := []geoPoint{}
+	areas := shape.searchAreas()
+	lastProcessed := 0
+	for i, area := range areas {
+		if area.isZero() {
+			continue
+		}
+		// with huge radiuses neighbors can be the same box
+		if lastProcessed != 0 && area == areas[lastProcessed] {
+			continue
+		}
+		if limit > 0 && len(points) >= limit {
+			break
+		}
+		points = geoPointsInBox(zs, area, shape, points, limit)
+		lastProcessed = i
+	}
+	return points
+}
+
+// geoPointsInBox appends the points of the geohash box which are inside the shape
+func geoPointsInBox(zs *ZSet, hash geoHashBits, shape *geoShape, points []geoPoint, limit int) []geoPoint {
+	r := zrangespec{min: float64(geohashAlign52Bits(hash)), maxex: true}
+	hash.bits++
+	r.max = float64(geohashAlign52Bits(hash))
+	for x := zs.zsl.firstInRange(&r); x != nil && r.lteMax(x.score); x = x.level[0].forward {
+		xy := geoDecodeScore(x.score)
+		if distance, ok := shape.contains(xy); ok {
+			points = append(points, geoPoint{longitude: xy[0], latitude: xy[1], dist: distance, score: x.score, member: x.member})
+			if limit > 0 && len(points) >= limit {
+				break
+			}
+		}
+	}
+	return points
+}
+
+// geoSortPoints sorts the points by their distance from the center
+func geoSortPoints(points []geoPoint, order int) {
+	switch order {
+	case geoSortAsc:
+		sort.SliceStable(points, func(i, j int) bool { return points[i].dist < points[j].dist })
+	case geoSortDesc:
+		sort.SliceStable(points, func(i, j int) bool { return points[i].dist > points[j].dist })
+	}
+}
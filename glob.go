@@ -0,0 +1,127 @@
+package main
+
+// Glob-style pattern matching as done by redis for KEYS, the MATCH option
+// of the SCAN family and pattern subscriptions:
+//
+//	*        any sequence of bytes, including the empty one
+//	?        exactly one byte
+//	[abc]    one of the bytes in the brackets, [a-c] for a range of bytes
+//	[^abc]   any byte except the ones in the brackets
+//	\x       the byte x, to match a special character literally
+
+// maximum number of nested * a pattern is matched with, abusive patterns
+// like "a*a*a*a*...b" would otherwise take forever
+const globMaxNesting = 1000
+
+// stringMatch tells whether str matches the glob pattern
+func stringMatch(pattern string, str string, nocase bool) bool {
+	skipLongerMatches := false
+	return stringMatchImpl(pattern, str, nocase, &skipLongerMatches, 0)
+}
+
+func toLower(b byte) byte {
+	if b >= 'A' && b <= 'Z' {
+		return b + 'a' - 'A'
+	}
+	return b
+}
+
+func stringMatchImpl(pattern string, str string, nocase bool, skipLongerMatches *bool, nesting int) bool {
+	if nesting > globMaxNesting {
+		return false
+	}
+	equal := func(a byte, b byte) bool {
+		if nocase {
+			return toLower(a) == toLower(b)
+		}
+		return a == b
+	}
+	for len(pattern) > 0 && len(str) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for len(str) > 0 {
+				if stringMatchImpl(pattern[1:], str, nocase, skipLongerMatches, nesting+1) {
+					return true
+				}
+				if *skipLongerMatches {
+					return false
+				}
+				str = str[1:]
+			}
+			// the rest of the pattern matches nowhere in the rest of the
+			// string, a longer match for an earlier * would not help as
+			// the rest of the pattern would then have to match even later
+			*skipLongerMatches = true
+			return false
+		case '?':
+			str = str[1:]
+		case '[':
+			pattern = pattern[1:]
+			not := len(pattern) > 0 && pattern[0] == '^'
+			if not {
+				pattern = pattern[1:]
+			}
+			match := false
+			for len(pattern) > 0 && pattern[0] != ']' {
+				switch {
+				case pattern[0] == '\\' && len(pattern) >= 2:
+					pattern = pattern[1:]
+					if pattern[0] == str[0] {
+						match = true
+					}
+				case len(pattern) >= 3 && pattern[1] == '-':
+					start, end, c := pattern[0], pattern[2], str[0]
+					if start > end {
+						start, end = end, start
+					}
+					if nocase {
+						start, end, c = toLower(start), toLower(end), toLower(c)
+					}
+					pattern = pattern[2:]
+					if c >= start && c <= end {
+						match = true
+					}
+				default:
+					if equal(pattern[0], str[0]) {
+						match = true
+					}
+				}
+				pattern = pattern[1:]
+			}
+			if not {
+				match = !match
+			}
+			if !match {
+				return false
+			}
+			str = str[1:]
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if !equal(pattern[0], str[0]) {
+				return false
+			}
+			str = str[1:]
+		}
+		// an unterminated [ consumes the whole pattern
+		if len(pattern) > 0 {
+			pattern = pattern[1:]
+		}
+	}
+	// trailing * match the end of the string, even an empty one
+	if len(str) == 0 {
+		for len(pattern) > 0 && pattern[0] == '*' {
+			pattern = pattern[1:]
+		}
+	}
+	return len(pattern) == 0 && len(str) == 0
+}
@@ -1,44 +1,241 @@
 package main
 
-import "strconv"
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
 
-var Handlers = map[string]func([]Value) Value{
-	"PING": ping,
+var Handlers = map[string]func(*Client, []Value) Value{
+	"PING":     ping,
+	"SHUTDOWN": shutdownCommand,
+	// connection commands
+	"HELLO":  hello,
+	"AUTH":   auth,
+	"SELECT": selectCommand,
 	// string commads
-	"SET":    set,
-	"GET":    get,
-	"MGET":   mget,
-	"INCR":   incr,
-	"INCRBY": incrby,
+	"SET":         set,
+	"GET":         get,
+	"MGET":        mget,
+	"INCR":        incr,
+	"INCRBY":      incrby,
+	"SETNX":       setnx,
+	"SETEX":       setex,
+	"PSETEX":      psetex,
+	"GETSET":      getset,
+	"GETDEL":      getdel,
+	"GETEX":       getex,
+	"DECR":        decr,
+	"DECRBY":      decrby,
+	"INCRBYFLOAT": incrbyfloat,
+	"APPEND":      appendCommand,
+	"STRLEN":      strlen,
+	"GETRANGE":    getrange,
+	"SUBSTR":      substr,
+	"SETRANGE":    setrange,
+	"MSET":        mset,
+	"MSETNX":      msetnx,
+	"LCS":         lcs,
 	// hash commands
-	"HSET":    hset,
-	"HGET":    hget,
-	"HGETALL": hgetall,
+	"HSET":         hset,
+	"HGET":         hget,
+	"HGETALL":      hgetall,
+	"HMSET":        hmset,
+	"HSETNX":       hsetnx,
+	"HDEL":         hdel,
+	"HEXISTS":      hexists,
+	"HLEN":         hlen,
+	"HSTRLEN":      hstrlen,
+	"HKEYS":        hkeys,
+	"HVALS":        hvals,
+	"HMGET":        hmget,
+	"HINCRBY":      hincrby,
+	"HINCRBYFLOAT": hincrbyfloat,
+	"HRANDFIELD":   hrandfield,
+	"HEXPIRE":      hexpire,
+	"HPEXPIRE":     hpexpire,
+	"HEXPIREAT":    hexpireat,
+	"HPEXPIREAT":   hpexpireat,
+	"HTTL":         httl,
+	"HPTTL":        hpttl,
+	"HEXPIRETIME":  hexpiretime,
+	"HPEXPIRETIME": hpexpiretime,
+	"HPERSIST":     hpersist,
+	"HGETEX":       hgetex,
 	// list commands
-	"LPUSH":  lpush,
-	"LPOP":   lpop,
-	"LLEN":   llen,
-	"LINDEX": lindex,
-	"LRANGE": lrange,
-	"RPUSH":  rpush,
-	"RPOP":   rpop,
+	"LPUSH":      lpush,
+	"LPOP":       lpop,
+	"LLEN":       llen,
+	"LINDEX":     lindex,
+	"LRANGE":     lrange,
+	"RPUSH":      rpush,
+	"RPOP":       rpop,
+	"LPUSHX":     lpushx,
+	"RPUSHX":     rpushx,
+	"LSET":       lset,
+	"LINSERT":    linsert,
+	"LREM":       lrem,
+	"LTRIM":      ltrim,
+	"LPOS":       lpos,
+	"LMOVE":      lmove,
+	"RPOPLPUSH":  rpoplpush,
+	"LMPOP":      lmpop,
+	"BLPOP":      blpop,
+	"BRPOP":      brpop,
+	"BLMOVE":     blmove,
+	"BRPOPLPUSH": brpoplpush,
+	"BLMPOP":     blmpop,
 	// set commands
-	"SADD":      sadd,
-	"SREM":      srem,
-	"SCARD":     scard,
-	"SISMEMBER": sismember,
+	"SADD":             sadd,
+	"SREM":             srem,
+	"SCARD":            scard,
+	"SISMEMBER":        sismember,
+	"SMEMBERS":         smembers,
+	"SMISMEMBER":       smismember,
+	"SINTER":           sinter,
+	"SINTERCARD":       sintercard,
+	"SUNION":           sunion,
+	"SDIFF":            sdiff,
+	"SINTERSTORE":      sinterstore,
+	"SUNIONSTORE":      sunionstore,
+	"SDIFFSTORE":       sdiffstore,
+	"SMOVE":            smove,
+	"SPOP":             spop,
+	"SRANDMEMBER":      srandmember,
+	"ZADD":             zadd,
+	"ZINCRBY":          zincrby,
+	"ZREM":             zrem,
+	"ZSCORE":           zscore,
+	"ZMSCORE":          zmscore,
+	"ZCARD":            zcard,
+	"ZCOUNT":           zcount,
+	"ZRANK":            zrank,
+	"ZREVRANK":         zrevrank,
+	"ZRANGE":           zrange,
+	"ZREVRANGE":        zrevrange,
+	"ZRANGEBYSCORE":    zrangebyscore,
+	"ZREVRANGEBYSCORE": zrevrangebyscore,
+	"ZRANGEBYLEX":      zrangebylex,
+	"ZREVRANGEBYLEX":   zrevrangebylex,
+	"ZRANGESTORE":      zrangestore,
+	"ZREMRANGEBYRANK":  zremrangebyrank,
+	"ZREMRANGEBYSCORE": zremrangebyscore,
+	"ZREMRANGEBYLEX":   zremrangebylex,
+	"ZUNION":           zunion,
+	"ZINTER":           zinter,
+	"ZDIFF":            zdiff,
+	"ZUNIONSTORE":      zunionstore,
+	"ZINTERSTORE":      zinterstore,
+	"ZDIFFSTORE":       zdiffstore,
+	"ZPOPMIN":          zpopmin,
+	"ZPOPMAX":          zpopmax,
+	"ZMPOP":            zmpop,
+	"BZPOPMIN":         bzpopmin,
+	"BZPOPMAX":         bzpopmax,
+	"BZMPOP":           bzmpop,
+	// stream commands
+	"XADD":       xadd,
+	"XLEN":       xlen,
+	"XRANGE":     xrange,
+	"XREVRANGE":  xrevrange,
+	"XDEL":       xdel,
+	"XTRIM":      xtrim,
+	"XREAD":      xread,
+	"XREADGROUP": xreadgroup,
+	"XACK":       xack,
+	"XGROUP":     xgroup,
+	"XPENDING":   xpending,
+	"XCLAIM":     xclaim,
+	"XAUTOCLAIM": xautoclaim,
+	"XINFO":      xinfo,
+	// hyperloglog commands
+	"PFADD":   pfadd,
+	"PFCOUNT": pfcount,
+	"PFMERGE": pfmerge,
+	// geo commands
+	"GEOADD":         geoadd,
+	"GEOPOS":         geopos,
+	"GEODIST":        geodist,
+	"GEOHASH":        geohash,
+	"GEOSEARCH":      geosearch,
+	"GEOSEARCHSTORE": geosearchstore,
+	// bit commands
+	"SETBIT":      setbit,
+	"GETBIT":      getbit,
+	"BITCOUNT":    bitcount,
+	"BITPOS":      bitpos,
+	"BITOP":       bitop,
+	"BITFIELD":    bitfield,
+	"BITFIELD_RO": bitfieldRO,
+	// scan commands
+	"KEYS":  keys,
+	"SCAN":  scan,
+	"SSCAN": sscan,
+	"HSCAN": hscan,
+	"ZSCAN": zscan,
+	// transaction commands
+	"MULTI":   multi,
+	"EXEC":    exec,
+	"DISCARD": discard,
+	"WATCH":   watch,
+	"UNWATCH": unwatch,
+	// pub/sub commands
+	"SUBSCRIBE":    subscribe,
+	"UNSUBSCRIBE":  unsubscribe,
+	"PSUBSCRIBE":   psubscribe,
+	"PUNSUBSCRIBE": punsubscribe,
+	"PUBLISH":      publish,
+	"PUBSUB":       pubsubCommand,
+	"SSUBSCRIBE":   ssubscribe,
+	"SUNSUBSCRIBE": sunsubscribe,
+	"SPUBLISH":     spublish,
+	// generic commands
+	"DEL":       del,
+	"UNLINK":    unlink,
+	"EXISTS":    exists,
+	"TYPE":      typeCommand,
+	"RENAME":    rename,
+	"RENAMENX":  renamenx,
+	"COPY":      copyCommand,
+	"DBSIZE":    dbsize,
+	"RANDOMKEY": randomkey,
+	"MOVE":      move,
+	"SWAPDB":    swapdb,
+	"FLUSHDB":   flushdb,
+	"FLUSHALL":  flushall,
+	// expire commands
+	"EXPIRE":      expire,
+	"PEXPIRE":     pexpire,
+	"EXPIREAT":    expireat,
+	"PEXPIREAT":   pexpireat,
+	"TTL":         ttl,
+	"PTTL":        pttl,
+	"EXPIRETIME":  expiretime,
+	"PEXPIRETIME": pexpiretime,
+	"PERSIST":     persist,
 }
 
-func ping(args []Value) Value { // works
+func ping(c *Client, args []Value) Value { // works
+	// in subscribe mode the reply has the same shape as the messages
+	if c.inSubscribeMode() {
+		message := ""
+		if len(args) > 0 {
+			message = args[0].bulk
+		}
+		return Value{typ: "array", array: []Value{{typ: "bulk", bulk: "pong"}, {typ: "bulk", bulk: message}}}
+	}
 	if len(args) == 0 {
 		return Value{typ: "string", str: "PONG"}
 	}
 
-	return Value{typ: "string", str: args[0].bulk}
+	return Value{typ: "bulk", bulk: args[0].bulk}
 }
 
 // SET commands
-func srem(args []Value) Value { // works
+func srem(c *Client, args []Value) Value { // works
 	if len(args) < 2 {
 		return Value{typ: "error", str: "ERR wrong number of arguments for 'srem' command"}
 	}
@@ -47,10 +244,13 @@ func srem(args []Value) Value { // works
 	for i := 1; i < len(args); i++ {
 		members = append(members, args[i].bulk)
 	}
-	elementsRemoved := ds_srem(key, members)
-	return Value{typ: "string", str: elementsRemoved}
+	elementsRemoved, err := ds_srem(c.db, key, members)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: elementsRemoved}
 }
-func sadd(args []Value) Value { // works
+func sadd(c *Client, args []Value) Value { // works
 	if len(args) < 2 {
 		return Value{typ: "error", str: "ERR wrong number of arguments for 'sadd' command"}
 	}
@@ -59,231 +259,4626 @@ func sadd(args []Value) Value { // works
 	for i := 1; i < len(args); i++ {
 		members = append(members, args[i].bulk)
 	}
-	elementsAdded := ds_sadd(key, members)
-	return Value{typ: "string", str: elementsAdded}
+	elementsAdded, err := ds_sadd(c.db, key, members)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: elementsAdded}
 }
-func scard(args []Value) Value { // works
+func scard(c *Client, args []Value) Value { // works
 	if len(args) != 1 {
 		return Value{typ: "error", str: "ERR wrong number of arguments for 'scard' command"}
 	}
 	key := args[0].bulk
 
-	cardinality := ds_scard(key)
-	return Value{typ: "string", str: cardinality}
+	cardinality, err := ds_scard(c.db, key)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: cardinality}
 }
-func sismember(args []Value) Value { // works
+func sismember(c *Client, args []Value) Value { // works
 	if len(args) != 2 {
 		return Value{typ: "error", str: "ERR wrong number of arguments for 'sismember' command"}
 	}
 	key := args[0].bulk
 	member := args[1].bulk
-	isMember := ds_sismember(key, member)
-	return Value{typ: "string", str: isMember}
-}
-func lrange(args []Value) Value {
-	// if len(args) != 2 {
-	// 	return Value{typ: "error", str: "ERR wrong number of arguments for 'lindex' command"}
-	// }
-	// key := args[0].bulk
-	// index:=args[1].bulk
-	// value, ok := ds_lindex(key,index)
-	// if !ok {
-	// 	return Value{typ: "null"}
-	// }
-	return Value{typ: "string", str: "value"}
-}
-
-func lindex(args []Value) Value { // works
-	if len(args) != 2 {
-		return Value{typ: "error", str: "ERR wrong number of arguments for 'lindex' command"}
-	}
-	key := args[0].bulk
-	index := args[1].bulk
-	value, ok := ds_lindex(key, index)
-	if !ok {
-		return Value{typ: "null"}
+	isMember, err := ds_sismember(c.db, key, member)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
 	}
-	return Value{typ: "bulk", bulk: value}
+	return Value{typ: "integer", num: isMember}
 }
-func llen(args []Value) Value { //works
+func smembers(c *Client, args []Value) Value {
 	if len(args) != 1 {
-		return Value{typ: "error", str: "ERR wrong number of arguments for 'lpop' command"}
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'smembers' command"}
 	}
-	key := args[0].bulk
-	value := ds_llen(key)
+	members, err := ds_smembers(c.db, args[0].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return bulkSet(members)
+}
 
-	return Value{typ: "string", str: value}
+// bulkSet builds a set reply, RESP2 clients receive it as an array
+func bulkSet(members []string) Value {
+	reply := bulkArray(members)
+	reply.typ = "set"
+	return reply
 }
-func rpop(args []Value) Value { // works
-	if len(args) != 1 {
-		return Value{typ: "error", str: "ERR wrong number of arguments for 'lpop' command"}
+
+// argsToStrings returns the bulk strings of the arguments
+func argsToStrings(args []Value) []string {
+	values := make([]string, 0, len(args))
+	for _, arg := range args {
+		values = append(values, arg.bulk)
 	}
-	key := args[0].bulk
-	value, ok := ds_rpop(key)
-	if !ok {
-		return Value{typ: "null"}
+	return values
+}
+
+func smismember(c *Client, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'smismember' command"}
 	}
-	return Value{typ: "bulk", bulk: value}
+	results, err := ds_smismember(c.db, args[0].bulk, argsToStrings(args[1:]))
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return integerArray(results)
+}
+
+func sinter(c *Client, args []Value) Value {
+	return setopGeneric(c, args, "sinter", SetInter)
 }
 
-func rpush(args []Value) Value { // works
+func sunion(c *Client, args []Value) Value {
+	return setopGeneric(c, args, "sunion", SetUnion)
+}
+
+func sdiff(c *Client, args []Value) Value {
+	return setopGeneric(c, args, "sdiff", SetDiff)
+}
+
+// setopGeneric implements SINTER, SUNION and SDIFF
+func setopGeneric(c *Client, args []Value, name string, op SetOperation) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", name)}
+	}
+	members, err := ds_setop(c.db, argsToStrings(args), op)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return bulkSet(members)
+}
+
+func sinterstore(c *Client, args []Value) Value {
+	return setopstoreGeneric(c, args, "sinterstore", SetInter)
+}
+
+func sunionstore(c *Client, args []Value) Value {
+	return setopstoreGeneric(c, args, "sunionstore", SetUnion)
+}
+
+func sdiffstore(c *Client, args []Value) Value {
+	return setopstoreGeneric(c, args, "sdiffstore", SetDiff)
+}
+
+// setopstoreGeneric implements SINTERSTORE, SUNIONSTORE and SDIFFSTORE
+func setopstoreGeneric(c *Client, args []Value, name string, op SetOperation) Value {
 	if len(args) < 2 {
-		return Value{typ: "error", str: "ERR wrong number of arguments for 'lpush' command"}
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", name)}
 	}
-	key := args[0].bulk
-	values := make([]string, 0)
-	for i := 1; i < len(args); i++ {
-		values = append(values, args[i].bulk)
+	size, err := ds_setopstore(c.db, args[0].bulk, argsToStrings(args[1:]), op)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
 	}
-	length := ds_rpush(key, values)
-	return Value{typ: "string", str: length}
+	return Value{typ: "integer", num: size}
 }
-func lpop(args []Value) Value { // works
-	if len(args) != 1 {
-		return Value{typ: "error", str: "ERR wrong number of arguments for 'lpop' command"}
+
+// SINTERCARD numkeys key [key ...] [LIMIT limit]
+func sintercard(c *Client, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'sintercard' command"}
+	}
+	numkeys, err := strconv.ParseInt(args[0].bulk, 10, 64)
+	if err != nil {
+		return Value{typ: "error", str: ErrNotInteger.Error()}
+	}
+	if numkeys <= 0 {
+		return Value{typ: "error", str: "ERR numkeys should be greater than 0"}
+	}
+	if numkeys > int64(len(args)-1) {
+		return Value{typ: "error", str: "ERR Number of keys can't be greater than number of args"}
+	}
+	keys := argsToStrings(args[1 : numkeys+1])
+	rest := args[numkeys+1:]
+	var limit int64 = 0
+	if len(rest) > 0 {
+		if len(rest) != 2 || strings.ToUpper(rest[0].bulk) != "LIMIT" {
+			return Value{typ: "error", str: "ERR syntax error"}
+		}
+		limit, err = strconv.ParseInt(rest[1].bulk, 10, 64)
+		if err != nil {
+			return Value{typ: "error", str: ErrNotInteger.Error()}
+		}
+		if limit < 0 {
+			return Value{typ: "error", str: "ERR LIMIT can't be negative"}
+		}
+	}
+	count, err := ds_sintercard(c.db, keys, limit)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: count}
+}
+
+// SMOVE source destination member
+func smove(c *Client, args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'smove' command"}
+	}
+	moved, err := ds_smove(c.db, args[0].bulk, args[1].bulk, args[2].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if moved == 0 {
+		c.preventPropagation()
+	}
+	return Value{typ: "integer", num: moved}
+}
+
+// SPOP key [count]
+func spop(c *Client, args []Value) Value {
+	if len(args) != 1 && len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'spop' command"}
 	}
 	key := args[0].bulk
-	value, ok := ds_lpop(key)
+	var count int64 = 1
+	if len(args) == 2 {
+		var err error
+		count, err = strconv.ParseInt(args[1].bulk, 10, 64)
+		if err != nil || count < 0 {
+			return Value{typ: "error", str: "ERR value is out of range, must be positive"}
+		}
+	}
+	members, ok, err := ds_spop(c.db, key, count)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	// the members are picked at random, the aof logs which ones were removed
+	if len(members) > 0 {
+		c.rewriteCommand(append([]string{"SREM", key}, members...)...)
+	} else {
+		c.preventPropagation()
+	}
+	if len(args) == 2 {
+		return bulkSet(members)
+	}
 	if !ok {
 		return Value{typ: "null"}
 	}
-	return Value{typ: "string", str: value}
+	return Value{typ: "bulk", bulk: members[0]}
 }
-func lpush(args []Value) Value { // works
-	if len(args) < 2 {
-		return Value{typ: "error", str: "ERR wrong number of arguments for 'lpush' command"}
+
+// SRANDMEMBER key [count]
+func srandmember(c *Client, args []Value) Value {
+	if len(args) != 1 && len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'srandmember' command"}
 	}
 	key := args[0].bulk
-	values := make([]string, 0)
-	for i := 1; i < len(args); i++ {
-		values = append(values, args[i].bulk)
+	if len(args) == 1 {
+		members, err := ds_srandmember(c.db, key, 1)
+		if err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+		if len(members) == 0 {
+			return Value{typ: "null"}
+		}
+		return Value{typ: "bulk", bulk: members[0]}
+	}
+	count, err := strconv.ParseInt(args[1].bulk, 10, 64)
+	if err != nil {
+		return Value{typ: "error", str: ErrNotInteger.Error()}
+	}
+	if count < -math.MaxInt64/2 {
+		return Value{typ: "error", str: "ERR value is out of range"}
+	}
+	members, err := ds_srandmember(c.db, key, count)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
 	}
-	length := ds_lpush(key, values)
-	return Value{typ: "string", str: length}
+	return bulkArray(members)
 }
 
-func mget(args []Value) Value {
-	if len(args) == 0 {
-		return Value{typ: "error", str: "ERR wrong number of arguments for 'mget' command"}
+func lrange(c *Client, args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'lrange' command"}
 	}
-
-	keys := make([]string, 0)
-	for i := 0; i < len(args); i++ {
-		keys = append(keys, args[i].bulk)
+	key := args[0].bulk
+	start, err1 := strconv.ParseInt(args[1].bulk, 10, 64)
+	stop, err2 := strconv.ParseInt(args[2].bulk, 10, 64)
+	if err1 != nil || err2 != nil {
+		return Value{typ: "error", str: ErrNotInteger.Error()}
 	}
-	value := ds_mget(keys)
-	values := []Value{}
-	for _, v := range value {
-		values = append(values, Value{typ: "bulk", bulk: v})
+	values, err := ds_lrange(c.db, key, start, stop)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
 	}
-	return Value{typ: "array", array: values}
+	return bulkArray(values)
 }
-func incrby(args []Value) Value { // works
-	if len(args) != 2 {
-		return Value{typ: "error", str: "ERR wrong number of arguments for 'incrby' command"}
+
+// bulkArray builds an array reply made of bulk strings
+func bulkArray(values []string) Value {
+	array := make([]Value, 0, len(values))
+	for _, value := range values {
+		array = append(array, Value{typ: "bulk", bulk: value})
 	}
+	return Value{typ: "array", array: array}
+}
 
+func lindex(c *Client, args []Value) Value { // works
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'lindex' command"}
+	}
 	key := args[0].bulk
-	increment := args[1].bulk
-	incr, err := strconv.ParseInt(increment, 10, 64)
+	index, err := strconv.ParseInt(args[1].bulk, 10, 64)
 	if err != nil {
-		return Value{typ: "error", str: "ERR wrong value of increment provided"}
+		return Value{typ: "error", str: ErrNotInteger.Error()}
 	}
-	value := ds_incrby(key, incr)
-
-	return Value{typ: "string", str: value}
+	value, ok, err := ds_lindex(c.db, key, index)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if !ok {
+		return Value{typ: "null"}
+	}
+	return Value{typ: "bulk", bulk: value}
 }
-func incr(args []Value) Value { // works
+func llen(c *Client, args []Value) Value { //works
 	if len(args) != 1 {
-		return Value{typ: "error", str: "ERR wrong number of arguments for 'incr' command"}
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'llen' command"}
 	}
-
 	key := args[0].bulk
+	value, err := ds_llen(c.db, key)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
 
-	value := ds_incr(key)
+	return Value{typ: "integer", num: value}
+}
+func rpop(c *Client, args []Value) Value { // works
+	return popGeneric(c, args, "rpop", false)
+}
+
+func rpush(c *Client, args []Value) Value { // works
+	return pushGeneric(c, args, "rpush", false, false)
+}
+func lpop(c *Client, args []Value) Value { // works
+	return popGeneric(c, args, "lpop", true)
+}
+func lpush(c *Client, args []Value) Value { // works
+	return pushGeneric(c, args, "lpush", true, false)
+}
 
-	return Value{typ: "string", str: value}
+func lpushx(c *Client, args []Value) Value {
+	return pushGeneric(c, args, "lpushx", true, true)
 }
 
-func set(args []Value) Value { //works
-	if len(args) != 2 {
-		return Value{typ: "error", str: "ERR wrong number of arguments for 'set' command"}
+func rpushx(c *Client, args []Value) Value {
+	return pushGeneric(c, args, "rpushx", false, true)
+}
+
+// pushGeneric implements LPUSH, RPUSH, LPUSHX and RPUSHX
+func pushGeneric(c *Client, args []Value, name string, head bool, onlyIfExists bool) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", name)}
+	}
+	key := args[0].bulk
+	values := make([]string, 0)
+	for i := 1; i < len(args); i++ {
+		values = append(values, args[i].bulk)
 	}
+	length, err := ds_push(c.db, key, values, head, onlyIfExists)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: length}
+}
 
+// popGeneric implements LPOP and RPOP
+// without a count a single bulk is returned, with a count an array is returned
+func popGeneric(c *Client, args []Value, name string, head bool) Value {
+	if len(args) != 1 && len(args) != 2 {
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", name)}
+	}
 	key := args[0].bulk
-	value := args[1].bulk
+	if len(args) == 1 {
+		values, ok, err := ds_pop(c.db, key, 1, head)
+		if err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+		if !ok {
+			return Value{typ: "null"}
+		}
+		return Value{typ: "bulk", bulk: values[0]}
+	}
 
-	ds_set(key, value)
+	count, err := strconv.ParseInt(args[1].bulk, 10, 64)
+	if err != nil || count < 0 {
+		return Value{typ: "error", str: "ERR value is out of range, must be positive"}
+	}
+	values, ok, err := ds_pop(c.db, key, int(count), head)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if !ok {
+		return Value{typ: "nullarray"}
+	}
+	return bulkArray(values)
+}
 
+func lset(c *Client, args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'lset' command"}
+	}
+	key := args[0].bulk
+	index, err := strconv.ParseInt(args[1].bulk, 10, 64)
+	if err != nil {
+		return Value{typ: "error", str: ErrNotInteger.Error()}
+	}
+	if err := ds_lset(c.db, key, index, args[2].bulk); err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
 	return Value{typ: "string", str: "OK"}
 }
 
-func get(args []Value) Value { //works
-	if len(args) != 1 {
-		return Value{typ: "error", str: "ERR wrong number of arguments for 'get' command"}
+func linsert(c *Client, args []Value) Value {
+	if len(args) != 4 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'linsert' command"}
 	}
-
 	key := args[0].bulk
-
-	value, ok := ds_get(key)
-
-	if !ok {
-		return Value{typ: "null"}
+	var before bool
+	switch strings.ToUpper(args[1].bulk) {
+	case "BEFORE":
+		before = true
+	case "AFTER":
+		before = false
+	default:
+		return Value{typ: "error", str: "ERR syntax error"}
+	}
+	length, err := ds_linsert(c.db, key, before, args[2].bulk, args[3].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
 	}
+	return Value{typ: "integer", num: length}
+}
 
-	return Value{typ: "bulk", bulk: value}
+func lrem(c *Client, args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'lrem' command"}
+	}
+	key := args[0].bulk
+	count, err := strconv.ParseInt(args[1].bulk, 10, 64)
+	if err != nil {
+		return Value{typ: "error", str: ErrNotInteger.Error()}
+	}
+	removed, err := ds_lrem(c.db, key, count, args[2].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: removed}
 }
 
-func hset(args []Value) Value { // works
+func ltrim(c *Client, args []Value) Value {
 	if len(args) != 3 {
-		return Value{typ: "error", str: "ERR wrong number of arguments for 'hset' command"}
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'ltrim' command"}
+	}
+	key := args[0].bulk
+	start, err1 := strconv.ParseInt(args[1].bulk, 10, 64)
+	stop, err2 := strconv.ParseInt(args[2].bulk, 10, 64)
+	if err1 != nil || err2 != nil {
+		return Value{typ: "error", str: ErrNotInteger.Error()}
+	}
+	if err := ds_ltrim(c.db, key, start, stop); err != nil {
+		return Value{typ: "error", str: err.Error()}
 	}
+	return Value{typ: "string", str: "OK"}
+}
 
-	hash := args[0].bulk
-	key := args[1].bulk
-	value := args[2].bulk
+// LPOS key element [RANK rank] [COUNT num-matches] [MAXLEN len]
+func lpos(c *Client, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'lpos' command"}
+	}
+	key := args[0].bulk
+	element := args[1].bulk
+	var rank int64 = 1
+	var count int64 = 0
+	var maxlen int64 = 0
+	withCount := false
+	for i := 2; i < len(args); i++ {
+		option := strings.ToUpper(args[i].bulk)
+		if (option != "RANK" && option != "COUNT" && option != "MAXLEN") || i+1 >= len(args) {
+			return Value{typ: "error", str: "ERR syntax error"}
+		}
+		num, err := strconv.ParseInt(args[i+1].bulk, 10, 64)
+		if err != nil {
+			return Value{typ: "error", str: ErrNotInteger.Error()}
+		}
+		i++
+		switch option {
+		case "RANK":
+			if num == 0 {
+				return Value{typ: "error", str: "ERR RANK can't be zero: use 1 to start from the first match, 2 from the second ... or use negative to start from the end of the list"}
+			}
+			if num == math.MinInt64 {
+				return Value{typ: "error", str: "ERR value is out of range"}
+			}
+			rank = num
+		case "COUNT":
+			if num < 0 {
+				return Value{typ: "error", str: "ERR COUNT can't be negative"}
+			}
+			count = num
+			withCount = true
+		case "MAXLEN":
+			if num < 0 {
+				return Value{typ: "error", str: "ERR MAXLEN can't be negative"}
+			}
+			maxlen = num
+		}
+	}
 
-	ds_hset(hash, key, value)
-	return Value{typ: "string", str: "OK"}
+	if !withCount {
+		count = 1
+	}
+	matches, err := ds_lpos(c.db, key, element, rank, count, maxlen)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if !withCount {
+		if len(matches) == 0 {
+			return Value{typ: "null"}
+		}
+		return Value{typ: "integer", num: matches[0]}
+	}
+	array := make([]Value, 0, len(matches))
+	for _, index := range matches {
+		array = append(array, Value{typ: "integer", num: index})
+	}
+	return Value{typ: "array", array: array}
 }
 
-func hget(args []Value) Value { // works
-	if len(args) != 2 {
-		return Value{typ: "error", str: "ERR wrong number of arguments for 'hget' command"}
+// parseListEnd parses the LEFT and RIGHT arguments of LMOVE and LMPOP
+// it returns true for LEFT, the head of the list
+func parseListEnd(arg string) (bool, error) {
+	switch strings.ToUpper(arg) {
+	case "LEFT":
+		return true, nil
+	case "RIGHT":
+		return false, nil
 	}
+	return false, errors.New("ERR syntax error")
+}
 
-	hash := args[0].bulk
-	key := args[1].bulk
+// LMOVE source destination LEFT|RIGHT LEFT|RIGHT
+func lmove(c *Client, args []Value) Value {
+	if len(args) != 4 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'lmove' command"}
+	}
+	fromHead, err := parseListEnd(args[2].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	toHead, err := parseListEnd(args[3].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return lmoveGeneric(c, args[0].bulk, args[1].bulk, fromHead, toHead)
+}
 
-	value, ok := ds_hget(hash, key)
+func rpoplpush(c *Client, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'rpoplpush' command"}
+	}
+	return lmoveGeneric(c, args[0].bulk, args[1].bulk, false, true)
+}
 
+func lmoveGeneric(c *Client, source string, destination string, fromHead bool, toHead bool) Value {
+	value, ok, err := ds_lmove(c.db, source, destination, fromHead, toHead)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
 	if !ok {
 		return Value{typ: "null"}
 	}
-
 	return Value{typ: "bulk", bulk: value}
 }
 
-func hgetall(args []Value) Value { // works
-	if len(args) != 1 {
-		return Value{typ: "error", str: "ERR wrong number of arguments for 'hgetall' command"}
+// mpopArgs holds the parsed arguments of LMPOP like commands
+type mpopArgs struct {
+	keys  []string
+	where string
+	count int64
+}
+
+// parseMpopArgs parses numkeys key [key ...] <where> [COUNT count]
+// where is validated by the caller as it differs between LMPOP and ZMPOP
+func parseMpopArgs(args []Value) (mpopArgs, error) {
+	parsed := mpopArgs{count: 1}
+	numkeys, err := strconv.ParseInt(args[0].bulk, 10, 64)
+	if err != nil {
+		return parsed, ErrNotInteger
+	}
+	if numkeys <= 0 {
+		return parsed, errors.New("ERR numkeys should be greater than 0")
+	}
+	if numkeys > int64(len(args)-2) {
+		return parsed, errors.New("ERR syntax error")
+	}
+	for i := 1; i <= int(numkeys); i++ {
+		parsed.keys = append(parsed.keys, args[i].bulk)
+	}
+	rest := args[numkeys+1:]
+	parsed.where = strings.ToUpper(rest[0].bulk)
+	rest = rest[1:]
+	if len(rest) == 0 {
+		return parsed, nil
 	}
+	if len(rest) != 2 || strings.ToUpper(rest[0].bulk) != "COUNT" {
+		return parsed, errors.New("ERR syntax error")
+	}
+	parsed.count, err = strconv.ParseInt(rest[1].bulk, 10, 64)
+	if err != nil || parsed.count <= 0 {
+		return parsed, errors.New("ERR count should be greater than 0")
+	}
+	return parsed, nil
+}
 
-	hash := args[0].bulk
+// LMPOP numkeys key [key ...] LEFT|RIGHT [COUNT count]
+func lmpop(c *Client, args []Value) Value {
+	if len(args) < 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'lmpop' command"}
+	}
+	parsed, err := parseMpopArgs(args)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	head, err := parseListEnd(parsed.where)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	key, values, ok, err := ds_mpop(c.db, parsed.keys, int(parsed.count), head)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if !ok {
+		c.preventPropagation()
+		return Value{typ: "nullarray"}
+	}
+	// only the list which was popped matters when replaying the AOF
+	pop := "RPOP"
+	if head {
+		pop = "LPOP"
+	}
+	c.rewriteCommand(pop, key, strconv.Itoa(len(values)))
+	return Value{typ: "array", array: []Value{{typ: "bulk", bulk: key}, bulkArray(values)}}
+}
+
+func blpop(c *Client, args []Value) Value {
+	return bpopGeneric(c, args, "blpop", true)
+}
 
-	HSETsMu.RLock()
-	value, ok := HSETs[hash]
-	HSETsMu.RUnlock()
+func brpop(c *Client, args []Value) Value {
+	return bpopGeneric(c, args, "brpop", false)
+}
 
-	if !ok {
-		return Value{typ: "null"}
+// BLPOP key [key ...] timeout
+func bpopGeneric(c *Client, args []Value, name string, head bool) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", name)}
+	}
+	timeout, err := parseTimeout(args[len(args)-1].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	keys := make([]string, 0, len(args)-1)
+	for _, arg := range args[:len(args)-1] {
+		keys = append(keys, arg.bulk)
 	}
+	return blockForKeys(c, keys, timeout, Value{typ: "nullarray"}, serveListPop(c.db, head, 0))
+}
 
-	values := []Value{}
-	for k, v := range value {
-		values = append(values, Value{typ: "bulk", bulk: k})
-		values = append(values, Value{typ: "bulk", bulk: v})
+// BLMOVE source destination LEFT|RIGHT LEFT|RIGHT timeout
+func blmove(c *Client, args []Value) Value {
+	if len(args) != 5 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'blmove' command"}
+	}
+	fromHead, err := parseListEnd(args[2].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	toHead, err := parseListEnd(args[3].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	timeout, err := parseTimeout(args[4].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
 	}
+	serve := serveListMove(c.db, args[1].bulk, fromHead, toHead)
+	return blockForKeys(c, []string{args[0].bulk}, timeout, Value{typ: "null"}, serve)
+}
 
-	return Value{typ: "array", array: values}
+// BRPOPLPUSH source destination timeout
+func brpoplpush(c *Client, args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'brpoplpush' command"}
+	}
+	timeout, err := parseTimeout(args[2].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	serve := serveListMove(c.db, args[1].bulk, false, true)
+	return blockForKeys(c, []string{args[0].bulk}, timeout, Value{typ: "null"}, serve)
+}
+
+// BLMPOP timeout numkeys key [key ...] LEFT|RIGHT [COUNT count]
+func blmpop(c *Client, args []Value) Value {
+	if len(args) < 4 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'blmpop' command"}
+	}
+	timeout, err := parseTimeout(args[0].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	parsed, err := parseMpopArgs(args[1:])
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	head, err := parseListEnd(parsed.where)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return blockForKeys(c, parsed.keys, timeout, Value{typ: "nullarray"}, serveListPop(c.db, head, int(parsed.count)))
+}
+
+func mget(c *Client, args []Value) Value {
+	if len(args) == 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'mget' command"}
+	}
+
+	keys := make([]string, 0)
+	for i := 0; i < len(args); i++ {
+		keys = append(keys, args[i].bulk)
+	}
+	value, found := ds_mget(c.db, keys)
+	values := []Value{}
+	for i, v := range value {
+		if !found[i] {
+			values = append(values, Value{typ: "null"})
+			continue
+		}
+		values = append(values, Value{typ: "bulk", bulk: v})
+	}
+	return Value{typ: "array", array: values}
+}
+func incrby(c *Client, args []Value) Value { // works
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'incrby' command"}
+	}
+
+	key := args[0].bulk
+	increment := args[1].bulk
+	incr, err := strconv.ParseInt(increment, 10, 64)
+	if err != nil {
+		return Value{typ: "error", str: ErrNotInteger.Error()}
+	}
+	value, err := ds_incrby(c.db, key, incr)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	return Value{typ: "integer", num: value}
+}
+func incr(c *Client, args []Value) Value { // works
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'incr' command"}
+	}
+
+	key := args[0].bulk
+
+	value, err := ds_incr(c.db, key)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	return Value{typ: "integer", num: value}
+}
+
+// DECRBY key decrement
+func decrby(c *Client, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'decrby' command"}
+	}
+	decrement, err := strconv.ParseInt(args[1].bulk, 10, 64)
+	if err != nil {
+		return Value{typ: "error", str: ErrNotInteger.Error()}
+	}
+	// the decrement can't be negated
+	if decrement == math.MinInt64 {
+		return Value{typ: "error", str: "ERR decrement would overflow"}
+	}
+	value, err := ds_incrby(c.db, args[0].bulk, -decrement)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: value}
+}
+
+// DECR key
+func decr(c *Client, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'decr' command"}
+	}
+	value, err := ds_incrby(c.db, args[0].bulk, -1)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: value}
+}
+
+// INCRBYFLOAT key increment
+func incrbyfloat(c *Client, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'incrbyfloat' command"}
+	}
+	increment, err := parseFloat(args[1].bulk)
+	if err != nil {
+		return Value{typ: "error", str: ErrNotFloat.Error()}
+	}
+	value, err := ds_incrbyfloat(c.db, args[0].bulk, increment)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	// the result is logged instead of the increment so that replaying
+	// the aof does not depend on how floats are rounded
+	c.rewriteCommand("SET", args[0].bulk, value, "KEEPTTL")
+	return Value{typ: "bulk", bulk: value}
+}
+
+// APPEND key value
+func appendCommand(c *Client, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'append' command"}
+	}
+	length, err := ds_append(c.db, args[0].bulk, args[1].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: length}
+}
+
+// STRLEN key
+func strlen(c *Client, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'strlen' command"}
+	}
+	length, err := ds_strlen(c.db, args[0].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: length}
+}
+
+// GETRANGE key start end
+func getrange(c *Client, args []Value) Value {
+	return getrangeGeneric(c, args, "getrange")
+}
+
+// SUBSTR key start end is the old name of GETRANGE
+func substr(c *Client, args []Value) Value {
+	return getrangeGeneric(c, args, "substr")
+}
+
+func getrangeGeneric(c *Client, args []Value, name string) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", name)}
+	}
+	start, err := strconv.ParseInt(args[1].bulk, 10, 64)
+	if err != nil {
+		return Value{typ: "error", str: ErrNotInteger.Error()}
+	}
+	end, err := strconv.ParseInt(args[2].bulk, 10, 64)
+	if err != nil {
+		return Value{typ: "error", str: ErrNotInteger.Error()}
+	}
+	value, err := ds_getrange(c.db, args[0].bulk, start, end)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "bulk", bulk: value}
+}
+
+// SETRANGE key offset value
+func setrange(c *Client, args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'setrange' command"}
+	}
+	offset, err := strconv.ParseInt(args[1].bulk, 10, 64)
+	if err != nil {
+		return Value{typ: "error", str: ErrNotInteger.Error()}
+	}
+	if offset < 0 {
+		return Value{typ: "error", str: ErrOffsetOutOfRange.Error()}
+	}
+	length, changed, err := ds_setrange(c.db, args[0].bulk, offset, args[2].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if !changed {
+		c.preventPropagation()
+	}
+	return Value{typ: "integer", num: length}
+}
+
+// MSET key value [key value ...]
+func mset(c *Client, args []Value) Value {
+	if len(args) < 2 || len(args)%2 != 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'mset' command"}
+	}
+	keys, values := splitKeyValues(args)
+	ds_mset(c.db, keys, values, false)
+	return Value{typ: "string", str: "OK"}
+}
+
+// MSETNX key value [key value ...]
+func msetnx(c *Client, args []Value) Value {
+	if len(args) < 2 || len(args)%2 != 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'msetnx' command"}
+	}
+	keys, values := splitKeyValues(args)
+	if !ds_mset(c.db, keys, values, true) {
+		c.preventPropagation()
+		return Value{typ: "integer", num: 0}
+	}
+	return Value{typ: "integer", num: 1}
+}
+
+// splitKeyValues splits the key value pairs of MSET
+func splitKeyValues(args []Value) (keys []string, values []string) {
+	for i := 0; i+1 < len(args); i += 2 {
+		keys = append(keys, args[i].bulk)
+		values = append(values, args[i+1].bulk)
+	}
+	return keys, values
+}
+
+// LCS key1 key2 [LEN] [IDX] [MINMATCHLEN min-match-len] [WITHMATCHLEN]
+func lcs(c *Client, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'lcs' command"}
+	}
+	var getLen, getIdx, withMatchLen bool
+	minMatchLen := int64(0)
+	for i := 2; i < len(args); i++ {
+		switch option := strings.ToUpper(args[i].bulk); {
+		case option == "LEN":
+			getLen = true
+		case option == "IDX":
+			getIdx = true
+		case option == "WITHMATCHLEN":
+			withMatchLen = true
+		case option == "MINMATCHLEN" && i+1 < len(args):
+			var err error
+			minMatchLen, err = strconv.ParseInt(args[i+1].bulk, 10, 64)
+			if err != nil {
+				return Value{typ: "error", str: ErrNotInteger.Error()}
+			}
+			minMatchLen = max(minMatchLen, 0)
+			i++
+		default:
+			return Value{typ: "error", str: "ERR syntax error"}
+		}
+	}
+	if getLen && getIdx {
+		return Value{typ: "error", str: "ERR If you want both the length and indexes, please just use IDX."}
+	}
+	result, matches, err := ds_lcs(c.db, args[0].bulk, args[1].bulk, getIdx, int(min(minMatchLen, math.MaxInt32)))
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if getLen {
+		return Value{typ: "integer", num: int64(len(result))}
+	}
+	if !getIdx {
+		return Value{typ: "bulk", bulk: result}
+	}
+	array := make([]Value, 0, len(matches))
+	for _, match := range matches {
+		rangeValue := func(r [2]int) Value {
+			return Value{typ: "array", array: []Value{{typ: "integer", num: int64(r[0])}, {typ: "integer", num: int64(r[1])}}}
+		}
+		entry := []Value{rangeValue(match.a), rangeValue(match.b)}
+		if withMatchLen {
+			entry = append(entry, Value{typ: "integer", num: int64(match.length)})
+		}
+		array = append(array, Value{typ: "array", array: entry})
+	}
+	return Value{typ: "map", array: []Value{
+		{typ: "bulk", bulk: "matches"}, {typ: "array", array: array},
+		{typ: "bulk", bulk: "len"}, {typ: "integer", num: int64(len(result))},
+	}}
+}
+
+// SET key value [NX | XX] [GET] [EX seconds | PX milliseconds |
+// EXAT unix-time-seconds | PXAT unix-time-milliseconds | KEEPTTL]
+func set(c *Client, args []Value) Value { //works
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'set' command"}
+	}
+
+	key := args[0].bulk
+	value := args[1].bulk
+
+	opts, err := parseSetOptions(args[2:], "set", false)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	return setGeneric(c, key, value, opts)
+}
+
+// setGeneric runs SET and replies the way SET does, it is shared by
+// all the commands which are just a special case of SET
+func setGeneric(c *Client, key string, value string, opts setOptions) Value {
+	old, oldExists, updated, err := ds_setGeneric(c.db, key, value, opts)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	// the aof gets a plain SET with an absolute expire time
+	if updated {
+		aofArgs := []string{"SET", key, value}
+		if opts.expireAt != -1 {
+			aofArgs = append(aofArgs, "PXAT", strconv.FormatInt(opts.expireAt, 10))
+		} else if opts.keepTTL {
+			aofArgs = append(aofArgs, "KEEPTTL")
+		}
+		c.rewriteCommand(aofArgs...)
+	} else {
+		c.preventPropagation()
+	}
+
+	if opts.get {
+		if !oldExists {
+			return Value{typ: "null"}
+		}
+		return Value{typ: "bulk", bulk: old}
+	}
+	if !updated {
+		return Value{typ: "null"}
+	}
+	return Value{typ: "string", str: "OK"}
+}
+
+// parseSetOptions parses the options of SET, or the ones of GETEX when getex is set
+// Expire times are converted to an absolute unix time in milliseconds
+func parseSetOptions(args []Value, name string, getex bool) (setOptions, error) {
+	opts := setOptions{expireAt: -1}
+	expireOptions := 0
+	for i := 0; i < len(args); i++ {
+		option := strings.ToUpper(args[i].bulk)
+		switch {
+		case option == "NX" && !getex:
+			opts.nx = true
+		case option == "XX" && !getex:
+			opts.xx = true
+		case option == "GET" && !getex:
+			opts.get = true
+		case option == "KEEPTTL" && !getex:
+			opts.keepTTL = true
+			expireOptions++
+		case option == "PERSIST" && getex:
+			opts.persist = true
+			expireOptions++
+		case option == "EX" || option == "PX" || option == "EXAT" || option == "PXAT":
+			if i+1 >= len(args) {
+				return opts, errors.New("ERR syntax error")
+			}
+			when, err := strconv.ParseInt(args[i+1].bulk, 10, 64)
+			if err != nil {
+				return opts, ErrNotInteger
+			}
+			when, err = toExpireAt(when, option, name)
+			if err != nil {
+				return opts, err
+			}
+			opts.expireAt = when
+			expireOptions++
+			i++
+		default:
+			return opts, errors.New("ERR syntax error")
+		}
+	}
+	if (opts.nx && opts.xx) || expireOptions > 1 {
+		return opts, errors.New("ERR syntax error")
+	}
+	return opts, nil
+}
+
+// toExpireAt converts the time given to one of the EX, PX, EXAT or PXAT
+// options into a unix time in milliseconds
+func toExpireAt(when int64, option string, name string) (int64, error) {
+	invalidExpireTime := fmt.Errorf("ERR invalid expire time in '%s' command", name)
+	if when <= 0 {
+		return 0, invalidExpireTime
+	}
+	if option == "EX" || option == "EXAT" {
+		if when > math.MaxInt64/1000 {
+			return 0, invalidExpireTime
+		}
+		when *= 1000
+	}
+	if option == "EX" || option == "PX" {
+		if when > math.MaxInt64-mstime() {
+			return 0, invalidExpireTime
+		}
+		when += mstime()
+	}
+	return when, nil
+}
+
+// SETNX key value
+func setnx(c *Client, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'setnx' command"}
+	}
+	reply := setGeneric(c, args[0].bulk, args[1].bulk, setOptions{nx: true, expireAt: -1})
+	if reply.typ == "null" {
+		return Value{typ: "integer", num: 0}
+	}
+	return Value{typ: "integer", num: 1}
+}
+
+// SETEX key seconds value
+func setex(c *Client, args []Value) Value {
+	return setexGeneric(c, args, "setex", "EX")
+}
+
+// PSETEX key milliseconds value
+func psetex(c *Client, args []Value) Value {
+	return setexGeneric(c, args, "psetex", "PX")
+}
+
+func setexGeneric(c *Client, args []Value, name string, option string) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", name)}
+	}
+	when, err := strconv.ParseInt(args[1].bulk, 10, 64)
+	if err != nil {
+		return Value{typ: "error", str: ErrNotInteger.Error()}
+	}
+	when, err = toExpireAt(when, option, name)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return setGeneric(c, args[0].bulk, args[2].bulk, setOptions{expireAt: when})
+}
+
+// GETSET key value
+func getset(c *Client, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'getset' command"}
+	}
+	return setGeneric(c, args[0].bulk, args[1].bulk, setOptions{get: true, expireAt: -1})
+}
+
+// GETDEL key
+func getdel(c *Client, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'getdel' command"}
+	}
+	value, ok, err := ds_getdel(c.db, args[0].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if !ok {
+		c.preventPropagation()
+		return Value{typ: "null"}
+	}
+	c.rewriteCommand("DEL", args[0].bulk)
+	return Value{typ: "bulk", bulk: value}
+}
+
+// GETEX key [EX seconds | PX milliseconds | EXAT unix-time-seconds |
+// PXAT unix-time-milliseconds | PERSIST]
+func getex(c *Client, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'getex' command"}
+	}
+	key := args[0].bulk
+	opts, err := parseSetOptions(args[1:], "getex", true)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	value, ok, err := ds_getex(c.db, key, opts)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if !ok {
+		c.preventPropagation()
+		return Value{typ: "null"}
+	}
+
+	switch {
+	case opts.persist:
+		c.rewriteCommand("PERSIST", key)
+	case opts.expireAt != -1 && opts.expireAt <= mstime():
+		c.rewriteCommand("DEL", key)
+	case opts.expireAt != -1:
+		c.rewriteCommand("PEXPIREAT", key, strconv.FormatInt(opts.expireAt, 10))
+	default:
+		// without options GETEX is just a GET
+		c.preventPropagation()
+	}
+	return Value{typ: "bulk", bulk: value}
+}
+
+func get(c *Client, args []Value) Value { //works
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'get' command"}
+	}
+
+	key := args[0].bulk
+
+	value, ok, err := ds_get(c.db, key)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	if !ok {
+		return Value{typ: "null"}
+	}
+
+	return Value{typ: "bulk", bulk: value}
+}
+
+// HSET key field value [field value ...]
+func hset(c *Client, args []Value) Value { // works
+	if len(args) < 3 || len(args)%2 == 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'hset' command"}
+	}
+	added, err := ds_hset(c.db, args[0].bulk, parseHashElements(args[1:]), false)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: added}
+}
+
+// HMSET is the older form of HSET which replies OK
+func hmset(c *Client, args []Value) Value {
+	if len(args) < 3 || len(args)%2 == 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'hmset' command"}
+	}
+	_, err := ds_hset(c.db, args[0].bulk, parseHashElements(args[1:]), false)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "string", str: "OK"}
+}
+
+func hsetnx(c *Client, args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'hsetnx' command"}
+	}
+	added, err := ds_hset(c.db, args[0].bulk, parseHashElements(args[1:]), true)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if added == 0 {
+		c.preventPropagation()
+	}
+	return Value{typ: "integer", num: added}
+}
+
+// parseHashElements turns field value pairs into hash elements
+func parseHashElements(args []Value) []HashElement {
+	elements := make([]HashElement, 0, len(args)/2)
+	for i := 0; i+1 < len(args); i += 2 {
+		elements = append(elements, HashElement{key: args[i].bulk, value: args[i+1].bulk})
+	}
+	return elements
+}
+
+func hdel(c *Client, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'hdel' command"}
+	}
+	fields := make([]string, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		fields = append(fields, arg.bulk)
+	}
+	removed, err := ds_hdel(c.db, args[0].bulk, fields)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if removed == 0 {
+		c.preventPropagation()
+	}
+	return Value{typ: "integer", num: removed}
+}
+
+func hexists(c *Client, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'hexists' command"}
+	}
+	_, ok, err := ds_hget(c.db, args[0].bulk, args[1].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if !ok {
+		return Value{typ: "integer", num: 0}
+	}
+	return Value{typ: "integer", num: 1}
+}
+
+func hlen(c *Client, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'hlen' command"}
+	}
+	length, err := ds_hlen(c.db, args[0].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: length}
+}
+
+func hstrlen(c *Client, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'hstrlen' command"}
+	}
+	value, _, err := ds_hget(c.db, args[0].bulk, args[1].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: int64(len(value))}
+}
+
+func hkeys(c *Client, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'hkeys' command"}
+	}
+	members, err := ds_hgetall(c.db, args[0].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	keys := make([]string, 0, len(members))
+	for _, member := range members {
+		keys = append(keys, member.key)
+	}
+	return bulkArray(keys)
+}
+
+func hvals(c *Client, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'hvals' command"}
+	}
+	members, err := ds_hgetall(c.db, args[0].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	values := make([]string, 0, len(members))
+	for _, member := range members {
+		values = append(values, member.value)
+	}
+	return bulkArray(values)
+}
+
+func hmget(c *Client, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'hmget' command"}
+	}
+	fields := make([]string, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		fields = append(fields, arg.bulk)
+	}
+	values, found, err := ds_hmget(c.db, args[0].bulk, fields)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	array := make([]Value, 0, len(values))
+	for i, value := range values {
+		if !found[i] {
+			array = append(array, Value{typ: "null"})
+			continue
+		}
+		array = append(array, Value{typ: "bulk", bulk: value})
+	}
+	return Value{typ: "array", array: array}
+}
+
+func hincrby(c *Client, args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'hincrby' command"}
+	}
+	incr, err := strconv.ParseInt(args[2].bulk, 10, 64)
+	if err != nil {
+		return Value{typ: "error", str: ErrNotInteger.Error()}
+	}
+	num, err := ds_hincrby(c.db, args[0].bulk, args[1].bulk, incr)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: num}
+}
+
+func hincrbyfloat(c *Client, args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'hincrbyfloat' command"}
+	}
+	incr, err := parseFloat(args[2].bulk)
+	if err != nil || math.IsInf(incr, 0) {
+		return Value{typ: "error", str: "ERR value is not a valid float"}
+	}
+	value, when, err := ds_hincrbyfloat(c.db, args[0].bulk, args[1].bulk, incr)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	// the result is logged instead of the increment so that replaying the aof
+	// does not depend on how floats are rounded, HSET discards the time to live
+	// of the field so it is logged again
+	c.rewriteCommand("HSET", args[0].bulk, args[1].bulk, value)
+	if when != -1 {
+		c.alsoPropagate("HPEXPIREAT", args[0].bulk, strconv.FormatInt(when, 10), "FIELDS", "1", args[1].bulk)
+	}
+	return Value{typ: "bulk", bulk: value}
+}
+
+// HRANDFIELD key [count [WITHVALUES]]
+func hrandfield(c *Client, args []Value) Value {
+	if len(args) < 1 || len(args) > 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'hrandfield' command"}
+	}
+	key := args[0].bulk
+	if len(args) == 1 {
+		members, err := ds_hrandfield(c.db, key, 1)
+		if err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+		if len(members) == 0 {
+			return Value{typ: "null"}
+		}
+		return Value{typ: "bulk", bulk: members[0].key}
+	}
+
+	count, err := strconv.ParseInt(args[1].bulk, 10, 64)
+	if err != nil {
+		return Value{typ: "error", str: ErrNotInteger.Error()}
+	}
+	withValues := false
+	if len(args) == 3 {
+		if strings.ToUpper(args[2].bulk) != "WITHVALUES" {
+			return Value{typ: "error", str: "ERR syntax error"}
+		}
+		withValues = true
+	}
+	if count < -math.MaxInt64/2 || (withValues && count > math.MaxInt64/2) {
+		return Value{typ: "error", str: "ERR value is out of range"}
+	}
+	members, err := ds_hrandfield(c.db, key, count)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	array := make([]Value, 0, len(members))
+	for _, member := range members {
+		field := Value{typ: "bulk", bulk: member.key}
+		if !withValues {
+			array = append(array, field)
+			continue
+		}
+		value := Value{typ: "bulk", bulk: member.value}
+		// RESP3 clients get every field paired with its value
+		if c.writer.proto == 3 {
+			array = append(array, Value{typ: "array", array: []Value{field, value}})
+		} else {
+			array = append(array, field, value)
+		}
+	}
+	return Value{typ: "array", array: array}
+}
+
+func hget(c *Client, args []Value) Value { // works
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'hget' command"}
+	}
+
+	hash := args[0].bulk
+	key := args[1].bulk
+
+	value, ok, err := ds_hget(c.db, hash, key)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	if !ok {
+		return Value{typ: "null"}
+	}
+
+	return Value{typ: "bulk", bulk: value}
+}
+
+func hgetall(c *Client, args []Value) Value { // works
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'hgetall' command"}
+	}
+
+	hash := args[0].bulk
+
+	members, err := ds_hgetall(c.db, hash)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	// RESP3 clients get a real map reply, the Writer sends it as a flat
+	// array of fields and values to RESP2 clients
+	values := []Value{}
+	for _, member := range members {
+		values = append(values, Value{typ: "bulk", bulk: member.key})
+		values = append(values, Value{typ: "bulk", bulk: member.value})
+	}
+
+	return Value{typ: "map", array: values}
+}
+
+// Hash field expiration commands
+
+// the largest expire time accepted for hash fields, like in redis it fits in 48 bits
+const hashFieldExpireMax = 1<<48 - 1
+
+var ErrInvalidHashFieldExpire = fmt.Errorf("ERR invalid expire time, must be >= 0 and <= %d", int64(hashFieldExpireMax))
+
+// parseFieldsArg parses FIELDS numfields field [field ...] which ends all
+// the hash field expiration commands
+func parseFieldsArg(args []Value) ([]string, error) {
+	if len(args) < 2 || strings.ToUpper(args[0].bulk) != "FIELDS" {
+		return nil, errors.New("ERR Mandatory argument FIELDS is missing or not at the right position")
+	}
+	numFields, err := strconv.ParseInt(args[1].bulk, 10, 64)
+	if err != nil || numFields <= 0 {
+		return nil, errors.New("ERR Parameter `numFields` should be greater than 0")
+	}
+	if numFields != int64(len(args)-2) {
+		return nil, errors.New("ERR The `numfields` parameter must match the number of arguments")
+	}
+	fields := make([]string, 0, numFields)
+	for _, arg := range args[2:] {
+		fields = append(fields, arg.bulk)
+	}
+	return fields, nil
+}
+
+// integerArray builds an array reply made of integers
+func integerArray(nums []int64) Value {
+	array := make([]Value, 0, len(nums))
+	for _, num := range nums {
+		array = append(array, Value{typ: "integer", num: num})
+	}
+	return Value{typ: "array", array: array}
+}
+
+// fieldsWithResult returns the fields whose result is the given one
+func fieldsWithResult(fields []string, results []int64, result int64) []string {
+	matching := []string{}
+	for i, field := range fields {
+		if results[i] == result {
+			matching = append(matching, field)
+		}
+	}
+	return matching
+}
+
+// HEXPIRE key seconds [NX|XX|GT|LT] FIELDS numfields field [field ...]
+func hexpire(c *Client, args []Value) Value {
+	return hexpireGeneric(c, args, "hexpire", mstime(), time.Second)
+}
+
+// HPEXPIRE key milliseconds [NX|XX|GT|LT] FIELDS numfields field [field ...]
+func hpexpire(c *Client, args []Value) Value {
+	return hexpireGeneric(c, args, "hpexpire", mstime(), time.Millisecond)
+}
+
+// HEXPIREAT key unix-time-seconds [NX|XX|GT|LT] FIELDS numfields field [field ...]
+func hexpireat(c *Client, args []Value) Value {
+	return hexpireGeneric(c, args, "hexpireat", 0, time.Second)
+}
+
+// HPEXPIREAT key unix-time-milliseconds [NX|XX|GT|LT] FIELDS numfields field [field ...]
+func hpexpireat(c *Client, args []Value) Value {
+	return hexpireGeneric(c, args, "hpexpireat", 0, time.Millisecond)
+}
+
+// hexpireGeneric implements the HEXPIRE family, the time given is added
+// to basetime after being converted to milliseconds
+func hexpireGeneric(c *Client, args []Value, name string, basetime int64, unit time.Duration) Value {
+	if len(args) < 4 {
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", name)}
+	}
+	key := args[0].bulk
+	when, err := strconv.ParseInt(args[1].bulk, 10, 64)
+	if err != nil {
+		return Value{typ: "error", str: ErrNotInteger.Error()}
+	}
+	if when < 0 || when > hashFieldExpireMax {
+		return Value{typ: "error", str: ErrInvalidHashFieldExpire.Error()}
+	}
+	if unit == time.Second {
+		when *= 1000
+	}
+	when += basetime
+	if when > hashFieldExpireMax {
+		return Value{typ: "error", str: ErrInvalidHashFieldExpire.Error()}
+	}
+
+	// the condition is optional, FIELDS comes right after the time without it
+	rest := args[2:]
+	flags := expireFlags{}
+	if strings.ToUpper(rest[0].bulk) != "FIELDS" {
+		flags, err = parseExpireFlags(rest[:1])
+		if err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+		rest = rest[1:]
+	}
+	fields, err := parseFieldsArg(rest)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	results, err := ds_hexpire(c.db, key, fields, when, flags)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	// the time is the same for all the fields, so either they were all deleted
+	// or they all got the new expire time
+	if deleted := fieldsWithResult(fields, results, HashFieldDeleted); len(deleted) > 0 {
+		c.rewriteCommand(append([]string{"HDEL", key}, deleted...)...)
+	} else if updated := fieldsWithResult(fields, results, HashFieldUpdated); len(updated) > 0 {
+		aofArgs := []string{"HPEXPIREAT", key, strconv.FormatInt(when, 10), "FIELDS", strconv.Itoa(len(updated))}
+		c.rewriteCommand(append(aofArgs, updated...)...)
+	} else {
+		c.preventPropagation()
+	}
+	return integerArray(results)
+}
+
+// HTTL key FIELDS numfields field [field ...]
+func httl(c *Client, args []Value) Value {
+	return httlGeneric(c, args, "httl", false, false)
+}
+
+// HPTTL key FIELDS numfields field [field ...]
+func hpttl(c *Client, args []Value) Value {
+	return httlGeneric(c, args, "hpttl", true, false)
+}
+
+// HEXPIRETIME key FIELDS numfields field [field ...]
+func hexpiretime(c *Client, args []Value) Value {
+	return httlGeneric(c, args, "hexpiretime", false, true)
+}
+
+// HPEXPIRETIME key FIELDS numfields field [field ...]
+func hpexpiretime(c *Client, args []Value) Value {
+	return httlGeneric(c, args, "hpexpiretime", true, true)
+}
+
+// httlGeneric replies with the remaining time to live of every field, or with
+// the absolute unix time at which it expires
+func httlGeneric(c *Client, args []Value, name string, milliseconds bool, absolute bool) Value {
+	if len(args) < 3 {
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", name)}
+	}
+	fields, err := parseFieldsArg(args[1:])
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	results, err := ds_hpexpiretime(c.db, args[0].bulk, fields)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	now := mstime()
+	for i, when := range results {
+		if when < 0 {
+			continue
+		}
+		switch {
+		case !absolute:
+			when -= now
+			if when < 0 {
+				when = 0
+			}
+			if !milliseconds {
+				// round to the closest second
+				when = (when + 500) / 1000
+			}
+		case !milliseconds:
+			when /= 1000
+		}
+		results[i] = when
+	}
+	return integerArray(results)
+}
+
+// HPERSIST key FIELDS numfields field [field ...]
+func hpersist(c *Client, args []Value) Value {
+	if len(args) < 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'hpersist' command"}
+	}
+	key := args[0].bulk
+	fields, err := parseFieldsArg(args[1:])
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	results, err := ds_hpersist(c.db, key, fields)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if updated := fieldsWithResult(fields, results, HashFieldUpdated); len(updated) > 0 {
+		c.rewriteCommand(append([]string{"HPERSIST", key, "FIELDS", strconv.Itoa(len(updated))}, updated...)...)
+	} else {
+		c.preventPropagation()
+	}
+	return integerArray(results)
+}
+
+// HGETEX key [EX seconds | PX milliseconds | EXAT unix-time-seconds |
+// PXAT unix-time-milliseconds | PERSIST] FIELDS numfields field [field ...]
+func hgetex(c *Client, args []Value) Value {
+	if len(args) < 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'hgetex' command"}
+	}
+	key := args[0].bulk
+	rest := args[1:]
+	var expireAt int64 = 0
+	persist := false
+	switch option := strings.ToUpper(rest[0].bulk); option {
+	case "PERSIST":
+		persist = true
+		rest = rest[1:]
+	case "EX", "PX", "EXAT", "PXAT":
+		if len(rest) < 2 {
+			return Value{typ: "error", str: "ERR syntax error"}
+		}
+		when, err := strconv.ParseInt(rest[1].bulk, 10, 64)
+		if err != nil {
+			return Value{typ: "error", str: ErrNotInteger.Error()}
+		}
+		expireAt, err = toExpireAt(when, option, "hgetex")
+		if err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+		if expireAt > hashFieldExpireMax {
+			return Value{typ: "error", str: ErrInvalidHashFieldExpire.Error()}
+		}
+		rest = rest[2:]
+	}
+	fields, err := parseFieldsArg(rest)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	values, found, err := ds_hgetex(c.db, key, fields, expireAt, persist)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	array := make([]Value, 0, len(values))
+	existing := []string{}
+	for i, value := range values {
+		if !found[i] {
+			array = append(array, Value{typ: "null"})
+			continue
+		}
+		existing = append(existing, fields[i])
+		array = append(array, Value{typ: "bulk", bulk: value})
+	}
+
+	numFields := strconv.Itoa(len(existing))
+	switch {
+	case len(existing) == 0 || (!persist && expireAt == 0):
+		c.preventPropagation()
+	case persist:
+		c.rewriteCommand(append([]string{"HPERSIST", key, "FIELDS", numFields}, existing...)...)
+	case expireAt <= mstime():
+		c.rewriteCommand(append([]string{"HDEL", key}, existing...)...)
+	default:
+		aofArgs := []string{"HPEXPIREAT", key, strconv.FormatInt(expireAt, 10), "FIELDS", numFields}
+		c.rewriteCommand(append(aofArgs, existing...)...)
+	}
+	return Value{typ: "array", array: array}
+}
+
+// Sorted set commands
+
+var ErrNotFloat = errors.New("ERR value is not a valid float")
+
+// parseScore parses a score, unlike other floats scores can be infinite
+func parseScore(arg string) (float64, error) {
+	score, err := parseFloat(arg)
+	if err != nil {
+		return 0, ErrNotFloat
+	}
+	return score, nil
+}
+
+// parseScoreRange parses the min and max of ZCOUNT and ZRANGE BYSCORE,
+// a leading ( excludes the score from the range
+func parseScoreRange(minArg string, maxArg string) (zrangespec, error) {
+	r := zrangespec{}
+	parse := func(arg string) (float64, bool, error) {
+		exclusive := strings.HasPrefix(arg, "(")
+		if exclusive {
+			arg = arg[1:]
+		}
+		score, err := parseFloat(arg)
+		if err != nil {
+			return 0, false, errors.New("ERR min or max is not a float")
+		}
+		return score, exclusive, nil
+	}
+	var err error
+	if r.min, r.minex, err = parse(minArg); err != nil {
+		return r, err
+	}
+	if r.max, r.maxex, err = parse(maxArg); err != nil {
+		return r, err
+	}
+	return r, nil
+}
+
+// parseLexRange parses the min and max of ZRANGE BYLEX, they start with ( for an
+// exclusive bound and [ for an inclusive one, - and + are the infinite bounds
+func parseLexRange(minArg string, maxArg string) (zlexrangespec, error) {
+	r := zlexrangespec{}
+	parse := func(arg string) (zlexBound, error) {
+		switch {
+		case arg == "-":
+			return zlexBound{inf: -1}, nil
+		case arg == "+":
+			return zlexBound{inf: 1}, nil
+		case strings.HasPrefix(arg, "("):
+			return zlexBound{value: arg[1:], exclusive: true}, nil
+		case strings.HasPrefix(arg, "["):
+			return zlexBound{value: arg[1:]}, nil
+		}
+		return zlexBound{}, errors.New("ERR min or max not valid string range item")
+	}
+	var err error
+	if r.min, err = parse(minArg); err != nil {
+		return r, err
+	}
+	if r.max, err = parse(maxArg); err != nil {
+		return r, err
+	}
+	return r, nil
+}
+
+// zsetReply builds the reply of the commands returning sorted set elements
+// RESP3 clients get every member paired with its score
+func zsetReply(c *Client, elements []ZSetElement, withScores bool) Value {
+	array := make([]Value, 0, len(elements))
+	for _, element := range elements {
+		member := Value{typ: "bulk", bulk: element.member}
+		if !withScores {
+			array = append(array, member)
+			continue
+		}
+		score := Value{typ: "double", dbl: element.score}
+		if c.writer.proto == 3 {
+			array = append(array, Value{typ: "array", array: []Value{member, score}})
+		} else {
+			array = append(array, member, score)
+		}
+	}
+	return Value{typ: "array", array: array}
+}
+
+// zsetPairs returns the elements as [member, score] pairs like ZMPOP replies
+func zsetPairs(elements []ZSetElement) Value {
+	array := make([]Value, 0, len(elements))
+	for _, element := range elements {
+		array = append(array, Value{typ: "array", array: []Value{
+			{typ: "bulk", bulk: element.member},
+			{typ: "double", dbl: element.score},
+		}})
+	}
+	return Value{typ: "array", array: array}
+}
+
+// ZADD key [NX|XX] [GT|LT] [CH] [INCR] score member [score member ...]
+func zadd(c *Client, args []Value) Value {
+	if len(args) < 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'zadd' command"}
+	}
+	key := args[0].bulk
+	flags := zaddFlags{}
+	ch := false
+	i := 1
+options:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i].bulk) {
+		case "NX":
+			flags.nx = true
+		case "XX":
+			flags.xx = true
+		case "GT":
+			flags.gt = true
+		case "LT":
+			flags.lt = true
+		case "CH":
+			ch = true
+		case "INCR":
+			flags.incr = true
+		default:
+			break options
+		}
+	}
+	pairs := args[i:]
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return Value{typ: "error", str: "ERR syntax error"}
+	}
+	if flags.incr && len(pairs) > 2 {
+		return Value{typ: "error", str: "ERR INCR option supports a single increment-element pair"}
+	}
+	if flags.nx && flags.xx {
+		return Value{typ: "error", str: "ERR XX and NX options at the same time are not compatible"}
+	}
+	if (flags.gt && flags.nx) || (flags.lt && flags.nx) || (flags.gt && flags.lt) {
+		return Value{typ: "error", str: "ERR GT, LT, and/or NX options at the same time are not compatible"}
+	}
+	elements := make([]ZSetElement, 0, len(pairs)/2)
+	for j := 0; j < len(pairs); j += 2 {
+		score, err := parseScore(pairs[j].bulk)
+		if err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+		elements = append(elements, ZSetElement{member: pairs[j+1].bulk, score: score})
+	}
+
+	added, updated, score, ok, err := ds_zadd(c.db, key, elements, flags)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if flags.incr {
+		if !ok {
+			c.preventPropagation()
+			return Value{typ: "null"}
+		}
+		return Value{typ: "double", dbl: score}
+	}
+	if ch {
+		return Value{typ: "integer", num: added + updated}
+	}
+	return Value{typ: "integer", num: added}
+}
+
+// ZINCRBY key increment member
+func zincrby(c *Client, args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'zincrby' command"}
+	}
+	incr, err := parseScore(args[1].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	elements := []ZSetElement{{member: args[2].bulk, score: incr}}
+	_, _, score, _, err := ds_zadd(c.db, args[0].bulk, elements, zaddFlags{incr: true})
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "double", dbl: score}
+}
+
+func zrem(c *Client, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'zrem' command"}
+	}
+	removed, err := ds_zrem(c.db, args[0].bulk, argsToStrings(args[1:]))
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if removed == 0 {
+		c.preventPropagation()
+	}
+	return Value{typ: "integer", num: removed}
+}
+
+func zscore(c *Client, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'zscore' command"}
+	}
+	score, ok, err := ds_zscore(c.db, args[0].bulk, args[1].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if !ok {
+		return Value{typ: "null"}
+	}
+	return Value{typ: "double", dbl: score}
+}
+
+func zmscore(c *Client, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'zmscore' command"}
+	}
+	scores, found, err := ds_zmscore(c.db, args[0].bulk, argsToStrings(args[1:]))
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	array := make([]Value, 0, len(scores))
+	for i, score := range scores {
+		if !found[i] {
+			array = append(array, Value{typ: "null"})
+			continue
+		}
+		array = append(array, Value{typ: "double", dbl: score})
+	}
+	return Value{typ: "array", array: array}
+}
+
+func zcard(c *Client, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'zcard' command"}
+	}
+	length, err := ds_zcard(c.db, args[0].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: length}
+}
+
+// ZCOUNT key min max
+func zcount(c *Client, args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'zcount' command"}
+	}
+	r, err := parseScoreRange(args[1].bulk, args[2].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	count, err := ds_zcount(c.db, args[0].bulk, r)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: count}
+}
+
+func zrank(c *Client, args []Value) Value {
+	return zrankGeneric(c, args, "zrank", false)
+}
+
+func zrevrank(c *Client, args []Value) Value {
+	return zrankGeneric(c, args, "zrevrank", true)
+}
+
+// ZRANK key member [WITHSCORE]
+func zrankGeneric(c *Client, args []Value, name string, reverse bool) Value {
+	if len(args) != 2 && len(args) != 3 {
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", name)}
+	}
+	withScore := len(args) == 3
+	if withScore && strings.ToUpper(args[2].bulk) != "WITHSCORE" {
+		return Value{typ: "error", str: "ERR syntax error"}
+	}
+	rank, score, ok, err := ds_zrank(c.db, args[0].bulk, args[1].bulk, reverse)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if !withScore {
+		if !ok {
+			return Value{typ: "null"}
+		}
+		return Value{typ: "integer", num: rank}
+	}
+	if !ok {
+		return Value{typ: "nullarray"}
+	}
+	return Value{typ: "array", array: []Value{{typ: "integer", num: rank}, {typ: "double", dbl: score}}}
+}
+
+// ZRANGE key start stop [BYSCORE|BYLEX] [REV] [LIMIT offset count] [WITHSCORES]
+func zrange(c *Client, args []Value) Value {
+	return zrangeGeneric(c, args, "zrange", ZRangeRank, false)
+}
+
+// ZREVRANGE key start stop [WITHSCORES]
+func zrevrange(c *Client, args []Value) Value {
+	return zrangeGeneric(c, args, "zrevrange", ZRangeRank, true)
+}
+
+// ZRANGEBYSCORE key min max [WITHSCORES] [LIMIT offset count]
+func zrangebyscore(c *Client, args []Value) Value {
+	return zrangeGeneric(c, args, "zrangebyscore", ZRangeScore, false)
+}
+
+// ZREVRANGEBYSCORE key max min [WITHSCORES] [LIMIT offset count]
+func zrevrangebyscore(c *Client, args []Value) Value {
+	return zrangeGeneric(c, args, "zrevrangebyscore", ZRangeScore, true)
+}
+
+// ZRANGEBYLEX key min max [LIMIT offset count]
+func zrangebylex(c *Client, args []Value) Value {
+	return zrangeGeneric(c, args, "zrangebylex", ZRangeLex, false)
+}
+
+// ZREVRANGEBYLEX key max min [LIMIT offset count]
+func zrevrangebylex(c *Client, args []Value) Value {
+	return zrangeGeneric(c, args, "zrevrangebylex", ZRangeLex, true)
+}
+
+// zrangeGeneric implements ZRANGE and the older commands it replaces,
+// which get how to range from their name instead of from options
+func zrangeGeneric(c *Client, args []Value, name string, by ZRangeType, rev bool) Value {
+	if len(args) < 3 {
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", name)}
+	}
+	spec, withScores, err := parseZrangeArgs(args, by, rev, name == "zrange")
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	elements, err := ds_zrange(c.db, args[0].bulk, spec)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return zsetReply(c, elements, withScores)
+}
+
+// parseZrangeArgs parses key start stop followed by the options of ZRANGE,
+// BYSCORE, BYLEX and REV are only accepted when unified is set
+func parseZrangeArgs(args []Value, by ZRangeType, rev bool, unified bool) (zrangeSpec, bool, error) {
+	spec := zrangeSpec{by: by, rev: rev, limit: -1}
+	withScores, hasLimit := false, false
+	for i := 3; i < len(args); i++ {
+		option := strings.ToUpper(args[i].bulk)
+		switch {
+		case option == "WITHSCORES" && (unified || by != ZRangeLex):
+			withScores = true
+		case option == "LIMIT" && i+2 < len(args) && (unified || by != ZRangeRank):
+			offset, err1 := strconv.ParseInt(args[i+1].bulk, 10, 64)
+			limit, err2 := strconv.ParseInt(args[i+2].bulk, 10, 64)
+			if err1 != nil || err2 != nil {
+				return spec, false, ErrNotInteger
+			}
+			spec.offset, spec.limit = offset, limit
+			hasLimit = true
+			i += 2
+		case option == "BYSCORE" && unified:
+			spec.by = ZRangeScore
+		case option == "BYLEX" && unified:
+			spec.by = ZRangeLex
+		case option == "REV" && unified:
+			spec.rev = true
+		default:
+			return spec, false, errors.New("ERR syntax error")
+		}
+	}
+	if hasLimit && spec.by == ZRangeRank {
+		return spec, false, errors.New("ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+	}
+	if withScores && spec.by == ZRangeLex {
+		return spec, false, errors.New("ERR syntax error, WITHSCORES not supported in combination with BYLEX")
+	}
+
+	// reversed score and lex ranges are given from max to min
+	minArg, maxArg := args[1].bulk, args[2].bulk
+	if spec.rev && spec.by != ZRangeRank {
+		minArg, maxArg = maxArg, minArg
+	}
+	var err error
+	switch spec.by {
+	case ZRangeRank:
+		var err1, err2 error
+		spec.start, err1 = strconv.ParseInt(minArg, 10, 64)
+		spec.stop, err2 = strconv.ParseInt(maxArg, 10, 64)
+		if err1 != nil || err2 != nil {
+			return spec, false, ErrNotInteger
+		}
+	case ZRangeScore:
+		spec.score, err = parseScoreRange(minArg, maxArg)
+	case ZRangeLex:
+		spec.lex, err = parseLexRange(minArg, maxArg)
+	}
+	return spec, withScores, err
+}
+
+// ZRANGESTORE dst src min max [BYSCORE|BYLEX] [REV] [LIMIT offset count]
+func zrangestore(c *Client, args []Value) Value {
+	if len(args) < 4 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'zrangestore' command"}
+	}
+	spec, withScores, err := parseZrangeArgs(args[1:], ZRangeRank, false, true)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if withScores {
+		return Value{typ: "error", str: "ERR syntax error"}
+	}
+	size, err := ds_zrangestore(c.db, args[0].bulk, args[1].bulk, spec)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: size}
+}
+
+// ZREMRANGEBYRANK key start stop
+func zremrangebyrank(c *Client, args []Value) Value {
+	return zremrangeGeneric(c, args, "zremrangebyrank", ZRangeRank)
+}
+
+// ZREMRANGEBYSCORE key min max
+func zremrangebyscore(c *Client, args []Value) Value {
+	return zremrangeGeneric(c, args, "zremrangebyscore", ZRangeScore)
+}
+
+// ZREMRANGEBYLEX key min max
+func zremrangebylex(c *Client, args []Value) Value {
+	return zremrangeGeneric(c, args, "zremrangebylex", ZRangeLex)
+}
+
+func zremrangeGeneric(c *Client, args []Value, name string, by ZRangeType) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", name)}
+	}
+	spec, _, err := parseZrangeArgs(args, by, false, false)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	removed, err := ds_zremrange(c.db, args[0].bulk, spec)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if removed == 0 {
+		c.preventPropagation()
+	}
+	return Value{typ: "integer", num: removed}
+}
+
+// zsetopArgs holds the parsed arguments of ZUNION like commands
+type zsetopArgs struct {
+	keys       []string
+	weights    []float64
+	aggregate  ZAggregate
+	withScores bool
+}
+
+// parseZsetopArgs parses numkeys key [key ...] [WEIGHTS weight [weight ...]]
+// [AGGREGATE SUM|MIN|MAX] [WITHSCORES], ZDIFF takes neither WEIGHTS nor AGGREGATE
+// and the STORE variants do not take WITHSCORES
+func parseZsetopArgs(args []Value, name string, op SetOperation, store bool) (zsetopArgs, error) {
+	parsed := zsetopArgs{}
+	numkeys, err := strconv.ParseInt(args[0].bulk, 10, 64)
+	if err != nil {
+		return parsed, ErrNotInteger
+	}
+	if numkeys < 1 {
+		return parsed, fmt.Errorf("ERR at least 1 input key is needed for '%s' command", name)
+	}
+	if numkeys > int64(len(args)-1) {
+		return parsed, errors.New("ERR syntax error")
+	}
+	parsed.keys = argsToStrings(args[1 : numkeys+1])
+	for i := int(numkeys) + 1; i < len(args); i++ {
+		option := strings.ToUpper(args[i].bulk)
+		remaining := len(args) - i - 1
+		switch {
+		case option == "WEIGHTS" && op != SetDiff && remaining >= int(numkeys):
+			parsed.weights = make([]float64, 0, numkeys)
+			for _, arg := range args[i+1 : i+1+int(numkeys)] {
+				weight, err := parseFloat(arg.bulk)
+				if err != nil {
+					return parsed, errors.New("ERR weight value is not a float")
+				}
+				parsed.weights = append(parsed.weights, weight)
+			}
+			i += int(numkeys)
+		case option == "AGGREGATE" && op != SetDiff && remaining >= 1:
+			switch strings.ToUpper(args[i+1].bulk) {
+			case "SUM":
+				parsed.aggregate = ZAggregateSum
+			case "MIN":
+				parsed.aggregate = ZAggregateMin
+			case "MAX":
+				parsed.aggregate = ZAggregateMax
+			default:
+				return parsed, errors.New("ERR syntax error")
+			}
+			i++
+		case option == "WITHSCORES" && !store:
+			parsed.withScores = true
+		default:
+			return parsed, errors.New("ERR syntax error")
+		}
+	}
+	return parsed, nil
+}
+
+func zunion(c *Client, args []Value) Value {
+	return zsetopGeneric(c, args, "zunion", SetUnion)
+}
+
+func zinter(c *Client, args []Value) Value {
+	return zsetopGeneric(c, args, "zinter", SetInter)
+}
+
+func zdiff(c *Client, args []Value) Value {
+	return zsetopGeneric(c, args, "zdiff", SetDiff)
+}
+
+// zsetopGeneric implements ZUNION, ZINTER and ZDIFF
+func zsetopGeneric(c *Client, args []Value, name string, op SetOperation) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", name)}
+	}
+	parsed, err := parseZsetopArgs(args, name, op, false)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	elements, err := ds_zsetop(c.db, parsed.keys, parsed.weights, parsed.aggregate, op)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return zsetReply(c, elements, parsed.withScores)
+}
+
+func zunionstore(c *Client, args []Value) Value {
+	return zsetopstoreGeneric(c, args, "zunionstore", SetUnion)
+}
+
+func zinterstore(c *Client, args []Value) Value {
+	return zsetopstoreGeneric(c, args, "zinterstore", SetInter)
+}
+
+func zdiffstore(c *Client, args []Value) Value {
+	return zsetopstoreGeneric(c, args, "zdiffstore", SetDiff)
+}
+
+// zsetopstoreGeneric implements ZUNIONSTORE, ZINTERSTORE and ZDIFFSTORE
+func zsetopstoreGeneric(c *Client, args []Value, name string, op SetOperation) Value {
+	if len(args) < 3 {
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", name)}
+	}
+	parsed, err := parseZsetopArgs(args[1:], name, op, true)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	size, err := ds_zsetopstore(c.db, args[0].bulk, parsed.keys, parsed.weights, parsed.aggregate, op)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: size}
+}
+
+func zpopmin(c *Client, args []Value) Value {
+	return zpopGeneric(c, args, "zpopmin", false)
+}
+
+func zpopmax(c *Client, args []Value) Value {
+	return zpopGeneric(c, args, "zpopmax", true)
+}
+
+// ZPOPMIN key [count]
+func zpopGeneric(c *Client, args []Value, name string, max bool) Value {
+	if len(args) != 1 && len(args) != 2 {
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", name)}
+	}
+	count := 1
+	if len(args) == 2 {
+		n, err := strconv.ParseInt(args[1].bulk, 10, 64)
+		if err != nil || n < 0 {
+			return Value{typ: "error", str: "ERR value is out of range, must be positive"}
+		}
+		count = int(min(n, math.MaxInt32))
+	}
+	elements, err := ds_zpop(c.db, args[0].bulk, count, max)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if len(elements) == 0 {
+		c.preventPropagation()
+	}
+	if len(args) == 2 {
+		return zsetReply(c, elements, true)
+	}
+	// without count even RESP3 clients get the member and its score in a flat array
+	array := []Value{}
+	for _, element := range elements {
+		array = append(array, Value{typ: "bulk", bulk: element.member}, Value{typ: "double", dbl: element.score})
+	}
+	return Value{typ: "array", array: array}
+}
+
+// parseZsetEnd parses the MIN|MAX argument of ZMPOP, it returns true for MAX
+func parseZsetEnd(arg string) (bool, error) {
+	switch strings.ToUpper(arg) {
+	case "MIN":
+		return false, nil
+	case "MAX":
+		return true, nil
+	}
+	return false, errors.New("ERR syntax error")
+}
+
+// ZMPOP numkeys key [key ...] MIN|MAX [COUNT count]
+func zmpop(c *Client, args []Value) Value {
+	if len(args) < 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'zmpop' command"}
+	}
+	parsed, err := parseMpopArgs(args)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	max, err := parseZsetEnd(parsed.where)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	key, elements, ok, err := ds_zmpop(c.db, parsed.keys, int(parsed.count), max)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if !ok {
+		c.preventPropagation()
+		return Value{typ: "nullarray"}
+	}
+	// only the sorted set which was popped matters when replaying the AOF
+	c.rewriteCommand(zpopCommandName(max), key, strconv.Itoa(len(elements)))
+	return Value{typ: "array", array: []Value{{typ: "bulk", bulk: key}, zsetPairs(elements)}}
+}
+
+func bzpopmin(c *Client, args []Value) Value {
+	return bzpopGeneric(c, args, "bzpopmin", false)
+}
+
+func bzpopmax(c *Client, args []Value) Value {
+	return bzpopGeneric(c, args, "bzpopmax", true)
+}
+
+// BZPOPMIN key [key ...] timeout
+func bzpopGeneric(c *Client, args []Value, name string, max bool) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", name)}
+	}
+	timeout, err := parseTimeout(args[len(args)-1].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	keys := argsToStrings(args[:len(args)-1])
+	return blockForKeys(c, keys, timeout, Value{typ: "nullarray"}, serveZSetPop(c.db, max, 0))
+}
+
+// BZMPOP timeout numkeys key [key ...] MIN|MAX [COUNT count]
+func bzmpop(c *Client, args []Value) Value {
+	if len(args) < 4 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'bzmpop' command"}
+	}
+	timeout, err := parseTimeout(args[0].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	parsed, err := parseMpopArgs(args[1:])
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	max, err := parseZsetEnd(parsed.where)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return blockForKeys(c, parsed.keys, timeout, Value{typ: "nullarray"}, serveZSetPop(c.db, max, int(parsed.count)))
+}
+
+// Stream commands
+
+var ErrInvalidStreamID = errors.New("ERR Invalid stream ID specified as stream command argument")
+
+// parseStreamID parses an ID given as <ms>-<seq> or <ms>, missingSeq is used as the
+// sequence number of the second form. Unless strict is set - and + are accepted
+// as the smallest and the biggest IDs
+func parseStreamID(arg string, missingSeq uint64, strict bool) (StreamID, error) {
+	if arg == "-" || arg == "+" {
+		if strict {
+			return StreamID{}, ErrInvalidStreamID
+		}
+		if arg == "-" {
+			return StreamID{}, nil
+		}
+		return maxStreamID, nil
+	}
+	msArg, seqArg, hasSeq := strings.Cut(arg, "-")
+	ms, err := strconv.ParseUint(msArg, 10, 64)
+	if err != nil {
+		return StreamID{}, ErrInvalidStreamID
+	}
+	seq := missingSeq
+	if hasSeq {
+		if seq, err = strconv.ParseUint(seqArg, 10, 64); err != nil {
+			return StreamID{}, ErrInvalidStreamID
+		}
+	}
+	return StreamID{ms: ms, seq: seq}, nil
+}
+
+// parseStreamIntervalID parses a start or an end of a range of IDs,
+// it returns true if the ID is preceded by ( to exclude it from the range
+func parseStreamIntervalID(arg string, missingSeq uint64) (StreamID, bool, error) {
+	if len(arg) > 1 && arg[0] == '(' {
+		id, err := parseStreamID(arg[1:], missingSeq, true)
+		return id, true, err
+	}
+	id, err := parseStreamID(arg, missingSeq, false)
+	return id, false, err
+}
+
+// parseStreamRange parses the start and the end of a range of IDs
+// turning exclusive ends into inclusive ones
+func parseStreamRange(startArg string, endArg string) (StreamID, StreamID, error) {
+	start, startExclusive, err := parseStreamIntervalID(startArg, 0)
+	if err != nil {
+		return start, start, err
+	}
+	end, endExclusive, err := parseStreamIntervalID(endArg, math.MaxUint64)
+	if err != nil {
+		return start, end, err
+	}
+	var ok bool
+	if startExclusive {
+		if start, ok = start.incr(); !ok {
+			return start, end, errors.New("ERR invalid start ID for the interval")
+		}
+	}
+	if endExclusive {
+		if end, ok = end.decr(); !ok {
+			return start, end, errors.New("ERR invalid end ID for the interval")
+		}
+	}
+	return start, end, nil
+}
+
+// parseXaddID parses the ID of XADD which may also be * or <ms>-*
+func parseXaddID(arg string) (xaddID, error) {
+	if arg == "*" {
+		return xaddID{auto: true}, nil
+	}
+	if ms, found := strings.CutSuffix(arg, "-*"); found {
+		id, err := parseStreamID(ms, 0, true)
+		if err != nil || strings.Contains(ms, "-") {
+			return xaddID{}, ErrInvalidStreamID
+		}
+		return xaddID{id: id, autoSeq: true}, nil
+	}
+	id, err := parseStreamID(arg, 0, true)
+	return xaddID{id: id}, err
+}
+
+// parseStreamTrimArgs parses the trimming options of XTRIM, and those of XADD together
+// with NOMKSTREAM when xadd is set. The options are parsed from args[i], for XADD
+// the returned index is the one of the ID following the options
+func parseStreamTrimArgs(args []Value, i int, xadd bool) (streamTrimArgs, bool, int, error) {
+	trim := streamTrimArgs{}
+	noMkStream, limitGiven := false, false
+options:
+	for ; i < len(args); i++ {
+		option := strings.ToUpper(args[i].bulk)
+		moreArgs := len(args) - 1 - i
+		switch {
+		case xadd && option == "*":
+			break options
+		case (option == "MAXLEN" || option == "MINID") && moreArgs > 0:
+			if trim.strategy != streamTrimNone {
+				return trim, false, i, errors.New("ERR syntax error, MAXLEN and MINID options at the same time are not compatible")
+			}
+			trim.approx = false
+			if next := args[i+1].bulk; moreArgs >= 2 && (next == "~" || next == "=") {
+				trim.approx = next == "~"
+				i++
+			}
+			if option == "MAXLEN" {
+				maxLen, err := strconv.ParseInt(args[i+1].bulk, 10, 64)
+				if err != nil {
+					return trim, false, i, ErrNotInteger
+				}
+				if maxLen < 0 {
+					return trim, false, i, errors.New("ERR The MAXLEN argument must be >= 0.")
+				}
+				trim.strategy, trim.maxLen = streamTrimMaxLen, maxLen
+			} else {
+				minID, err := parseStreamID(args[i+1].bulk, 0, true)
+				if err != nil {
+					return trim, false, i, err
+				}
+				trim.strategy, trim.minID = streamTrimMinID, minID
+			}
+			i++
+		case option == "LIMIT" && moreArgs > 0:
+			limit, err := strconv.ParseInt(args[i+1].bulk, 10, 64)
+			if err != nil {
+				return trim, false, i, ErrNotInteger
+			}
+			if limit < 0 {
+				return trim, false, i, errors.New("ERR The LIMIT argument must be >= 0.")
+			}
+			trim.limit, limitGiven = limit, true
+			i++
+		case xadd && option == "NOMKSTREAM":
+			noMkStream = true
+		case xadd:
+			// the first argument which is not an option is the ID
+			break options
+		default:
+			return trim, false, i, errors.New("ERR syntax error")
+		}
+	}
+	if limitGiven && !trim.approx {
+		return trim, false, i, errors.New("ERR syntax error, LIMIT cannot be used without the special ~ option")
+	}
+	if trim.approx && !limitGiven {
+		trim.limit = streamTrimDefaultLimit
+	}
+	return trim, noMkStream, i, nil
+}
+
+// streamEntryValue returns the entry as [id, [field, value, ...]],
+// entries deleted from the stream have no fields
+func streamEntryValue(entry StreamEntry) Value {
+	id := Value{typ: "bulk", bulk: entry.id.String()}
+	if entry.fields == nil {
+		return Value{typ: "array", array: []Value{id, {typ: "nullarray"}}}
+	}
+	return Value{typ: "array", array: []Value{id, bulkArray(entry.fields)}}
+}
+
+func streamEntriesValue(entries []StreamEntry) Value {
+	array := make([]Value, 0, len(entries))
+	for _, entry := range entries {
+		array = append(array, streamEntryValue(entry))
+	}
+	return Value{typ: "array", array: array}
+}
+
+// streamReadReply builds the reply of XREAD and XREADGROUP,
+// RESP3 clients get a map of every key to its entries
+func streamReadReply(c *Client, keys []string, results [][]StreamEntry) Value {
+	array := make([]Value, 0, len(keys))
+	for i, key := range keys {
+		if c.writer.proto == 3 {
+			array = append(array, Value{typ: "bulk", bulk: key}, streamEntriesValue(results[i]))
+			continue
+		}
+		array = append(array, Value{typ: "array", array: []Value{{typ: "bulk", bulk: key}, streamEntriesValue(results[i])}})
+	}
+	if c.writer.proto == 3 {
+		return Value{typ: "map", array: array}
+	}
+	return Value{typ: "array", array: array}
+}
+
+func streamIDsValue(ids []StreamID) Value {
+	array := make([]Value, 0, len(ids))
+	for _, id := range ids {
+		array = append(array, Value{typ: "bulk", bulk: id.String()})
+	}
+	return Value{typ: "array", array: array}
+}
+
+// XADD key [NOMKSTREAM] [MAXLEN|MINID [=|~] threshold [LIMIT count]] *|id field value [field value ...]
+func xadd(c *Client, args []Value) Value {
+	if len(args) < 4 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'xadd' command"}
+	}
+	key := args[0].bulk
+	trim, noMkStream, i, err := parseStreamTrimArgs(args, 1, true)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if fields := len(args) - i - 1; fields < 2 || fields%2 != 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'xadd' command"}
+	}
+	id, err := parseXaddID(args[i].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if !id.auto && !id.autoSeq && id.id.isZero() {
+		return Value{typ: "error", str: "ERR The ID specified in XADD must be greater than 0-0"}
+	}
+
+	newID, ok, err := ds_xadd(c.db, key, id, argsToStrings(args[i+1:]), trim, noMkStream)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if !ok {
+		c.preventPropagation()
+		return Value{typ: "null"}
+	}
+	// the aof logs the ID which was generated so that the entry gets the same one
+	aofArgs := append([]string{"XADD"}, argsToStrings(args)...)
+	aofArgs[i+1] = newID.String()
+	c.rewriteCommand(aofArgs...)
+	return Value{typ: "bulk", bulk: newID.String()}
+}
+
+func xlen(c *Client, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'xlen' command"}
+	}
+	length, err := ds_xlen(c.db, args[0].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: length}
+}
+
+// XRANGE key start end [COUNT count]
+func xrange(c *Client, args []Value) Value {
+	return xrangeGeneric(c, args, "xrange", false)
+}
+
+// XREVRANGE key end start [COUNT count]
+func xrevrange(c *Client, args []Value) Value {
+	return xrangeGeneric(c, args, "xrevrange", true)
+}
+
+func xrangeGeneric(c *Client, args []Value, name string, rev bool) Value {
+	if len(args) < 3 {
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", name)}
+	}
+	startArg, endArg := args[1].bulk, args[2].bulk
+	if rev {
+		startArg, endArg = endArg, startArg
+	}
+	start, end, err := parseStreamRange(startArg, endArg)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	var count int64 = -1
+	for i := 3; i < len(args); i++ {
+		if strings.ToUpper(args[i].bulk) != "COUNT" || i+1 == len(args) {
+			return Value{typ: "error", str: "ERR syntax error"}
+		}
+		count, err = strconv.ParseInt(args[i+1].bulk, 10, 64)
+		if err != nil {
+			return Value{typ: "error", str: ErrNotInteger.Error()}
+		}
+		count = max(count, 0)
+		i++
+	}
+	if count == 0 {
+		return Value{typ: "nullarray"}
+	}
+	entries, err := ds_xrange(c.db, args[0].bulk, start, end, int(max(count, 0)), rev)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return streamEntriesValue(entries)
+}
+
+// XDEL key id [id ...]
+func xdel(c *Client, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'xdel' command"}
+	}
+	ids := make([]StreamID, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		id, err := parseStreamID(arg.bulk, 0, true)
+		if err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+		ids = append(ids, id)
+	}
+	deleted, err := ds_xdel(c.db, args[0].bulk, ids)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if deleted == 0 {
+		c.preventPropagation()
+	}
+	return Value{typ: "integer", num: deleted}
+}
+
+// XTRIM key MAXLEN|MINID [=|~] threshold [LIMIT count]
+func xtrim(c *Client, args []Value) Value {
+	if len(args) < 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'xtrim' command"}
+	}
+	trim, _, _, err := parseStreamTrimArgs(args, 1, false)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if trim.strategy == streamTrimNone {
+		return Value{typ: "error", str: "ERR syntax error, XTRIM must be called with a trimming strategy"}
+	}
+	removed, err := ds_xtrim(c.db, args[0].bulk, trim)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if removed == 0 {
+		c.preventPropagation()
+	}
+	return Value{typ: "integer", num: removed}
+}
+
+// xreadArgs holds the parsed arguments of XREAD and XREADGROUP
+type xreadArgs struct {
+	group    string
+	consumer string
+	count    int
+	block    bool
+	timeout  time.Duration
+	noAck    bool
+	keys     []string
+	ids      []streamReadID
+}
+
+// parseXreadArgs parses the arguments of XREAD, or of XREADGROUP when group is set
+func parseXreadArgs(args []Value, name string, group bool) (xreadArgs, error) {
+	parsed := xreadArgs{}
+	streams := -1
+options:
+	for i := 0; i < len(args); i++ {
+		option := strings.ToUpper(args[i].bulk)
+		moreArgs := len(args) - 1 - i
+		switch {
+		case option == "BLOCK" && moreArgs > 0:
+			ms, err := strconv.ParseInt(args[i+1].bulk, 10, 64)
+			if err != nil {
+				return parsed, errors.New("ERR timeout is not an integer or out of range")
+			}
+			if ms < 0 {
+				return parsed, errors.New("ERR timeout is negative")
+			}
+			parsed.block, parsed.timeout = true, time.Duration(min(ms, math.MaxInt64/int64(time.Millisecond)))*time.Millisecond
+			i++
+		case option == "COUNT" && moreArgs > 0:
+			count, err := strconv.ParseInt(args[i+1].bulk, 10, 64)
+			if err != nil {
+				return parsed, ErrNotInteger
+			}
+			parsed.count = int(min(max(count, 0), math.MaxInt32))
+			i++
+		case option == "STREAMS" && moreArgs > 0:
+			streams = i + 1
+			break options
+		case option == "GROUP" && moreArgs >= 2:
+			if !group {
+				return parsed, errors.New("ERR The GROUP option is only supported by XREADGROUP. You called XREAD instead.")
+			}
+			parsed.group, parsed.consumer = args[i+1].bulk, args[i+2].bulk
+			i += 2
+		case option == "NOACK":
+			if !group {
+				return parsed, errors.New("ERR The NOACK option is only supported by XREADGROUP. You called XREAD instead.")
+			}
+			parsed.noAck = true
+		default:
+			return parsed, errors.New("ERR syntax error")
+		}
+	}
+	if streams == -1 {
+		return parsed, errors.New("ERR syntax error")
+	}
+	rest := args[streams:]
+	if len(rest)%2 != 0 {
+		special := "$"
+		if group {
+			special = ">"
+		}
+		return parsed, fmt.Errorf("ERR Unbalanced '%s' list of streams: for each stream key an ID or '%s' must be specified.", name, special)
+	}
+	if group && parsed.group == "" {
+		return parsed, errors.New("ERR Missing GROUP option for XREADGROUP")
+	}
+	parsed.keys = argsToStrings(rest[:len(rest)/2])
+	for _, arg := range rest[len(rest)/2:] {
+		switch {
+		case arg.bulk == "$" && group:
+			return parsed, errors.New("ERR The $ ID is meaningless in the context of XREADGROUP: you want to read the history of this consumer by specifying a proper ID, or use the > ID to get new messages. The $ ID would just return an empty result set.")
+		case arg.bulk == "$":
+			parsed.ids = append(parsed.ids, streamReadID{last: true})
+		case arg.bulk == ">" && !group:
+			return parsed, errors.New("ERR The > ID can be specified only when calling XREADGROUP using the GROUP <group> <consumer> option.")
+		case arg.bulk == ">":
+			parsed.ids = append(parsed.ids, streamReadID{undelivered: true})
+		default:
+			id, err := parseStreamID(arg.bulk, 0, true)
+			if err != nil {
+				return parsed, err
+			}
+			parsed.ids = append(parsed.ids, streamReadID{id: id})
+		}
+	}
+	return parsed, nil
+}
+
+// XREAD [COUNT count] [BLOCK milliseconds] STREAMS key [key ...] id [id ...]
+func xread(c *Client, args []Value) Value {
+	if len(args) < 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'xread' command"}
+	}
+	parsed, err := parseXreadArgs(args, "xread", false)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	results, err := ds_xread(c.db, parsed.keys, parsed.ids, parsed.count)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	// only the streams having new entries are replied
+	keys, entries := []string{}, [][]StreamEntry{}
+	for i, key := range parsed.keys {
+		if len(results[i]) > 0 {
+			keys, entries = append(keys, key), append(entries, results[i])
+		}
+	}
+	if len(keys) > 0 {
+		return streamReadReply(c, keys, entries)
+	}
+	if !parsed.block {
+		return Value{typ: "nullarray"}
+	}
+	serve := serveStreamRead(c.db, c, parsed.keys, parsed.ids, parsed.count)
+	return blockForKeys(c, parsed.keys, parsed.timeout, Value{typ: "nullarray"}, serve)
+}
+
+// XREADGROUP GROUP group consumer [COUNT count] [BLOCK milliseconds] [NOACK] STREAMS key [key ...] id [id ...]
+func xreadgroup(c *Client, args []Value) Value {
+	if len(args) < 6 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'xreadgroup' command"}
+	}
+	parsed, err := parseXreadArgs(args, "xreadgroup", true)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	results, err := ds_xreadgroup(c.db, parsed.group, parsed.consumer, parsed.keys, parsed.ids, parsed.count, parsed.noAck)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	// the history of the consumer is replied even when it is empty
+	keys, entries := []string{}, [][]StreamEntry{}
+	for i, key := range parsed.keys {
+		if len(results[i]) > 0 || !parsed.ids[i].undelivered {
+			keys, entries = append(keys, key), append(entries, results[i])
+		}
+	}
+	if len(keys) > 0 {
+		return streamReadReply(c, keys, entries)
+	}
+	if !parsed.block {
+		return Value{typ: "nullarray"}
+	}
+	serve := serveStreamReadGroup(c.db, c, parsed.group, parsed.consumer, parsed.count, parsed.noAck)
+	return blockForKeys(c, parsed.keys, parsed.timeout, Value{typ: "nullarray"}, serve)
+}
+
+// XACK key group id [id ...]
+func xack(c *Client, args []Value) Value {
+	if len(args) < 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'xack' command"}
+	}
+	ids := make([]StreamID, 0, len(args)-2)
+	for _, arg := range args[2:] {
+		id, err := parseStreamID(arg.bulk, 0, true)
+		if err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+		ids = append(ids, id)
+	}
+	acked, err := ds_xack(c.db, args[0].bulk, args[1].bulk, ids)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if acked == 0 {
+		c.preventPropagation()
+	}
+	return Value{typ: "integer", num: acked}
+}
+
+// parseGroupID parses the ID given to XGROUP CREATE and SETID, $ stands for the last ID of the stream
+// It also parses the ENTRIESREAD option and MKSTREAM when create is set
+func parseGroupID(args []Value, create bool) (id StreamID, last bool, mkStream bool, entriesRead int64, err error) {
+	entriesRead = streamInvalidEntriesRead
+	if args[0].bulk == "$" {
+		last = true
+	} else if id, err = parseStreamID(args[0].bulk, 0, true); err != nil {
+		return
+	}
+	for i := 1; i < len(args); i++ {
+		option := strings.ToUpper(args[i].bulk)
+		switch {
+		case option == "MKSTREAM" && create:
+			mkStream = true
+		case option == "ENTRIESREAD" && i+1 < len(args):
+			if entriesRead, err = strconv.ParseInt(args[i+1].bulk, 10, 64); err != nil {
+				err = ErrNotInteger
+				return
+			}
+			if entriesRead < 0 && entriesRead != streamInvalidEntriesRead {
+				err = errors.New("ERR value for ENTRIESREAD must be positive or -1")
+				return
+			}
+			i++
+		default:
+			err = errors.New("ERR syntax error")
+			return
+		}
+	}
+	return
+}
+
+// XGROUP CREATE key group id|$ [MKSTREAM] [ENTRIESREAD entries-read]
+// XGROUP SETID key group id|$ [ENTRIESREAD entries-read]
+// XGROUP DESTROY key group
+// XGROUP CREATECONSUMER key group consumer
+// XGROUP DELCONSUMER key group consumer
+func xgroup(c *Client, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'xgroup' command"}
+	}
+	subcommand := strings.ToLower(args[0].bulk)
+	args = args[1:]
+	arityError := Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for 'xgroup|%s' command", subcommand)}
+	switch subcommand {
+	case "create":
+		if len(args) < 3 || len(args) > 6 {
+			return arityError
+		}
+		id, last, mkStream, entriesRead, err := parseGroupID(args[2:], true)
+		if err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+		if err := ds_xgroupCreate(c.db, args[0].bulk, args[1].bulk, id, last, mkStream, entriesRead); err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+		return Value{typ: "string", str: "OK"}
+	case "setid":
+		if len(args) != 3 && len(args) != 5 {
+			return arityError
+		}
+		id, last, _, entriesRead, err := parseGroupID(args[2:], false)
+		if err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+		if err := ds_xgroupSetID(c.db, args[0].bulk, args[1].bulk, id, last, entriesRead); err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+		return Value{typ: "string", str: "OK"}
+	case "destroy":
+		if len(args) != 2 {
+			return arityError
+		}
+		destroyed, err := ds_xgroupDestroy(c.db, args[0].bulk, args[1].bulk)
+		if err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+		if !destroyed {
+			c.preventPropagation()
+			return Value{typ: "integer", num: 0}
+		}
+		return Value{typ: "integer", num: 1}
+	case "createconsumer":
+		if len(args) != 3 {
+			return arityError
+		}
+		created, err := ds_xgroupCreateConsumer(c.db, args[0].bulk, args[1].bulk, args[2].bulk)
+		if err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+		if !created {
+			c.preventPropagation()
+			return Value{typ: "integer", num: 0}
+		}
+		return Value{typ: "integer", num: 1}
+	case "delconsumer":
+		if len(args) != 3 {
+			return arityError
+		}
+		pending, err := ds_xgroupDelConsumer(c.db, args[0].bulk, args[1].bulk, args[2].bulk)
+		if err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+		return Value{typ: "integer", num: pending}
+	}
+	return Value{typ: "error", str: fmt.Sprintf("ERR unknown subcommand '%s'. Try XGROUP HELP.", subcommand)}
+}
+
+// XPENDING key group [[IDLE min-idle-time] start end count [consumer]]
+func xpending(c *Client, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'xpending' command"}
+	}
+	key, group := args[0].bulk, args[1].bulk
+	if len(args) == 2 {
+		consumers, ids, err := ds_xpendingSummary(c.db, key, group)
+		if err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+		if len(ids) == 0 {
+			return Value{typ: "array", array: []Value{{typ: "integer", num: 0}, {typ: "null"}, {typ: "null"}, {typ: "nullarray"}}}
+		}
+		array := make([]Value, 0, len(consumers))
+		for _, consumer := range consumers {
+			array = append(array, Value{typ: "array", array: []Value{
+				{typ: "bulk", bulk: consumer.name},
+				{typ: "bulk", bulk: strconv.Itoa(len(consumer.pending))},
+			}})
+		}
+		return Value{typ: "array", array: []Value{
+			{typ: "integer", num: int64(len(ids))},
+			{typ: "bulk", bulk: ids[0].String()},
+			{typ: "bulk", bulk: ids[len(ids)-1].String()},
+			{typ: "array", array: array},
+		}}
+	}
+
+	i := 2
+	var minIdle int64 = 0
+	if strings.ToUpper(args[i].bulk) == "IDLE" && len(args) > i+1 {
+		var err error
+		if minIdle, err = strconv.ParseInt(args[i+1].bulk, 10, 64); err != nil {
+			return Value{typ: "error", str: ErrNotInteger.Error()}
+		}
+		i += 2
+	}
+	if rest := len(args) - i; rest != 3 && rest != 4 {
+		return Value{typ: "error", str: "ERR syntax error"}
+	}
+	start, end, err := parseStreamRange(args[i].bulk, args[i+1].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	count, err := strconv.ParseInt(args[i+2].bulk, 10, 64)
+	if err != nil {
+		return Value{typ: "error", str: ErrNotInteger.Error()}
+	}
+	consumer := ""
+	if len(args) == i+4 {
+		consumer = args[i+3].bulk
+	}
+	pending, err := ds_xpending(c.db, key, group, start, end, int(min(max(count, 0), math.MaxInt32)), consumer, minIdle)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	now := mstime()
+	array := make([]Value, 0, len(pending))
+	for _, p := range pending {
+		array = append(array, Value{typ: "array", array: []Value{
+			{typ: "bulk", bulk: p.id.String()},
+			{typ: "bulk", bulk: p.consumer},
+			{typ: "integer", num: now - p.deliveryTime},
+			{typ: "integer", num: p.deliveryCount},
+		}})
+	}
+	return Value{typ: "array", array: array}
+}
+
+// claimedValue returns the claimed entries, or only their IDs when justID is set
+func claimedValue(claimed []streamPendingEntry, justID bool) Value {
+	array := make([]Value, 0, len(claimed))
+	for _, p := range claimed {
+		if justID {
+			array = append(array, Value{typ: "bulk", bulk: p.id.String()})
+		} else {
+			array = append(array, streamEntryValue(*p.entry))
+		}
+	}
+	return Value{typ: "array", array: array}
+}
+
+// propagateClaims logs the work of XCLAIM and XAUTOCLAIM which depends on the time
+// it was done at, every claimed entry is logged as a XCLAIM setting its delivery time
+// and count, and the pending entries deleted from the stream are acknowledged
+func propagateClaims(c *Client, key string, group string, claimed []streamPendingEntry, deleted []StreamID, lastID *StreamID) {
+	commands := [][]string{}
+	for _, p := range claimed {
+		command := []string{"XCLAIM", key, group, p.consumer, "0", p.id.String(),
+			"TIME", strconv.FormatInt(p.deliveryTime, 10),
+			"RETRYCOUNT", strconv.FormatInt(p.deliveryCount, 10), "FORCE", "JUSTID"}
+		if lastID != nil {
+			command = append(command, "LASTID", lastID.String())
+		}
+		commands = append(commands, command)
+	}
+	if len(deleted) > 0 {
+		command := []string{"XACK", key, group}
+		for _, id := range deleted {
+			command = append(command, id.String())
+		}
+		commands = append(commands, command)
+	}
+	if len(commands) == 0 {
+		// only the last ID of the group may have changed
+		if lastID == nil {
+			c.preventPropagation()
+		}
+		return
+	}
+	c.rewriteCommand(commands[0]...)
+	for _, command := range commands[1:] {
+		c.alsoPropagate(command...)
+	}
+}
+
+// XCLAIM key group consumer min-idle-time id [id ...] [IDLE ms] [TIME unix-time-milliseconds]
+// [RETRYCOUNT count] [FORCE] [JUSTID] [LASTID lastid]
+func xclaim(c *Client, args []Value) Value {
+	if len(args) < 5 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'xclaim' command"}
+	}
+	minIdle, err := strconv.ParseInt(args[3].bulk, 10, 64)
+	if err != nil {
+		return Value{typ: "error", str: "ERR Invalid min-idle-time argument for XCLAIM"}
+	}
+	minIdle = max(minIdle, 0)
+	ids := []StreamID{}
+	i := 4
+	for ; i < len(args); i++ {
+		id, err := parseStreamID(args[i].bulk, 0, true)
+		if err != nil {
+			break
+		}
+		ids = append(ids, id)
+	}
+
+	now := mstime()
+	opts := xclaimOptions{deliveryTime: -1, retryCount: -1}
+	for ; i < len(args); i++ {
+		option := strings.ToUpper(args[i].bulk)
+		moreArgs := len(args) - 1 - i
+		switch {
+		case option == "FORCE":
+			opts.force = true
+		case option == "JUSTID":
+			opts.justID = true
+		case option == "IDLE" && moreArgs > 0:
+			idle, err := strconv.ParseInt(args[i+1].bulk, 10, 64)
+			if err != nil {
+				return Value{typ: "error", str: "ERR Invalid IDLE option argument for XCLAIM"}
+			}
+			opts.deliveryTime = now - idle
+			i++
+		case option == "TIME" && moreArgs > 0:
+			when, err := strconv.ParseInt(args[i+1].bulk, 10, 64)
+			if err != nil {
+				return Value{typ: "error", str: "ERR Invalid TIME option argument for XCLAIM"}
+			}
+			opts.deliveryTime = when
+			i++
+		case option == "RETRYCOUNT" && moreArgs > 0:
+			retryCount, err := strconv.ParseInt(args[i+1].bulk, 10, 64)
+			if err != nil {
+				return Value{typ: "error", str: "ERR Invalid RETRYCOUNT option argument for XCLAIM"}
+			}
+			opts.retryCount = retryCount
+			i++
+		case option == "LASTID" && moreArgs > 0:
+			lastID, err := parseStreamID(args[i+1].bulk, 0, true)
+			if err != nil {
+				return Value{typ: "error", str: err.Error()}
+			}
+			opts.lastID = &lastID
+			i++
+		default:
+			return Value{typ: "error", str: fmt.Sprintf("ERR Unrecognized XCLAIM option '%s'", args[i].bulk)}
+		}
+	}
+	// delivery times in the future are not allowed
+	if opts.deliveryTime < 0 || opts.deliveryTime > now {
+		opts.deliveryTime = now
+	}
+
+	key, group := args[0].bulk, args[1].bulk
+	claimed, deleted, err := ds_xclaim(c.db, key, group, args[2].bulk, minIdle, ids, opts)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	propagateClaims(c, key, group, claimed, deleted, opts.lastID)
+	return claimedValue(claimed, opts.justID)
+}
+
+// XAUTOCLAIM key group consumer min-idle-time start [COUNT count] [JUSTID]
+func xautoclaim(c *Client, args []Value) Value {
+	if len(args) < 5 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'xautoclaim' command"}
+	}
+	minIdle, err := strconv.ParseInt(args[3].bulk, 10, 64)
+	if err != nil {
+		return Value{typ: "error", str: "ERR Invalid min-idle-time argument for XAUTOCLAIM"}
+	}
+	minIdle = max(minIdle, 0)
+	start, exclusive, err := parseStreamIntervalID(args[4].bulk, 0)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if exclusive {
+		var ok bool
+		if start, ok = start.incr(); !ok {
+			return Value{typ: "error", str: "ERR invalid start ID for the interval"}
+		}
+	}
+	var count int64 = 100
+	justID := false
+	for i := 5; i < len(args); i++ {
+		option := strings.ToUpper(args[i].bulk)
+		switch {
+		case option == "COUNT" && i+1 < len(args):
+			count, err = strconv.ParseInt(args[i+1].bulk, 10, 64)
+			if err != nil {
+				return Value{typ: "error", str: ErrNotInteger.Error()}
+			}
+			// the number of entries scanned is ten times the count
+			if count < 1 || count > math.MaxInt32/10 {
+				return Value{typ: "error", str: "ERR COUNT must be > 0"}
+			}
+			i++
+		case option == "JUSTID":
+			justID = true
+		default:
+			return Value{typ: "error", str: "ERR syntax error"}
+		}
+	}
+
+	key, group := args[0].bulk, args[1].bulk
+	next, claimed, deleted, err := ds_xautoclaim(c.db, key, group, args[2].bulk, minIdle, start, int(count), justID)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	propagateClaims(c, key, group, claimed, deleted, nil)
+	return Value{typ: "array", array: []Value{
+		{typ: "bulk", bulk: next.String()},
+		claimedValue(claimed, justID),
+		streamIDsValue(deleted),
+	}}
+}
+
+// XINFO STREAM key [FULL [COUNT count]]
+// XINFO GROUPS key
+// XINFO CONSUMERS key group
+func xinfo(c *Client, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'xinfo' command"}
+	}
+	subcommand := strings.ToLower(args[0].bulk)
+	args = args[1:]
+	arityError := Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for 'xinfo|%s' command", subcommand)}
+	switch subcommand {
+	case "stream":
+		if len(args) < 1 {
+			return arityError
+		}
+		return xinfoStream(c, args)
+	case "groups":
+		if len(args) != 1 {
+			return arityError
+		}
+		groups, err := ds_xinfoGroups(c.db, args[0].bulk)
+		if err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+		array := make([]Value, 0, len(groups))
+		for _, group := range groups {
+			array = append(array, Value{typ: "map", array: []Value{
+				{typ: "bulk", bulk: "name"}, {typ: "bulk", bulk: group.name},
+				{typ: "bulk", bulk: "consumers"}, {typ: "integer", num: int64(group.consumerCount)},
+				{typ: "bulk", bulk: "pending"}, {typ: "integer", num: int64(group.pendingCount)},
+				{typ: "bulk", bulk: "last-delivered-id"}, {typ: "bulk", bulk: group.lastID.String()},
+				{typ: "bulk", bulk: "entries-read"}, entriesReadValue(group.entriesRead),
+				{typ: "bulk", bulk: "lag"}, lagValue(group),
+			}})
+		}
+		return Value{typ: "array", array: array}
+	case "consumers":
+		if len(args) != 2 {
+			return arityError
+		}
+		consumers, err := ds_xinfoConsumers(c.db, args[0].bulk, args[1].bulk)
+		if err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+		now := mstime()
+		array := make([]Value, 0, len(consumers))
+		for _, consumer := range consumers {
+			var inactive int64 = -1
+			if consumer.activeTime != -1 {
+				inactive = now - consumer.activeTime
+			}
+			array = append(array, Value{typ: "map", array: []Value{
+				{typ: "bulk", bulk: "name"}, {typ: "bulk", bulk: consumer.name},
+				{typ: "bulk", bulk: "pending"}, {typ: "integer", num: int64(len(consumer.pending))},
+				{typ: "bulk", bulk: "idle"}, {typ: "integer", num: now - consumer.seenTime},
+				{typ: "bulk", bulk: "inactive"}, {typ: "integer", num: inactive},
+			}})
+		}
+		return Value{typ: "array", array: array}
+	}
+	return Value{typ: "error", str: fmt.Sprintf("ERR unknown subcommand '%s'. Try XINFO HELP.", subcommand)}
+}
+
+// entriesReadValue returns the entries read counter of a consumer group, null if it is unknown
+func entriesReadValue(entriesRead int64) Value {
+	if entriesRead == streamInvalidEntriesRead {
+		return Value{typ: "null"}
+	}
+	return Value{typ: "integer", num: entriesRead}
+}
+
+func lagValue(group streamGroupInfo) Value {
+	if !group.lagKnown {
+		return Value{typ: "null"}
+	}
+	return Value{typ: "integer", num: group.lag}
+}
+
+// xinfoStream replies to XINFO STREAM key [FULL [COUNT count]]
+func xinfoStream(c *Client, args []Value) Value {
+	full := false
+	var count int64 = 10
+	if len(args) > 1 {
+		if strings.ToUpper(args[1].bulk) != "FULL" {
+			return Value{typ: "error", str: "ERR syntax error"}
+		}
+		full = true
+		if len(args) > 2 {
+			if len(args) != 4 || strings.ToUpper(args[2].bulk) != "COUNT" {
+				return Value{typ: "error", str: "ERR syntax error"}
+			}
+			var err error
+			if count, err = strconv.ParseInt(args[3].bulk, 10, 64); err != nil {
+				return Value{typ: "error", str: ErrNotInteger.Error()}
+			}
+			if count < 0 {
+				count = 10
+			}
+		}
+	}
+	info, err := ds_xinfoStream(c.db, args[0].bulk, full, int(min(count, math.MaxInt32)))
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	reply := []Value{
+		{typ: "bulk", bulk: "length"}, {typ: "integer", num: info.length},
+		{typ: "bulk", bulk: "last-generated-id"}, {typ: "bulk", bulk: info.lastID.String()},
+		{typ: "bulk", bulk: "max-deleted-entry-id"}, {typ: "bulk", bulk: info.maxDeletedID.String()},
+		{typ: "bulk", bulk: "entries-added"}, {typ: "integer", num: info.entriesAdded},
+		{typ: "bulk", bulk: "recorded-first-entry-id"}, {typ: "bulk", bulk: info.firstID.String()},
+	}
+	if !full {
+		edge := func(entry *StreamEntry) Value {
+			if entry == nil {
+				return Value{typ: "null"}
+			}
+			return streamEntryValue(*entry)
+		}
+		reply = append(reply,
+			Value{typ: "bulk", bulk: "groups"}, Value{typ: "integer", num: int64(info.groupCount)},
+			Value{typ: "bulk", bulk: "first-entry"}, edge(info.first),
+			Value{typ: "bulk", bulk: "last-entry"}, edge(info.last),
+		)
+		return Value{typ: "map", array: reply}
+	}
+
+	groups := make([]Value, 0, len(info.groups))
+	for _, group := range info.groups {
+		pending := make([]Value, 0, len(group.pending))
+		for _, p := range group.pending {
+			pending = append(pending, Value{typ: "array", array: []Value{
+				{typ: "bulk", bulk: p.id.String()},
+				{typ: "bulk", bulk: p.consumer},
+				{typ: "integer", num: p.deliveryTime},
+				{typ: "integer", num: p.deliveryCount},
+			}})
+		}
+		consumers := make([]Value, 0, len(group.consumers))
+		for _, consumer := range group.consumers {
+			consumerPending := make([]Value, 0, len(consumer.pending))
+			for _, p := range consumer.pending {
+				consumerPending = append(consumerPending, Value{typ: "array", array: []Value{
+					{typ: "bulk", bulk: p.id.String()},
+					{typ: "integer", num: p.deliveryTime},
+					{typ: "integer", num: p.deliveryCount},
+				}})
+			}
+			consumers = append(consumers, Value{typ: "map", array: []Value{
+				{typ: "bulk", bulk: "name"}, {typ: "bulk", bulk: consumer.name},
+				{typ: "bulk", bulk: "seen-time"}, {typ: "integer", num: consumer.seenTime},
+				{typ: "bulk", bulk: "active-time"}, {typ: "integer", num: consumer.activeTime},
+				{typ: "bulk", bulk: "pel-count"}, {typ: "integer", num: int64(len(consumer.pending))},
+				{typ: "bulk", bulk: "pending"}, {typ: "array", array: consumerPending},
+			}})
+		}
+		groups = append(groups, Value{typ: "map", array: []Value{
+			{typ: "bulk", bulk: "name"}, {typ: "bulk", bulk: group.name},
+			{typ: "bulk", bulk: "last-delivered-id"}, {typ: "bulk", bulk: group.lastID.String()},
+			{typ: "bulk", bulk: "entries-read"}, entriesReadValue(group.entriesRead),
+			{typ: "bulk", bulk: "lag"}, lagValue(group),
+			{typ: "bulk", bulk: "pel-count"}, {typ: "integer", num: int64(group.pendingCount)},
+			{typ: "bulk", bulk: "pending"}, {typ: "array", array: pending},
+			{typ: "bulk", bulk: "consumers"}, {typ: "array", array: consumers},
+		}})
+	}
+	reply = append(reply,
+		Value{typ: "bulk", bulk: "entries"}, streamEntriesValue(info.entries),
+		Value{typ: "bulk", bulk: "groups"}, Value{typ: "array", array: groups},
+	)
+	return Value{typ: "map", array: reply}
+}
+
+// HyperLogLog commands
+
+// PFADD key [element [element ...]]
+func pfadd(c *Client, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'pfadd' command"}
+	}
+	updated, err := ds_pfadd(c.db, args[0].bulk, argsToStrings(args[1:]))
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if !updated {
+		c.preventPropagation()
+		return Value{typ: "integer", num: 0}
+	}
+	return Value{typ: "integer", num: 1}
+}
+
+// PFCOUNT key [key ...]
+func pfcount(c *Client, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'pfcount' command"}
+	}
+	card, cached, err := ds_pfcount(c.db, argsToStrings(args))
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	// only the cardinality cached in the header needs to be logged
+	if !cached {
+		c.preventPropagation()
+	}
+	return Value{typ: "integer", num: card}
+}
+
+// PFMERGE destkey [sourcekey [sourcekey ...]]
+func pfmerge(c *Client, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'pfmerge' command"}
+	}
+	if err := ds_pfmerge(c.db, args[0].bulk, argsToStrings(args[1:])); err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "string", str: "OK"}
+}
+
+// Geo commands
+
+// parseLonLat parses a longitude followed by a latitude
+func parseLonLat(args []Value) ([2]float64, error) {
+	longitude, err := parseFloat(args[0].bulk)
+	if err != nil {
+		return [2]float64{}, ErrNotFloat
+	}
+	latitude, err := parseFloat(args[1].bulk)
+	if err != nil {
+		return [2]float64{}, ErrNotFloat
+	}
+	if longitude < geoLongMin || longitude > geoLongMax || latitude < geoLatMin || latitude > geoLatMax {
+		return [2]float64{}, fmt.Errorf("ERR invalid longitude,latitude pair %f,%f", longitude, latitude)
+	}
+	return [2]float64{longitude, latitude}, nil
+}
+
+// parseGeoUnit returns the length in meters of the unit
+func parseGeoUnit(arg string) (float64, error) {
+	switch strings.ToLower(arg) {
+	case "m":
+		return 1, nil
+	case "km":
+		return 1000, nil
+	case "ft":
+		return 0.3048, nil
+	case "mi":
+		return 1609.34, nil
+	}
+	return 0, errors.New("ERR unsupported unit provided. please use M, KM, FT, MI")
+}
+
+// geoCoordValue replies a longitude or a latitude, RESP2 clients
+// get it with 17 decimals without the trailing zeros like in redis
+func geoCoordValue(c *Client, coord float64) Value {
+	if c.writer.proto == 3 {
+		return Value{typ: "double", dbl: coord}
+	}
+	str := strings.TrimRight(strconv.FormatFloat(coord, 'f', 17, 64), "0")
+	str = strings.TrimSuffix(str, ".")
+	if str == "-0" {
+		str = "0"
+	}
+	return Value{typ: "bulk", bulk: str}
+}
+
+func geoDistanceValue(distance float64) Value {
+	return Value{typ: "bulk", bulk: strconv.FormatFloat(distance, 'f', 4, 64)}
+}
+
+// GEOADD key [NX|XX] [CH] longitude latitude member [longitude latitude member ...]
+func geoadd(c *Client, args []Value) Value {
+	if len(args) < 4 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'geoadd' command"}
+	}
+	key := args[0].bulk
+	flags := zaddFlags{}
+	ch := false
+	i := 1
+options:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i].bulk) {
+		case "NX":
+			flags.nx = true
+		case "XX":
+			flags.xx = true
+		case "CH":
+			ch = true
+		default:
+			break options
+		}
+	}
+	triples := args[i:]
+	if len(triples) == 0 || len(triples)%3 != 0 || (flags.nx && flags.xx) {
+		return Value{typ: "error", str: "ERR syntax error"}
+	}
+	// the points are added as a ZADD of their geohashes which is what the aof logs
+	aofArgs := append([]string{"ZADD"}, argsToStrings(args[:i])...)
+	elements := make([]ZSetElement, 0, len(triples)/3)
+	for j := 0; j < len(triples); j += 3 {
+		xy, err := parseLonLat(triples[j : j+2])
+		if err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+		score, _ := geoEncodeScore(xy[0], xy[1])
+		elements = append(elements, ZSetElement{member: triples[j+2].bulk, score: score})
+		aofArgs = append(aofArgs, strconv.FormatInt(int64(score), 10), triples[j+2].bulk)
+	}
+
+	added, updated, _, _, err := ds_zadd(c.db, key, elements, flags)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	c.rewriteCommand(aofArgs...)
+	if ch {
+		return Value{typ: "integer", num: added + updated}
+	}
+	return Value{typ: "integer", num: added}
+}
+
+// GEOPOS key [member [member ...]]
+func geopos(c *Client, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'geopos' command"}
+	}
+	positions, err := ds_geopos(c.db, args[0].bulk, argsToStrings(args[1:]))
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	array := make([]Value, 0, len(positions))
+	for _, xy := range positions {
+		if xy == nil {
+			array = append(array, Value{typ: "nullarray"})
+			continue
+		}
+		array = append(array, Value{typ: "array", array: []Value{geoCoordValue(c, xy[0]), geoCoordValue(c, xy[1])}})
+	}
+	return Value{typ: "array", array: array}
+}
+
+// GEODIST key member1 member2 [M|KM|FT|MI]
+func geodist(c *Client, args []Value) Value {
+	if len(args) < 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'geodist' command"}
+	}
+	if len(args) > 4 {
+		return Value{typ: "error", str: "ERR syntax error"}
+	}
+	conversion := 1.0
+	if len(args) == 4 {
+		var err error
+		if conversion, err = parseGeoUnit(args[3].bulk); err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+	}
+	distance, ok, err := ds_geodist(c.db, args[0].bulk, args[1].bulk, args[2].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if !ok {
+		return Value{typ: "null"}
+	}
+	return geoDistanceValue(distance / conversion)
+}
+
+// GEOHASH key [member [member ...]]
+func geohash(c *Client, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'geohash' command"}
+	}
+	positions, err := ds_geopos(c.db, args[0].bulk, argsToStrings(args[1:]))
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	array := make([]Value, 0, len(positions))
+	for _, xy := range positions {
+		if xy == nil {
+			array = append(array, Value{typ: "null"})
+			continue
+		}
+		array = append(array, Value{typ: "bulk", bulk: geohashString(*xy)})
+	}
+	return Value{typ: "array", array: array}
+}
+
+// What GEOSEARCH replies along with the members, and STOREDIST of GEOSEARCHSTORE
+type geoSearchFlags struct {
+	withDist  bool
+	withHash  bool
+	withCoord bool
+	storeDist bool
+}
+
+// parseGeoSearchArgs parses the options of GEOSEARCH, or of GEOSEARCHSTORE when store is set
+func parseGeoSearchArgs(args []Value, name string, store bool) (geoSearchArgs, geoSearchFlags, error) {
+	search := geoSearchArgs{sort: geoSortNone}
+	flags := geoSearchFlags{}
+	fromMember, byRadius, byBox := false, false, false
+	for i := 0; i < len(args); i++ {
+		option := strings.ToUpper(args[i].bulk)
+		moreArgs := len(args) - 1 - i
+		switch {
+		case option == "WITHDIST":
+			flags.withDist = true
+		case option == "WITHHASH":
+			flags.withHash = true
+		case option == "WITHCOORD":
+			flags.withCoord = true
+		case option == "ANY":
+			search.any = true
+		case option == "ASC":
+			search.sort = geoSortAsc
+		case option == "DESC":
+			search.sort = geoSortDesc
+		case option == "COUNT" && moreArgs > 0:
+			count, err := strconv.ParseInt(args[i+1].bulk, 10, 64)
+			if err != nil {
+				return search, flags, ErrNotInteger
+			}
+			if count <= 0 {
+				return search, flags, errors.New("ERR COUNT must be > 0")
+			}
+			search.count = int(min(count, math.MaxInt32))
+			i++
+		case option == "FROMMEMBER" && moreArgs > 0 && !fromMember && !search.fromLonLat:
+			search.fromMember, fromMember = args[i+1].bulk, true
+			i++
+		case option == "FROMLONLAT" && moreArgs > 1 && !fromMember && !search.fromLonLat:
+			xy, err := parseLonLat(args[i+1 : i+3])
+			if err != nil {
+				return search, flags, err
+			}
+			search.shape.xy, search.fromLonLat = xy, true
+			i += 2
+		case option == "BYRADIUS" && moreArgs > 1 && !byRadius && !byBox:
+			radius, err := parseFloat(args[i+1].bulk)
+			if err != nil {
+				return search, flags, errors.New("ERR need numeric radius")
+			}
+			if radius < 0 {
+				return search, flags, errors.New("ERR radius cannot be negative")
+			}
+			conversion, err := parseGeoUnit(args[i+2].bulk)
+			if err != nil {
+				return search, flags, err
+			}
+			search.shape.typ, search.shape.radius, search.shape.conversion = geoShapeCircle, radius, conversion
+			byRadius = true
+			i += 2
+		case option == "BYBOX" && moreArgs > 2 && !byRadius && !byBox:
+			width, err := parseFloat(args[i+1].bulk)
+			if err != nil {
+				return search, flags, errors.New("ERR need numeric width")
+			}
+			height, err := parseFloat(args[i+2].bulk)
+			if err != nil {
+				return search, flags, errors.New("ERR need numeric height")
+			}
+			if height < 0 || width < 0 {
+				return search, flags, errors.New("ERR height or width cannot be negative")
+			}
+			conversion, err := parseGeoUnit(args[i+3].bulk)
+			if err != nil {
+				return search, flags, err
+			}
+			search.shape.typ, search.shape.width, search.shape.height = geoShapeBox, width, height
+			search.shape.conversion = conversion
+			byBox = true
+			i += 3
+		case option == "STOREDIST" && store:
+			flags.storeDist = true
+		default:
+			return search, flags, errors.New("ERR syntax error")
+		}
+	}
+	if store && (flags.withDist || flags.withHash || flags.withCoord) {
+		return search, flags, errors.New("ERR GEOSEARCHSTORE is not compatible with WITHDIST, WITHHASH and WITHCOORD options")
+	}
+	if !fromMember && !search.fromLonLat {
+		return search, flags, fmt.Errorf("ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for %s", name)
+	}
+	if !byRadius && !byBox {
+		return search, flags, fmt.Errorf("ERR exactly one of BYRADIUS and BYBOX can be specified for %s", name)
+	}
+	if search.any && search.count == 0 {
+		return search, flags, errors.New("ERR the ANY argument requires COUNT argument")
+	}
+	return search, flags, nil
+}
+
+// GEOSEARCH key FROMMEMBER member|FROMLONLAT longitude latitude
+// BYRADIUS radius M|KM|FT|MI|BYBOX width height M|KM|FT|MI
+// [ASC|DESC] [COUNT count [ANY]] [WITHCOORD] [WITHDIST] [WITHHASH]
+func geosearch(c *Client, args []Value) Value {
+	if len(args) < 6 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'geosearch' command"}
+	}
+	search, flags, err := parseGeoSearchArgs(args[1:], "geosearch", false)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	points, err := ds_geosearch(c.db, args[0].bulk, search)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	array := make([]Value, 0, len(points))
+	for _, point := range points {
+		member := Value{typ: "bulk", bulk: point.member}
+		if !flags.withDist && !flags.withHash && !flags.withCoord {
+			array = append(array, member)
+			continue
+		}
+		item := []Value{member}
+		if flags.withDist {
+			item = append(item, geoDistanceValue(point.dist/search.shape.conversion))
+		}
+		if flags.withHash {
+			item = append(item, Value{typ: "integer", num: int64(point.score)})
+		}
+		if flags.withCoord {
+			item = append(item, Value{typ: "array", array: []Value{geoCoordValue(c, point.longitude), geoCoordValue(c, point.latitude)}})
+		}
+		array = append(array, Value{typ: "array", array: item})
+	}
+	return Value{typ: "array", array: array}
+}
+
+// GEOSEARCHSTORE destination source FROMMEMBER member|FROMLONLAT longitude latitude
+// BYRADIUS radius M|KM|FT|MI|BYBOX width height M|KM|FT|MI
+// [ASC|DESC] [COUNT count [ANY]] [STOREDIST]
+func geosearchstore(c *Client, args []Value) Value {
+	if len(args) < 7 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'geosearchstore' command"}
+	}
+	search, flags, err := parseGeoSearchArgs(args[2:], "geosearchstore", true)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	stored, err := ds_geosearchstore(c.db, args[0].bulk, args[1].bulk, search, flags.storeDist)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: stored}
+}
+
+// Bit commands
+
+// parseBitOffset parses the bit offset of SETBIT, GETBIT and BITFIELD, it
+// can't be negative nor point past the biggest string a client could send.
+// In BITFIELD "#N" is the offset of the Nth field of width bits
+func parseBitOffset(arg string, width uint) (int64, error) {
+	multiplier := int64(1)
+	if width > 0 && strings.HasPrefix(arg, "#") {
+		arg = arg[1:]
+		multiplier = int64(width)
+	}
+	offset, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || offset < 0 || offset > math.MaxInt64/multiplier {
+		return 0, ErrBitOffset
+	}
+	offset *= multiplier
+	if offset>>3 >= maxBulkLength {
+		return 0, ErrBitOffset
+	}
+	return offset, nil
+}
+
+// SETBIT key offset value
+func setbit(c *Client, args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'setbit' command"}
+	}
+	offset, err := parseBitOffset(args[1].bulk, 0)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if args[2].bulk != "0" && args[2].bulk != "1" {
+		return Value{typ: "error", str: ErrBitValue.Error()}
+	}
+	old, err := ds_setbit(c.db, args[0].bulk, offset, args[2].bulk == "1")
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: int64(old)}
+}
+
+// GETBIT key offset
+func getbit(c *Client, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'getbit' command"}
+	}
+	offset, err := parseBitOffset(args[1].bulk, 0)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	bit, err := ds_getbit(c.db, args[0].bulk, offset)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: int64(bit)}
+}
+
+// parseBitRange parses the optional start, end and BYTE|BIT arguments of
+// BITCOUNT and BITPOS, BITCOUNT needs both start and end
+func parseBitRange(args []Value, needEnd bool) (bitRangeSpec, error) {
+	var spec bitRangeSpec
+	if len(args) > 3 || (needEnd && len(args) == 1) {
+		return spec, errors.New("ERR syntax error")
+	}
+	var err error
+	if len(args) >= 1 {
+		spec.hasStart = true
+		if spec.start, err = strconv.ParseInt(args[0].bulk, 10, 64); err != nil {
+			return spec, ErrNotInteger
+		}
+	}
+	if len(args) >= 2 {
+		spec.hasEnd = true
+		if spec.end, err = strconv.ParseInt(args[1].bulk, 10, 64); err != nil {
+			return spec, ErrNotInteger
+		}
+	}
+	if len(args) == 3 {
+		switch strings.ToUpper(args[2].bulk) {
+		case "BIT":
+			spec.isBit = true
+		case "BYTE":
+		default:
+			return spec, errors.New("ERR syntax error")
+		}
+	}
+	return spec, nil
+}
+
+// BITCOUNT key [start end [BYTE | BIT]]
+func bitcount(c *Client, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'bitcount' command"}
+	}
+	spec, err := parseBitRange(args[1:], true)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	count, err := ds_bitcount(c.db, args[0].bulk, spec)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: count}
+}
+
+// BITPOS key bit [start [end [BYTE | BIT]]]
+func bitpos(c *Client, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'bitpos' command"}
+	}
+	bit, err := strconv.ParseInt(args[1].bulk, 10, 64)
+	if err != nil {
+		return Value{typ: "error", str: ErrNotInteger.Error()}
+	}
+	if bit != 0 && bit != 1 {
+		return Value{typ: "error", str: ErrBitposBit.Error()}
+	}
+	spec, err := parseBitRange(args[2:], false)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	pos, err := ds_bitpos(c.db, args[0].bulk, int(bit), spec)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: pos}
+}
+
+// BITOP AND | OR | XOR | NOT | DIFF destkey key [key ...]
+func bitop(c *Client, args []Value) Value {
+	if len(args) < 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'bitop' command"}
+	}
+	op := strings.ToUpper(args[0].bulk)
+	keys := argsToStrings(args[2:])
+	switch op {
+	case "AND", "OR", "XOR":
+	case "NOT":
+		if len(keys) != 1 {
+			return Value{typ: "error", str: "ERR BITOP NOT must be called with a single source key."}
+		}
+	case "DIFF":
+		if len(keys) < 2 {
+			return Value{typ: "error", str: "ERR BITOP DIFF must be called with at least two source keys."}
+		}
+	default:
+		return Value{typ: "error", str: "ERR syntax error"}
+	}
+	length, err := ds_bitop(c.db, op, args[1].bulk, keys)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "integer", num: length}
+}
+
+// parseBitfieldOps parses the subcommands of BITFIELD, the whole command
+// is rejected before running anything if one of them is wrong
+func parseBitfieldOps(args []Value) ([]bitfieldOp, error) {
+	ops := make([]bitfieldOp, 0)
+	overflow := bitfieldOverflowWrap
+	for i := 0; i < len(args); {
+		remaining := len(args) - i - 1
+		subcommand := strings.ToUpper(args[i].bulk)
+		var op bitfieldOp
+		switch {
+		case subcommand == "GET" && remaining >= 2:
+			op.op = bitfieldGet
+		case subcommand == "SET" && remaining >= 3:
+			op.op = bitfieldSet
+		case subcommand == "INCRBY" && remaining >= 3:
+			op.op = bitfieldIncrBy
+		case subcommand == "OVERFLOW" && remaining >= 1:
+			switch strings.ToUpper(args[i+1].bulk) {
+			case "WRAP":
+				overflow = bitfieldOverflowWrap
+			case "SAT":
+				overflow = bitfieldOverflowSat
+			case "FAIL":
+				overflow = bitfieldOverflowFail
+			default:
+				return nil, ErrBitfieldOverflow
+			}
+			i += 2
+			continue
+		default:
+			return nil, errors.New("ERR syntax error")
+		}
+		var err error
+		if op.typ, err = parseBitfieldType(args[i+1].bulk); err != nil {
+			return nil, err
+		}
+		if op.offset, err = parseBitOffset(args[i+2].bulk, op.typ.bits); err != nil {
+			return nil, err
+		}
+		i += 3
+		if op.op != bitfieldGet {
+			if op.value, err = strconv.ParseInt(args[i].bulk, 10, 64); err != nil {
+				return nil, ErrNotInteger
+			}
+			op.overflow = overflow
+			i++
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// bitfieldGeneric implements BITFIELD and BITFIELD_RO
+func bitfieldGeneric(c *Client, args []Value, readonly bool) Value {
+	ops, err := parseBitfieldOps(args[1:])
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if readonly {
+		for _, op := range ops {
+			if op.op != bitfieldGet {
+				return Value{typ: "error", str: ErrBitfieldRO.Error()}
+			}
+		}
+	}
+	results, changed, err := ds_bitfield(c.db, args[0].bulk, ops)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if !changed {
+		c.preventPropagation()
+	}
+	array := make([]Value, 0, len(results))
+	for _, result := range results {
+		if result == nil {
+			array = append(array, Value{typ: "null"})
+			continue
+		}
+		array = append(array, Value{typ: "integer", num: *result})
+	}
+	return Value{typ: "array", array: array}
+}
+
+// BITFIELD key [GET encoding offset | [OVERFLOW WRAP | SAT | FAIL]
+// <SET encoding offset value | INCRBY encoding offset increment> ...]
+func bitfield(c *Client, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'bitfield' command"}
+	}
+	return bitfieldGeneric(c, args, false)
+}
+
+// BITFIELD_RO key [GET encoding offset ...]
+func bitfieldRO(c *Client, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'bitfield_ro' command"}
+	}
+	return bitfieldGeneric(c, args, true)
+}
+
+// Scan commands
+
+// KEYS pattern
+func keys(c *Client, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'keys' command"}
+	}
+	array := make([]Value, 0)
+	for _, key := range ds_keys(c.db, args[0].bulk) {
+		array = append(array, Value{typ: "bulk", bulk: key})
+	}
+	return Value{typ: "array", array: array}
+}
+
+// parseScanCursor parses the cursor of the scan commands, the one
+// returned by the previous call or 0 to start a new iteration
+func parseScanCursor(arg string) (uint64, error) {
+	cursor, err := strconv.ParseUint(arg, 10, 64)
+	if err != nil {
+		return 0, errors.New("ERR invalid cursor")
+	}
+	return cursor, nil
+}
+
+// parseScanOptions parses the options following the cursor, TYPE is only
+// accepted by SCAN, NOVALUES by HSCAN and NOSCORES by ZSCAN
+func parseScanOptions(args []Value, name string) (scanOptions, error) {
+	opts := scanOptions{count: 10}
+	for i := 0; i < len(args); i++ {
+		option := strings.ToUpper(args[i].bulk)
+		switch {
+		case option == "COUNT" && i+1 < len(args):
+			count, err := strconv.ParseInt(args[i+1].bulk, 10, 64)
+			if err != nil {
+				return opts, ErrNotInteger
+			}
+			if count < 1 {
+				return opts, errors.New("ERR syntax error")
+			}
+			opts.count = int(min(count, math.MaxInt32))
+			i++
+		case option == "MATCH" && i+1 < len(args):
+			opts.match = args[i+1].bulk
+			i++
+		case option == "TYPE" && i+1 < len(args) && name == "scan":
+			typ, ok := parseObjectType(args[i+1].bulk)
+			if !ok {
+				return opts, fmt.Errorf("ERR unknown type name '%s'", args[i+1].bulk)
+			}
+			opts.typ, opts.hasType = typ, true
+			i++
+		case option == "NOVALUES" && name == "hscan", option == "NOSCORES" && name == "zscan":
+			opts.noValues = true
+		default:
+			return opts, errors.New("ERR syntax error")
+		}
+	}
+	return opts, nil
+}
+
+// parseObjectType returns the type named like the TYPE command names it
+func parseObjectType(name string) (ObjectType, bool) {
+	for typ := StringType; typ <= StreamType; typ++ {
+		if strings.EqualFold(typ.String(), name) {
+			return typ, true
+		}
+	}
+	return 0, false
+}
+
+// scanReply builds the reply of the scan commands, the next cursor and the elements found
+func scanReply(cursor uint64, elements []Value) Value {
+	return Value{typ: "array", array: []Value{
+		{typ: "bulk", bulk: strconv.FormatUint(cursor, 10)},
+		{typ: "array", array: elements},
+	}}
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+func scan(c *Client, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'scan' command"}
+	}
+	cursor, err := parseScanCursor(args[0].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	opts, err := parseScanOptions(args[1:], "scan")
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	cursor, keys := ds_scan(c.db, cursor, opts)
+	elements := make([]Value, 0, len(keys))
+	for _, key := range keys {
+		elements = append(elements, Value{typ: "bulk", bulk: key})
+	}
+	return scanReply(cursor, elements)
+}
+
+// SSCAN key cursor [MATCH pattern] [COUNT count]
+func sscan(c *Client, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'sscan' command"}
+	}
+	cursor, err := parseScanCursor(args[1].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	opts, err := parseScanOptions(args[2:], "sscan")
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	cursor, members, err := ds_sscan(c.db, args[0].bulk, cursor, opts)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	elements := make([]Value, 0, len(members))
+	for _, member := range members {
+		elements = append(elements, Value{typ: "bulk", bulk: member})
+	}
+	return scanReply(cursor, elements)
+}
+
+// HSCAN key cursor [MATCH pattern] [COUNT count] [NOVALUES]
+func hscan(c *Client, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'hscan' command"}
+	}
+	cursor, err := parseScanCursor(args[1].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	opts, err := parseScanOptions(args[2:], "hscan")
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	cursor, fields, err := ds_hscan(c.db, args[0].bulk, cursor, opts)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	elements := make([]Value, 0, 2*len(fields))
+	for _, field := range fields {
+		elements = append(elements, Value{typ: "bulk", bulk: field.key})
+		if !opts.noValues {
+			elements = append(elements, Value{typ: "bulk", bulk: field.value})
+		}
+	}
+	return scanReply(cursor, elements)
+}
+
+// ZSCAN key cursor [MATCH pattern] [COUNT count] [NOSCORES]
+func zscan(c *Client, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'zscan' command"}
+	}
+	cursor, err := parseScanCursor(args[1].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	opts, err := parseScanOptions(args[2:], "zscan")
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	cursor, members, err := ds_zscan(c.db, args[0].bulk, cursor, opts)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	elements := make([]Value, 0, 2*len(members))
+	for _, member := range members {
+		elements = append(elements, Value{typ: "bulk", bulk: member.member})
+		// the scores are strings whatever the protocol, like in redis
+		if !opts.noValues {
+			elements = append(elements, Value{typ: "bulk", bulk: formatDouble(member.score)})
+		}
+	}
+	return scanReply(cursor, elements)
+}
+
+// Generic commands
+
+// DEL key [key ...]
+func del(c *Client, args []Value) Value {
+	if len(args) == 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'del' command"}
+	}
+	keys := make([]string, 0)
+	for i := 0; i < len(args); i++ {
+		keys = append(keys, args[i].bulk)
+	}
+	deleted := ds_del(c.db, keys)
+	return Value{typ: "integer", num: deleted}
+}
+
+// UNLINK key [key ...]
+// there is no background freeing here so it behaves exactly like DEL
+func unlink(c *Client, args []Value) Value {
+	if len(args) == 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'unlink' command"}
+	}
+	return del(c, args)
+}
+
+// EXISTS key [key ...]
+func exists(c *Client, args []Value) Value {
+	if len(args) == 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'exists' command"}
+	}
+	keys := make([]string, 0)
+	for i := 0; i < len(args); i++ {
+		keys = append(keys, args[i].bulk)
+	}
+	count := ds_exists(c.db, keys)
+	return Value{typ: "integer", num: count}
+}
+
+// TYPE key
+func typeCommand(c *Client, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'type' command"}
+	}
+	return Value{typ: "string", str: ds_type(c.db, args[0].bulk)}
+}
+
+// RENAME key newkey
+func rename(c *Client, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'rename' command"}
+	}
+	_, err := ds_rename(c.db, args[0].bulk, args[1].bulk, false)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	return Value{typ: "string", str: "OK"}
+}
+
+// RENAMENX key newkey
+func renamenx(c *Client, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'renamenx' command"}
+	}
+	renamed, err := ds_rename(c.db, args[0].bulk, args[1].bulk, true)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if !renamed {
+		return Value{typ: "integer", num: 0}
+	}
+	return Value{typ: "integer", num: 1}
+}
+
+// COPY source destination [DB destination-db] [REPLACE]
+func copyCommand(c *Client, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'copy' command"}
+	}
+	source := args[0].bulk
+	destination := args[1].bulk
+	replace := false
+	dst := c.db
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i].bulk) {
+		case "REPLACE":
+			replace = true
+		case "DB":
+			if i+1 >= len(args) {
+				return Value{typ: "error", str: "ERR syntax error"}
+			}
+			db, err := parseDatabase(args[i+1].bulk)
+			if err != nil {
+				return Value{typ: "error", str: err.Error()}
+			}
+			dst = db
+			i++
+		default:
+			return Value{typ: "error", str: "ERR syntax error"}
+		}
+	}
+	if source == destination && dst == c.db {
+		return Value{typ: "error", str: "ERR source and destination objects are the same"}
+	}
+	if !ds_copy(c.db, dst, source, destination, replace) {
+		return Value{typ: "integer", num: 0}
+	}
+	return Value{typ: "integer", num: 1}
+}
+
+// DBSIZE
+func dbsize(c *Client, args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'dbsize' command"}
+	}
+	return Value{typ: "integer", num: ds_dbsize(c.db)}
+}
+
+// RANDOMKEY
+func randomkey(c *Client, args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'randomkey' command"}
+	}
+	key, ok := ds_randomkey(c.db)
+	if !ok {
+		return Value{typ: "null"}
+	}
+	return Value{typ: "bulk", bulk: key}
+}
+
+var ErrDbIndex = errors.New("ERR DB index is out of range")
+
+// parseDatabase returns the database whose index is arg
+func parseDatabase(arg string) (*Keyspace, error) {
+	index, err := strconv.Atoi(arg)
+	if err != nil {
+		return nil, ErrNotInteger
+	}
+	if index < 0 || index >= len(databases) {
+		return nil, ErrDbIndex
+	}
+	return databases[index], nil
+}
+
+// MOVE key db
+func move(c *Client, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'move' command"}
+	}
+	dst, err := parseDatabase(args[1].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	if dst == c.db {
+		return Value{typ: "error", str: "ERR source and destination objects are the same"}
+	}
+	if !ds_move(c.db, dst, args[0].bulk) {
+		c.preventPropagation()
+		return Value{typ: "integer", num: 0}
+	}
+	return Value{typ: "integer", num: 1}
+}
+
+// SWAPDB index1 index2
+func swapdb(c *Client, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'swapdb' command"}
+	}
+	first, err := strconv.Atoi(args[0].bulk)
+	if err != nil {
+		return Value{typ: "error", str: "ERR invalid first DB index"}
+	}
+	second, err := strconv.Atoi(args[1].bulk)
+	if err != nil {
+		return Value{typ: "error", str: "ERR invalid second DB index"}
+	}
+	if first < 0 || first >= len(databases) || second < 0 || second >= len(databases) {
+		return Value{typ: "error", str: ErrDbIndex.Error()}
+	}
+	if first != second {
+		ds_swapdb(databases[first], databases[second])
+	}
+	return Value{typ: "string", str: "OK"}
+}
+
+// parseFlushMode checks the optional ASYNC or SYNC argument of FLUSHDB and FLUSHALL,
+// the keys are always freed right away
+func parseFlushMode(args []Value) error {
+	if len(args) > 1 {
+		return errors.New("ERR syntax error")
+	}
+	if len(args) == 1 {
+		mode := strings.ToUpper(args[0].bulk)
+		if mode != "ASYNC" && mode != "SYNC" {
+			return errors.New("ERR syntax error")
+		}
+	}
+	return nil
+}
+
+// FLUSHDB [ASYNC | SYNC]
+func flushdb(c *Client, args []Value) Value {
+	if err := parseFlushMode(args); err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	ds_flushdb(c.db)
+	return Value{typ: "string", str: "OK"}
+}
+
+// FLUSHALL [ASYNC | SYNC]
+func flushall(c *Client, args []Value) Value {
+	if err := parseFlushMode(args); err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+	ds_flushall()
+	return Value{typ: "string", str: "OK"}
+}
+
+// Expire commands
+
+// EXPIRE key seconds [NX | XX | GT | LT]
+func expire(c *Client, args []Value) Value {
+	return expireGeneric(c, args, "expire", mstime(), time.Second)
+}
+
+// PEXPIRE key milliseconds [NX | XX | GT | LT]
+func pexpire(c *Client, args []Value) Value {
+	return expireGeneric(c, args, "pexpire", mstime(), time.Millisecond)
+}
+
+// EXPIREAT key unix-time-seconds [NX | XX | GT | LT]
+func expireat(c *Client, args []Value) Value {
+	return expireGeneric(c, args, "expireat", 0, time.Second)
+}
+
+// PEXPIREAT key unix-time-milliseconds [NX | XX | GT | LT]
+func pexpireat(c *Client, args []Value) Value {
+	return expireGeneric(c, args, "pexpireat", 0, time.Millisecond)
+}
+
+// expireGeneric implements the whole EXPIRE family, the time given by the client
+// is in unit and is added to basetime which is the current time for the relative
+// commands and 0 for the absolute ones
+// The aof always gets the absolute time in milliseconds through PEXPIREAT
+func expireGeneric(c *Client, args []Value, name string, basetime int64, unit time.Duration) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", name)}
+	}
+	key := args[0].bulk
+	when, err := strconv.ParseInt(args[1].bulk, 10, 64)
+	if err != nil {
+		return Value{typ: "error", str: ErrNotInteger.Error()}
+	}
+
+	flags, err := parseExpireFlags(args[2:])
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	invalidExpireTime := Value{typ: "error", str: fmt.Sprintf("ERR invalid expire time in '%s' command", name)}
+	if unit == time.Second {
+		if when > math.MaxInt64/1000 || when < math.MinInt64/1000 {
+			return invalidExpireTime
+		}
+		when *= 1000
+	}
+	if (when > 0 && basetime > math.MaxInt64-when) || (when < 0 && basetime < math.MinInt64-when) {
+		return invalidExpireTime
+	}
+	when += basetime
+
+	updated, deleted := ds_expire(c.db, key, when, flags)
+	switch {
+	case deleted:
+		// a time in the past deletes the key
+		c.rewriteCommand("DEL", key)
+	case updated == 1:
+		c.rewriteCommand("PEXPIREAT", key, strconv.FormatInt(when, 10))
+	default:
+		c.preventPropagation()
+	}
+	return Value{typ: "integer", num: updated}
+}
+
+func parseExpireFlags(args []Value) (expireFlags, error) {
+	flags := expireFlags{}
+	for _, arg := range args {
+		switch strings.ToUpper(arg.bulk) {
+		case "NX":
+			flags.nx = true
+		case "XX":
+			flags.xx = true
+		case "GT":
+			flags.gt = true
+		case "LT":
+			flags.lt = true
+		default:
+			return flags, fmt.Errorf("ERR Unsupported option %s", arg.bulk)
+		}
+	}
+	if flags.nx && (flags.xx || flags.gt || flags.lt) {
+		return flags, errors.New("ERR NX and XX, GT or LT options at the same time are not compatible")
+	}
+	if flags.gt && flags.lt {
+		return flags, errors.New("ERR GT and LT options at the same time are not compatible")
+	}
+	return flags, nil
+}
+
+// TTL key
+func ttl(c *Client, args []Value) Value {
+	return ttlGeneric(c, args, "ttl", false, false)
+}
+
+// PTTL key
+func pttl(c *Client, args []Value) Value {
+	return ttlGeneric(c, args, "pttl", true, false)
+}
+
+// EXPIRETIME key
+func expiretime(c *Client, args []Value) Value {
+	return ttlGeneric(c, args, "expiretime", false, true)
+}
+
+// PEXPIRETIME key
+func pexpiretime(c *Client, args []Value) Value {
+	return ttlGeneric(c, args, "pexpiretime", true, true)
+}
+
+// ttlGeneric replies with the remaining time to live of the key, or with the
+// unix time at which it expires when absolute is set
+// -2 means the key does not exist and -1 that it has no time to live
+func ttlGeneric(c *Client, args []Value, name string, milliseconds bool, absolute bool) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", name)}
+	}
+	when := ds_pexpiretime(c.db, args[0].bulk)
+	if when < 0 {
+		return Value{typ: "integer", num: when}
+	}
+
+	if !absolute {
+		when -= mstime()
+		if when < 0 {
+			when = 0
+		}
+		if !milliseconds {
+			// round to the closest second
+			return Value{typ: "integer", num: (when + 500) / 1000}
+		}
+		return Value{typ: "integer", num: when}
+	}
+	if !milliseconds {
+		return Value{typ: "integer", num: when / 1000}
+	}
+	return Value{typ: "integer", num: when}
+}
+
+// PERSIST key
+func persist(c *Client, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'persist' command"}
+	}
+	removed := ds_persist(c.db, args[0].bulk)
+	if removed == 0 {
+		c.preventPropagation()
+	}
+	return Value{typ: "integer", num: removed}
 }
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// HyperLogLog following the layout of redis so that the strings holding
+// them can be exchanged with it, GET returns the same bytes redis would.
+//
+// The string starts with a 16 bytes header:
+//
+//	"HYLL" | encoding (1 byte) | 3 unused bytes | cached cardinality (8 bytes little endian)
+//
+// the most significant bit of the cached cardinality is set once the
+// cache is not valid anymore.
+//
+// The 16384 registers follow. The dense encoding packs them in 6 bits
+// each, the least significant bits first. The sparse encoding describes
+// runs of registers with three opcodes:
+//
+//	ZERO  00xxxxxx          xxxxxx+1 registers set to 0, up to 64
+//	XZERO 01xxxxxx yyyyyyyy the 14 bits value+1 registers set to 0, up to 16384
+//	VAL   1vvvvvxx          xx+1 registers set to vvvvv+1, up to 4 registers up to 32
+//
+// A sparse HyperLogLog is converted to the dense encoding when a register
+// goes above 32 or when it grows above hll-sparse-max-bytes.
+const (
+	hllP           = 14 // bits of the hash selecting the register
+	hllQ           = 64 - hllP
+	hllRegisters   = 1 << hllP
+	hllBits        = 6
+	hllRegisterMax = 1<<hllBits - 1
+	hllHeaderSize  = 16
+	hllDenseSize   = hllHeaderSize + (hllRegisters*hllBits+7)/8
+	hllDense       = 0
+	hllSparse      = 1
+	hllAlphaInf    = 0.721347520444481703680
+
+	hllSparseZeroMaxLen  = 64
+	hllSparseXZeroMaxLen = 16384
+	hllSparseValMaxValue = 32
+	hllSparseValMaxLen   = 4
+
+	// seed of the hash of the elements
+	hllHashSeed = 0xadc83b19
+)
+
+var ErrInvalidHLL = errors.New("WRONGTYPE Key is not a valid HyperLogLog string value.")
+var ErrCorruptedHLL = errors.New("INVALIDOBJ Corrupted HLL object detected")
+
+// murmurHash64A is the 64 bits MurmurHash2 by Austin Appleby,
+// reading the blocks as little endian like redis does on every platform
+func murmurHash64A(data []byte, seed uint64) uint64 {
+	const m = 0xc6a4a7935bd1e995
+	const r = 47
+	h := seed ^ (uint64(len(data)) * m)
+	for len(data) >= 8 {
+		k := binary.LittleEndian.Uint64(data)
+		k *= m
+		k ^= k >> r
+		k *= m
+		h ^= k
+		h *= m
+		data = data[8:]
+	}
+	if len(data) > 0 {
+		for i := len(data) - 1; i >= 0; i-- {
+			h ^= uint64(data[i]) << (8 * i)
+		}
+		h *= m
+	}
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+	return h
+}
+
+// hllPatLen returns the register selected by the element and the
+// length of the run of zeros of the rest of its hash plus one
+func hllPatLen(element string) (int, uint8) {
+	hash := murmurHash64A([]byte(element), hllHashSeed)
+	index := int(hash & (hllRegisters - 1))
+	// the bit above the Q bits stops the count
+	hash >>= hllP
+	hash |= 1 << hllQ
+	count := uint8(1)
+	for bit := uint64(1); hash&bit == 0; bit <<= 1 {
+		count++
+	}
+	return index, count
+}
+
+// hllCreate returns an empty sparse HyperLogLog, its cached cardinality is 0
+func hllCreate() []byte {
+	hll := make([]byte, hllHeaderSize, hllHeaderSize+2)
+	copy(hll, "HYLL")
+	hll[4] = hllSparse
+	for zeros := hllRegisters; zeros > 0; zeros -= hllSparseXZeroMaxLen {
+		hll = hllAppendZeros(hll, min(zeros, hllSparseXZeroMaxLen))
+	}
+	return hll
+}
+
+// isHLL reports whether the string looks like a HyperLogLog
+func isHLL(hll []byte) bool {
+	if len(hll) < hllHeaderSize || string(hll[:4]) != "HYLL" || hll[4] > hllSparse {
+		return false
+	}
+	return hll[4] != hllDense || len(hll) == hllDenseSize
+}
+
+func hllCachedCardinality(hll []byte) (uint64, bool) {
+	if hll[15]&0x80 != 0 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint64(hll[8:16]), true
+}
+
+func hllSetCachedCardinality(hll []byte, card uint64) {
+	binary.LittleEndian.PutUint64(hll[8:16], card)
+}
+
+func hllInvalidateCache(hll []byte) {
+	hll[15] |= 0x80
+}
+
+// hllDenseGet returns the register at index, registers are the bytes after the header
+func hllDenseGet(registers []byte, index int) uint8 {
+	pos := index * hllBits / 8
+	fb := uint(index * hllBits & 7)
+	b0 := uint(registers[pos])
+	var b1 uint
+	// the last register does not span two bytes
+	if pos+1 < len(registers) {
+		b1 = uint(registers[pos+1])
+	}
+	return uint8((b0>>fb | b1<<(8-fb)) & hllRegisterMax)
+}
+
+// hllDenseSet raises the register at index to count,
+// it returns false if the register was already as high
+func hllDenseSet(registers []byte, index int, count uint8) bool {
+	if count <= hllDenseGet(registers, index) {
+		return false
+	}
+	pos := index * hllBits / 8
+	fb := uint(index * hllBits & 7)
+	registers[pos] &^= byte(hllRegisterMax << fb)
+	registers[pos] |= count << fb
+	if pos+1 < len(registers) {
+		registers[pos+1] &^= byte(hllRegisterMax >> (8 - fb))
+		registers[pos+1] |= count >> (8 - fb)
+	}
+	return true
+}
+
+func hllSparseIsZero(op byte) bool  { return op&0xc0 == 0 }
+func hllSparseIsXZero(op byte) bool { return op&0xc0 == 0x40 }
+func hllSparseIsVal(op byte) bool   { return op&0x80 != 0 }
+
+func hllSparseZeroLen(op byte) int             { return int(op&0x3f) + 1 }
+func hllSparseXZeroLen(op byte, next byte) int { return (int(op&0x3f)<<8 | int(next)) + 1 }
+func hllSparseValValue(op byte) uint8          { return (op>>2)&0x1f + 1 }
+func hllSparseValLen(op byte) int              { return int(op&0x3) + 1 }
+
+func hllSparseVal(value uint8, length int) byte {
+	return (value-1)<<2 | byte(length-1) | 0x80
+}
+
+// hllAppendZeros appends a ZERO or a XZERO opcode for length registers
+func hllAppendZeros(ops []byte, length int) []byte {
+	if length > hllSparseZeroMaxLen {
+		length--
+		return append(ops, byte(length>>8)|0x40, byte(length&0xff))
+	}
+	return append(ops, byte(length-1))
+}
+
+// hllSparseToDense converts a sparse HyperLogLog to the dense encoding
+// keeping its header, dense ones are returned as they are
+func hllSparseToDense(hll []byte) ([]byte, error) {
+	if hll[4] == hllDense {
+		return hll, nil
+	}
+	dense := make([]byte, hllDenseSize)
+	copy(dense, hll[:hllHeaderSize])
+	dense[4] = hllDense
+	registers := dense[hllHeaderSize:]
+	sparse := hll[hllHeaderSize:]
+	index := 0
+	for p := 0; p < len(sparse); {
+		op := sparse[p]
+		switch {
+		case hllSparseIsZero(op):
+			index += hllSparseZeroLen(op)
+			p++
+		case hllSparseIsXZero(op):
+			if p+1 == len(sparse) {
+				return nil, ErrCorruptedHLL
+			}
+			index += hllSparseXZeroLen(op, sparse[p+1])
+			p += 2
+		default:
+			runLen, value := hllSparseValLen(op), hllSparseValValue(op)
+			if index+runLen > hllRegisters {
+				return nil, ErrCorruptedHLL
+			}
+			for end := index + runLen; index < end; index++ {
+				hllDenseSet(registers, index, value)
+			}
+			p++
+		}
+	}
+	if index != hllRegisters {
+		return nil, ErrCorruptedHLL
+	}
+	return dense, nil
+}
+
+// hllSparseSet raises the register at index to count rewriting the opcode
+// covering it, the HyperLogLog is converted to the dense encoding when the
+// count does not fit or the result would be too big. It returns the
+// HyperLogLog, which may have moved, and whether the register changed
+func hllSparseSet(hll []byte, index int, count uint8) ([]byte, bool, error) {
+	if count > hllSparseValMaxValue {
+		return hllPromoteAndSet(hll, index, count)
+	}
+
+	// find the opcode covering the register, first is the first
+	// register it covers and prev the position of the previous one
+	sparse := hll[hllHeaderSize:]
+	p, prev, first, span, opLen := 0, 0, 0, 0, 1
+	for p < len(sparse) {
+		op := sparse[p]
+		opLen = 1
+		if hllSparseIsZero(op) {
+			span = hllSparseZeroLen(op)
+		} else if hllSparseIsVal(op) {
+			span = hllSparseValLen(op)
+		} else {
+			if p+1 == len(sparse) {
+				return hll, false, ErrCorruptedHLL
+			}
+			span = hllSparseXZeroLen(op, sparse[p+1])
+			opLen = 2
+		}
+		if index <= first+span-1 {
+			break
+		}
+		prev = p
+		p += opLen
+		first += span
+	}
+	if span == 0 || p >= len(sparse) {
+		return hll, false, ErrCorruptedHLL
+	}
+
+	op := sparse[p]
+	isVal, isZero := hllSparseIsVal(op), hllSparseIsZero(op)
+	if isVal {
+		if hllSparseValValue(op) >= count {
+			return hll, false, nil
+		}
+		// a single register is updated in place
+		if span == 1 {
+			sparse[p] = hllSparseVal(count, 1)
+			return hllSparseMergeValues(hll, prev), true, nil
+		}
+	}
+	if isZero && span == 1 {
+		sparse[p] = hllSparseVal(count, 1)
+		return hllSparseMergeValues(hll, prev), true, nil
+	}
+
+	// otherwise the opcode is split in the registers before the one set,
+	// the register set and the registers after it
+	last := first + span - 1
+	seq := make([]byte, 0, 5)
+	if isVal {
+		value := hllSparseValValue(op)
+		if index != first {
+			seq = append(seq, hllSparseVal(value, index-first))
+		}
+		seq = append(seq, hllSparseVal(count, 1))
+		if index != last {
+			seq = append(seq, hllSparseVal(value, last-index))
+		}
+	} else {
+		if index != first {
+			seq = hllAppendZeros(seq, index-first)
+		}
+		seq = append(seq, hllSparseVal(count, 1))
+		if index != last {
+			seq = hllAppendZeros(seq, last-index)
+		}
+	}
+	if delta := len(seq) - opLen; delta > 0 && len(hll)+delta > config.hllSparseMaxBytes {
+		return hllPromoteAndSet(hll, index, count)
+	}
+	updated := make([]byte, 0, len(hll)+len(seq)-opLen)
+	updated = append(updated, hll[:hllHeaderSize+p]...)
+	updated = append(updated, seq...)
+	updated = append(updated, hll[hllHeaderSize+p+opLen:]...)
+	return hllSparseMergeValues(updated, prev), true, nil
+}
+
+// hllPromoteAndSet converts the HyperLogLog to the dense encoding and sets the register
+func hllPromoteAndSet(hll []byte, index int, count uint8) ([]byte, bool, error) {
+	dense, err := hllSparseToDense(hll)
+	if err != nil {
+		return hll, false, err
+	}
+	hllDenseSet(dense[hllHeaderSize:], index, count)
+	return dense, true, nil
+}
+
+// hllSparseMergeValues merges adjacent VAL opcodes having the same value
+// looking at the few opcodes following start, where an opcode was just split
+func hllSparseMergeValues(hll []byte, start int) []byte {
+	sparse := hll[hllHeaderSize:]
+	p := start
+	for scan := 5; p < len(sparse) && scan > 0; scan-- {
+		if hllSparseIsXZero(sparse[p]) {
+			p += 2
+			continue
+		}
+		if hllSparseIsZero(sparse[p]) {
+			p++
+			continue
+		}
+		if p+1 < len(sparse) && hllSparseIsVal(sparse[p+1]) {
+			value := hllSparseValValue(sparse[p])
+			length := hllSparseValLen(sparse[p]) + hllSparseValLen(sparse[p+1])
+			if value == hllSparseValValue(sparse[p+1]) && length <= hllSparseValMaxLen {
+				sparse[p+1] = hllSparseVal(value, length)
+				sparse = append(sparse[:p], sparse[p+1:]...)
+				// try merging the result with the opcode on its right
+				continue
+			}
+		}
+		p++
+	}
+	return hll[:hllHeaderSize+len(sparse)]
+}
+
+// hllAdd adds the element to the HyperLogLog, it returns the HyperLogLog
+// which may have moved and whether one of its registers changed
+func hllAdd(hll []byte, element string) ([]byte, bool, error) {
+	index, count := hllPatLen(element)
+	switch hll[4] {
+	case hllDense:
+		return hll, hllDenseSet(hll[hllHeaderSize:], index, count), nil
+	case hllSparse:
+		return hllSparseSet(hll, index, count)
+	}
+	return hll, false, ErrCorruptedHLL
+}
+
+// hllMerge raises the registers in max to the ones of the HyperLogLog
+func hllMerge(max []uint8, hll []byte) error {
+	if hll[4] == hllDense {
+		registers := hll[hllHeaderSize:]
+		for i := range max {
+			if value := hllDenseGet(registers, i); value > max[i] {
+				max[i] = value
+			}
+		}
+		return nil
+	}
+	sparse := hll[hllHeaderSize:]
+	index := 0
+	for p := 0; p < len(sparse); {
+		op := sparse[p]
+		switch {
+		case hllSparseIsZero(op):
+			index += hllSparseZeroLen(op)
+			p++
+		case hllSparseIsXZero(op):
+			if p+1 == len(sparse) {
+				return ErrCorruptedHLL
+			}
+			index += hllSparseXZeroLen(op, sparse[p+1])
+			p += 2
+		default:
+			runLen, value := hllSparseValLen(op), hllSparseValValue(op)
+			if index+runLen > hllRegisters {
+				return ErrCorruptedHLL
+			}
+			for end := index + runLen; index < end; index++ {
+				if value > max[index] {
+					max[index] = value
+				}
+			}
+			p++
+		}
+	}
+	if index != hllRegisters {
+		return ErrCorruptedHLL
+	}
+	return nil
+}
+
+// hllCount estimates the cardinality of the HyperLogLog
+func hllCount(hll []byte) (uint64, error) {
+	registers := make([]uint8, hllRegisters)
+	if err := hllMerge(registers, hll); err != nil {
+		return 0, err
+	}
+	return hllCountRegisters(registers), nil
+}
+
+// hllCountRegisters estimates the cardinality from the registers using the
+// estimator of Otmar Ertl's "New cardinality estimation algorithms for
+// HyperLogLog sketches", the same one redis uses
+func hllCountRegisters(registers []uint8) uint64 {
+	var histogram [hllRegisterMax + 1]int
+	for _, value := range registers {
+		histogram[value]++
+	}
+	m := float64(hllRegisters)
+	z := m * hllTau((m-float64(histogram[hllQ+1]))/m)
+	for j := hllQ; j >= 1; j-- {
+		z += float64(histogram[j])
+		z *= 0.5
+	}
+	z += m * hllSigma(float64(histogram[0])/m)
+	return uint64(math.Round(hllAlphaInf * m * m / z))
+}
+
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y, z := 1.0, x
+	for {
+		x *= x
+		zPrime := z
+		z += x * y
+		y += y
+		if zPrime == z {
+			return z
+		}
+	}
+}
+
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y, z := 1.0, 1-x
+	for {
+		x = math.Sqrt(x)
+		zPrime := z
+		y *= 0.5
+		z -= math.Pow(1-x, 2) * y
+		if zPrime == z {
+			return z / 3
+		}
+	}
+}
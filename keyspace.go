@@ -0,0 +1,797 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Types of the values which can be stored in the keyspace
+type ObjectType int
+
+const (
+	StringType ObjectType = iota
+	ListType
+	SetType
+	HashType
+	ZSetType
+	StreamType
+)
+
+// String returns the name of the type as replied by the TYPE command
+func (t ObjectType) String() string {
+	switch t {
+	case StringType:
+		return "string"
+	case ListType:
+		return "list"
+	case SetType:
+		return "set"
+	case HashType:
+		return "hash"
+	case ZSetType:
+		return "zset"
+	case StreamType:
+		return "stream"
+	default:
+		return "none"
+	}
+}
+
+// Data structure representing a value stored in the keyspace
+// Only the field matching typ is used
+type Object struct {
+	typ    ObjectType
+	str    string
+	list   *List
+	set    *Dict[struct{}]
+	hash   *Dict[string]
+	zset   *ZSet
+	stream *Stream
+	// unix time in milliseconds at which the fields of the hash expire,
+	// only the fields with a time to live have an entry
+	hashExpires map[string]int64
+}
+
+func newStringObject(value string) *Object {
+	return &Object{typ: StringType, str: value}
+}
+
+func newListObject() *Object {
+	return &Object{typ: ListType, list: &List{head: nil, tail: nil, length: 0}}
+}
+
+func newSetObject() *Object {
+	return &Object{typ: SetType, set: newDict[struct{}]()}
+}
+
+func newHashObject() *Object {
+	return &Object{typ: HashType, hash: newDict[string]()}
+}
+
+func newZSetObject() *Object {
+	return &Object{typ: ZSetType, zset: newZSet()}
+}
+
+func newStreamObject() *Object {
+	return &Object{typ: StreamType, stream: newStream()}
+}
+
+// duplicate returns a deep copy of the object, used by COPY
+func (o *Object) duplicate() *Object {
+	switch o.typ {
+	case ListType:
+		dup := newListObject()
+		for _, value := range ds_ltrav(o.list) {
+			dup.list.pushTail(value)
+		}
+		return dup
+	case SetType:
+		dup := newSetObject()
+		for member := range o.set.keys() {
+			dup.set.set(member, struct{}{})
+		}
+		return dup
+	case HashType:
+		dup := newHashObject()
+		for field, value := range o.hash.all() {
+			dup.hash.set(field, value)
+		}
+		for field, when := range o.hashExpires {
+			dup.setHashFieldExpire(field, when)
+		}
+		return dup
+	case ZSetType:
+		dup := newZSetObject()
+		for _, element := range o.zset.elements() {
+			dup.zset.add(element.score, element.member, zaddFlags{})
+		}
+		return dup
+	case StreamType:
+		return &Object{typ: StreamType, stream: o.stream.duplicate()}
+	default:
+		return newStringObject(o.str)
+	}
+}
+
+// Error returned when a command is used against a key holding another type
+var ErrWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+// Data structure holding every key of the database
+// Strings, lists, sets, hashes, sorted sets and streams all live in the same dict so a key
+// can only ever hold one type of value
+// Keys with a time to live also have an entry in expires
+// There is one Keyspace for every database, clients pick theirs with SELECT
+type Keyspace struct {
+	id      int // index of the database
+	mu      sync.RWMutex
+	dict    *Dict[*Object]
+	expires map[string]int64 // unix time in milliseconds at which the key expires
+	// writing is true while mu is held for writing, expired keys found
+	// by a lookup are then deleted instead of just being hidden
+	writing bool
+	// clients blocked by BLPOP and friends, in order of arrival for every key
+	blocking map[string][]*blockedClient
+	// keys which may now serve some blocked client, see signalKeyAsReady
+	readyKeys    []string
+	readyKeysSet map[string]bool
+	// keys of the hashes which have fields with a time to live, used by the
+	// active expire cycle. Entries are removed lazily once the key no longer
+	// holds such a hash
+	hashFieldExpireKeys map[string]bool
+	// clients watching keys with WATCH, see signalModifiedKey
+	watchedKeys map[string][]*Client
+}
+
+func NewKeyspace(id int) *Keyspace {
+	return &Keyspace{
+		id:           id,
+		dict:         newDict[*Object](),
+		expires:      map[string]int64{},
+		blocking:     map[string][]*blockedClient{},
+		readyKeysSet: map[string]bool{},
+
+		hashFieldExpireKeys: map[string]bool{},
+		watchedKeys:         map[string][]*Client{},
+	}
+}
+
+// mstime returns the current unix time in milliseconds
+func mstime() int64 {
+	return time.Now().UnixMilli()
+}
+
+// The databases of the server, their number is set by the databases option
+var databases []*Keyspace
+
+func createDatabases() {
+	databases = make([]*Keyspace, config.databases)
+	for i := range databases {
+		databases[i] = NewKeyspace(i)
+	}
+}
+
+// lock acquires the keyspace for a command which modifies it
+func (ks *Keyspace) lock() {
+	ks.mu.Lock()
+	ks.writing = true
+}
+
+func (ks *Keyspace) unlock() {
+	ks.writing = false
+	ks.mu.Unlock()
+}
+
+// lockDatabases locks two databases for writing, they are always locked in the
+// same order so that commands using the same two databases can't deadlock
+func lockDatabases(a *Keyspace, b *Keyspace) {
+	if a == b {
+		a.lock()
+		return
+	}
+	if a.id > b.id {
+		a, b = b, a
+	}
+	a.lock()
+	b.lock()
+}
+
+func unlockDatabases(a *Keyspace, b *Keyspace) {
+	a.unlock()
+	if a != b {
+		b.unlock()
+	}
+}
+
+// The helpers below expect the caller to hold ks.mu
+
+// isExpired tells if the key has a time to live which already elapsed
+// While the aof is being replayed nothing expires, the DEL logged when the
+// key actually expired takes care of removing it at the right moment
+func (ks *Keyspace) isExpired(key string) bool {
+	if server.loading.Load() {
+		return false
+	}
+	when, ok := ks.expires[key]
+	return ok && when <= mstime()
+}
+
+// expireIfNeeded deletes the key if it is expired, it needs the keyspace locked for writing
+// Keys looked up with only the read lock held are hidden when they are expired
+// and are reclaimed by the next write or by the active expire cycle
+func (ks *Keyspace) expireIfNeeded(key string) bool {
+	if !ks.isExpired(key) {
+		return false
+	}
+	ks.deleteExpired(key)
+	return true
+}
+
+// deleteExpired removes a key whose time to live elapsed and logs a DEL to the aof,
+// so that the commands logged after it are replayed against the same keyspace
+func (ks *Keyspace) deleteExpired(key string) {
+	ks.dict.delete(key)
+	delete(ks.expires, key)
+	ks.signalModifiedKey(key)
+	ks.notifyKeyspaceEvent(notifyExpired, "expired", key)
+	propagateDel(ks.id, key)
+}
+
+// lookup returns the object stored at key, expired keys are reported as missing
+func (ks *Keyspace) lookup(key string) (*Object, bool) {
+	if ks.writing {
+		ks.expireIfNeeded(key)
+	}
+	obj, ok := ks.dict.get(key)
+	if !ok || ks.isExpired(key) {
+		return nil, false
+	}
+	// commands modifying a hash never see its expired fields
+	if ks.writing && len(obj.hashExpires) > 0 && !ks.expireHashFields(key, obj) {
+		return nil, false
+	}
+	return obj, true
+}
+
+// lookupType returns the object stored at key if it has the expected type
+// a missing key returns nil without an error
+func (ks *Keyspace) lookupType(key string, typ ObjectType) (*Object, error) {
+	obj, ok := ks.lookup(key)
+	if !ok {
+		return nil, nil
+	}
+	if obj.typ != typ {
+		return nil, ErrWrongType
+	}
+	return obj, nil
+}
+
+// lookupOrCreate returns the object stored at key creating it with
+// create if the key does not exist yet
+func (ks *Keyspace) lookupOrCreate(key string, typ ObjectType, create func() *Object) (*Object, error) {
+	obj, err := ks.lookupType(key, typ)
+	if err != nil {
+		return nil, err
+	}
+	if obj == nil {
+		obj = create()
+		ks.set(key, obj)
+	}
+	return obj, nil
+}
+
+// set stores the object at key overwriting whatever was there,
+// like in redis overwriting a key also discards its time to live
+func (ks *Keyspace) set(key string, obj *Object) {
+	if ks.dict.set(key, obj) {
+		ks.notifyKeyspaceEvent(notifyNew, "new", key)
+	}
+	delete(ks.expires, key)
+	ks.signalModifiedKey(key)
+	ks.signalKeyAsReady(key)
+	if len(obj.hashExpires) > 0 {
+		ks.hashFieldExpireKeys[key] = true
+	}
+}
+
+// delete removes the key and its time to live, it returns false
+// if the key did not exist or was already expired
+func (ks *Keyspace) delete(key string) bool {
+	if ks.expireIfNeeded(key) {
+		return false
+	}
+	if !ks.dict.delete(key) {
+		return false
+	}
+	delete(ks.expires, key)
+	ks.signalModifiedKey(key)
+	return true
+}
+
+// getExpire returns the unix time in milliseconds at which the key expires
+// keys without a time to live return -1
+func (ks *Keyspace) getExpire(key string) int64 {
+	when, ok := ks.expires[key]
+	if !ok {
+		return -1
+	}
+	return when
+}
+
+func (ks *Keyspace) setExpire(key string, when int64) {
+	ks.expires[key] = when
+	ks.signalModifiedKey(key)
+}
+
+// removeExpire makes the key persistent, returns false if it had no time to live
+func (ks *Keyspace) removeExpire(key string) bool {
+	if _, ok := ks.expires[key]; !ok {
+		return false
+	}
+	delete(ks.expires, key)
+	ks.signalModifiedKey(key)
+	return true
+}
+
+// Number of keys with a time to live checked by every loop of the active expire cycle
+const activeExpireCycleKeysPerLoop = 20
+
+// activeExpireCycle runs forever in its own go routine reclaiming the expired keys
+// which are never accessed again
+// Every 100ms it samples keys with a time to live in every database and deletes the
+// expired ones, if more than 25% of the sample was expired it is likely that many more
+// are so it samples again until it runs out of its 25ms time budget
+func activeExpireCycle() {
+	for {
+		time.Sleep(100 * time.Millisecond)
+
+		// like a command, so that keys don't expire in the middle of EXEC
+		server.cmdMu.RLock()
+		start := time.Now()
+		for _, db := range databases {
+			db.activeExpire(start)
+		}
+		server.cmdMu.RUnlock()
+	}
+}
+
+// activeExpire runs the active expire cycle started at start on the keys of ks
+func (ks *Keyspace) activeExpire(start time.Time) {
+	ks.lock()
+	defer ks.unlock()
+	for {
+		sampled, expired := 0, 0
+		now := mstime()
+		// go starts iterating maps at a random position
+		for key, when := range ks.expires {
+			if sampled == activeExpireCycleKeysPerLoop {
+				break
+			}
+			sampled++
+			if when <= now {
+				ks.deleteExpired(key)
+				expired++
+			}
+		}
+		if expired*4 <= sampled || time.Since(start) > 25*time.Millisecond {
+			break
+		}
+	}
+	ks.activeExpireHashFields()
+}
+
+// Hash field expiration
+// Fields of a hash can have their own time to live, like keys the expired
+// fields are hidden by the commands reading the hash, deleted by the ones
+// modifying it and reclaimed in the background by activeExpireHashFields
+
+// hashFieldExpired tells if the field has a time to live which already elapsed,
+// nothing expires while the aof is being replayed
+func (o *Object) hashFieldExpired(field string) bool {
+	if len(o.hashExpires) == 0 || server.loading.Load() {
+		return false
+	}
+	when, ok := o.hashExpires[field]
+	return ok && when <= mstime()
+}
+
+// hashGet returns the value of the field unless it is missing or expired
+func (o *Object) hashGet(field string) (string, bool) {
+	value, ok := o.hash.get(field)
+	if !ok || o.hashFieldExpired(field) {
+		return "", false
+	}
+	return value, true
+}
+
+// hashLen returns the number of fields which are not expired
+func (o *Object) hashLen() int {
+	if len(o.hashExpires) == 0 {
+		return o.hash.len()
+	}
+	length := 0
+	for field := range o.hash.keys() {
+		if !o.hashFieldExpired(field) {
+			length++
+		}
+	}
+	return length
+}
+
+// hashSet sets the field, like in redis overwriting a field discards its time to live
+func (o *Object) hashSet(field string, value string) {
+	o.hash.set(field, value)
+	delete(o.hashExpires, field)
+}
+
+// hashDelete removes the field together with its time to live
+func (o *Object) hashDelete(field string) {
+	o.hash.delete(field)
+	delete(o.hashExpires, field)
+}
+
+// getHashFieldExpire returns the unix time in milliseconds at which the field expires
+// fields without a time to live return -1
+func (o *Object) getHashFieldExpire(field string) int64 {
+	when, ok := o.hashExpires[field]
+	if !ok {
+		return -1
+	}
+	return when
+}
+
+func (o *Object) setHashFieldExpire(field string, when int64) {
+	if o.hashExpires == nil {
+		o.hashExpires = map[string]int64{}
+	}
+	o.hashExpires[field] = when
+}
+
+// expireHashFields deletes the expired fields of the hash stored at key and logs
+// an HDEL for them, the key is deleted together with its last field
+// It returns false if the key was deleted, it needs the keyspace locked for writing
+func (ks *Keyspace) expireHashFields(key string, obj *Object) bool {
+	expired := []string{}
+	for field := range obj.hashExpires {
+		if obj.hashFieldExpired(field) {
+			expired = append(expired, field)
+		}
+	}
+	if len(expired) == 0 {
+		return true
+	}
+	for _, field := range expired {
+		obj.hashDelete(field)
+	}
+	propagate(ks.id, append([]string{"HDEL", key}, expired...)...)
+	ks.signalModifiedKey(key)
+	ks.notifyKeyspaceEvent(notifyHash, "hexpired", key)
+	if obj.hash.len() == 0 {
+		ks.delete(key)
+		ks.notifyKeyspaceEvent(notifyGeneric, "del", key)
+		return false
+	}
+	return true
+}
+
+// trackHashFieldExpires makes the active expire cycle look at the hash stored at key
+func (ks *Keyspace) trackHashFieldExpires(key string) {
+	ks.hashFieldExpireKeys[key] = true
+}
+
+// activeExpireHashFields reclaims the expired fields of some of the hashes having
+// fields with a time to live, it is run by activeExpireCycle
+func (ks *Keyspace) activeExpireHashFields() {
+	sampled := 0
+	for key := range ks.hashFieldExpireKeys {
+		if sampled == activeExpireCycleKeysPerLoop {
+			break
+		}
+		sampled++
+		// looking the hash up for writing deletes its expired fields
+		obj, ok := ks.lookup(key)
+		if !ok || obj.typ != HashType || len(obj.hashExpires) == 0 {
+			delete(ks.hashFieldExpireKeys, key)
+		}
+	}
+}
+
+// Generic key commands
+
+func ds_del(db *Keyspace, keys []string) int64 {
+	db.lock()
+	defer db.unlock()
+	var deleted int64 = 0
+	for _, key := range keys {
+		if db.delete(key) {
+			db.notifyKeyspaceEvent(notifyGeneric, "del", key)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// ds_exists counts the keys which exist, a key given twice is counted twice
+func ds_exists(db *Keyspace, keys []string) int64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var count int64 = 0
+	for _, key := range keys {
+		if _, ok := db.lookup(key); ok {
+			count++
+		}
+	}
+	return count
+}
+
+func ds_type(db *Keyspace, key string) string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	obj, ok := db.lookup(key)
+	if !ok {
+		return "none"
+	}
+	return obj.typ.String()
+}
+
+var ErrNoSuchKey = errors.New("ERR no such key")
+
+// ds_rename moves the value at key to newkey, with nx set nothing is done
+// if newkey already exists and false is returned
+func ds_rename(db *Keyspace, key string, newkey string, nx bool) (bool, error) {
+	db.lock()
+	defer db.unlock()
+	obj, ok := db.lookup(key)
+	if !ok {
+		return false, ErrNoSuchKey
+	}
+	if nx {
+		if _, exists := db.lookup(newkey); exists {
+			return false, nil
+		}
+	}
+	if key == newkey {
+		return true, nil
+	}
+	// the time to live moves together with the value
+	when := db.getExpire(key)
+	db.delete(key)
+	db.set(newkey, obj)
+	if when != -1 {
+		db.setExpire(newkey, when)
+	}
+	db.notifyKeyspaceEvent(notifyGeneric, "rename_from", key)
+	db.notifyKeyspaceEvent(notifyGeneric, "rename_to", newkey)
+	return true, nil
+}
+
+// ds_copy copies the value at source to destination in the database dst,
+// unless replace is set nothing is done if destination already exists
+func ds_copy(db *Keyspace, dst *Keyspace, source string, destination string, replace bool) bool {
+	lockDatabases(db, dst)
+	defer unlockDatabases(db, dst)
+	obj, ok := db.lookup(source)
+	if !ok {
+		return false
+	}
+	if _, exists := dst.lookup(destination); exists && !replace {
+		return false
+	}
+	dst.set(destination, obj.duplicate())
+	if when := db.getExpire(source); when != -1 {
+		dst.setExpire(destination, when)
+	}
+	dst.notifyKeyspaceEvent(notifyGeneric, "copy_to", destination)
+	return true
+}
+
+// ds_move moves the key to the database dst together with its time to live,
+// nothing is done if the key is missing or if it already exists in dst
+func ds_move(db *Keyspace, dst *Keyspace, key string) bool {
+	lockDatabases(db, dst)
+	defer unlockDatabases(db, dst)
+	obj, ok := db.lookup(key)
+	if !ok {
+		return false
+	}
+	if _, exists := dst.lookup(key); exists {
+		return false
+	}
+	when := db.getExpire(key)
+	db.delete(key)
+	dst.set(key, obj)
+	if when != -1 {
+		dst.setExpire(key, when)
+	}
+	db.notifyKeyspaceEvent(notifyGeneric, "move_from", key)
+	dst.notifyKeyspaceEvent(notifyGeneric, "move_to", key)
+	return true
+}
+
+// ds_swapdb exchanges the keys of two databases, the clients connected to
+// one of them now see the keys of the other one
+// Clients blocked on keys stay in their database, the keys which now
+// exist there may serve them
+func ds_swapdb(a *Keyspace, b *Keyspace) {
+	lockDatabases(a, b)
+	defer unlockDatabases(a, b)
+	a.touchAllWatchedKeys(b)
+	b.touchAllWatchedKeys(a)
+	a.dict, b.dict = b.dict, a.dict
+	a.expires, b.expires = b.expires, a.expires
+	a.hashFieldExpireKeys, b.hashFieldExpireKeys = b.hashFieldExpireKeys, a.hashFieldExpireKeys
+	for _, db := range []*Keyspace{a, b} {
+		for key := range db.blocking {
+			if _, ok := db.lookup(key); ok {
+				db.signalKeyAsReady(key)
+			}
+		}
+	}
+}
+
+// ds_flushdb removes every key of the database
+func ds_flushdb(db *Keyspace) {
+	db.lock()
+	defer db.unlock()
+	db.touchAllWatchedKeys(nil)
+	db.dict = newDict[*Object]()
+	db.expires = map[string]int64{}
+	db.hashFieldExpireKeys = map[string]bool{}
+}
+
+// ds_flushall removes every key of every database
+func ds_flushall() {
+	for _, db := range databases {
+		ds_flushdb(db)
+	}
+}
+
+// ds_keys returns the keys matching the glob pattern
+func ds_keys(db *Keyspace, pattern string) []string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	keys := make([]string, 0)
+	for key := range db.dict.keys() {
+		if db.isExpired(key) {
+			continue
+		}
+		if pattern == "*" || stringMatch(pattern, key, false) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Options of SCAN, SSCAN, HSCAN and ZSCAN
+type scanOptions struct {
+	match    string     // only return the elements matching this glob pattern, "" for all
+	count    int        // how many elements to look at, more or less
+	typ      ObjectType // only return the keys holding this type, SCAN only
+	hasType  bool
+	noValues bool // HSCAN only returns the fields, ZSCAN only the members
+}
+
+func (opts scanOptions) matches(element string) bool {
+	return opts.match == "" || opts.match == "*" || stringMatch(opts.match, element, false)
+}
+
+// ds_scan returns the keys found in the next buckets of the keyspace from
+// cursor on and the cursor to continue with, 0 once the iteration is over.
+// A key present from the first call to the last one is returned at least
+// once, even when keys were added or removed in the meantime
+func ds_scan(db *Keyspace, cursor uint64, opts scanOptions) (uint64, []string) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	keys := make([]string, 0)
+	cursor = scanDict(db.dict, cursor, opts.count, func(key string, obj *Object) {
+		if db.isExpired(key) || !opts.matches(key) {
+			return
+		}
+		if opts.hasType && obj.typ != opts.typ {
+			return
+		}
+		keys = append(keys, key)
+	})
+	return cursor, keys
+}
+
+func ds_dbsize(db *Keyspace) int64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return int64(db.dict.len())
+}
+
+// Number of random keys RANDOMKEY tries before looking for a key which
+// is not expired in the whole keyspace
+const randomKeyMaxTries = 100
+
+func ds_randomkey(db *Keyspace) (string, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	for tries := 0; tries < randomKeyMaxTries; tries++ {
+		key, ok := db.dict.randomKey()
+		if !ok {
+			return "", false
+		}
+		if !db.isExpired(key) {
+			return key, true
+		}
+	}
+	for key := range db.dict.keys() {
+		if !db.isExpired(key) {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// Expire commands
+
+// Conditions accepted by the EXPIRE family of commands
+type expireFlags struct {
+	nx bool // set the expiry only when the key has none
+	xx bool // set the expiry only when the key already has one
+	gt bool // set the expiry only when the new one is greater than the current one
+	lt bool // set the expiry only when the new one is less than the current one
+}
+
+// ds_expire sets the time to live of key to the unix time when in milliseconds
+// It returns 0 if the key does not exist or the flags prevented the change, a time
+// which is already in the past deletes the key right away
+func ds_expire(db *Keyspace, key string, when int64, flags expireFlags) (int64, bool) {
+	db.lock()
+	defer db.unlock()
+	if _, ok := db.lookup(key); !ok {
+		return 0, false
+	}
+
+	// keys without a time to live are treated as having an infinite one
+	current := db.getExpire(key)
+	if flags.nx && current != -1 {
+		return 0, false
+	}
+	if flags.xx && current == -1 {
+		return 0, false
+	}
+	if flags.gt && (current == -1 || when <= current) {
+		return 0, false
+	}
+	if flags.lt && current != -1 && when >= current {
+		return 0, false
+	}
+
+	// while the aof is replayed the key is kept, it is deleted by the DEL
+	// which was logged when it expired
+	if when <= mstime() && !server.loading.Load() {
+		db.delete(key)
+		db.notifyKeyspaceEvent(notifyGeneric, "del", key)
+		return 1, true
+	}
+	db.setExpire(key, when)
+	db.notifyKeyspaceEvent(notifyGeneric, "expire", key)
+	return 1, false
+}
+
+// ds_pexpiretime returns the unix time in milliseconds at which the key expires,
+// -1 if the key has no time to live and -2 if it does not exist
+func ds_pexpiretime(db *Keyspace, key string) int64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if _, ok := db.lookup(key); !ok {
+		return -2
+	}
+	return db.getExpire(key)
+}
+
+func ds_persist(db *Keyspace, key string) int64 {
+	db.lock()
+	defer db.unlock()
+	if _, ok := db.lookup(key); !ok {
+		return 0
+	}
+	if !db.removeExpire(key) {
+		return 0
+	}
+	db.notifyKeyspaceEvent(notifyGeneric, "persist", key)
+	return 1
+}
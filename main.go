@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 
@@ -10,10 +11,16 @@ import (
 )
 
 func main() {
-	fmt.Println("Listening on port :6379")
+	flag.Parse()
+	if config.databases < 1 {
+		fmt.Println("databases must be at least 1")
+		return
+	}
+	createDatabases()
+	fmt.Printf("Listening on port :%d\n", config.port)
 
 	// Create a new server
-	l, err := net.Listen("tcp", ":6379")
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", config.port))
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -23,77 +30,51 @@ func main() {
 		log.Println(err)
 		return
 	}
-	defer rdb.Close()
-
-	// aof, err := NewAof("database.aof")
-	// if err != nil {
-	// 	fmt.Println(err)
-	// 	return
-	// }
-	// defer aof.Close()
-
-	// aof.Read(func(value Value) {
-	// 	command := strings.ToUpper(value.array[0].bulk)
-	// 	args := value.array[1:]
-
-	// 	handler, ok := Handlers[command]
-	// 	if !ok {
-	// 		fmt.Println("Invalid command: ", command)
-	// 		return
-	// 	}
-
-	// 	handler(args)
-	// })
-
-	// Listen for connections
-	conn, err := l.Accept()
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
-
-	defer conn.Close()
+	server.listener = l
+	server.rdb = rdb
 
-	for {
-		resp := NewResp(conn)
-		value, err := resp.Read()
+	if config.appendOnly {
+		aof, err := NewAof("database.aof")
 		if err != nil {
 			fmt.Println(err)
 			return
 		}
+		server.aof = aof
+
+		client := newFakeClient()
+		server.loading.Store(true)
+		aof.Read(func(value Value) {
+			command := strings.ToUpper(value.array[0].bulk)
+			args := value.array[1:]
+
+			handler, ok := Handlers[command]
+			if !ok {
+				fmt.Println("Invalid command: ", command)
+				return
+			}
+
+			// the commands of a transaction are run by its EXEC
+			if client.multi != nil && !multiCommands[command] {
+				client.queueCommand(command, value, handler)
+				return
+			}
+
+			handler(client, args)
+		})
+		server.loading.Store(false)
+	}
 
-		if value.typ != "array" {
-			fmt.Println("Invalid request, expected array")
-			continue
-		}
-
-		if len(value.array) == 0 {
-			fmt.Println("Invalid request, expected array length > 0")
-			continue
-		}
+	// reclaim the expired keys which are never accessed again
+	go activeExpireCycle()
 
-		command := strings.ToUpper(value.array[0].bulk)
-		args := value.array[1:]
-		log.Println(command)
-		log.Println(args)
-		writer := NewWriter(conn)
+	// the files are flushed and closed by the shutdown which happens
+	// on SIGINT/SIGTERM or when a client sends the SHUTDOWN command
+	go server.handleSignals()
 
-		handler, ok := Handlers[command]
-		if !ok {
-			fmt.Println("Invalid command: ", command)
-			writer.Write(Value{typ: "error", str: fmt.Sprint("Invalid command: ", command)})
-			continue
-		}
+	// Listen for connections, every client is served in its own go routine
+	server.serve()
 
-		// if the command belongs to the aofSet which contains the set of commands to be written to
-		// the aof then log it
-		// aofCommand, ok := aofSet[command]
-		// if ok {
-		// 	if aofCommand {
-		// 		aof.Write(value)
-		// 	}
-		// }
-		result := handler(args)
-		writer.Write(result)
-	}
+	// serve only returns once a shutdown has closed the listener,
+	// the shutdown exits the process as soon as it is done
+	select {}
 }
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Transactions
+// After MULTI the commands of the client are queued instead of being run, EXEC then
+// runs the whole queue while holding the command lock for writing so that no other
+// client runs anything in the middle of the transaction.
+//
+// WATCH makes transactions check and set: EXEC fails with a null reply and runs
+// nothing if one of the keys watched by the client was modified since WATCH.
+// Every modification of a key calls signalModifiedKey which marks the clients
+// watching it as dirty, keys expiring are also found by EXEC itself
+
+// Commands which are run right away by a client in a transaction
+var multiCommands = map[string]bool{
+	"MULTI":   true,
+	"EXEC":    true,
+	"DISCARD": true,
+	"WATCH":   true,
+}
+
+// Commands which can't be queued in a transaction
+var noMultiCommands = map[string]bool{
+	"SUBSCRIBE":    true,
+	"UNSUBSCRIBE":  true,
+	"PSUBSCRIBE":   true,
+	"PUNSUBSCRIBE": true,
+	"SSUBSCRIBE":   true,
+	"SUNSUBSCRIBE": true,
+}
+
+// Number of arguments of every command, the command name included, like in the
+// redis command table a negative arity is the minimum number of arguments
+// Commands are checked when they are queued so that a transaction holding
+// a command which can never run is discarded as a whole
+var commandArity = map[string]int{
+	"PING": -1, "SHUTDOWN": -1, "HELLO": -1, "AUTH": -2, "SELECT": 2,
+	"MULTI": 1, "EXEC": 1, "DISCARD": 1, "WATCH": -2, "UNWATCH": 1,
+	// string commands
+	"SET": -3, "GET": 2, "MGET": -2, "INCR": 2, "INCRBY": 3, "SETNX": 3, "SETEX": 4,
+	"PSETEX": 4, "GETSET": 3, "GETDEL": 2, "GETEX": -2, "DECR": 2, "DECRBY": 3,
+	"INCRBYFLOAT": 3, "APPEND": 3, "STRLEN": 2, "GETRANGE": 4, "SUBSTR": 4,
+	"SETRANGE": 4, "MSET": -3, "MSETNX": -3, "LCS": -3,
+	// hash commands
+	"HSET": -4, "HGET": 3, "HGETALL": 2, "HMSET": -4, "HSETNX": 4, "HDEL": -3,
+	"HEXISTS": 3, "HLEN": 2, "HSTRLEN": 3, "HKEYS": 2, "HVALS": 2, "HMGET": -3,
+	"HINCRBY": 4, "HINCRBYFLOAT": 4, "HRANDFIELD": -2, "HEXPIRE": -6, "HPEXPIRE": -6,
+	"HEXPIREAT": -6, "HPEXPIREAT": -6, "HTTL": -5, "HPTTL": -5, "HEXPIRETIME": -5,
+	"HPEXPIRETIME": -5, "HPERSIST": -5, "HGETEX": -5,
+	// list commands
+	"LPUSH": -3, "LPOP": -2, "LLEN": 2, "LINDEX": 3, "LRANGE": 4, "RPUSH": -3,
+	"RPOP": -2, "LPUSHX": -3, "RPUSHX": -3, "LSET": 4, "LINSERT": 5, "LREM": 4,
+	"LTRIM": 4, "LPOS": -3, "LMOVE": 5, "RPOPLPUSH": 3, "LMPOP": -4, "BLPOP": -3,
+	"BRPOP": -3, "BLMOVE": 6, "BRPOPLPUSH": 4, "BLMPOP": -5,
+	// set commands
+	"SADD": -3, "SREM": -3, "SCARD": 2, "SISMEMBER": 3, "SMEMBERS": 2, "SMISMEMBER": -3,
+	"SINTER": -2, "SINTERCARD": -3, "SUNION": -2, "SDIFF": -2, "SINTERSTORE": -3,
+	"SUNIONSTORE": -3, "SDIFFSTORE": -3, "SMOVE": 4, "SPOP": -2, "SRANDMEMBER": -2,
+	// sorted set commands
+	"ZADD": -4, "ZINCRBY": 4, "ZREM": -3, "ZSCORE": 3, "ZMSCORE": -3, "ZCARD": 2,
+	"ZCOUNT": 4, "ZRANK": -3, "ZREVRANK": -3, "ZRANGE": -4, "ZREVRANGE": -4,
+	"ZRANGEBYSCORE": -4, "ZREVRANGEBYSCORE": -4, "ZRANGEBYLEX": -4, "ZREVRANGEBYLEX": -4,
+	"ZRANGESTORE": -5, "ZREMRANGEBYRANK": 4, "ZREMRANGEBYSCORE": 4, "ZREMRANGEBYLEX": 4,
+	"ZUNION": -3, "ZINTER": -3, "ZDIFF": -3, "ZUNIONSTORE": -4, "ZINTERSTORE": -4,
+	"ZDIFFSTORE": -4, "ZPOPMIN": -2, "ZPOPMAX": -2, "ZMPOP": -4, "BZPOPMIN": -3,
+	"BZPOPMAX": -3, "BZMPOP": -5,
+	// stream commands
+	"XADD": -5, "XLEN": 2, "XRANGE": -4, "XREVRANGE": -4, "XDEL": -3, "XTRIM": -4,
+	"XREAD": -4, "XREADGROUP": -7, "XACK": -4, "XGROUP": -2, "XPENDING": -3,
+	"XCLAIM": -6, "XAUTOCLAIM": -6, "XINFO": -2,
+	// hyperloglog commands
+	"PFADD": -2, "PFCOUNT": -2, "PFMERGE": -2,
+	// geo commands
+	"GEOADD": -5, "GEOPOS": -2, "GEODIST": -4, "GEOHASH": -2, "GEOSEARCH": -7,
+	"GEOSEARCHSTORE": -8,
+	// bit commands
+	"SETBIT": 4, "GETBIT": 3, "BITCOUNT": -2, "BITPOS": -3, "BITOP": -4,
+	"BITFIELD": -2, "BITFIELD_RO": -2,
+	// pub/sub commands
+	"SUBSCRIBE": -2, "UNSUBSCRIBE": -1, "PSUBSCRIBE": -2, "PUNSUBSCRIBE": -1, "PUBLISH": 3,
+	"PUBSUB": -2, "SSUBSCRIBE": -2, "SUNSUBSCRIBE": -1, "SPUBLISH": 3,
+	// scan commands
+	"KEYS": 2, "SCAN": -2, "SSCAN": -3, "HSCAN": -3, "ZSCAN": -3,
+	// generic commands
+	"DEL": -2, "UNLINK": -2, "EXISTS": -2, "TYPE": 2, "RENAME": 3, "RENAMENX": 3,
+	"COPY": -3, "DBSIZE": 1, "RANDOMKEY": 1, "MOVE": 3, "SWAPDB": 3, "FLUSHDB": -1,
+	"FLUSHALL": -1,
+	// expire commands
+	"EXPIRE": -3, "PEXPIRE": -3, "EXPIREAT": -3, "PEXPIREAT": -3, "TTL": 2, "PTTL": 2,
+	"EXPIRETIME": 2, "PEXPIRETIME": 2, "PERSIST": 2,
+}
+
+// checkArity tells if the command can be called with argc arguments, the command name included
+func checkArity(command string, argc int) bool {
+	arity, ok := commandArity[command]
+	if !ok {
+		return true
+	}
+	if arity < 0 {
+		return argc >= -arity
+	}
+	return argc == arity
+}
+
+// The commands queued by a client in a transaction
+type multiState struct {
+	commands []queuedCommand
+	// set when a command could not be queued, EXEC then discards the transaction
+	aborted bool
+}
+
+type queuedCommand struct {
+	name    string
+	value   Value
+	handler func(*Client, []Value) Value
+}
+
+// A key watched by a client
+type watchedKey struct {
+	db  *Keyspace
+	key string
+	// a key which was already expired when it was watched does not make
+	// EXEC fail just because it is still expired
+	expired bool
+}
+
+var ErrExecAbort = errors.New("EXECABORT Transaction discarded because of previous errors.")
+
+// queueCommand adds the command to the transaction of the client, a command called
+// with the wrong number of arguments is not queued and makes EXEC fail
+func (c *Client) queueCommand(command string, value Value, handler func(*Client, []Value) Value) Value {
+	if !checkArity(command, len(value.array)) {
+		c.multi.aborted = true
+		return Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(command))}
+	}
+	// their replies are pushed, they would not be part of the reply of EXEC
+	if noMultiCommands[command] {
+		c.multi.aborted = true
+		return Value{typ: "error", str: "ERR Command not allowed inside a transaction"}
+	}
+	c.multi.commands = append(c.multi.commands, queuedCommand{name: command, value: value, handler: handler})
+	return Value{typ: "string", str: "QUEUED"}
+}
+
+// flagTransaction makes EXEC fail, used when a command could not be queued
+func (c *Client) flagTransaction() {
+	if c.multi != nil {
+		c.multi.aborted = true
+	}
+}
+
+// watchKey makes EXEC fail if the key of the selected database is modified
+func (c *Client) watchKey(key string) {
+	db := c.db
+	for _, w := range c.watched {
+		if w.db == db && w.key == key {
+			return
+		}
+	}
+	db.lock()
+	defer db.unlock()
+	db.watchedKeys[key] = append(db.watchedKeys[key], c)
+	c.watched = append(c.watched, watchedKey{db: db, key: key, expired: db.isExpired(key)})
+}
+
+// unwatchAllKeys forgets all the keys watched by the client
+func (c *Client) unwatchAllKeys() {
+	for _, w := range c.watched {
+		w.db.lock()
+		clients := w.db.watchedKeys[w.key]
+		for i, other := range clients {
+			if other == c {
+				clients = append(clients[:i], clients[i+1:]...)
+				break
+			}
+		}
+		if len(clients) == 0 {
+			delete(w.db.watchedKeys, w.key)
+		} else {
+			w.db.watchedKeys[w.key] = clients
+		}
+		w.db.unlock()
+	}
+	c.watched = nil
+	c.dirtyCAS.Store(false)
+}
+
+// isWatchedKeyExpired tells if one of the keys watched by the client expired since
+// it was watched, expired keys are not always deleted by the time EXEC runs
+func (c *Client) isWatchedKeyExpired() bool {
+	for _, w := range c.watched {
+		w.db.mu.RLock()
+		expired := !w.expired && w.db.isExpired(w.key)
+		w.db.mu.RUnlock()
+		if expired {
+			return true
+		}
+	}
+	return false
+}
+
+// signalModifiedKey is called every time a key is modified,
+// the EXEC of the clients watching the key then fails
+// the caller must hold the keyspace lock for writing
+func (ks *Keyspace) signalModifiedKey(key string) {
+	for _, c := range ks.watchedKeys[key] {
+		c.dirtyCAS.Store(true)
+	}
+}
+
+// touchAllWatchedKeys signals the watched keys of ks which exist in ks or in other as
+// modified, it is called before the keys of ks are flushed or swapped with the ones of other
+func (ks *Keyspace) touchAllWatchedKeys(other *Keyspace) {
+	for key := range ks.watchedKeys {
+		if ks.dict.has(key) || (other != nil && other.dict.has(key)) {
+			ks.signalModifiedKey(key)
+		}
+	}
+}
+
+// Transaction commands
+
+// MULTI
+func multi(c *Client, args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'multi' command"}
+	}
+	if c.multi != nil {
+		return Value{typ: "error", str: "ERR MULTI calls can not be nested"}
+	}
+	c.multi = &multiState{}
+	return Value{typ: "string", str: "OK"}
+}
+
+// EXEC runs the queued commands and replies with the reply of each of them,
+// or with a null reply if a watched key was modified
+// It holds the command lock for writing, see exclusiveCommands
+func exec(c *Client, args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'exec' command"}
+	}
+	if c.multi == nil {
+		return Value{typ: "error", str: "ERR EXEC without MULTI"}
+	}
+	transaction := c.multi
+	c.multi = nil
+	if transaction.aborted {
+		c.unwatchAllKeys()
+		return Value{typ: "error", str: ErrExecAbort.Error()}
+	}
+	if c.dirtyCAS.Load() || c.isWatchedKeyExpired() {
+		c.unwatchAllKeys()
+		return Value{typ: "nullarray"}
+	}
+	c.unwatchAllKeys()
+
+	// the commands which get logged to the aof are wrapped in MULTI and EXEC
+	// by execute so that the transaction is replayed as a whole
+	c.inExec = true
+	replies := make([]Value, 0, len(transaction.commands))
+	for _, queued := range transaction.commands {
+		replies = append(replies, c.execute(queued.name, queued.value, queued.handler))
+	}
+	c.inExec = false
+	if c.execLogged {
+		c.execLogged = false
+		err := server.aof.Write(c.db.id, Value{typ: "array", array: []Value{{typ: "bulk", bulk: "EXEC"}}})
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	return Value{typ: "array", array: replies}
+}
+
+// DISCARD
+func discard(c *Client, args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'discard' command"}
+	}
+	if c.multi == nil {
+		return Value{typ: "error", str: "ERR DISCARD without MULTI"}
+	}
+	c.multi = nil
+	c.unwatchAllKeys()
+	return Value{typ: "string", str: "OK"}
+}
+
+// WATCH key [key ...]
+func watch(c *Client, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'watch' command"}
+	}
+	if c.multi != nil {
+		return Value{typ: "error", str: "ERR WATCH inside MULTI is not allowed"}
+	}
+	for _, arg := range args {
+		c.watchKey(arg.bulk)
+	}
+	return Value{typ: "string", str: "OK"}
+}
+
+// UNWATCH
+func unwatch(c *Client, args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'unwatch' command"}
+	}
+	c.unwatchAllKeys()
+	return Value{typ: "string", str: "OK"}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Keyspace notifications
+// Commands modifying a key publish an event about it, to __keyspace@<db>__:<key>
+// with the event as message and to __keyevent@<db>__:<event> with the key as
+// message. The notify-keyspace-events option selects which events are published
+// as a string of flags, the same ones as in redis:
+//
+//	K     keyspace events, published to __keyspace@<db>__:<key>
+//	E     keyevent events, published to __keyevent@<db>__:<event>
+//	g     generic commands like DEL, EXPIRE, RENAME...
+//	$     string commands
+//	l     list commands
+//	s     set commands
+//	h     hash commands
+//	z     sorted set commands
+//	t     stream commands
+//	x     expired events, sent when a key expires
+//	e     evicted events, accepted for compatibility as keys are never evicted
+//	m     key miss events, accepted for compatibility but never sent
+//	n     new key events, sent when a key is created
+//	A     alias for g$lshztxe
+//
+// K or E and at least one class of events are needed for anything to be published,
+// the default empty string disables the notifications.
+
+const (
+	notifyKeyspace = 1 << iota
+	notifyKeyevent
+	notifyGeneric
+	notifyString
+	notifyList
+	notifySet
+	notifyHash
+	notifyZset
+	notifyExpired
+	notifyEvicted
+	notifyStream
+	notifyKeyMiss
+	notifyNew
+
+	notifyAll = notifyGeneric | notifyString | notifyList | notifySet | notifyHash | notifyZset | notifyExpired | notifyEvicted | notifyStream
+)
+
+// parseNotifyKeyspaceEvents converts the flags of notify-keyspace-events to the notify classes
+func parseNotifyKeyspaceEvents(flags string) (int, error) {
+	classes := 0
+	for _, flag := range flags {
+		switch flag {
+		case 'A':
+			classes |= notifyAll
+		case 'g':
+			classes |= notifyGeneric
+		case '$':
+			classes |= notifyString
+		case 'l':
+			classes |= notifyList
+		case 's':
+			classes |= notifySet
+		case 'h':
+			classes |= notifyHash
+		case 'z':
+			classes |= notifyZset
+		case 'x':
+			classes |= notifyExpired
+		case 'e':
+			classes |= notifyEvicted
+		case 'K':
+			classes |= notifyKeyspace
+		case 'E':
+			classes |= notifyKeyevent
+		case 't':
+			classes |= notifyStream
+		case 'm':
+			classes |= notifyKeyMiss
+		case 'n':
+			classes |= notifyNew
+		default:
+			return 0, fmt.Errorf("invalid event class character '%c'", flag)
+		}
+	}
+	return classes, nil
+}
+
+// notifyKeyspaceEvent publishes the event which happened to the key if its class
+// is enabled, the event is the lower case name of the command most of the time
+func (ks *Keyspace) notifyKeyspaceEvent(class int, event string, key string) {
+	flags := config.notifyKeyspaceEvents
+	if flags&class == 0 {
+		return
+	}
+	db := strconv.Itoa(ks.id)
+	if flags&notifyKeyspace != 0 {
+		publishMessage("__keyspace@"+db+"__:"+key, event)
+	}
+	if flags&notifyKeyevent != 0 {
+		publishMessage("__keyevent@"+db+"__:"+event, key)
+	}
+}
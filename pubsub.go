@@ -0,0 +1,342 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Publish/subscribe
+// Clients subscribe to channels, or to glob patterns of channels matched with
+// stringMatch, and receive every message published to them afterwards.
+//
+// The messages are pushed to the subscribers with Writer.Push which never waits
+// for the subscriber to read them, a subscriber reading slower than messages are
+// published is disconnected once more than client-output-buffer-limit-pubsub
+// bytes are waiting to be sent to it.
+//
+// A RESP2 connection can only use the subscribe mode commands while it has
+// subscriptions, RESP3 connections receive the messages as push values
+// in between their replies and can run any command.
+//
+// Shard channels, used by SSUBSCRIBE and SPUBLISH, are a separate namespace
+// of channels which cluster clients expect, there is a single shard here.
+// Patterns never match them.
+
+type pubsubState struct {
+	mu sync.Mutex
+	// the subscribers of every channel, pattern and shard channel with at least one subscriber
+	channels      map[string]map[*Client]bool
+	patterns      map[string]map[*Client]bool
+	shardChannels map[string]map[*Client]bool
+}
+
+var pubsub = pubsubState{
+	channels:      map[string]map[*Client]bool{},
+	patterns:      map[string]map[*Client]bool{},
+	shardChannels: map[string]map[*Client]bool{},
+}
+
+// Commands a RESP2 client can run while it has subscriptions
+var subscribeModeCommands = map[string]bool{
+	"SUBSCRIBE":    true,
+	"UNSUBSCRIBE":  true,
+	"PSUBSCRIBE":   true,
+	"PUNSUBSCRIBE": true,
+	"SSUBSCRIBE":   true,
+	"SUNSUBSCRIBE": true,
+	"PING":         true,
+}
+
+// Handlers which already pushed their replies return noReply, which is not written
+var noReply = Value{typ: "noreply"}
+
+// subscriptionCount returns the number of channels and patterns the client is subscribed to
+func (c *Client) subscriptionCount() int {
+	return len(c.channels) + len(c.patterns)
+}
+
+// inSubscribeMode tells if the client can only run the subscribe mode commands
+func (c *Client) inSubscribeMode() bool {
+	return c.writer.proto == 2 && c.subscriptionCount()+len(c.shardChannels) > 0
+}
+
+// push sends the value to the client without waiting for it to be written,
+// the client is disconnected if its output buffer limit is reached
+// It returns false if the value could not be queued
+func (c *Client) push(v Value) bool {
+	if c.conn == nil {
+		return false
+	}
+	err := c.writer.Push(v, config.pubsubBufferLimit)
+	if err == ErrOutputBufferLimit {
+		log.Printf("client %d closed for overcoming of output buffer limits", c.id)
+		c.conn.Close()
+	}
+	return err == nil
+}
+
+// pushSubscription replies to a subscribe or unsubscribe command for one channel
+// or pattern with the number of subscriptions the client has left
+// The caller must hold pubsub.mu so that the reply is pushed before any message
+func (c *Client) pushSubscription(kind string, name *string, count int) {
+	reply := Value{typ: "push", array: []Value{{typ: "bulk", bulk: kind}, {typ: "null"}, {typ: "integer", num: int64(count)}}}
+	if name != nil {
+		reply.array[1] = Value{typ: "bulk", bulk: *name}
+	}
+	c.push(reply)
+}
+
+// subscribeTo adds the client to the subscribers of name, subscriptions is the set of
+// channels or patterns of the client and subscribers the matching map of pubsub
+// The caller must hold pubsub.mu
+func (c *Client) subscribeTo(subscriptions *map[string]bool, subscribers map[string]map[*Client]bool, name string) {
+	if *subscriptions == nil {
+		*subscriptions = map[string]bool{}
+	}
+	(*subscriptions)[name] = true
+	if subscribers[name] == nil {
+		subscribers[name] = map[*Client]bool{}
+	}
+	subscribers[name][c] = true
+}
+
+// unsubscribeFrom removes the client from the subscribers of name, see subscribeTo
+func (c *Client) unsubscribeFrom(subscriptions map[string]bool, subscribers map[string]map[*Client]bool, name string) {
+	if !subscriptions[name] {
+		return
+	}
+	delete(subscriptions, name)
+	delete(subscribers[name], c)
+	if len(subscribers[name]) == 0 {
+		delete(subscribers, name)
+	}
+}
+
+// unsubscribeAll removes all the subscriptions of a client which disconnected
+func (c *Client) unsubscribeAll() {
+	pubsub.mu.Lock()
+	defer pubsub.mu.Unlock()
+	for channel := range c.channels {
+		c.unsubscribeFrom(c.channels, pubsub.channels, channel)
+	}
+	for pattern := range c.patterns {
+		c.unsubscribeFrom(c.patterns, pubsub.patterns, pattern)
+	}
+	for channel := range c.shardChannels {
+		c.unsubscribeFrom(c.shardChannels, pubsub.shardChannels, channel)
+	}
+}
+
+// unsubscribeArgs returns the channels or patterns named by the arguments of
+// an unsubscribe command, all the ones of the client when there are none
+func unsubscribeArgs(args []Value, subscriptions map[string]bool) []string {
+	if len(args) == 0 {
+		return slices.Sorted(maps.Keys(subscriptions))
+	}
+	names := make([]string, 0, len(args))
+	for _, arg := range args {
+		names = append(names, arg.bulk)
+	}
+	return names
+}
+
+// publishMessage sends the message to the subscribers of the channel and
+// of the patterns matching it, it returns the number of clients reached
+func publishMessage(channel string, message string) int {
+	pubsub.mu.Lock()
+	defer pubsub.mu.Unlock()
+
+	receivers := 0
+	for c := range pubsub.channels[channel] {
+		if c.push(Value{typ: "push", array: []Value{
+			{typ: "bulk", bulk: "message"}, {typ: "bulk", bulk: channel}, {typ: "bulk", bulk: message},
+		}}) {
+			receivers++
+		}
+	}
+	for pattern, subscribers := range pubsub.patterns {
+		if !stringMatch(pattern, channel, false) {
+			continue
+		}
+		for c := range subscribers {
+			if c.push(Value{typ: "push", array: []Value{
+				{typ: "bulk", bulk: "pmessage"}, {typ: "bulk", bulk: pattern},
+				{typ: "bulk", bulk: channel}, {typ: "bulk", bulk: message},
+			}}) {
+				receivers++
+			}
+		}
+	}
+	return receivers
+}
+
+// publishShardMessage sends the message to the subscribers of the shard channel
+func publishShardMessage(channel string, message string) int {
+	pubsub.mu.Lock()
+	defer pubsub.mu.Unlock()
+	receivers := 0
+	for c := range pubsub.shardChannels[channel] {
+		if c.push(Value{typ: "push", array: []Value{
+			{typ: "bulk", bulk: "smessage"}, {typ: "bulk", bulk: channel}, {typ: "bulk", bulk: message},
+		}}) {
+			receivers++
+		}
+	}
+	return receivers
+}
+
+// Pub/sub commands
+
+// SUBSCRIBE channel [channel ...]
+func subscribe(c *Client, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'subscribe' command"}
+	}
+	pubsub.mu.Lock()
+	defer pubsub.mu.Unlock()
+	for _, arg := range args {
+		c.subscribeTo(&c.channels, pubsub.channels, arg.bulk)
+		c.pushSubscription("subscribe", &arg.bulk, c.subscriptionCount())
+	}
+	return noReply
+}
+
+// UNSUBSCRIBE [channel [channel ...]]
+// without arguments the client is unsubscribed from every channel
+func unsubscribe(c *Client, args []Value) Value {
+	pubsub.mu.Lock()
+	defer pubsub.mu.Unlock()
+	channels := unsubscribeArgs(args, c.channels)
+	if len(channels) == 0 {
+		c.pushSubscription("unsubscribe", nil, c.subscriptionCount())
+	}
+	for _, channel := range channels {
+		c.unsubscribeFrom(c.channels, pubsub.channels, channel)
+		c.pushSubscription("unsubscribe", &channel, c.subscriptionCount())
+	}
+	return noReply
+}
+
+// PSUBSCRIBE pattern [pattern ...]
+func psubscribe(c *Client, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'psubscribe' command"}
+	}
+	pubsub.mu.Lock()
+	defer pubsub.mu.Unlock()
+	for _, arg := range args {
+		c.subscribeTo(&c.patterns, pubsub.patterns, arg.bulk)
+		c.pushSubscription("psubscribe", &arg.bulk, c.subscriptionCount())
+	}
+	return noReply
+}
+
+// PUNSUBSCRIBE [pattern [pattern ...]]
+func punsubscribe(c *Client, args []Value) Value {
+	pubsub.mu.Lock()
+	defer pubsub.mu.Unlock()
+	patterns := unsubscribeArgs(args, c.patterns)
+	if len(patterns) == 0 {
+		c.pushSubscription("punsubscribe", nil, c.subscriptionCount())
+	}
+	for _, pattern := range patterns {
+		c.unsubscribeFrom(c.patterns, pubsub.patterns, pattern)
+		c.pushSubscription("punsubscribe", &pattern, c.subscriptionCount())
+	}
+	return noReply
+}
+
+// SSUBSCRIBE shardchannel [shardchannel ...]
+// the replies count the shard channels only
+func ssubscribe(c *Client, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'ssubscribe' command"}
+	}
+	pubsub.mu.Lock()
+	defer pubsub.mu.Unlock()
+	for _, arg := range args {
+		c.subscribeTo(&c.shardChannels, pubsub.shardChannels, arg.bulk)
+		c.pushSubscription("ssubscribe", &arg.bulk, len(c.shardChannels))
+	}
+	return noReply
+}
+
+// SUNSUBSCRIBE [shardchannel [shardchannel ...]]
+func sunsubscribe(c *Client, args []Value) Value {
+	pubsub.mu.Lock()
+	defer pubsub.mu.Unlock()
+	channels := unsubscribeArgs(args, c.shardChannels)
+	if len(channels) == 0 {
+		c.pushSubscription("sunsubscribe", nil, len(c.shardChannels))
+	}
+	for _, channel := range channels {
+		c.unsubscribeFrom(c.shardChannels, pubsub.shardChannels, channel)
+		c.pushSubscription("sunsubscribe", &channel, len(c.shardChannels))
+	}
+	return noReply
+}
+
+// PUBLISH channel message
+func publish(c *Client, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'publish' command"}
+	}
+	return Value{typ: "integer", num: int64(publishMessage(args[0].bulk, args[1].bulk))}
+}
+
+// SPUBLISH shardchannel message
+func spublish(c *Client, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'spublish' command"}
+	}
+	return Value{typ: "integer", num: int64(publishShardMessage(args[0].bulk, args[1].bulk))}
+}
+
+// PUBSUB CHANNELS [pattern] | NUMSUB [channel ...] | NUMPAT |
+// SHARDCHANNELS [pattern] | SHARDNUMSUB [shardchannel ...]
+func pubsubCommand(c *Client, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'pubsub' command"}
+	}
+	subcommand := strings.ToLower(args[0].bulk)
+	args = args[1:]
+	arityError := Value{typ: "error", str: fmt.Sprintf("ERR wrong number of arguments for 'pubsub|%s' command", subcommand)}
+
+	pubsub.mu.Lock()
+	defer pubsub.mu.Unlock()
+	channels := pubsub.channels
+	if strings.HasPrefix(subcommand, "shard") {
+		channels = pubsub.shardChannels
+	}
+	switch subcommand {
+	case "channels", "shardchannels":
+		if len(args) > 1 {
+			return arityError
+		}
+		reply := Value{typ: "array", array: []Value{}}
+		for channel := range channels {
+			if len(args) == 0 || stringMatch(args[0].bulk, channel, false) {
+				reply.array = append(reply.array, Value{typ: "bulk", bulk: channel})
+			}
+		}
+		return reply
+	case "numsub", "shardnumsub":
+		reply := Value{typ: "array", array: make([]Value, 0, 2*len(args))}
+		for _, arg := range args {
+			reply.array = append(reply.array,
+				Value{typ: "bulk", bulk: arg.bulk},
+				Value{typ: "integer", num: int64(len(channels[arg.bulk]))})
+		}
+		return reply
+	case "numpat":
+		if len(args) != 0 {
+			return arityError
+		}
+		return Value{typ: "integer", num: int64(len(pubsub.patterns))}
+	}
+	return Value{typ: "error", str: fmt.Sprintf("ERR unknown subcommand '%s'. Try PUBSUB HELP.", subcommand)}
+}
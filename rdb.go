@@ -1,9 +1,11 @@
 package main
 
 import (
+	"encoding/binary"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"os"
 	"strconv"
 	"sync"
@@ -13,18 +15,24 @@ import (
 type Rdb struct {
 	file *os.File
 	mu   sync.Mutex
+	quit chan struct{} // closed by Close to stop the background save go routine
 }
 
 const (
 	MAGIC               = "REDIS" // The MAGIC FLAG has to be the first bytes written to the rdb
-	VERSION             = "0001"  // The VERSION FLAG will then be written to the file
-	SELECT_DB           = 0xFE    // The SELECT_DB FLAG is used to indicate that a database serialization follows
-	DATABASE_NO         = 1       // The DatabaseNo will follow the SELECT_DB FLAG
+	VERSION             = "0002"  // The VERSION FLAG will then be written to the file
+	SELECT_DB           = 0xFE    // The SELECT_DB FLAG is followed by the number of the database whose keys follow
 	RDB_EOF             = 0xFF    // The RDB_EOF FLAG indicates the end of the rdb file
+	EXPIRETIME_MS       = 0xFC    // The EXPIRETIME_MS FLAG is followed by the expire time of the next key in milliseconds
+	EXPIRETIME          = 0xFD    // The EXPIRETIME FLAG is followed by the expire time of the next key in seconds
 	StringValueEncoding = 0       // Indicates the following value encoding is of String type
 	ListValueEncoding   = 1       // Indicates the following value encoding is of List type
 	SetValueEncoding    = 2       // Indicates the following value encoding is of Set type
 	HashValueEncoding   = 4       // Indicates the following value encoding is of Hash type
+	ZSetValueEncoding   = 5       // Indicates the following value encoding is of Sorted Set type
+	StreamValueEncoding = 21      // Indicates the following value encoding is of Stream type
+	// Indicates a Hash whose fields are each followed by their expire time in milliseconds, 0 for none
+	HashMetadataValueEncoding = 24
 )
 
 func NewRbd(path string) (*Rdb, error) {
@@ -42,32 +50,52 @@ func NewRbd(path string) (*Rdb, error) {
 
 	rdb := &Rdb{
 		file: f,
+		quit: make(chan struct{}),
 	}
-	err = rdb.load()
-	if err != nil {
-		log.Println(err)
-		return nil, err
-	}
-	// start go routine to overwrite the rdb and save to disk every 60 seconds
-	go func() {
-		for {
-			time.Sleep(20 * time.Second)
-			log.Println("starting to write rdb")
-			err := rdb.write()
-			if err != nil {
-				log.Println(err)
-				panic(err)
-			}
-			log.Println("finished writing rdb")
+	// when the append only file is enabled it is the source of truth
+	// and gets replayed instead of loading the rdb
+	if !config.appendOnly {
+		err = rdb.load()
+		if err != nil {
+			log.Println(err)
+			return nil, err
 		}
-	}()
+	}
+	// start go routine to overwrite the rdb and save to disk every save-interval seconds
+	if config.saveInterval > 0 {
+		go rdb.saveEvery(time.Duration(config.saveInterval) * time.Second)
+	}
 
 	return rdb, nil
 }
 
+// saveEvery writes the rdb periodically until the rdb is closed
+func (rdb *Rdb) saveEvery(interval time.Duration) {
+	for {
+		select {
+		case <-rdb.quit:
+			return
+		case <-time.After(interval):
+		}
+		log.Println("starting to write rdb")
+		// like a command, so that the snapshot does not hold half of a transaction
+		server.cmdMu.RLock()
+		err := rdb.write()
+		server.cmdMu.RUnlock()
+		if err != nil {
+			log.Println(err)
+			panic(err)
+		}
+		log.Println("finished writing rdb")
+	}
+}
+
 func (rdb *Rdb) Close() error {
 	rdb.mu.Lock()
 	defer rdb.mu.Unlock()
+	// a save which is already in progress holds the lock so it gets to finish,
+	// closing quit makes sure that no new save is started afterwards
+	close(rdb.quit)
 
 	return rdb.file.Close()
 }
@@ -78,11 +106,13 @@ func (rdb *Rdb) write() error {
 	defer rdb.mu.Unlock()
 	// we open the file
 	log.Println("trying to open file")
-	temp, err := os.OpenFile("database_temp.rdb", os.O_CREATE|os.O_RDWR, 0666)
+	// O_TRUNC makes sure nothing is left over from a previous save which was interrupted
+	temp, err := os.OpenFile("database_temp.rdb", os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
 	if err != nil {
 		log.Println(err)
 		return err
 	}
+	defer temp.Close()
 	log.Println("opened file")
 	// move to the beginning of the file
 	temp.Seek(0, io.SeekStart)
@@ -95,33 +125,12 @@ func (rdb *Rdb) write() error {
 	}
 	log.Println("wrote constants")
 
-	// then we write the StringSETs datastructure
-	err = writeStrings(temp, &offset)
-	if err != nil {
-		return err
-	}
-	log.Println("wrote strings successfully")
-
-	// then we write the LISTS datastructure
-	err = writeLists(temp, &offset)
-	if err != nil {
-		return err
-	}
-	log.Println("wrote lists successfully")
-
-	// then we write the SETs datastucture
-	err = writeSets(temp, &offset)
-	if err != nil {
-		return err
-	}
-	log.Println("wrote sets successfully")
-
-	// then we write the HSETs datastructure
-	err = writeHash(temp, &offset)
+	// then we write every key of the keyspace
+	err = writeKeyspace(temp, &offset)
 	if err != nil {
 		return err
 	}
-	log.Println("wrote hash successfully")
+	log.Println("wrote keyspace successfully")
 
 	// then we write the RdbEOF flag
 	err = writeRdb_Eof(temp, &offset)
@@ -168,7 +177,7 @@ func (rdb *Rdb) load() error {
 	}
 	curr.Seek(0, io.SeekStart)
 	offset = 0
-	err = readConstants(curr, &offset)
+	version, err := readConstants(curr, &offset)
 	log.Println("Offset: ", offset)
 	if err != nil {
 		log.Println("Failed to read constants lol")
@@ -191,7 +200,7 @@ func (rdb *Rdb) load() error {
 		}
 		if byteRead == SELECT_DB {
 			log.Println("read SELECT_DB FLAG of a new Database")
-			rbdEof, newDbFlag, err := readRdbDatabase(curr, &offset)
+			rbdEof, newDbFlag, err := readRdbDatabase(curr, &offset, version)
 			if err != nil {
 				return err
 			}
@@ -207,15 +216,43 @@ func (rdb *Rdb) load() error {
 	}
 }
 
-func readRdbDatabase(curr *os.File, offset *int) (rdbEof bool, newDb bool, err error) {
+func readRdbDatabase(curr *os.File, offset *int, version string) (rdbEof bool, newDb bool, err error) {
 	databaseNumber, n, _, err, _, _ := readRdbLength(curr, *offset)
 	log.Println(databaseNumber)
 	if err != nil {
 		return false, false, err
 	}
 	*offset += n
+	// files of the first version only had one database, always numbered 1
+	if version == "0001" {
+		databaseNumber = 0
+	}
+	if databaseNumber < 0 || databaseNumber >= len(databases) {
+		return false, false, fmt.Errorf("the rdb file has keys in database %d but only %d databases are configured", databaseNumber, len(databases))
+	}
+	db := databases[databaseNumber]
 	log.Println("Offset: ", offset)
+	// the expire time read before a key, -1 if the key has none
+	var expireAt int64 = -1
 	for {
+		// a key with a time to live is preceded by one of the EXPIRETIME flags
+		opcode := make([]byte, 1)
+		_, err := curr.ReadAt(opcode, int64(*offset))
+		if err != nil {
+			if err == io.EOF {
+				return true, false, nil
+			}
+			return false, false, err
+		}
+		if opcode[0] == EXPIRETIME_MS || opcode[0] == EXPIRETIME {
+			expireAt, n, err = readRdbExpireTime(curr, *offset)
+			if err != nil {
+				return false, false, err
+			}
+			*offset += n
+			continue
+		}
+
 		valueEncoding, n, end, err, newDbFlag, _ := readRdbLength(curr, *offset)
 		log.Println(valueEncoding, n, end, err)
 		if err != nil {
@@ -225,6 +262,8 @@ func readRdbDatabase(curr *os.File, offset *int) (rdbEof bool, newDb bool, err e
 			return false, false, err
 		}
 		if newDbFlag {
+			// the flag is consumed here, the number of the next database follows it
+			*offset += 1
 			return false, true, nil
 		}
 		if end {
@@ -233,35 +272,113 @@ func readRdbDatabase(curr *os.File, offset *int) (rdbEof bool, newDb bool, err e
 		}
 		*offset += n
 		log.Println("Offset: ", offset)
+		var key string
 		if valueEncoding == SetValueEncoding {
 			log.Println("read value encoding of Set", valueEncoding)
-			err = readRdbSet(curr, offset)
+			key, err = readRdbSet(db, curr, offset)
 			if err != nil {
 				return false, false, err
 			}
 		} else if valueEncoding == HashValueEncoding {
 			log.Println("read value encoding of Hash", valueEncoding)
-			err = readRdbHash(curr, offset)
+			key, err = readRdbHash(db, curr, offset, false)
+			if err != nil {
+				return false, false, err
+			}
+		} else if valueEncoding == ZSetValueEncoding {
+			log.Println("read value encoding of Sorted Set", valueEncoding)
+			key, err = readRdbZSet(db, curr, offset)
+			if err != nil {
+				return false, false, err
+			}
+		} else if valueEncoding == StreamValueEncoding {
+			log.Println("read value encoding of Stream", valueEncoding)
+			key, err = readRdbStream(db, curr, offset)
+			if err != nil {
+				return false, false, err
+			}
+		} else if valueEncoding == HashMetadataValueEncoding {
+			log.Println("read value encoding of Hash with field expire times", valueEncoding)
+			key, err = readRdbHash(db, curr, offset, true)
 			if err != nil {
 				return false, false, err
 			}
 		} else if valueEncoding == ListValueEncoding {
 			log.Println("read value encoding of List", valueEncoding)
-			err = readRdbList(curr, offset)
+			key, err = readRdbList(db, curr, offset)
 			if err != nil {
 				return false, false, err
 			}
 		} else if valueEncoding == StringValueEncoding {
 			log.Println("read value encoding of String", valueEncoding)
-			err = readRdbStringSet(curr, offset)
+			key, err = readRdbStringSet(db, curr, offset)
 			if err != nil {
 				log.Println("finished reading stringSet with", err)
 				return false, false, err
 			}
 		}
 
+		if expireAt != -1 {
+			loadExpire(db, key, expireAt)
+			expireAt = -1
+		}
+	}
+}
+
+// readRdbExpireTime reads an EXPIRETIME_MS flag followed by the unix time in milliseconds
+// as 8 little endian bytes, or an EXPIRETIME flag followed by the unix time in seconds as
+// 4 little endian bytes. It returns the time in milliseconds and the number of bytes read
+func readRdbExpireTime(file *os.File, offset int) (int64, int, error) {
+	opcode := make([]byte, 1)
+	_, err := file.ReadAt(opcode, int64(offset))
+	if err != nil {
+		return -1, 0, err
+	}
+	if opcode[0] == EXPIRETIME {
+		timeBytes := make([]byte, 4)
+		_, err = file.ReadAt(timeBytes, int64(offset)+1)
+		if err != nil {
+			return -1, 0, err
+		}
+		return int64(binary.LittleEndian.Uint32(timeBytes)) * 1000, 5, nil
+	}
+	timeBytes := make([]byte, 8)
+	_, err = file.ReadAt(timeBytes, int64(offset)+1)
+	if err != nil {
+		return -1, 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(timeBytes)), 9, nil
+}
+
+// loadExpire sets the time to live of a key which was just loaded,
+// keys which expired while the server was down are dropped
+func loadExpire(db *Keyspace, key string, when int64) {
+	db.lock()
+	defer db.unlock()
+	if when <= mstime() {
+		db.delete(key)
+		return
+	}
+	// a hash may have been dropped with all its fields already expired
+	if !db.dict.has(key) {
+		return
+	}
+	db.setExpire(key, when)
+}
+
+// Function which writes the EXPIRETIME_MS flag followed by the unix time
+// in milliseconds as 8 little endian bytes, like redis does
+func writeExpireTime(temp *os.File, offset *int, when int64) error {
+	expireBytes := []byte{EXPIRETIME_MS}
+	expireBytes = binary.LittleEndian.AppendUint64(expireBytes, uint64(when))
+	n, err := temp.WriteAt(expireBytes, int64(*offset))
+	if err != nil {
+		return err
 	}
+	*offset += n
+	return nil
 }
+
 func writeConstants(temp *os.File, offset *int) error {
 	// writes the MAGIC FLAG
 	constantBytes := make([]byte, 0)
@@ -283,154 +400,284 @@ func writeConstants(temp *os.File, offset *int) error {
 	log.Println("Offset: ", *offset)
 	constantBytes = append(constantBytes, []byte(VERSION)...)
 
-	// writes the SELECT_DB FLAG
-	n, err = temp.WriteAt([]byte{SELECT_DB}, int64(*offset))
-	if err != nil {
-		return err
+	log.Println(constantBytes)
+	return nil
+}
+
+// Function which writes the keys of every database to the Rdb file
+// The keys of each database which is not empty follow a SELECT_DB flag
+// and the number of the database
+func writeKeyspace(temp *os.File, offset *int) error {
+	for _, db := range databases {
+		err := writeDatabase(temp, offset, db)
+		if err != nil {
+			return err
+		}
 	}
-	*offset += n
-	log.Println("Offset: ", *offset)
-	constantBytes = append(constantBytes, []byte{SELECT_DB}...)
+	return nil
+}
 
-	// Then we write the DATABASE no
-	databaseSelector := serializeLength(DATABASE_NO)
-	n, err = temp.WriteAt(databaseSelector, int64(*offset))
+// Function which writes every key of the database to the Rdb file
+// Each key is written with the value encoding of the type it is holding
+func writeDatabase(temp *os.File, offset *int, db *Keyspace) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.dict.len() == 0 {
+		return nil
+	}
+	selectBytes := append([]byte{SELECT_DB}, serializeLength(db.id)...)
+	n, err := temp.WriteAt(selectBytes, int64(*offset))
 	if err != nil {
 		return err
 	}
-	constantBytes = append(constantBytes, databaseSelector...)
 	*offset += n
-	log.Println("Offset: ", *offset)
-	log.Println(constantBytes)
-	return nil
-}
-
-// Function which writes the StringSETS DataStructure to the Rdb file
-func writeStrings(temp *os.File, offset *int) error {
-	StringSETSMu.Lock()
-	defer StringSETSMu.Unlock()
-	// We write each key and value using String Encoding
-	if len(StringSETS) > 0 {
-		for key, value := range StringSETS {
-			// We first write the StringValue
-			valueEncoding := serializeLength(StringValueEncoding)
-			log.Println(valueEncoding, len(valueEncoding))
-			n, err := temp.WriteAt(valueEncoding, int64(*offset))
-			if err != nil {
-				return err
+	for key, obj := range db.dict.all() {
+		// expired keys which were not reclaimed yet are not saved
+		if db.isExpired(key) {
+			continue
+		}
+		// neither are hashes whose fields all expired, the expire time written
+		// below would otherwise end up attached to the next key of the file
+		var hashMembers []HashElement
+		if obj.typ == HashType {
+			hashMembers = ds_htrav(obj)
+			if len(hashMembers) == 0 {
+				continue
 			}
-			*offset += n
-			keyBytes := serializeString(key)
-			log.Println(keyBytes, len(keyBytes))
-			valueBytes := serializeValue(value)
-			log.Println(valueBytes, len(valueBytes))
-			stringBytes := make([]byte, 0)
-			// Concatenate the key and value serialization
-			// so in case we fail in the middle we wont have partially written
-			// a key without writing a value
-			stringBytes = append(stringBytes, keyBytes...)
-			stringBytes = append(stringBytes, valueBytes...)
-			log.Println(stringBytes, len(stringBytes))
-			n, err = temp.WriteAt(stringBytes, int64(*offset))
+		}
+		// keys with a time to live are preceded by their expire time
+		if when := db.getExpire(key); when != -1 {
+			err := writeExpireTime(temp, offset, when)
 			if err != nil {
 				return err
 			}
-			*offset += n
+		}
+		var err error
+		switch obj.typ {
+		case StringType:
+			err = writeString(temp, offset, key, obj.str)
+		case ListType:
+			err = writeList(temp, offset, key, obj.list)
+		case SetType:
+			err = writeSet(temp, offset, key, obj.set)
+		case HashType:
+			err = writeHash(temp, offset, key, obj, hashMembers)
+		case ZSetType:
+			err = writeZSet(temp, offset, key, obj.zset)
+		case StreamType:
+			err = writeStream(temp, offset, key, obj.stream)
+		}
+		if err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-// Function which writes the LISTS DataStructure to the Rdb file
-func writeLists(temp *os.File, offset *int) error {
-	LISTSMu.Lock()
-	defer LISTSMu.Unlock()
-	// We iterate through each key->List mapping in the LISTS Map
-	for key, list := range LISTS {
-		// Then we extract all the values in that particular list
-		values := ds_ltrav(list)
-		if len(values) > 0 {
+// Function which writes a String to the Rdb file
+func writeString(temp *os.File, offset *int, key string, value string) error {
+	// We write each key and value using String Encoding
+	// We first write the StringValue
+	valueEncoding := serializeLength(StringValueEncoding)
+	log.Println(valueEncoding, len(valueEncoding))
+	n, err := temp.WriteAt(valueEncoding, int64(*offset))
+	if err != nil {
+		return err
+	}
+	*offset += n
+	keyBytes := serializeString(key)
+	log.Println(keyBytes, len(keyBytes))
+	valueBytes := serializeValue(value)
+	log.Println(valueBytes, len(valueBytes))
+	stringBytes := make([]byte, 0)
+	// Concatenate the key and value serialization
+	// so in case we fail in the middle we wont have partially written
+	// a key without writing a value
+	stringBytes = append(stringBytes, keyBytes...)
+	stringBytes = append(stringBytes, valueBytes...)
+	log.Println(stringBytes, len(stringBytes))
+	n, err = temp.WriteAt(stringBytes, int64(*offset))
+	if err != nil {
+		return err
+	}
+	*offset += n
+	return nil
+}
 
-			// We write the StringValueEncoding which idetifies
-			// that the following key value is of String type
-			n, err := temp.WriteAt(serializeLength(ListValueEncoding), int64(*offset))
-			if err != nil {
-				return err
-			}
-			*offset += n
-			// Then we write the key which is basically the name of the List
-			keyBytes := serializeString(key)
-			n, err = temp.WriteAt(keyBytes, int64(*offset))
-			if err != nil {
-				return err
-			}
-			*offset += n
-			length := len(values)
-			// Then we write the length of the List
-			lengthBytes := serializeLength(length)
-			n, err = temp.WriteAt(lengthBytes, int64(*offset))
+// Function which writes a List to the Rdb file
+func writeList(temp *os.File, offset *int, key string, list *List) error {
+	// Then we extract all the values in that particular list
+	values := ds_ltrav(list)
+	if len(values) > 0 {
+
+		// We write the ListValueEncoding which idetifies
+		// that the following key value is of List type
+		n, err := temp.WriteAt(serializeLength(ListValueEncoding), int64(*offset))
+		if err != nil {
+			return err
+		}
+		*offset += n
+		// Then we write the key which is basically the name of the List
+		keyBytes := serializeString(key)
+		n, err = temp.WriteAt(keyBytes, int64(*offset))
+		if err != nil {
+			return err
+		}
+		*offset += n
+		length := len(values)
+		// Then we write the length of the List
+		lengthBytes := serializeLength(length)
+		n, err = temp.WriteAt(lengthBytes, int64(*offset))
+		if err != nil {
+			return err
+		}
+		*offset += n
+
+		// All the values in the List are being stored in the String encoding format
+		for i := 0; i < length; i++ {
+			valueBytes := serializeString(values[i])
+			n, err = temp.WriteAt(valueBytes, int64(*offset))
 			if err != nil {
 				return err
 			}
 			*offset += n
-
-			// All the values in the List are being stored in the String encoding format
-			for i := 0; i < length; i++ {
-				valueBytes := serializeString(values[i])
-				n, err = temp.WriteAt(valueBytes, int64(*offset))
-				if err != nil {
-					return err
-				}
-				*offset += n
-			}
 		}
 	}
 	return nil
 }
 
-// Function which writes the Sets DataStructure to the Rdb file
+// Function which writes a Set to the Rdb file
 // Sets are written similarly as Lists
 // We first write the Value Flag which identifies that the value is of SET Encoding
 // Then we write the Set name as the key, the Size of the set in Length encoding and then
 // all the members belonging to the Set as strings
-func writeSets(temp *os.File, offset *int) error {
-	SETsMu.Lock()
-	defer SETsMu.Unlock()
-	for key, list := range SETs {
-		// extract all the members of the list
-		members := ds_strav(list)
-		if len(members) > 0 {
-			// write the ValueType flag for a Set to the file
-			n, err := temp.WriteAt(serializeLength(SetValueEncoding), int64(*offset))
-			if err != nil {
-				return err
-			}
-			*offset += n
-			// write the key which is the set name to the file
-			keyBytes := serializeString(key)
-			n, err = temp.WriteAt(keyBytes, int64(*offset))
-			if err != nil {
-				return err
-			}
-			*offset += n
-			length := len(members)
-			// write the key which is the set name to the file
-			lengthBytes := serializeLength(length)
-			n, err = temp.WriteAt(lengthBytes, int64(*offset))
+func writeSet(temp *os.File, offset *int, key string, set *Dict[struct{}]) error {
+	// extract all the members of the set
+	members := ds_strav(set)
+	if len(members) > 0 {
+		// write the ValueType flag for a Set to the file
+		n, err := temp.WriteAt(serializeLength(SetValueEncoding), int64(*offset))
+		if err != nil {
+			return err
+		}
+		*offset += n
+		// write the key which is the set name to the file
+		keyBytes := serializeString(key)
+		n, err = temp.WriteAt(keyBytes, int64(*offset))
+		if err != nil {
+			return err
+		}
+		*offset += n
+		length := len(members)
+		// write the number of members of the set to the file
+		lengthBytes := serializeLength(length)
+		n, err = temp.WriteAt(lengthBytes, int64(*offset))
+		if err != nil {
+			return err
+		}
+		*offset += n
+		for i := 0; i < length; i++ {
+			valueBytes := serializeString(members[i])
+			n, err = temp.WriteAt(valueBytes, int64(*offset))
 			if err != nil {
 				return err
 			}
 			*offset += n
-			for i := 0; i < length; i++ {
-				valueBytes := serializeString(members[i])
-				n, err = temp.WriteAt(valueBytes, int64(*offset))
-				if err != nil {
-					return err
-				}
-				*offset += n
+		}
+	}
+	return nil
+}
+
+// Function for serializing Sorted Set Value Encoding
+// Every member is followed by its score as 8 little endian bytes, the
+// binary representation of the float64 keeps the score exact
+func writeZSet(temp *os.File, offset *int, key string, zset *ZSet) error {
+	elements := zset.elements()
+	if len(elements) == 0 {
+		return nil
+	}
+	// write the ValueType flag for a Sorted Set to the file
+	n, err := temp.WriteAt(serializeLength(ZSetValueEncoding), int64(*offset))
+	if err != nil {
+		return err
+	}
+	*offset += n
+	// write the key which is the sorted set name to the file
+	n, err = temp.WriteAt(serializeString(key), int64(*offset))
+	if err != nil {
+		return err
+	}
+	*offset += n
+	// write the number of members of the sorted set to the file
+	n, err = temp.WriteAt(serializeLength(len(elements)), int64(*offset))
+	if err != nil {
+		return err
+	}
+	*offset += n
+	for _, element := range elements {
+		elementBytes := serializeString(element.member)
+		elementBytes = binary.LittleEndian.AppendUint64(elementBytes, math.Float64bits(element.score))
+		n, err = temp.WriteAt(elementBytes, int64(*offset))
+		if err != nil {
+			return err
+		}
+		*offset += n
+	}
+	return nil
+}
+
+// appendStreamID serializes a stream ID as its milliseconds and sequence number, each as 8 little endian bytes
+func appendStreamID(buf []byte, id StreamID) []byte {
+	buf = binary.LittleEndian.AppendUint64(buf, id.ms)
+	return binary.LittleEndian.AppendUint64(buf, id.seq)
+}
+
+// Function for serializing Stream Value Encoding
+// The entries are written with their IDs followed by the number of fields and the fields,
+// then come the IDs and counters of the stream and its consumer groups, whose pending
+// entries are written under the consumer they were delivered to. Empty streams are saved
+// as well since they keep their last ID and their consumer groups
+func writeStream(temp *os.File, offset *int, key string, stream *Stream) error {
+	buf := serializeLength(StreamValueEncoding)
+	buf = append(buf, serializeString(key)...)
+	buf = append(buf, serializeLength(len(stream.entries))...)
+	for _, entry := range stream.entries {
+		buf = appendStreamID(buf, entry.id)
+		buf = append(buf, serializeLength(len(entry.fields))...)
+		for _, field := range entry.fields {
+			buf = append(buf, serializeString(field)...)
+		}
+	}
+	buf = appendStreamID(buf, stream.lastID)
+	buf = appendStreamID(buf, stream.maxDeletedID)
+	buf = appendStreamID(buf, stream.firstID)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(stream.entriesAdded))
+
+	buf = append(buf, serializeLength(len(stream.groups))...)
+	for _, name := range stream.groupNames() {
+		group := stream.groups[name]
+		buf = append(buf, serializeString(name)...)
+		buf = appendStreamID(buf, group.lastID)
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(group.entriesRead))
+		buf = append(buf, serializeLength(len(group.consumers))...)
+		for _, consumer := range group.consumers {
+			buf = append(buf, serializeString(consumer.name)...)
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(consumer.seenTime))
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(consumer.activeTime))
+			buf = append(buf, serializeLength(len(consumer.pel))...)
+			for _, id := range sortedIDs(consumer.pel) {
+				nack := consumer.pel[id]
+				buf = appendStreamID(buf, id)
+				buf = binary.LittleEndian.AppendUint64(buf, uint64(nack.deliveryTime))
+				buf = binary.LittleEndian.AppendUint64(buf, uint64(nack.deliveryCount))
 			}
 		}
 	}
+	n, err := temp.WriteAt(buf, int64(*offset))
+	if err != nil {
+		return err
+	}
+	*offset += n
 	return nil
 }
 
@@ -445,53 +692,63 @@ func writeRdb_Eof(temp *os.File, offset *int) error {
 }
 
 // Function for serializing Hash Value Encoding
-func writeHash(temp *os.File, offset *int) error {
-	HSETsMu.Lock()
-	defer HSETsMu.Unlock()
-	// traversing through the key(names of the hashes) and the hash
-	for key, hash := range HSETs {
-		// extracting all the members of the hash
-		// members is an array of HashElement stuct which contains
-		// both the key and value
-		members := ds_htrav(hash)
-		if len(members) > 0 {
-			// write the ValueType flag for a Hash to the file
-			n, err := temp.WriteAt(serializeLength(HashValueEncoding), int64(*offset))
-			if err != nil {
-				return err
-			}
-			*offset += n
-			// write the key which is the hash name to the file
-			keyBytes := serializeString(key)
-			n, err = temp.WriteAt(keyBytes, int64(*offset))
-			if err != nil {
-				return err
-			}
-			*offset += n
-			// write the length of the members of the file
-			length := len(members)
-			lengthBytes := serializeLength(length)
-			n, err = temp.WriteAt(lengthBytes, int64(*offset))
-			if err != nil {
-				return err
-			}
-			*offset += n
-			// then we traverse through all the elements of the members array
-			// and write each key and value of the hash to the file as strings
-			for i := 0; i < length; i++ {
-				keyBytes := serializeString(members[i].key)
-				valueBytes := serializeString(members[i].value)
-				memberBytes := make([]byte, 0)
-				// Preallocate memory for stringBytes
-				memberBytes = append(memberBytes, keyBytes...)
-				memberBytes = append(memberBytes, valueBytes...)
-				n, err := temp.WriteAt(memberBytes, int64(*offset))
-				if err != nil {
-					return err
-				}
-				*offset += n
+// members are the fields of the hash which are not expired, there is at least one
+func writeHash(temp *os.File, offset *int, key string, obj *Object, members []HashElement) error {
+	// hashes with fields having a time to live use their own encoding
+	// so that the expire time of every field can follow its value
+	withExpires := false
+	for _, member := range members {
+		if obj.getHashFieldExpire(member.key) != -1 {
+			withExpires = true
+			break
+		}
+	}
+	// write the ValueType flag for a Hash to the file
+	encoding := HashValueEncoding
+	if withExpires {
+		encoding = HashMetadataValueEncoding
+	}
+	n, err := temp.WriteAt(serializeLength(encoding), int64(*offset))
+	if err != nil {
+		return err
+	}
+	*offset += n
+	// write the key which is the hash name to the file
+	keyBytes := serializeString(key)
+	n, err = temp.WriteAt(keyBytes, int64(*offset))
+	if err != nil {
+		return err
+	}
+	*offset += n
+	// write the length of the members of the file
+	length := len(members)
+	lengthBytes := serializeLength(length)
+	n, err = temp.WriteAt(lengthBytes, int64(*offset))
+	if err != nil {
+		return err
+	}
+	*offset += n
+	// then we traverse through all the elements of the members array
+	// and write each key and value of the hash to the file as strings
+	for i := 0; i < length; i++ {
+		keyBytes := serializeString(members[i].key)
+		valueBytes := serializeString(members[i].value)
+		memberBytes := make([]byte, 0)
+		// Preallocate memory for stringBytes
+		memberBytes = append(memberBytes, keyBytes...)
+		memberBytes = append(memberBytes, valueBytes...)
+		if withExpires {
+			var when uint64 = 0
+			if fieldExpire := obj.getHashFieldExpire(members[i].key); fieldExpire != -1 {
+				when = uint64(fieldExpire)
 			}
+			memberBytes = binary.LittleEndian.AppendUint64(memberBytes, when)
+		}
+		n, err := temp.WriteAt(memberBytes, int64(*offset))
+		if err != nil {
+			return err
 		}
+		*offset += n
 	}
 	return nil
 }
@@ -508,15 +765,217 @@ func renameRbd() error {
 	return nil
 }
 
-func readRdbSet(file *os.File, offset *int) error {
-	SETsMu.Lock()
-	defer SETsMu.Unlock()
+func readRdbZSet(db *Keyspace, file *os.File, offset *int) (string, error) {
+	db.lock()
+	defer db.unlock()
+	keySize, n, _, err, _, _ := readRdbLength(file, *offset)
+	if err != nil {
+		return "", err
+	}
+	*offset += n
+	key := make([]byte, keySize)
+	n, err = file.ReadAt(key, int64(*offset))
+	if err != nil {
+		return "", err
+	}
+	*offset += n
+	zsetSize, n, _, err, _, _ := readRdbLength(file, *offset)
+	if err != nil {
+		return "", err
+	}
+	*offset += n
+
+	obj := newZSetObject()
+	db.set(string(key), obj)
+	for i := 0; i < zsetSize; i++ {
+		memberSize, n, _, err, _, _ := readRdbLength(file, *offset)
+		if err != nil {
+			return "", err
+		}
+		*offset += n
+		member := make([]byte, memberSize)
+		n, err = file.ReadAt(member, int64(*offset))
+		if err != nil {
+			return "", err
+		}
+		*offset += n
+		scoreBytes := make([]byte, 8)
+		n, err = file.ReadAt(scoreBytes, int64(*offset))
+		if err != nil {
+			return "", err
+		}
+		*offset += n
+		score := math.Float64frombits(binary.LittleEndian.Uint64(scoreBytes))
+		obj.zset.add(score, string(member), zaddFlags{})
+	}
+	return string(key), nil
+}
+
+// readRdbUint64 reads 8 little endian bytes
+func readRdbUint64(file *os.File, offset *int) (uint64, error) {
+	buf := make([]byte, 8)
+	n, err := file.ReadAt(buf, int64(*offset))
+	if err != nil {
+		return 0, err
+	}
+	*offset += n
+	return binary.LittleEndian.Uint64(buf), nil
+}
+
+// readRdbStreamID reads a stream ID written by appendStreamID
+func readRdbStreamID(file *os.File, offset *int) (StreamID, error) {
+	ms, err := readRdbUint64(file, offset)
+	if err != nil {
+		return StreamID{}, err
+	}
+	seq, err := readRdbUint64(file, offset)
+	return StreamID{ms: ms, seq: seq}, err
+}
+
+// readRdbRawString reads a string written by serializeString
+func readRdbRawString(file *os.File, offset *int) (string, error) {
+	size, n, _, err, _, _ := readRdbLength(file, *offset)
+	if err != nil {
+		return "", err
+	}
+	*offset += n
+	str := make([]byte, size)
+	n, err = file.ReadAt(str, int64(*offset))
+	if err != nil {
+		return "", err
+	}
+	*offset += n
+	return string(str), nil
+}
+
+// readRdbLengthAt reads a length written by serializeLength
+func readRdbLengthAt(file *os.File, offset *int) (int, error) {
+	length, n, _, err, _, _ := readRdbLength(file, *offset)
+	if err != nil {
+		return 0, err
+	}
+	*offset += n
+	return length, nil
+}
+
+// readRdbStream reads a stream written by writeStream
+func readRdbStream(db *Keyspace, file *os.File, offset *int) (string, error) {
+	db.lock()
+	defer db.unlock()
+	key, err := readRdbRawString(file, offset)
+	if err != nil {
+		return "", err
+	}
+	entriesCount, err := readRdbLengthAt(file, offset)
+	if err != nil {
+		return "", err
+	}
+	obj := newStreamObject()
+	stream := obj.stream
+	for i := 0; i < entriesCount; i++ {
+		id, err := readRdbStreamID(file, offset)
+		if err != nil {
+			return "", err
+		}
+		fieldsCount, err := readRdbLengthAt(file, offset)
+		if err != nil {
+			return "", err
+		}
+		fields := make([]string, 0, fieldsCount)
+		for j := 0; j < fieldsCount; j++ {
+			field, err := readRdbRawString(file, offset)
+			if err != nil {
+				return "", err
+			}
+			fields = append(fields, field)
+		}
+		stream.entries = append(stream.entries, StreamEntry{id: id, fields: fields})
+	}
+	for _, id := range []*StreamID{&stream.lastID, &stream.maxDeletedID, &stream.firstID} {
+		if *id, err = readRdbStreamID(file, offset); err != nil {
+			return "", err
+		}
+	}
+	entriesAdded, err := readRdbUint64(file, offset)
+	if err != nil {
+		return "", err
+	}
+	stream.entriesAdded = int64(entriesAdded)
+
+	groupsCount, err := readRdbLengthAt(file, offset)
+	if err != nil {
+		return "", err
+	}
+	for i := 0; i < groupsCount; i++ {
+		name, err := readRdbRawString(file, offset)
+		if err != nil {
+			return "", err
+		}
+		lastID, err := readRdbStreamID(file, offset)
+		if err != nil {
+			return "", err
+		}
+		entriesRead, err := readRdbUint64(file, offset)
+		if err != nil {
+			return "", err
+		}
+		stream.createGroup(name, lastID, int64(entriesRead))
+		group := stream.groups[name]
+		consumersCount, err := readRdbLengthAt(file, offset)
+		if err != nil {
+			return "", err
+		}
+		for j := 0; j < consumersCount; j++ {
+			consumerName, err := readRdbRawString(file, offset)
+			if err != nil {
+				return "", err
+			}
+			seenTime, err := readRdbUint64(file, offset)
+			if err != nil {
+				return "", err
+			}
+			activeTime, err := readRdbUint64(file, offset)
+			if err != nil {
+				return "", err
+			}
+			consumer := group.consumer(consumerName, true, int64(seenTime))
+			consumer.activeTime = int64(activeTime)
+			pendingCount, err := readRdbLengthAt(file, offset)
+			if err != nil {
+				return "", err
+			}
+			for k := 0; k < pendingCount; k++ {
+				id, err := readRdbStreamID(file, offset)
+				if err != nil {
+					return "", err
+				}
+				deliveryTime, err := readRdbUint64(file, offset)
+				if err != nil {
+					return "", err
+				}
+				deliveryCount, err := readRdbUint64(file, offset)
+				if err != nil {
+					return "", err
+				}
+				nack := &StreamNACK{deliveryTime: int64(deliveryTime), deliveryCount: int64(deliveryCount), consumer: consumer}
+				consumer.pel[id] = nack
+				group.pel[id] = nack
+			}
+		}
+	}
+	db.set(key, obj)
+	return key, nil
+}
+
+func readRdbSet(db *Keyspace, file *os.File, offset *int) (string, error) {
+	db.lock()
+	defer db.unlock()
 
 	// Read key size
 	keySize, n, _, err, _, _ := readRdbLength(file, *offset)
 	log.Println(keySize, n, err)
 	if err != nil {
-		return err
+		return "", err
 	}
 	*offset += n
 
@@ -525,148 +984,173 @@ func readRdbSet(file *os.File, offset *int) error {
 	log.Println(string(key))
 	n, err = file.ReadAt(key, int64(*offset))
 	if err != nil {
-		return err
+		return "", err
 	}
 	*offset += n
 
 	// Read set size
 	setSize, n, _, err, _, _ := readRdbLength(file, *offset)
 	if err != nil {
-		return err
+		return "", err
 	}
 	*offset += n
 
 	// Initialize the set if it doesn't exist
-	if SETs[string(key)] == nil {
-		SETs[string(key)] = make(map[string]bool)
+	obj, ok := db.lookup(string(key))
+	if !ok || obj.typ != SetType {
+		obj = newSetObject()
+		db.set(string(key), obj)
 	}
 
 	// Read each value in the set
 	for i := 0; i < setSize; i++ {
 		valueSize, n, _, err, _, _ := readRdbLength(file, *offset)
 		if err != nil {
-			return err
+			return "", err
 		}
 		*offset += n
 
 		value := make([]byte, valueSize)
 		n, err = file.ReadAt(value, int64(*offset))
 		if err != nil {
-			return err
+			return "", err
 		}
 		*offset += n
 
 		// Add the value to the set
-		SETs[string(key)][string(value)] = true
+		obj.set.set(string(value), struct{}{})
 	}
 
-	return nil
+	return string(key), nil
 }
-func readRdbHash(file *os.File, offset *int) error {
-	HSETsMu.Lock()
-	defer HSETsMu.Unlock()
+
+// readRdbHash reads a hash, withExpires tells if every field is followed by its expire time
+func readRdbHash(db *Keyspace, file *os.File, offset *int, withExpires bool) (string, error) {
+	db.lock()
+	defer db.unlock()
 	hashNameSize, n, _, err, _, _ := readRdbLength(file, *offset)
 	if err != nil {
-		return err
+		return "", err
 	}
 	*offset += n
 	hashName := make([]byte, hashNameSize)
 	n, err = file.ReadAt(hashName, int64(*offset))
 	if err != nil {
-		return err
+		return "", err
 	}
-	// Initialize the set if it doesn't exist
-	if HSETs[string(hashName)] == nil {
-		HSETs[string(hashName)] = make(map[string]string)
+	// Initialize the hash if it doesn't exist
+	obj, ok := db.lookup(string(hashName))
+	if !ok || obj.typ != HashType {
+		obj = newHashObject()
+		db.set(string(hashName), obj)
 	}
 
 	*offset += n
 	hashSize, n, _, err, _, _ := readRdbLength(file, *offset)
 	if err != nil {
-		return err
+		return "", err
 	}
 	*offset += n
 	for i := 0; i < hashSize; i++ {
 		keySize, n, _, err, _, _ := readRdbLength(file, *offset)
 		if err != nil {
-			return err
+			return "", err
 		}
 		*offset += n
 		key := make([]byte, keySize)
 		n, err = file.ReadAt(key, int64(*offset))
 		if err != nil {
-			return err
+			return "", err
 		}
 		*offset += n
 		valueSize, n, _, err, _, _ := readRdbLength(file, *offset)
 		if err != nil {
-			return err
+			return "", err
 		}
 		*offset += n
 		value := make([]byte, valueSize)
 		n, err = file.ReadAt(value, int64(*offset))
 		if err != nil {
-			return err
+			return "", err
 		}
 		*offset += n
-		HSETs[string(hashName)][string(key)] = string(value)
+		obj.hash.set(string(key), string(value))
+		if withExpires {
+			timeBytes := make([]byte, 8)
+			n, err = file.ReadAt(timeBytes, int64(*offset))
+			if err != nil {
+				return "", err
+			}
+			*offset += n
+			when := int64(binary.LittleEndian.Uint64(timeBytes))
+			// fields which expired while the server was down are dropped
+			if when != 0 && when <= mstime() {
+				obj.hash.delete(string(key))
+			} else if when != 0 {
+				obj.setHashFieldExpire(string(key), when)
+				db.trackHashFieldExpires(string(hashName))
+			}
+		}
 	}
-	return nil
+	if obj.hash.len() == 0 {
+		db.delete(string(hashName))
+	}
+	return string(hashName), nil
 }
 
-func readRdbList(file *os.File, offset *int) error {
-	// LISTSMu.Lock()
-	// defer LISTSMu.Unlock()
+func readRdbList(db *Keyspace, file *os.File, offset *int) (string, error) {
 	keySize, n, _, err, _, _ := readRdbLength(file, *offset)
 	if err != nil {
-		return err
+		return "", err
 	}
 	*offset += n
 	key := make([]byte, keySize)
 	n, err = file.ReadAt(key, int64(*offset))
 	if err != nil {
-		return err
+		return "", err
 	}
 	*offset += n
 	setSize, n, _, err, _, _ := readRdbLength(file, *offset)
 	if err != nil {
-		return err
+		return "", err
 	}
 	*offset += n
 	values := make([]string, 0)
 	for i := 0; i < setSize; i++ {
 		valueSize, n, _, err, _, _ := readRdbLength(file, *offset)
 		if err != nil {
-			return err
+			return "", err
 		}
 		*offset += n
 		value := make([]byte, valueSize)
 		n, err = file.ReadAt(value, int64(*offset))
 		if err != nil {
-			return err
+			return "", err
 		}
 		*offset += n
 		values = append(values, string(value))
 	}
-	ds_rpush(string(key), values)
-	return nil
+	_, err = ds_rpush(db, string(key), values)
+	return string(key), err
 }
-func readConstants(file *os.File, offset *int) error {
+
+// readConstants reads the MAGIC and VERSION flags and returns the version
+func readConstants(file *os.File, offset *int) (string, error) {
 	magicBytes := make([]byte, len(MAGIC))
 	n, err := file.ReadAt(magicBytes, int64(*offset))
 	if err != nil {
-		return err
+		return "", err
 	}
 	log.Print(magicBytes)
 	*offset += n
 	versionBytes := make([]byte, len(VERSION))
 	n, err = file.ReadAt(versionBytes, int64(*offset))
 	if err != nil {
-		return err
+		return "", err
 	}
 	log.Print(versionBytes)
 	*offset += n
-	return nil
+	return string(versionBytes), nil
 }
 
 func deserializeValue(file *os.File, offset *int) (string, error) {
@@ -691,12 +1175,12 @@ func deserializeValue(file *os.File, offset *int) (string, error) {
 	*offset += n
 	return string(value), nil
 }
-func readRdbStringSet(file *os.File, offset *int) error {
+func readRdbStringSet(db *Keyspace, file *os.File, offset *int) (string, error) {
 	log.Println("Offset: ", offset)
 	keySize, n, _, err, _, _ := readRdbLength(file, *offset)
 	log.Println(keySize, n, err)
 	if err != nil {
-		return err
+		return "", err
 	}
 	*offset += n
 	log.Println("Offset: ", offset)
@@ -713,6 +1197,6 @@ func readRdbStringSet(file *os.File, offset *int) error {
 		log.Println("error while deserializing value", err)
 		// return err
 	}
-	ds_set(string(key), value)
-	return nil
+	ds_set(db, string(key), value)
+	return string(key), nil
 }
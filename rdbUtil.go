@@ -34,9 +34,10 @@ func bitsToByte(bits string) byte {
 
 func serializeValue(value string) (valueBytes []byte) {
 	valueBytes = make([]byte, 0)
+	// only strings which read back exactly the same are stored as integers,
+	// "007", "+5" or binary data like bitmaps must be kept byte for byte
 	num, err := strconv.ParseInt(value, 10, 64)
-	if err != nil {
-		log.Println("Error parsing string:", err)
+	if err != nil || strconv.FormatInt(num, 10) != value {
 		valueBytes = append(valueBytes, serializeString(value)...)
 		return valueBytes
 	}
@@ -72,11 +73,10 @@ func serializeValue(value string) (valueBytes []byte) {
 		log.Println(valueBytes, len(valueBytes))
 		return valueBytes
 	default:
-		log.Printf("The number %d must be represented as an int64\n", num)
-		int64Num := int64(num)
-		log.Printf("Stored as int64: %d\n", int64Num)
+		// there is no int64 encoding, bigger numbers are stored as strings
+		valueBytes = append(valueBytes, serializeString(value)...)
+		return valueBytes
 	}
-	return nil
 }
 
 func readRdbLength(file *os.File, offset int) (result int,
@@ -142,7 +142,8 @@ func readRdbLength(file *os.File, offset int) (result int,
 				log.Println("Error reading 1 bytes for length:", err)
 				return -1, -1, false, err, false, false
 			}
-			length := int(nextBytes[0])
+			// the integers are signed, -5 must not come back as 251
+			length := int(int8(nextBytes[0]))
 			return length, 2, false, nil, false, true
 		} else if typeOfNumber == 1 {
 			log.Println("reached the type 1 of number reading")
@@ -153,7 +154,7 @@ func readRdbLength(file *os.File, offset int) (result int,
 				return -1, -1, false, err, false, false
 			}
 			// Convert the 4 bytes to a 32-bit integer (big-endian)
-			length := int(binary.BigEndian.Uint16(nextBytes))
+			length := int(int16(binary.BigEndian.Uint16(nextBytes)))
 			return length, 3, false, nil, false, true
 		} else if typeOfNumber == 2 {
 			log.Println("reached the type 2 of number reading")
@@ -164,7 +165,7 @@ func readRdbLength(file *os.File, offset int) (result int,
 				return -1, -1, false, err, false, false
 			}
 			// Convert the 4 bytes to a 32-bit integer (big-endian)
-			length := int(binary.BigEndian.Uint32(nextBytes))
+			length := int(int32(binary.BigEndian.Uint32(nextBytes)))
 			return length, 5, false, nil, false, true
 		}
 		return -1, -1, false, nil, false, false
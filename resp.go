@@ -2,9 +2,12 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"strconv"
+	"sync"
 )
 
 const (
@@ -13,12 +16,28 @@ const (
 	INTEGER = ':'
 	BULK    = '$'
 	ARRAY   = '*'
+	// RESP3 types
+	MAP       = '%'
+	SET       = '~'
+	DOUBLE    = ','
+	BOOLEAN   = '#'
+	NULL      = '_'
+	BIGNUMBER = '('
+	VERBATIM  = '='
+	ATTRIBUTE = '|'
+	PUSH      = '>'
 )
 
+// Value holds any RESP value
+// map and attribute values keep their keys and values one after the other in array,
+// set and push values keep their elements in array like an array value does,
+// booleans are stored in num, doubles in dbl, big numbers in str
+// and verbatim strings keep their format in str and the text in bulk
 type Value struct {
 	typ   string
 	str   string
-	num   int
+	num   int64
+	dbl   float64
 	bulk  string
 	array []Value
 }
@@ -70,6 +89,25 @@ func (r *Resp) readInteger() (x int, n int, err error) {
 	return int(i64), n, nil
 }
 
+// Errors caused by a client which is not speaking the protocol correctly
+// After replying with one of these the connection has to be closed, since
+// there is no way to know where the next request starts
+type ProtocolError struct {
+	msg string
+}
+
+func (e *ProtocolError) Error() string {
+	return "Protocol error: " + e.msg
+}
+
+const (
+	maxBulkLength   = 512 * 1024 * 1024 // the biggest bulk string a client can send
+	maxInlineLength = 64 * 1024         // the longest inline command a client can send
+)
+
+// Read reads the next request sent by the client
+// Requests are normally arrays of bulk strings, anything which does not start with
+// a type byte is treated as an "inline" command, the way telnet or nc would send it
 func (r *Resp) Read() (Value, error) {
 	// first we will read a single byte to determine the type
 	// since the type is always first
@@ -79,14 +117,103 @@ func (r *Resp) Read() (Value, error) {
 		return Value{}, err
 	}
 
+	switch _type {
+	case ARRAY, BULK, STRING, ERROR, INTEGER,
+		MAP, SET, DOUBLE, BOOLEAN, NULL, BIGNUMBER, VERBATIM, ATTRIBUTE, PUSH:
+		return r.readValue(_type)
+	default:
+		if _type < ' ' && _type != '\r' && _type != '\n' && _type != '\t' || _type > '~' {
+			return Value{}, &ProtocolError{msg: fmt.Sprintf("unknown type byte %q", _type)}
+		}
+		r.reader.UnreadByte()
+		return r.readInline()
+	}
+}
+
+// readValue reads a value whose type byte has already been read
+func (r *Resp) readValue(_type byte) (Value, error) {
 	switch _type {
 	case ARRAY:
 		return r.readArray()
 	case BULK:
 		return r.readBulk()
+	case STRING:
+		line, _, err := r.readLine()
+		if err != nil {
+			return Value{}, err
+		}
+		return Value{typ: "string", str: string(line)}, nil
+	case ERROR:
+		line, _, err := r.readLine()
+		if err != nil {
+			return Value{}, err
+		}
+		return Value{typ: "error", str: string(line)}, nil
+	case INTEGER:
+		line, _, err := r.readLine()
+		if err != nil {
+			return Value{}, err
+		}
+		num, err := strconv.ParseInt(string(line), 10, 64)
+		if err != nil {
+			return Value{}, &ProtocolError{msg: "invalid integer"}
+		}
+		return Value{typ: "integer", num: num}, nil
+	case MAP:
+		return r.readAggregate("map", 2)
+	case ATTRIBUTE:
+		return r.readAggregate("attribute", 2)
+	case SET:
+		return r.readAggregate("set", 1)
+	case PUSH:
+		return r.readAggregate("push", 1)
+	case DOUBLE:
+		line, _, err := r.readLine()
+		if err != nil {
+			return Value{}, err
+		}
+		// ParseFloat also understands the inf, -inf and nan special values
+		dbl, err := strconv.ParseFloat(string(line), 64)
+		if err != nil {
+			return Value{}, &ProtocolError{msg: "invalid double"}
+		}
+		return Value{typ: "double", dbl: dbl}, nil
+	case BOOLEAN:
+		line, _, err := r.readLine()
+		if err != nil {
+			return Value{}, err
+		}
+		switch string(line) {
+		case "t":
+			return Value{typ: "boolean", num: 1}, nil
+		case "f":
+			return Value{typ: "boolean", num: 0}, nil
+		}
+		return Value{}, &ProtocolError{msg: "invalid boolean"}
+	case NULL:
+		_, _, err := r.readLine()
+		if err != nil {
+			return Value{}, err
+		}
+		return Value{typ: "null"}, nil
+	case BIGNUMBER:
+		line, _, err := r.readLine()
+		if err != nil {
+			return Value{}, err
+		}
+		return Value{typ: "bignum", str: string(line)}, nil
+	case VERBATIM:
+		v, err := r.readBulk()
+		if err != nil {
+			return v, err
+		}
+		// the text is prefixed by its format, for example "txt:"
+		if len(v.bulk) < 4 || v.bulk[3] != ':' {
+			return Value{}, &ProtocolError{msg: "invalid verbatim string"}
+		}
+		return Value{typ: "verbatim", str: v.bulk[:3], bulk: v.bulk[4:]}, nil
 	default:
-		fmt.Printf("Unknown type: %v", string(_type))
-		return Value{}, nil
+		return Value{}, &ProtocolError{msg: fmt.Sprintf("unknown type byte %q", _type)}
 	}
 }
 
@@ -97,13 +224,27 @@ func (r *Resp) readArray() (Value, error) {
 	// read length of array
 	len, _, err := r.readInteger()
 	if err != nil {
+		if _, ok := err.(*strconv.NumError); ok {
+			return v, &ProtocolError{msg: "invalid multibulk length"}
+		}
 		return v, err
 	}
+	// *-1 is the null array
+	if len == -1 {
+		return Value{typ: "nullarray"}, nil
+	}
+	if len < 0 {
+		return v, &ProtocolError{msg: "invalid multibulk length"}
+	}
 
 	// foreach line, parse and read the value
 	v.array = make([]Value, 0)
 	for i := 0; i < len; i++ {
-		val, err := r.Read()
+		_type, err := r.reader.ReadByte()
+		if err != nil {
+			return v, err
+		}
+		val, err := r.readValue(_type)
 		if err != nil {
 			return v, err
 		}
@@ -115,6 +256,38 @@ func (r *Resp) readArray() (Value, error) {
 	return v, nil
 }
 
+// readAggregate reads the RESP3 aggregate types, maps and attributes are sent with
+// the number of pairs so every entry is made of 2 values
+func (r *Resp) readAggregate(typ string, valuesPerEntry int) (Value, error) {
+	v := Value{typ: typ}
+
+	len, _, err := r.readInteger()
+	if err != nil {
+		if _, ok := err.(*strconv.NumError); ok {
+			return v, &ProtocolError{msg: "invalid aggregate length"}
+		}
+		return v, err
+	}
+	if len < 0 {
+		return v, &ProtocolError{msg: "invalid aggregate length"}
+	}
+
+	v.array = make([]Value, 0)
+	for i := 0; i < len*valuesPerEntry; i++ {
+		_type, err := r.reader.ReadByte()
+		if err != nil {
+			return v, err
+		}
+		val, err := r.readValue(_type)
+		if err != nil {
+			return v, err
+		}
+		v.array = append(v.array, val)
+	}
+
+	return v, nil
+}
+
 func (r *Resp) readBulk() (Value, error) {
 	v := Value{}
 
@@ -122,34 +295,243 @@ func (r *Resp) readBulk() (Value, error) {
 
 	len, _, err := r.readInteger()
 	if err != nil {
+		if _, ok := err.(*strconv.NumError); ok {
+			return v, &ProtocolError{msg: "invalid bulk length"}
+		}
 		return v, err
 	}
+	// $-1 is the null bulk string
+	if len == -1 {
+		return Value{typ: "null"}, nil
+	}
+	if len < 0 || len > maxBulkLength {
+		return v, &ProtocolError{msg: "invalid bulk length"}
+	}
 
-	bulk := make([]byte, len)
+	// io.ReadFull keeps reading until the whole bulk has arrived,
+	// a single Read can return less if the bulk is split across packets
+	bulk := make([]byte, len+2)
+	_, err = io.ReadFull(r.reader, bulk)
+	if err != nil {
+		return v, err
+	}
+	if bulk[len] != '\r' || bulk[len+1] != '\n' {
+		return v, &ProtocolError{msg: "expected CRLF after bulk string"}
+	}
 
-	r.reader.Read(bulk)
+	v.bulk = string(bulk[:len])
 
-	v.bulk = string(bulk)
+	return v, nil
+}
 
-	// Read the trailing CRLF
-	r.readLine()
+// readInline reads a command sent as a plain line of text like "SET key value\n"
+// The arguments are split the same way redis-cli splits them, so quotes can be used
+// for arguments containing spaces
+func (r *Resp) readInline() (Value, error) {
+	line := make([]byte, 0)
+	for {
+		b, err := r.reader.ReadByte()
+		if err != nil {
+			return Value{}, err
+		}
+		if b == '\n' {
+			break
+		}
+		line = append(line, b)
+		if len(line) > maxInlineLength {
+			return Value{}, &ProtocolError{msg: "too big inline request"}
+		}
+	}
+	// telnet sends \r\n while nc only sends \n
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
 
+	args, err := splitArgs(string(line))
+	if err != nil {
+		return Value{}, err
+	}
+	v := Value{typ: "array", array: make([]Value, 0, len(args))}
+	for _, arg := range args {
+		v.array = append(v.array, Value{typ: "bulk", bulk: arg})
+	}
 	return v, nil
 }
 
-// Marshal Value to bytes
+// splitArgs splits an inline command into its arguments
+// Arguments are separated by spaces and can be quoted:
+// "double quotes" support the \n \r \t \b \a \\ \" and \xff escapes
+// 'single quotes' only support \' to escape the quote
+func splitArgs(line string) ([]string, error) {
+	args := make([]string, 0)
+	i := 0
+	for {
+		// skip the blanks
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+
+		inDoubleQuotes := false
+		inSingleQuotes := false
+		current := make([]byte, 0)
+		done := false
+		for !done {
+			if inDoubleQuotes {
+				if i == len(line) {
+					return nil, &ProtocolError{msg: "unbalanced quotes in request"}
+				}
+				if line[i] == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHexDigit(line[i+2]) && isHexDigit(line[i+3]) {
+					b, _ := strconv.ParseUint(line[i+2:i+4], 16, 8)
+					current = append(current, byte(b))
+					i += 3
+				} else if line[i] == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						current = append(current, '\n')
+					case 'r':
+						current = append(current, '\r')
+					case 't':
+						current = append(current, '\t')
+					case 'b':
+						current = append(current, '\b')
+					case 'a':
+						current = append(current, '\a')
+					default:
+						current = append(current, line[i])
+					}
+				} else if line[i] == '"' {
+					// the closing quote must be followed by a space or nothing at all
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, &ProtocolError{msg: "unbalanced quotes in request"}
+					}
+					done = true
+				} else {
+					current = append(current, line[i])
+				}
+			} else if inSingleQuotes {
+				if i == len(line) {
+					return nil, &ProtocolError{msg: "unbalanced quotes in request"}
+				}
+				if line[i] == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+					current = append(current, '\'')
+				} else if line[i] == '\'' {
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, &ProtocolError{msg: "unbalanced quotes in request"}
+					}
+					done = true
+				} else {
+					current = append(current, line[i])
+				}
+			} else {
+				if i == len(line) {
+					break
+				}
+				switch line[i] {
+				case ' ', '\n', '\r', '\t', 0:
+					done = true
+				case '"':
+					inDoubleQuotes = true
+				case '\'':
+					inSingleQuotes = true
+				default:
+					current = append(current, line[i])
+				}
+			}
+			if i < len(line) {
+				i++
+			}
+		}
+		args = append(args, string(current))
+	}
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\r' || b == '\n' || b == '\v' || b == '\f'
+}
+
+func isHexDigit(b byte) bool {
+	return (b >= '0' && b <= '9') || (b >= 'a' && b <= 'f') || (b >= 'A' && b <= 'F')
+}
+
+// Marshal Value to bytes using the RESP2 protocol
 func (v Value) Marshal() []byte {
+	return v.marshal(2)
+}
+
+// marshal encodes the Value for a connection speaking the given protocol version
+// RESP2 has no map, set, double, boolean, big number, verbatim or push types so these
+// are downgraded to the closest RESP2 type the same way redis does it
+func (v Value) marshal(proto int) []byte {
 	switch v.typ {
 	case "array":
-		return v.marshalArray()
+		return v.marshalAggregate(ARRAY, proto)
 	case "bulk":
 		return v.marshalBulk()
 	case "string":
 		return v.marshalString()
+	case "integer":
+		return v.marshalSimple(INTEGER, strconv.FormatInt(v.num, 10))
 	case "null":
-		return v.marshallNull()
+		if proto >= 3 {
+			return v.marshallNull()
+		}
+		return []byte("$-1\r\n")
+	case "nullarray":
+		if proto >= 3 {
+			return v.marshallNull()
+		}
+		return v.marshallNullArray()
 	case "error":
 		return v.marshallError()
+	case "map":
+		if proto >= 3 {
+			return v.marshalMap(MAP, proto)
+		}
+		return v.marshalAggregate(ARRAY, proto)
+	case "set":
+		if proto >= 3 {
+			return v.marshalAggregate(SET, proto)
+		}
+		return v.marshalAggregate(ARRAY, proto)
+	case "push":
+		if proto >= 3 {
+			return v.marshalAggregate(PUSH, proto)
+		}
+		return v.marshalAggregate(ARRAY, proto)
+	case "attribute":
+		// RESP2 clients have no way of receiving attributes so they are left out
+		if proto >= 3 {
+			return v.marshalMap(ATTRIBUTE, proto)
+		}
+		return []byte{}
+	case "double":
+		if proto >= 3 {
+			return v.marshalSimple(DOUBLE, formatDouble(v.dbl))
+		}
+		return Value{typ: "bulk", bulk: formatDouble(v.dbl)}.marshalBulk()
+	case "boolean":
+		if proto >= 3 {
+			if v.num != 0 {
+				return v.marshalSimple(BOOLEAN, "t")
+			}
+			return v.marshalSimple(BOOLEAN, "f")
+		}
+		return v.marshalSimple(INTEGER, strconv.FormatInt(v.num, 10))
+	case "bignum":
+		if proto >= 3 {
+			return v.marshalSimple(BIGNUMBER, v.str)
+		}
+		return Value{typ: "bulk", bulk: v.str}.marshalBulk()
+	case "verbatim":
+		if proto >= 3 {
+			return v.marshalVerbatim()
+		}
+		return Value{typ: "bulk", bulk: v.bulk}.marshalBulk()
 	default:
 		return []byte{}
 	}
@@ -178,20 +560,64 @@ func (v Value) marshalBulk() []byte {
 	return bytes
 }
 
-func (v Value) marshalArray() []byte {
+// marshalAggregate encodes arrays, sets and pushes which only differ by their type byte
+func (v Value) marshalAggregate(_type byte, proto int) []byte {
 	len := len(v.array)
 	var bytes []byte
-	bytes = append(bytes, ARRAY)
+	bytes = append(bytes, _type)
 	bytes = append(bytes, strconv.Itoa(len)...)
 	bytes = append(bytes, '\r', '\n')
 
 	for i := 0; i < len; i++ {
-		bytes = append(bytes, v.array[i].Marshal()...)
+		bytes = append(bytes, v.array[i].marshal(proto)...)
+	}
+
+	return bytes
+}
+
+// marshalMap encodes maps and attributes, the array holds the keys and the values
+// one after the other and the length sent is the number of pairs
+func (v Value) marshalMap(_type byte, proto int) []byte {
+	var bytes []byte
+	bytes = append(bytes, _type)
+	bytes = append(bytes, strconv.Itoa(len(v.array)/2)...)
+	bytes = append(bytes, '\r', '\n')
+
+	for i := 0; i < len(v.array); i++ {
+		bytes = append(bytes, v.array[i].marshal(proto)...)
 	}
 
 	return bytes
 }
 
+// marshalSimple encodes the types which are a single line after the type byte
+func (v Value) marshalSimple(_type byte, line string) []byte {
+	var bytes []byte
+	bytes = append(bytes, _type)
+	bytes = append(bytes, line...)
+	bytes = append(bytes, '\r', '\n')
+
+	return bytes
+}
+
+// Verbatim strings are bulk strings prefixed by a 3 letter format like "txt:"
+func (v Value) marshalVerbatim() []byte {
+	format := v.str
+	if format == "" {
+		format = "txt"
+	}
+	var bytes []byte
+	bytes = append(bytes, VERBATIM)
+	bytes = append(bytes, strconv.Itoa(len(v.bulk)+4)...)
+	bytes = append(bytes, '\r', '\n')
+	bytes = append(bytes, format...)
+	bytes = append(bytes, ':')
+	bytes = append(bytes, v.bulk...)
+	bytes = append(bytes, '\r', '\n')
+
+	return bytes
+}
+
 func (v Value) marshallError() []byte {
 	var bytes []byte
 	bytes = append(bytes, ERROR)
@@ -202,26 +628,131 @@ func (v Value) marshallError() []byte {
 }
 
 func (v Value) marshallNull() []byte {
-	return []byte("$-1\r\n")
+	return []byte("_\r\n")
+}
+
+func (v Value) marshallNullArray() []byte {
+	return []byte("*-1\r\n")
+}
+
+// formatDouble formats a double the way redis replies with it, integral values
+// are written without an exponent unless they are too big to be exact
+func formatDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+	abs := math.Abs(f)
+	if abs != 0 && (abs < 1e-4 || abs >= 1e17) {
+		return strconv.FormatFloat(f, 'e', -1, 64)
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
 }
 
 // Writer
 
+// Writer encodes the values sent over a connection. The replies are written by
+// the go routine serving the connection while the values pushed by other clients,
+// like the messages of PUBLISH, are buffered and written in the background so that
+// a slow connection never slows down the client pushing to it
 type Writer struct {
 	writer io.Writer
+	proto  int // the protocol version negotiated by HELLO, RESP2 until then
+
+	mu sync.Mutex
+	// bytes waiting to be written, writing is set while they are being written
+	pending []byte
+	writing bool
+	// total number of bytes queued and written so far, Write waits
+	// for the bytes of its value to be written before returning
+	queued  int64
+	written int64
+	flushed *sync.Cond
+	err     error // the first write error, nothing is written after it
 }
 
+var ErrOutputBufferLimit = errors.New("output buffer limit reached")
+
 func NewWriter(w io.Writer) *Writer {
-	return &Writer{writer: w}
+	writer := &Writer{writer: w, proto: 2}
+	writer.flushed = sync.NewCond(&writer.mu)
+	return writer
 }
 
+// Write writes the value after the values pushed before it
 func (w *Writer) Write(v Value) error {
-	var bytes = v.Marshal()
+	var bytes = v.marshal(w.proto)
+	if len(bytes) == 0 {
+		return nil
+	}
 
-	_, err := w.writer.Write(bytes)
-	if err != nil {
-		return err
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending = append(w.pending, bytes...)
+	w.queued += int64(len(bytes))
+	target := w.queued
+	if !w.writing {
+		w.writing = true
+		w.flush()
+	}
+	for w.written < target && w.err == nil {
+		w.flushed.Wait()
 	}
+	return w.err
+}
 
+// Push queues the value to be written in the background, it fails without queuing
+// anything if more than limit bytes would be waiting to be written, 0 means no limit
+func (w *Writer) Push(v Value, limit int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	bytes := v.marshal(w.proto)
+	// the bytes being written count too, they are not sent until the write returns
+	if limit > 0 && w.queued-w.written+int64(len(bytes)) > int64(limit) {
+		return ErrOutputBufferLimit
+	}
+	w.pending = append(w.pending, bytes...)
+	w.queued += int64(len(bytes))
+	if !w.writing {
+		w.writing = true
+		go func() {
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			w.flush()
+		}()
+	}
 	return nil
 }
+
+// flush writes the pending bytes until there are none left, it is called with
+// mu held and writing set by the only go routine writing, mu is released while
+// the bytes are written so that more values can be queued in the meantime
+func (w *Writer) flush() {
+	for len(w.pending) > 0 && w.err == nil {
+		bytes := w.pending
+		w.pending = nil
+		w.mu.Unlock()
+		_, err := w.writer.Write(bytes)
+		w.mu.Lock()
+		w.written += int64(len(bytes))
+		w.err = err
+	}
+	w.pending = nil
+	w.writing = false
+	w.flushed.Broadcast()
+}
+
+// setProto changes the protocol version, the values pushed
+// by other clients are encoded with it from then on
+func (w *Writer) setProto(proto int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.proto = proto
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// Data structure representing the server itself
+// It keeps track of the listener and the persistence files so that they can
+// be flushed and closed when the server shuts down
+type Server struct {
+	listener net.Listener
+	rdb      *Rdb
+	aof      *Aof
+	// Every command is run while holding cmdMu for reading,
+	// commands present in exclusiveCommands hold it for writing
+	// which waits for all the in-flight commands to finish and
+	// stops any new command from running until they are done
+	cmdMu        sync.RWMutex
+	shuttingDown atomic.Bool
+	loading      atomic.Bool // true while the aof is being replayed
+}
+
+var server = &Server{}
+
+// The redis version we report to clients through HELLO
+const serverVersion = "7.4.0"
+
+// Set of commands which need the whole server to themselves
+// MOVE, SWAPDB and FLUSHALL change more than one database, the rdb snapshot
+// locks the databases one at a time and must not see them half done
+var exclusiveCommands = map[string]bool{
+	"SHUTDOWN": true,
+	"EXEC":     true,
+	"MOVE":     true,
+	"SWAPDB":   true,
+	"FLUSHALL": true,
+}
+
+// Options accepted by SHUTDOWN [NOSAVE|SAVE] [NOW] [FORCE]
+type shutdownFlags struct {
+	nosave bool
+	save   bool
+	now    bool
+	force  bool
+}
+
+var ErrShutdown = errors.New("ERR Errors trying to SHUTDOWN. Check logs.")
+
+// serve accepts connections until the listener gets closed by a shutdown
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if s.shuttingDown.Load() {
+				return
+			}
+			log.Println(err)
+			continue
+		}
+
+		go handleConnection(conn)
+	}
+}
+
+// handleSignals shuts the server down when SIGINT or SIGTERM is received
+// If the final save fails the server keeps running, like redis does
+func (s *Server) handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	for sig := range signals {
+		log.Println("received", sig, "scheduling shutdown...")
+		s.cmdMu.Lock()
+		err := s.shutdown(shutdownFlags{})
+		s.cmdMu.Unlock()
+		log.Println(err)
+	}
+}
+
+// shutdown saves the dataset, stops accepting connections, closes the
+// persistence files and exits the process
+// The caller must hold cmdMu for writing so that no command is running
+// It only returns if something went wrong and force was not set
+func (s *Server) shutdown(flags shutdownFlags) error {
+	log.Println("user requested shutdown...")
+	failed := false
+
+	if s.aof != nil {
+		log.Println("calling fsync() on the AOF file")
+		err := s.aof.Sync()
+		if err != nil {
+			log.Println("error while syncing the AOF file", err)
+			if !flags.force {
+				return ErrShutdown
+			}
+			failed = true
+		}
+	}
+
+	// like in redis the dataset is only saved when snapshots are enabled, unless SAVE is given
+	if flags.save || (!flags.nosave && config.saveInterval > 0) {
+		log.Println("saving the final RDB snapshot before exiting")
+		err := s.rdb.write()
+		if err != nil {
+			log.Println("error trying to save the DB, can't exit", err)
+			if !flags.force {
+				return ErrShutdown
+			}
+			failed = true
+		}
+	}
+
+	// stop accepting new connections, clients which are still connected
+	// will stay blocked on cmdMu until the process exits
+	s.shuttingDown.Store(true)
+	s.listener.Close()
+	if s.aof != nil {
+		s.aof.Close()
+	}
+	s.rdb.Close()
+
+	if failed {
+		log.Println("forced shutdown after errors, bye bye...")
+		os.Exit(1)
+	}
+	log.Println("redis is now ready to exit, bye bye...")
+	os.Exit(0)
+	return nil
+}
+
+func shutdownCommand(c *Client, args []Value) Value {
+	flags := shutdownFlags{}
+	for _, arg := range args {
+		switch strings.ToUpper(arg.bulk) {
+		case "NOSAVE":
+			flags.nosave = true
+		case "SAVE":
+			flags.save = true
+		case "NOW":
+			// we have no replicas to wait for so NOW is accepted
+			// only for compatibility
+			flags.now = true
+		case "FORCE":
+			flags.force = true
+		default:
+			return Value{typ: "error", str: "ERR syntax error"}
+		}
+	}
+	if flags.nosave && flags.save {
+		return Value{typ: "error", str: "ERR syntax error"}
+	}
+
+	err := server.shutdown(flags)
+	return Value{typ: "error", str: err.Error()}
+}
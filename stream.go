@@ -0,0 +1,456 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+)
+
+// Streams are an append only log of entries, every entry is made of field value
+// pairs and identified by an ID made of a unix time in milliseconds and a
+// sequence number. IDs always increase, even when entries are deleted.
+// Redis keeps the entries in a radix tree of listpacks, here they are kept in a
+// slice ordered by ID: new entries are appended at the end and trimming removes
+// them from the front, ranges are found with a binary search
+//
+// Consumer groups remember the last entry delivered to the group and the entries
+// delivered but not acknowledged yet, the pending entries list (PEL). Every
+// pending entry belongs to the consumer it was last delivered to, which also
+// keeps it in its own PEL
+
+// ID of a stream entry
+type StreamID struct {
+	ms  uint64
+	seq uint64
+}
+
+// The biggest possible ID, nothing can be added after it
+var maxStreamID = StreamID{ms: math.MaxUint64, seq: math.MaxUint64}
+
+func (id StreamID) String() string {
+	return strconv.FormatUint(id.ms, 10) + "-" + strconv.FormatUint(id.seq, 10)
+}
+
+// compare compares two IDs like strings.Compare
+func (id StreamID) compare(other StreamID) int {
+	switch {
+	case id.ms < other.ms:
+		return -1
+	case id.ms > other.ms:
+		return 1
+	case id.seq < other.seq:
+		return -1
+	case id.seq > other.seq:
+		return 1
+	}
+	return 0
+}
+
+func (id StreamID) isZero() bool {
+	return id.ms == 0 && id.seq == 0
+}
+
+// incr returns the next ID, false if id is the biggest possible one
+func (id StreamID) incr() (StreamID, bool) {
+	if id.seq < math.MaxUint64 {
+		return StreamID{ms: id.ms, seq: id.seq + 1}, true
+	}
+	if id.ms < math.MaxUint64 {
+		return StreamID{ms: id.ms + 1, seq: 0}, true
+	}
+	return id, false
+}
+
+// decr returns the previous ID, false if id is 0-0
+func (id StreamID) decr() (StreamID, bool) {
+	if id.seq > 0 {
+		return StreamID{ms: id.ms, seq: id.seq - 1}, true
+	}
+	if id.ms > 0 {
+		return StreamID{ms: id.ms - 1, seq: math.MaxUint64}, true
+	}
+	return id, false
+}
+
+// An entry of a stream, fields holds the field value pairs one after the other
+type StreamEntry struct {
+	id     StreamID
+	fields []string
+}
+
+// Data structure representing a stream
+type Stream struct {
+	entries []StreamEntry
+	// the last ID added to the stream, which may have been deleted since
+	lastID StreamID
+	// ID of the first entry, 0-0 when the stream is empty
+	firstID StreamID
+	// the biggest ID deleted by XDEL, entries deleted in the middle of the stream
+	// prevent knowing how many entries a consumer group has left to read
+	maxDeletedID StreamID
+	// number of entries ever added to the stream
+	entriesAdded int64
+	groups       map[string]*StreamGroup
+}
+
+// The entries read counter of a consumer group is unknown
+const streamInvalidEntriesRead = -1
+
+// Data structure representing a consumer group
+type StreamGroup struct {
+	name string
+	// the last ID delivered to the consumers of the group
+	lastID StreamID
+	// number of entries of the stream the group has read, used to compute its lag
+	entriesRead int64
+	pel         map[StreamID]*StreamNACK
+	consumers   map[string]*StreamConsumer
+}
+
+// Data structure representing a consumer of a consumer group
+type StreamConsumer struct {
+	name string
+	// unix time in milliseconds at which the consumer last tried to read or claim
+	seenTime int64
+	// unix time in milliseconds at which the consumer last read or claimed
+	// something, -1 if it never did
+	activeTime int64
+	pel        map[StreamID]*StreamNACK
+}
+
+// A pending entry, delivered to a consumer but not acknowledged yet
+type StreamNACK struct {
+	deliveryTime  int64 // unix time in milliseconds of the last delivery
+	deliveryCount int64
+	consumer      *StreamConsumer
+}
+
+func newStream() *Stream {
+	return &Stream{groups: map[string]*StreamGroup{}}
+}
+
+func (s *Stream) length() int {
+	return len(s.entries)
+}
+
+// search returns the index of the first entry with an ID greater or equal to id
+func (s *Stream) search(id StreamID) int {
+	return sort.Search(len(s.entries), func(i int) bool {
+		return s.entries[i].id.compare(id) >= 0
+	})
+}
+
+// lookup returns the entry with the given ID, nil if there is none
+func (s *Stream) lookup(id StreamID) *StreamEntry {
+	i := s.search(id)
+	if i < len(s.entries) && s.entries[i].id == id {
+		return &s.entries[i]
+	}
+	return nil
+}
+
+// nextID returns the ID generated for a new entry added at the unix time in milliseconds now
+func (s *Stream) nextID(now int64) StreamID {
+	if uint64(now) > s.lastID.ms {
+		return StreamID{ms: uint64(now), seq: 0}
+	}
+	id, _ := s.lastID.incr()
+	return id
+}
+
+// add appends the entry, its ID must be greater than the last ID of the stream
+func (s *Stream) add(id StreamID, fields []string) {
+	if len(s.entries) == 0 {
+		s.firstID = id
+	}
+	s.entries = append(s.entries, StreamEntry{id: id, fields: fields})
+	s.lastID = id
+	s.entriesAdded++
+}
+
+// removeFirst removes the first n entries
+func (s *Stream) removeFirst(n int) {
+	// clear the removed entries so that their fields can be freed
+	// before the slice is reallocated
+	for i := 0; i < n; i++ {
+		s.entries[i] = StreamEntry{}
+	}
+	s.entries = s.entries[n:]
+	s.updateFirstID()
+}
+
+func (s *Stream) updateFirstID() {
+	if len(s.entries) == 0 {
+		s.firstID = StreamID{}
+		return
+	}
+	s.firstID = s.entries[0].id
+}
+
+// delete removes the entry with the given ID, it returns false if there is none
+func (s *Stream) delete(id StreamID) bool {
+	i := s.search(id)
+	if i == len(s.entries) || s.entries[i].id != id {
+		return false
+	}
+	if i == 0 {
+		s.removeFirst(1)
+	} else {
+		s.entries = append(s.entries[:i], s.entries[i+1:]...)
+	}
+	if id.compare(s.maxDeletedID) > 0 {
+		s.maxDeletedID = id
+	}
+	return true
+}
+
+// Trimming strategies of XADD and XTRIM
+const (
+	streamTrimNone   = iota
+	streamTrimMaxLen // keep at most maxLen entries
+	streamTrimMinID  // remove the entries with an ID smaller than minID
+)
+
+// How XADD and XTRIM trim the stream
+type streamTrimArgs struct {
+	strategy int
+	maxLen   int64
+	minID    StreamID
+	// the ~ option allows trimming less than asked, here the exact number of
+	// entries is removed but never more than limit of them, 0 for no limit
+	approx bool
+	limit  int64
+}
+
+// the LIMIT used by the ~ option when none is given
+const streamTrimDefaultLimit = 10000
+
+// trim removes the entries from the start of the stream following the
+// trimming arguments, it returns the number of entries removed
+func (s *Stream) trim(args streamTrimArgs) int64 {
+	var n int
+	switch args.strategy {
+	case streamTrimMaxLen:
+		if int64(len(s.entries)) > args.maxLen {
+			n = len(s.entries) - int(args.maxLen)
+		}
+	case streamTrimMinID:
+		n = s.search(args.minID)
+	}
+	if args.approx && args.limit > 0 && int64(n) > args.limit {
+		n = int(args.limit)
+	}
+	if n > 0 {
+		s.removeFirst(n)
+	}
+	return int64(n)
+}
+
+// rangeEntries returns the entries with an ID between start and end included,
+// from end to start when rev is set. count limits the number of entries unless it is 0
+func (s *Stream) rangeEntries(start StreamID, end StreamID, count int, rev bool) []StreamEntry {
+	entries := []StreamEntry{}
+	if start.compare(end) > 0 {
+		return entries
+	}
+	first := s.search(start)
+	last := s.search(end)
+	if last < len(s.entries) && s.entries[last].id == end {
+		last++
+	}
+	if rev {
+		for i := last - 1; i >= first && (count == 0 || len(entries) < count); i-- {
+			entries = append(entries, s.entries[i])
+		}
+		return entries
+	}
+	for i := first; i < last && (count == 0 || len(entries) < count); i++ {
+		entries = append(entries, s.entries[i])
+	}
+	return entries
+}
+
+// rangeHasTombstones tells if entries were deleted by XDEL after start
+func (s *Stream) rangeHasTombstones(start StreamID) bool {
+	if len(s.entries) == 0 || s.maxDeletedID.isZero() {
+		return false
+	}
+	return start.compare(s.maxDeletedID) <= 0
+}
+
+// estimateDistanceFromFirstEverEntry returns the number of entries added up to id,
+// it is only known when no entry was deleted in the middle of the stream
+func (s *Stream) estimateDistanceFromFirstEverEntry(id StreamID) int64 {
+	if s.entriesAdded == 0 {
+		return 0
+	}
+	if len(s.entries) == 0 && id.compare(s.lastID) <= 0 {
+		return s.entriesAdded
+	}
+	cmpLast := id.compare(s.lastID)
+	if cmpLast == 0 {
+		return s.entriesAdded
+	} else if cmpLast > 0 {
+		return streamInvalidEntriesRead
+	}
+	if s.maxDeletedID.isZero() || s.maxDeletedID.compare(s.firstID) < 0 {
+		// no entry was deleted in the middle of the stream
+		switch id.compare(s.firstID) {
+		case -1:
+			return s.entriesAdded - int64(len(s.entries))
+		case 0:
+			return s.entriesAdded - int64(len(s.entries)) + 1
+		}
+	}
+	return streamInvalidEntriesRead
+}
+
+// lag returns the number of entries the group has left to read, false if it is unknown
+func (s *Stream) lag(g *StreamGroup) (int64, bool) {
+	if s.entriesAdded == 0 {
+		return 0, true
+	}
+	if g.entriesRead != streamInvalidEntriesRead && !s.rangeHasTombstones(g.lastID) {
+		return s.entriesAdded - g.entriesRead, true
+	}
+	entriesRead := s.estimateDistanceFromFirstEverEntry(g.lastID)
+	if entriesRead == streamInvalidEntriesRead {
+		return 0, false
+	}
+	return s.entriesAdded - entriesRead, true
+}
+
+// createGroup adds a consumer group which starts reading after id,
+// it returns false if the group already exists
+func (s *Stream) createGroup(name string, id StreamID, entriesRead int64) bool {
+	if _, ok := s.groups[name]; ok {
+		return false
+	}
+	s.groups[name] = &StreamGroup{
+		name:        name,
+		lastID:      id,
+		entriesRead: entriesRead,
+		pel:         map[StreamID]*StreamNACK{},
+		consumers:   map[string]*StreamConsumer{},
+	}
+	return true
+}
+
+// groupNames returns the names of the consumer groups in order
+func (s *Stream) groupNames() []string {
+	names := make([]string, 0, len(s.groups))
+	for name := range s.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// delivered moves the last ID of the group to id, an entry it just read,
+// keeping track of the number of entries it read
+func (s *Stream) delivered(g *StreamGroup, id StreamID) {
+	if id.compare(g.lastID) <= 0 {
+		return
+	}
+	if g.entriesRead != streamInvalidEntriesRead && !s.rangeHasTombstones(id) {
+		g.entriesRead++
+	} else if s.entriesAdded != 0 {
+		g.entriesRead = s.estimateDistanceFromFirstEverEntry(id)
+	}
+	g.lastID = id
+}
+
+// consumer returns the consumer with the given name, it is created
+// when create is set and it does not exist yet
+func (g *StreamGroup) consumer(name string, create bool, now int64) *StreamConsumer {
+	consumer, ok := g.consumers[name]
+	if !ok && create {
+		consumer = &StreamConsumer{name: name, seenTime: now, activeTime: -1, pel: map[StreamID]*StreamNACK{}}
+		g.consumers[name] = consumer
+	}
+	return consumer
+}
+
+// deleteConsumer removes the consumer and its pending entries,
+// it returns the number of entries it had pending
+func (g *StreamGroup) deleteConsumer(name string) int64 {
+	consumer, ok := g.consumers[name]
+	if !ok {
+		return 0
+	}
+	for id := range consumer.pel {
+		delete(g.pel, id)
+	}
+	delete(g.consumers, name)
+	return int64(len(consumer.pel))
+}
+
+// deliver adds the entry to the PEL of the consumer, if it was already pending
+// for another consumer it now belongs to this one
+func (g *StreamGroup) deliver(id StreamID, consumer *StreamConsumer, now int64) {
+	nack, ok := g.pel[id]
+	if !ok {
+		nack = &StreamNACK{}
+		g.pel[id] = nack
+	} else {
+		delete(nack.consumer.pel, id)
+	}
+	nack.consumer = consumer
+	nack.deliveryTime = now
+	nack.deliveryCount = 1
+	consumer.pel[id] = nack
+}
+
+// claim transfers the pending entry to the consumer, the consumer
+// of an entry which was just added to the PEL by XCLAIM FORCE is nil
+func (g *StreamGroup) claim(id StreamID, nack *StreamNACK, consumer *StreamConsumer) {
+	if nack.consumer != nil && nack.consumer != consumer {
+		delete(nack.consumer.pel, id)
+	}
+	nack.consumer = consumer
+	consumer.pel[id] = nack
+}
+
+// ack removes the entry from the PEL, it returns false if it was not pending
+func (g *StreamGroup) ack(id StreamID) bool {
+	nack, ok := g.pel[id]
+	if !ok {
+		return false
+	}
+	delete(g.pel, id)
+	delete(nack.consumer.pel, id)
+	return true
+}
+
+// sortedIDs returns the IDs of the pending entries in order
+func sortedIDs(pel map[StreamID]*StreamNACK) []StreamID {
+	ids := make([]StreamID, 0, len(pel))
+	for id := range pel {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].compare(ids[j]) < 0 })
+	return ids
+}
+
+// duplicate returns a deep copy of the stream and of its consumer groups
+func (s *Stream) duplicate() *Stream {
+	dup := newStream()
+	dup.entries = append([]StreamEntry{}, s.entries...)
+	dup.lastID, dup.firstID, dup.maxDeletedID = s.lastID, s.firstID, s.maxDeletedID
+	dup.entriesAdded = s.entriesAdded
+	for name, g := range s.groups {
+		dup.createGroup(name, g.lastID, g.entriesRead)
+		dupGroup := dup.groups[name]
+		for consumerName, consumer := range g.consumers {
+			dupConsumer := dupGroup.consumer(consumerName, true, consumer.seenTime)
+			dupConsumer.activeTime = consumer.activeTime
+		}
+		for id, nack := range g.pel {
+			dupNack := &StreamNACK{deliveryTime: nack.deliveryTime, deliveryCount: nack.deliveryCount}
+			dupNack.consumer = dupGroup.consumers[nack.consumer.name]
+			dupNack.consumer.pel[id] = dupNack
+			dupGroup.pel[id] = dupNack
+		}
+	}
+	return dup
+}
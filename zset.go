@@ -0,0 +1,540 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"strings"
+)
+
+// Sorted sets are implemented like in redis with a dict mapping every member
+// to its score and a skiplist keeping the members ordered by score, members
+// with the same score being ordered lexicographically
+// The dict gives O(1) score lookups while the skiplist gives O(log(N))
+// inserts, deletes and rank lookups together with ordered range scans
+
+const (
+	zskiplistMaxLevel = 32   // enough for 2^64 elements
+	zskiplistP        = 0.25 // probability for a node to get one more level
+)
+
+type zskiplistLevel struct {
+	forward *zskiplistNode
+	// number of nodes the forward pointer skips, summing the spans
+	// traversed to reach a node gives its rank
+	span int
+}
+
+type zskiplistNode struct {
+	member   string
+	score    float64
+	backward *zskiplistNode
+	level    []zskiplistLevel
+}
+
+type zskiplist struct {
+	header *zskiplistNode
+	tail   *zskiplistNode
+	length int
+	level  int // number of levels of the tallest node
+}
+
+func newZskiplistNode(level int, score float64, member string) *zskiplistNode {
+	return &zskiplistNode{member: member, score: score, level: make([]zskiplistLevel, level)}
+}
+
+func newZskiplist() *zskiplist {
+	return &zskiplist{header: newZskiplistNode(zskiplistMaxLevel, 0, ""), level: 1}
+}
+
+// zslRandomLevel returns the level of a new node
+// every level is zskiplistP times less likely than the previous one
+func zslRandomLevel() int {
+	level := 1
+	for level < zskiplistMaxLevel && rand.Float64() < zskiplistP {
+		level++
+	}
+	return level
+}
+
+// zslSortsBefore tells if the node sorts before the element with the given score and member
+func zslSortsBefore(node *zskiplistNode, score float64, member string) bool {
+	return node.score < score || (node.score == score && node.member < member)
+}
+
+// insert adds a new node, the member must not already be in the skiplist
+func (zsl *zskiplist) insert(score float64, member string) *zskiplistNode {
+	update := make([]*zskiplistNode, zskiplistMaxLevel)
+	rank := make([]int, zskiplistMaxLevel)
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		// rank[i] is the rank of update[i]
+		if i != zsl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && zslSortsBefore(x.level[i].forward, score, member) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	level := zslRandomLevel()
+	if level > zsl.level {
+		for i := zsl.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = zsl.header
+			update[i].level[i].span = zsl.length
+		}
+		zsl.level = level
+	}
+
+	x = newZskiplistNode(level, score, member)
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = (rank[0] - rank[i]) + 1
+	}
+	// the levels above the new node now skip one more node
+	for i := level; i < zsl.level; i++ {
+		update[i].level[i].span++
+	}
+
+	if update[0] != zsl.header {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		zsl.tail = x
+	}
+	zsl.length++
+	return x
+}
+
+// deleteNode unlinks x, update holds the last node before x at every level
+func (zsl *zskiplist) deleteNode(x *zskiplistNode, update []*zskiplistNode) {
+	for i := 0; i < zsl.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		zsl.tail = x.backward
+	}
+	for zsl.level > 1 && zsl.header.level[zsl.level-1].forward == nil {
+		zsl.level--
+	}
+	zsl.length--
+}
+
+// findUpdate returns the last node before the element at every level
+func (zsl *zskiplist) findUpdate(score float64, member string) []*zskiplistNode {
+	update := make([]*zskiplistNode, zskiplistMaxLevel)
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && zslSortsBefore(x.level[i].forward, score, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	return update
+}
+
+// delete removes the element with the given score and member
+// it returns false if there is no such element
+func (zsl *zskiplist) delete(score float64, member string) bool {
+	update := zsl.findUpdate(score, member)
+	x := update[0].level[0].forward
+	if x == nil || x.score != score || x.member != member {
+		return false
+	}
+	zsl.deleteNode(x, update)
+	return true
+}
+
+// updateScore changes the score of the member, which has to be in the skiplist
+// The node is updated in place when it keeps its position
+func (zsl *zskiplist) updateScore(curscore float64, member string, newscore float64) *zskiplistNode {
+	update := zsl.findUpdate(curscore, member)
+	x := update[0].level[0].forward
+	if (x.backward == nil || x.backward.score < newscore) &&
+		(x.level[0].forward == nil || x.level[0].forward.score > newscore) {
+		x.score = newscore
+		return x
+	}
+	zsl.deleteNode(x, update)
+	return zsl.insert(newscore, member)
+}
+
+// getRank returns the 1 based rank of the element, 0 if it is not in the skiplist
+func (zsl *zskiplist) getRank(score float64, member string) int {
+	rank := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil &&
+			(x.level[i].forward.score < score ||
+				(x.level[i].forward.score == score && x.level[i].forward.member <= member)) {
+			rank += x.level[i].span
+			x = x.level[i].forward
+		}
+		if x != zsl.header && x.member == member {
+			return rank
+		}
+	}
+	return 0
+}
+
+// getElementByRank returns the node with the given 1 based rank
+func (zsl *zskiplist) getElementByRank(rank int) *zskiplistNode {
+	traversed := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == rank {
+			return x
+		}
+	}
+	return nil
+}
+
+// Range of scores, min and max are excluded when minex and maxex are set
+type zrangespec struct {
+	min, max     float64
+	minex, maxex bool
+}
+
+func (r *zrangespec) gteMin(score float64) bool {
+	if r.minex {
+		return score > r.min
+	}
+	return score >= r.min
+}
+
+func (r *zrangespec) lteMax(score float64) bool {
+	if r.maxex {
+		return score < r.max
+	}
+	return score <= r.max
+}
+
+// isInRange tells if some part of the skiplist is in the range
+func (zsl *zskiplist) isInRange(r *zrangespec) bool {
+	if r.min > r.max || (r.min == r.max && (r.minex || r.maxex)) {
+		return false
+	}
+	if zsl.tail == nil || !r.gteMin(zsl.tail.score) {
+		return false
+	}
+	first := zsl.header.level[0].forward
+	return first != nil && r.lteMax(first.score)
+}
+
+// firstInRange returns the first node in the range, nil if there is none
+func (zsl *zskiplist) firstInRange(r *zrangespec) *zskiplistNode {
+	if !zsl.isInRange(r) {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !r.gteMin(x.level[i].forward.score) {
+			x = x.level[i].forward
+		}
+	}
+	// the range is not empty so there is a next node
+	x = x.level[0].forward
+	if !r.lteMax(x.score) {
+		return nil
+	}
+	return x
+}
+
+// lastInRange returns the last node in the range, nil if there is none
+func (zsl *zskiplist) lastInRange(r *zrangespec) *zskiplistNode {
+	if !zsl.isInRange(r) {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && r.lteMax(x.level[i].forward.score) {
+			x = x.level[i].forward
+		}
+	}
+	if !r.gteMin(x.score) {
+		return nil
+	}
+	return x
+}
+
+// One end of a lexicographic range, inf is -1 for "-" and 1 for "+"
+// which sort before and after every member
+type zlexBound struct {
+	value     string
+	exclusive bool
+	inf       int
+}
+
+// compare compares the member with the bound like strings.Compare
+func (b *zlexBound) compare(member string) int {
+	if b.inf != 0 {
+		return -b.inf
+	}
+	return strings.Compare(member, b.value)
+}
+
+// Range of members used when all the members have the same score
+type zlexrangespec struct {
+	min, max zlexBound
+}
+
+func (r *zlexrangespec) gteMin(member string) bool {
+	if r.min.exclusive {
+		return r.min.compare(member) > 0
+	}
+	return r.min.compare(member) >= 0
+}
+
+func (r *zlexrangespec) lteMax(member string) bool {
+	if r.max.exclusive {
+		return r.max.compare(member) < 0
+	}
+	return r.max.compare(member) <= 0
+}
+
+// empty tells if no member can ever be in the range
+func (r *zlexrangespec) empty() bool {
+	if r.min.inf == 1 || r.max.inf == -1 {
+		return true
+	}
+	if r.min.inf == -1 || r.max.inf == 1 {
+		return false
+	}
+	cmp := strings.Compare(r.min.value, r.max.value)
+	return cmp > 0 || (cmp == 0 && (r.min.exclusive || r.max.exclusive))
+}
+
+func (zsl *zskiplist) isInLexRange(r *zlexrangespec) bool {
+	if r.empty() {
+		return false
+	}
+	if zsl.tail == nil || !r.gteMin(zsl.tail.member) {
+		return false
+	}
+	first := zsl.header.level[0].forward
+	return first != nil && r.lteMax(first.member)
+}
+
+// firstInLexRange returns the first node in the range, nil if there is none
+func (zsl *zskiplist) firstInLexRange(r *zlexrangespec) *zskiplistNode {
+	if !zsl.isInLexRange(r) {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !r.gteMin(x.level[i].forward.member) {
+			x = x.level[i].forward
+		}
+	}
+	x = x.level[0].forward
+	if !r.lteMax(x.member) {
+		return nil
+	}
+	return x
+}
+
+// lastInLexRange returns the last node in the range, nil if there is none
+func (zsl *zskiplist) lastInLexRange(r *zlexrangespec) *zskiplistNode {
+	if !zsl.isInLexRange(r) {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && r.lteMax(x.level[i].forward.member) {
+			x = x.level[i].forward
+		}
+	}
+	if !r.gteMin(x.member) {
+		return nil
+	}
+	return x
+}
+
+// deleteRangeByScore removes the nodes with a score in the range from the
+// skiplist and from dict, it returns the number of nodes removed
+func (zsl *zskiplist) deleteRangeByScore(r *zrangespec, dict *Dict[float64]) int {
+	update := make([]*zskiplistNode, zskiplistMaxLevel)
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !r.gteMin(x.level[i].forward.score) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	return zsl.deleteFrom(x.level[0].forward, update, dict, func(x *zskiplistNode) bool {
+		return r.lteMax(x.score)
+	})
+}
+
+// deleteRangeByLex removes the nodes with a member in the range from the
+// skiplist and from dict, it returns the number of nodes removed
+func (zsl *zskiplist) deleteRangeByLex(r *zlexrangespec, dict *Dict[float64]) int {
+	update := make([]*zskiplistNode, zskiplistMaxLevel)
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !r.gteMin(x.level[i].forward.member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	return zsl.deleteFrom(x.level[0].forward, update, dict, func(x *zskiplistNode) bool {
+		return r.lteMax(x.member)
+	})
+}
+
+// deleteRangeByRank removes the nodes with a 1 based rank between start and end
+// included from the skiplist and from dict, it returns the number of nodes removed
+func (zsl *zskiplist) deleteRangeByRank(start int, end int, dict *Dict[float64]) int {
+	update := make([]*zskiplistNode, zskiplistMaxLevel)
+	traversed := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span < start {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	rank := start
+	return zsl.deleteFrom(x.level[0].forward, update, dict, func(x *zskiplistNode) bool {
+		ok := rank <= end
+		rank++
+		return ok
+	})
+}
+
+// deleteFrom removes the nodes starting at x as long as inRange accepts them,
+// update holds the last node before x at every level
+func (zsl *zskiplist) deleteFrom(x *zskiplistNode, update []*zskiplistNode, dict *Dict[float64], inRange func(x *zskiplistNode) bool) int {
+	removed := 0
+	for x != nil && inRange(x) {
+		next := x.level[0].forward
+		zsl.deleteNode(x, update)
+		dict.delete(x.member)
+		removed++
+		x = next
+	}
+	return removed
+}
+
+// Data structure representing a sorted set
+type ZSet struct {
+	dict *Dict[float64]
+	zsl  *zskiplist
+}
+
+// A member of a sorted set together with its score
+type ZSetElement struct {
+	member string
+	score  float64
+}
+
+func newZSet() *ZSet {
+	return &ZSet{dict: newDict[float64](), zsl: newZskiplist()}
+}
+
+func (zs *ZSet) length() int {
+	return zs.dict.len()
+}
+
+// Options of ZADD
+type zaddFlags struct {
+	nx   bool // only add new members
+	xx   bool // only update existing members
+	gt   bool // only update when the new score is greater
+	lt   bool // only update when the new score is less
+	incr bool // add the score to the current one
+}
+
+// Results of ZSet.add
+const (
+	zaddNop     = iota // nothing was done because of the flags
+	zaddAdded          // the member was added
+	zaddUpdated        // the score of the member changed
+	zaddSame           // the member already had this score
+	zaddNaN            // the increment made the score NaN
+)
+
+// add adds the member or updates its score following the flags
+// it returns what was done and the score the member ends up with
+func (zs *ZSet) add(score float64, member string, flags zaddFlags) (int, float64) {
+	current, exists := zs.dict.get(member)
+	if !exists {
+		if flags.xx {
+			return zaddNop, 0
+		}
+		zs.dict.set(member, score)
+		zs.zsl.insert(score, member)
+		return zaddAdded, score
+	}
+
+	if flags.nx {
+		return zaddNop, current
+	}
+	if flags.incr {
+		score += current
+		if math.IsNaN(score) {
+			return zaddNaN, current
+		}
+	}
+	if (flags.gt && score <= current) || (flags.lt && score >= current) {
+		return zaddNop, current
+	}
+	if score == current {
+		return zaddSame, score
+	}
+	zs.zsl.updateScore(current, member, score)
+	zs.dict.set(member, score)
+	return zaddUpdated, score
+}
+
+// remove deletes the member, it returns false if it was not in the set
+func (zs *ZSet) remove(member string) bool {
+	score, ok := zs.dict.get(member)
+	if !ok {
+		return false
+	}
+	zs.dict.delete(member)
+	zs.zsl.delete(score, member)
+	return true
+}
+
+// rank returns the 0 based rank of the member, counted from the highest
+// score when reverse is set
+func (zs *ZSet) rank(member string, reverse bool) (int, bool) {
+	score, ok := zs.dict.get(member)
+	if !ok {
+		return 0, false
+	}
+	rank := zs.zsl.getRank(score, member)
+	if reverse {
+		return zs.zsl.length - rank, true
+	}
+	return rank - 1, true
+}
+
+// elements returns all the members ordered by score
+func (zs *ZSet) elements() []ZSetElement {
+	elements := make([]ZSetElement, 0, zs.length())
+	for x := zs.zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+		elements = append(elements, ZSetElement{member: x.member, score: x.score})
+	}
+	return elements
+}